@@ -0,0 +1,501 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// startAdmin serves the admin API on ADMIN_LISTEN, either a TCP address or
+// "unix:<path>" for a Unix socket. The admin API has no authentication of its
+// own: keep it on localhost or a socket only trusted users can access. A TCP
+// address without a host, like ":9090", listens on the loopback interface
+// only.
+func startAdmin(handler http.Handler) (*http.Server, error) {
+	network, addr := adminNetwork()
+	if network == "tcp" && !isLoopback(addr) {
+		log.Printf("The admin API listens on %s, not on a loopback address: anyone reaching it has full control", addr)
+	}
+	if network == "unix" {
+		// A socket left behind by an unclean shutdown blocks the address.
+		os.Remove(addr)
+	}
+	var ln net.Listener
+	var err error
+	if network == "unix" {
+		ln, err = net.Listen(network, addr)
+	} else {
+		ln, err = listenTCP(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		os.Chmod(addr, 0600)
+	}
+	srv := &http.Server{Handler: withRequestID(handler)}
+	go func() {
+		log.Printf("Admin API started on %s", listenerAddr(ln.Addr()))
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatalf("Admin Serve: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+func adminNetwork() (network, addr string) {
+	if path, ok := strings.CutPrefix(AdminListen, "unix:"); ok {
+		return "unix", path
+	}
+	if strings.HasPrefix(AdminListen, ":") {
+		if ListenFamily == familyIPv6 {
+			return "tcp", "[::1]" + AdminListen
+		}
+		return "tcp", "127.0.0.1" + AdminListen
+	}
+	return "tcp", AdminListen
+}
+
+// adminAPI serves the operations behind "uploader admin" on the admin
+// listener:
+//
+//	GET    /sessions             incomplete uploads
+//	DELETE /sessions/<id>        abort an upload
+//	POST   /purge-temp           remove uploads idle for ?older_than or expired
+//	GET    /files                stored files, with ?annotation=<key>[=<value>]
+//	DELETE /files/<name>         delete a stored file
+//	GET    /previews/<name>      preview of a stored video
+//	GET    /annotations/<name>   annotations of a stored file
+//	PATCH  /annotations/<name>   set annotations of a stored file
+//	POST   /verify-checksums     re-hash stored files, or only ?name
+//	POST   /rebuild-index        re-create the file index
+//	POST   /reconcile            find inconsistencies, ?<class>=<action>
+//	GET    /pending-stores       completed uploads that failed to be stored
+//	POST   /pending-stores/<id>  retry storing an upload now
+//	GET    /failed-uploads       uploads that failed to be assembled, and why
+//	GET    /replication          files waiting to be copied to the replica
+//	GET    /watch-folder         files waiting to be exported to the watch folder
+//	GET    /deliveries           deliveries and their progress
+//	GET    /storage              space used in total, per folder and per user
+//	POST   /sign-url             sign a URL for reading ?name=<bucket>/<key>
+//	GET    /metrics              gauges in the Prometheus text format
+//	GET    /qr                   QR code of ?text, ?format=png or svg
+//	GET    /drain                uploads a drain is waiting for
+//	POST   /drain                refuse new uploads and fail /ready
+//	GET    /users/<user>/export  archive of the files and metadata of a user
+//	DELETE /users/<user>         purge the data of a user
+//	GET    /tokens               upload tokens, by ID, and their use
+//	GET    /tokens/<id>          what an upload token allows
+//	DELETE /tokens/<id>          revoke an upload token
+//	GET    /overrides            requests for higher size limits, ?pending
+//	POST   /overrides/<id>/approve  grant a request, ?hours and ?max_size
+//	POST   /overrides/<id>/deny  refuse a request
+type adminAPI struct {
+	composer *tusd.StoreComposer
+}
+
+func (a *adminAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("/sessions", a.sessions)
+	mux.HandleFunc("/sessions/", a.sessions)
+	mux.HandleFunc("/purge-temp", a.purgeTemp)
+	mux.HandleFunc("/files", a.files)
+	mux.HandleFunc("/files/", a.files)
+	mux.HandleFunc("/previews/", a.previews)
+	mux.HandleFunc("/annotations/", a.annotations)
+	mux.HandleFunc("/verify-checksums", a.verifyChecksums)
+	mux.HandleFunc("/rebuild-index", a.rebuildIndex)
+	mux.HandleFunc("/reconcile", a.reconcile)
+	mux.HandleFunc("/pending-stores", a.pendingStores)
+	mux.HandleFunc("/pending-stores/", a.pendingStores)
+	mux.HandleFunc("/failed-uploads", a.failedUploads)
+	mux.HandleFunc("/replication", a.replication)
+	mux.HandleFunc("/watch-folder", a.watchFolder)
+	mux.HandleFunc("/deliveries", a.deliveries)
+	mux.HandleFunc("/storage", a.storage)
+	mux.HandleFunc("/sign-url", a.signURL)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/qr", a.qr)
+	mux.HandleFunc("/drain", a.drain)
+	mux.HandleFunc("/users/", a.users)
+	mux.HandleFunc("/tokens", a.tokens)
+	mux.HandleFunc("/tokens/", a.tokens)
+	mux.HandleFunc("/overrides", a.overrides)
+	mux.HandleFunc("/overrides/", a.overrides)
+}
+
+type sessionInfo struct {
+	ID       string    `json:"id"`
+	Offset   int64     `json:"offset"`
+	Size     int64     `json:"size"`
+	Filename string    `json:"filename,omitempty"`
+	Modified time.Time `json:"modified"`
+	// State is "uploading", "alive" or "abandoned", see heartbeatHandler.
+	State     string    `json:"state"`
+	Heartbeat time.Time `json:"heartbeat,omitzero"`
+}
+
+func (a *adminAPI) sessions(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		uploads, err := incompleteUploads()
+		if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := make([]sessionInfo, 0, len(uploads))
+		now := time.Now()
+		for id, modified := range uploads {
+			session := sessionInfo{ID: id, Modified: modified, State: sessionState(id, now), Heartbeat: lastHeartbeat(id)}
+			if upload, err := a.composer.Core.GetUpload(r.Context(), id); err == nil {
+				if info, err := upload.GetInfo(r.Context()); err == nil {
+					session.Offset = info.Offset
+					session.Size = info.Size
+					session.Filename = info.MetaData["filename"]
+				}
+			}
+			list = append(list, session)
+		}
+		slices.SortFunc(list, func(a, b sessionInfo) int { return a.Modified.Compare(b.Modified) })
+		writeJSON(w, http.StatusOK, list)
+	case id != "" && r.Method == http.MethodDelete:
+		if !uploadIDPattern.MatchString(id) {
+			httpError(w, "Invalid upload ID", http.StatusBadRequest)
+			return
+		}
+		if err := terminateUpload(r.Context(), a.composer, id); errors.Is(err, tusd.ErrNotFound) {
+			httpError(w, "Upload not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Upload %s aborted by admin", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *adminAPI) purgeTemp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	olderThan := UploadExpiry
+	if v := r.URL.Query().Get("older_than"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			httpError(w, "Invalid older_than", http.StatusBadRequest)
+			return
+		}
+		olderThan = d
+	}
+	cutoff := time.Now().Add(-olderThan)
+	result, err := collectExpiredUploads(r.Context(), a.composer, cutoff, cutoff)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"result": result})
+}
+
+type storedFileInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Tiered   bool      `json:"tiered,omitempty"`
+	// Preview is set if the file is a video with a preview at
+	// /previews/<name>.
+	Preview bool `json:"preview,omitempty"`
+	// LastModified is the modification time of the file on the device it
+	// was uploaded from, if the client sent it.
+	LastModified time.Time `json:"last_modified,omitzero"`
+	// Annotations are the attributes derived from the file by the jobs
+	// processing it.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	VirusTotal *vtVerdict `json:"virustotal,omitempty"`
+	// Replication is the state of the copy on REPLICA_TARGET, if set.
+	Replication *replicaState `json:"replication,omitempty"`
+}
+
+func (a *adminAPI) files(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/files"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		list := []storedFileInfo{}
+		filters := r.URL.Query()["annotation"]
+		err := walkStoredFiles(r.Context(), func(name string, info os.FileInfo, tiered bool) error {
+			file := storedFileInfo{Name: name, Size: info.Size(), Modified: info.ModTime(), Tiered: tiered, Preview: hasPreview(name)}
+			if tiered {
+				stub, err := readTieredStub(name)
+				if err != nil {
+					return nil
+				}
+				file.Size, file.Modified = stub.Size, stub.ModTime
+			}
+			if storedFiles != nil {
+				if rec, ok := storedFiles.get(name); ok {
+					file.SHA256, file.VirusTotal, file.LastModified = rec.SHA256, rec.VirusTotal, rec.LastModified
+					file.Annotations = rec.Annotations
+				}
+			}
+			if !matchAnnotations(file.Annotations, filters) {
+				return nil
+			}
+			if replication != nil {
+				state := replication.state(name)
+				file.Replication = &state
+			}
+			list = append(list, file)
+			return nil
+		})
+		if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case name != "" && r.Method == http.MethodDelete:
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			httpError(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		_, err := os.Stat(filepath.Join(UploadPath, filepath.FromSlash(name)))
+		tiered := os.IsNotExist(err)
+		if err := deleteStored(name, tiered); os.IsNotExist(err) {
+			httpError(w, "File not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("File %s deleted by admin", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *adminAPI) previews(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	servePreview(w, r, strings.Trim(strings.TrimPrefix(r.URL.Path, "/previews"), "/"))
+}
+
+func (a *adminAPI) verifyChecksums(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if storedFiles == nil {
+		httpError(w, "No file index with this storage backend", http.StatusConflict)
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		writeJSON(w, http.StatusOK, []checksumResult{storedFiles.verifyChecksum(name)})
+		return
+	}
+	results, err := storedFiles.verifyChecksums(r.Context())
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (a *adminAPI) rebuildIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if storedFiles == nil {
+		httpError(w, "No file index with this storage backend", http.StatusConflict)
+		return
+	}
+	n, err := storedFiles.rebuild(r.Context())
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("File index rebuilt with %d files", n)
+	writeJSON(w, http.StatusOK, map[string]int{"files": n})
+}
+
+func (a *adminAPI) reconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	actions := reconcileActions{}
+	for class, values := range r.URL.Query() {
+		actions[class] = values[0]
+	}
+	if err := actions.validate(); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	found, err := reconcile(r.Context(), actions)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, item := range found {
+		if item.Action != reconcileReport {
+			log.Printf("Reconcile: %s %s: %s", item.Class, item.Path, item.Action)
+		}
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+func (a *adminAPI) pendingStores(w http.ResponseWriter, r *http.Request) {
+	if storeRetries == nil {
+		httpError(w, "No pending stores with this storage backend", http.StatusConflict)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/pending-stores"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, storeRetries.list())
+	case id != "" && r.Method == http.MethodPost:
+		if !storeRetries.retryNow(id) {
+			httpError(w, "Upload not pending", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// failedUploads lists the uploads that failed to be assembled for good, with
+// their reason, from their diagnostic bundles.
+func (a *adminAPI) failedUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := failedUploads()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *adminAPI) replication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if replication == nil {
+		httpError(w, "Replication is not enabled, set REPLICA_TARGET", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, replication.backlog())
+}
+
+func (a *adminAPI) watchFolder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if watchFolder == nil {
+		httpError(w, "The watch folder is not enabled, set WATCH_FOLDER", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, watchFolder.backlog())
+}
+
+func (a *adminAPI) deliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries.list())
+}
+
+// signURL creates a signed URL for reading the S3 object name, given as
+// <bucket>/<key>, for the duration in ttl (24h by default). The URL is
+// relative to the S3 endpoint unless S3_PUBLIC_URL is set.
+func (a *adminAPI) signURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if S3DownloadSecret == "" {
+		httpError(w, "S3_DOWNLOAD_SECRET is not set", http.StatusConflict)
+		return
+	}
+	name := strings.Trim(r.URL.Query().Get("name"), "/")
+	bucket, key, _ := strings.Cut(name, "/")
+	if _, ok := s3ObjectPath(bucket, key); !ok || !s3BucketName.MatchString(bucket) {
+		httpError(w, "Invalid object name, expected BUCKET/KEY", http.StatusBadRequest)
+		return
+	}
+	ttl := 24 * time.Hour
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			httpError(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	expires := time.Now().Add(ttl)
+	u := url.URL{Path: "/" + name, RawQuery: signDownload("/"+name, expires).Encode()}
+	writeJSON(w, http.StatusOK, map[string]any{"url": S3PublicURL + u.String(), "expires": expires})
+}
+
+// qr renders text, such as a signed URL, as a QR code to be scanned with a
+// phone: a PNG image with scale pixels per module (8 by default) or an SVG
+// image.
+func (a *adminAPI) qr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	text := r.URL.Query().Get("text")
+	if text == "" {
+		httpError(w, "Missing text", http.StatusBadRequest)
+		return
+	}
+	scale := 8
+	if v := r.URL.Query().Get("scale"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 32 {
+			httpError(w, "Invalid scale", http.StatusBadRequest)
+			return
+		}
+		scale = n
+	}
+	code, err := encodeQR([]byte(text))
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "png":
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(code.png(scale))
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		io.WriteString(w, code.svg())
+	default:
+		httpError(w, "Invalid format, expected png or svg", http.StatusBadRequest)
+	}
+}
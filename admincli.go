@@ -0,0 +1,867 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const adminUsage = `usage: uploader admin [--addr ADDR] [--json] COMMAND [ARGS]
+
+Commands:
+  list-sessions              list incomplete uploads
+  abort ID...                abort incomplete uploads
+  purge-temp [--older-than]  remove incomplete uploads idle for a while
+  list-files [--sort KEY] [--annotation KEY[=VALUE]]
+                             list stored files, by name, modified or
+                             original (the modification time on the
+                             uploader's device), with that annotation
+  delete NAME...             delete stored files
+  annotate NAME KEY=VALUE... set annotations of a stored file, or remove
+                             them with KEY=
+  verify-checksums [NAME]    re-hash stored files and compare with the index
+  rebuild-index              re-create the file index from the stored files
+  reconcile [--CLASS ACTION]  find unindexed, missing, orphan and temp files
+                             and report (default), delete or adopt them
+  pending-stores             list completed uploads that failed to be stored
+  retry-store ID...          retry storing uploads now
+  failed-uploads             list uploads that failed to be assembled and why
+  replication                list files waiting to be copied to the replica
+  watch-folder               list files waiting to be exported to the watch
+                             folder
+  deliveries                 list deliveries and their combined progress
+  jobs                       list scheduled jobs and their last run
+  run JOB                    run a scheduled job now, e.g. "run scrub"
+  sign-url [--ttl D] [--qr FILE] BUCKET/KEY
+                             create a signed URL for reading an S3 object,
+                             with its QR code written to a .png or .svg FILE
+  drain [--wait]             refuse new uploads and report, or wait for,
+                             the uploads still in flight
+  export-user [-o FILE] USER  write the files and metadata of an FTP or SFTP
+                             user to a .tar.gz archive
+  purge-user USER            delete the files, uploads and receipts of a user
+  tokens                     list upload tokens, by ID, and their use
+  inspect-token TOKEN|ID     show what an upload token allows
+  revoke-token TOKEN|ID...   revoke upload tokens at once
+  overrides [--pending]      list requests for higher size limits
+  approve-override [--hours N] [--max-size SIZE] ID
+                             raise the size limit of the requester, to
+                             the size asked for by default, for 24 hours
+  deny-override ID...        refuse requests for higher size limits
+`
+
+// runAdmin implements "uploader admin": it runs operations on a running
+// server through its admin API, e.g.
+//
+//	uploader admin --addr unix:/run/uploader/admin.sock list-sessions
+//
+// The address defaults to ADMIN_LISTEN, so on the server host the command
+// works with the environment of the server.
+func runAdmin(args []string) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, adminUsage) }
+	addr := fs.String("addr", AdminListen, "admin API address, host:port or unix:<path>")
+	raw := fs.Bool("json", false, "print the JSON responses of the admin API")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *addr == "" {
+		fmt.Fprintln(os.Stderr, "ADMIN_LISTEN is not set, pass --addr")
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	c := newAdminClient(*addr, *raw)
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	var err error
+	switch cmd {
+	case "list-sessions":
+		err = c.listSessions()
+	case "abort":
+		err = c.each(cmdArgs, "ID", func(id string) error {
+			return c.do(http.MethodDelete, "/sessions/"+url.PathEscape(id), nil)
+		})
+	case "purge-temp":
+		err = c.purgeTemp(cmdArgs)
+	case "list-files":
+		err = c.listFiles(cmdArgs)
+	case "delete":
+		err = c.each(cmdArgs, "NAME", func(name string) error {
+			return c.do(http.MethodDelete, "/files/"+(&url.URL{Path: name}).EscapedPath(), nil)
+		})
+	case "annotate":
+		err = c.annotate(cmdArgs)
+	case "verify-checksums":
+		err = c.verifyChecksums(cmdArgs)
+	case "rebuild-index":
+		var res struct {
+			Files int `json:"files"`
+		}
+		if err = c.do(http.MethodPost, "/rebuild-index", &res); err == nil && !c.raw {
+			fmt.Printf("Indexed %d files\n", res.Files)
+		}
+	case "reconcile":
+		err = c.reconcile(cmdArgs)
+	case "pending-stores":
+		err = c.listPendingStores()
+	case "retry-store":
+		err = c.each(cmdArgs, "ID", func(id string) error {
+			return c.do(http.MethodPost, "/pending-stores/"+url.PathEscape(id), nil)
+		})
+	case "failed-uploads":
+		err = c.listFailedUploads()
+	case "replication":
+		err = c.listReplication()
+	case "watch-folder":
+		err = c.listWatchFolder()
+	case "deliveries":
+		err = c.listDeliveries()
+	case "jobs":
+		err = c.listJobs()
+	case "run":
+		err = c.runJob(cmdArgs)
+	case "sign-url":
+		err = c.signURL(cmdArgs)
+	case "drain":
+		err = c.drain(cmdArgs)
+	case "export-user":
+		err = c.exportUser(cmdArgs)
+	case "purge-user":
+		err = c.purgeUser(cmdArgs)
+	case "tokens":
+		err = c.listTokens()
+	case "inspect-token":
+		err = c.inspectToken(cmdArgs)
+	case "revoke-token":
+		err = c.each(cmdArgs, "TOKEN", func(token string) error {
+			return c.do(http.MethodDelete, "/tokens/"+adminTokenID(token), nil)
+		})
+	case "overrides":
+		err = c.listOverrides(cmdArgs)
+	case "approve-override":
+		err = c.approveOverride(cmdArgs)
+	case "deny-override":
+		err = c.each(cmdArgs, "ID", func(id string) error {
+			return c.do(http.MethodPost, "/overrides/"+url.PathEscape(id)+"/deny", nil)
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		fs.Usage()
+		return 2
+	}
+	var usage usageError
+	if errors.As(err, &usage) {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// errChecksumsFailed makes verify-checksums exit with status 1 when a file
+// did not verify.
+var errChecksumsFailed = errors.New("some files failed verification")
+
+type adminClient struct {
+	client *http.Client
+	base   string
+	raw    bool
+}
+
+func newAdminClient(addr string, raw bool) *adminClient {
+	transport := &http.Transport{}
+	base := "http://" + addr
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = "http://admin"
+	}
+	return &adminClient{client: &http.Client{Transport: transport}, base: base, raw: raw}
+}
+
+// do calls the admin API and decodes the response into v, or prints it in
+// --json mode.
+func (c *adminClient) do(method, path string, v any) error {
+	body, err := c.fetch(method, path)
+	if err != nil {
+		return err
+	}
+	if c.raw {
+		os.Stdout.Write(body)
+		return nil
+	}
+	if v == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+// fetch calls the admin API and returns the response body.
+func (c *adminClient) fetch(method, path string) ([]byte, error) {
+	return c.send(method, path, nil)
+}
+
+// send calls the admin API with the JSON data, unless it is nil, and
+// returns the response body.
+func (c *adminClient) send(method, path string, data []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, c.base+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s", method, path, errorMessage(body))
+	}
+	return body, nil
+}
+
+// each runs fn for every argument, reporting failures and carrying on.
+func (c *adminClient) each(args []string, what string, fn func(string) error) error {
+	if len(args) == 0 {
+		return usageError("missing " + what)
+	}
+	var failed error
+	for _, arg := range args {
+		if err := fn(arg); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			failed = errors.New("some operations failed")
+			continue
+		}
+		if !c.raw {
+			fmt.Printf("%s: done\n", arg)
+		}
+	}
+	return failed
+}
+
+func (c *adminClient) listSessions() error {
+	var sessions []sessionInfo
+	if err := c.do(http.MethodGet, "/sessions", &sessions); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPROGRESS\tIDLE\tSTATE\tFILENAME")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%s/%s\t%s\t%s\t%s\n", s.ID, formatByteSize(s.Offset), formatByteSize(s.Size),
+			time.Since(s.Modified).Round(time.Second), s.State, s.Filename)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) purgeTemp(args []string) error {
+	fs := flag.NewFlagSet("purge-temp", flag.ContinueOnError)
+	olderThan := fs.Duration("older-than", UploadExpiry, "remove uploads not written to for this long")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid arguments")
+	}
+	var res struct {
+		Result string `json:"result"`
+	}
+	path := "/purge-temp?older_than=" + url.QueryEscape(olderThan.String())
+	if err := c.do(http.MethodPost, path, &res); err != nil || c.raw {
+		return err
+	}
+	if res.Result == "" {
+		res.Result = "nothing to remove"
+	}
+	fmt.Println(res.Result)
+	return nil
+}
+
+// listFiles lists the stored files, sorted by --sort. Files without an
+// original modification time sort by their modification time.
+func (c *adminClient) listFiles(args []string) error {
+	fs := flag.NewFlagSet("list-files", flag.ContinueOnError)
+	sortBy := fs.String("sort", "name", "sort by name, modified or original")
+	var annotations []string
+	fs.Func("annotation", "list only files with the annotation KEY or KEY=VALUE", func(v string) error {
+		annotations = append(annotations, v)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return usageError("invalid arguments")
+	}
+	path := "/files"
+	if len(annotations) > 0 {
+		path += "?" + url.Values{"annotation": annotations}.Encode()
+	}
+	var files []storedFileInfo
+	if err := c.do(http.MethodGet, path, &files); err != nil || c.raw {
+		return err
+	}
+	switch *sortBy {
+	case "name":
+	case "modified":
+		slices.SortStableFunc(files, func(a, b storedFileInfo) int { return a.Modified.Compare(b.Modified) })
+	case "original":
+		original := func(f storedFileInfo) time.Time {
+			if f.LastModified.IsZero() {
+				return f.Modified
+			}
+			return f.LastModified
+		}
+		slices.SortStableFunc(files, func(a, b storedFileInfo) int { return original(a).Compare(original(b)) })
+	default:
+		return usageError("--sort is name, modified or original")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tMODIFIED\tORIGINAL\tSHA256\tVIRUSTOTAL\tREPLICA\t")
+	for _, f := range files {
+		original := "-"
+		if !f.LastModified.IsZero() {
+			original = f.LastModified.Local().Format(time.DateTime)
+		}
+		sum := f.SHA256
+		if sum == "" {
+			sum = "-"
+		}
+		verdict := "-"
+		if f.VirusTotal != nil {
+			verdict = f.VirusTotal.String()
+		}
+		replica := "-"
+		if f.Replication != nil {
+			replica = f.Replication.State
+		}
+		var flags []string
+		if f.Tiered {
+			flags = append(flags, "tiered")
+		}
+		if f.Preview {
+			flags = append(flags, "preview")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.Name, formatByteSize(f.Size), f.Modified.Local().Format(time.DateTime), original, sum, verdict, replica, strings.Join(flags, ","))
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) annotate(args []string) error {
+	if len(args) < 2 {
+		return usageError("annotate takes a NAME and KEY=VALUE pairs")
+	}
+	changes := map[string]*string{}
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return usageError("invalid annotation " + arg + ", expected KEY=VALUE")
+		}
+		changes[key] = nil
+		if value != "" {
+			changes[key] = &value
+		}
+	}
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	body, err := c.send(http.MethodPatch, "/annotations/"+(&url.URL{Path: args[0]}).EscapedPath(), data)
+	if err != nil || c.raw {
+		os.Stdout.Write(body)
+		return err
+	}
+	var annotations map[string]string
+	if err := json.Unmarshal(body, &annotations); err != nil {
+		return err
+	}
+	for _, key := range slices.Sorted(maps.Keys(annotations)) {
+		fmt.Printf("%s=%s\n", key, annotations[key])
+	}
+	return nil
+}
+
+func (c *adminClient) verifyChecksums(args []string) error {
+	path := "/verify-checksums"
+	if len(args) > 1 {
+		return usageError("verify-checksums takes at most one NAME")
+	}
+	if len(args) == 1 {
+		path += "?name=" + url.QueryEscape(args[0])
+	}
+	var results []checksumResult
+	if err := c.do(http.MethodPost, path, &results); err != nil || c.raw {
+		return err
+	}
+	counts := map[string]int{}
+	for _, res := range results {
+		counts[res.Status]++
+		switch res.Status {
+		case checksumOK, checksumTiered:
+		case checksumMismatch:
+			fmt.Printf("%s: mismatch, expected %s, got %s\n", res.Name, res.Expected, res.Actual)
+		case checksumFailed:
+			fmt.Printf("%s: error: %s\n", res.Name, res.Error)
+		default:
+			fmt.Printf("%s: %s\n", res.Name, res.Status)
+		}
+	}
+	fmt.Printf("Verified %d files: %d ok, %d mismatch, %d missing, %d unindexed, %d tiered, %d errors\n",
+		len(results), counts[checksumOK], counts[checksumMismatch], counts[checksumMissing],
+		counts[checksumUnindexed], counts[checksumTiered], counts[checksumFailed])
+	if counts[checksumMismatch]+counts[checksumMissing]+counts[checksumFailed] > 0 {
+		return errChecksumsFailed
+	}
+	return nil
+}
+
+func (c *adminClient) reconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	classes := []string{inconsistencyUnindexed, inconsistencyMissing, inconsistencyOrphan, inconsistencyTemp}
+	actions := map[string]*string{}
+	for _, class := range classes {
+		usage := "report or delete"
+		if class == inconsistencyUnindexed {
+			usage = "report, delete or adopt"
+		}
+		actions[class] = fs.String(class, reconcileReport, usage+" "+class+" files")
+	}
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid arguments")
+	}
+	query, checked := url.Values{}, reconcileActions{}
+	for class, action := range actions {
+		query.Set(class, *action)
+		checked[class] = *action
+	}
+	if err := checked.validate(); err != nil {
+		return usageError(err.Error())
+	}
+	var found []inconsistency
+	if err := c.do(http.MethodPost, "/reconcile?"+query.Encode(), &found); err != nil || c.raw {
+		return err
+	}
+	failed := 0
+	for _, item := range found {
+		switch {
+		case item.Error != "":
+			failed++
+			fmt.Printf("%s %s: %s failed: %s\n", item.Class, item.Path, *actions[item.Class], item.Error)
+		case item.Action == reconcileReport:
+			fmt.Printf("%s %s\n", item.Class, item.Path)
+		default:
+			fmt.Printf("%s %s: %s\n", item.Class, item.Path, item.Action)
+		}
+	}
+	fmt.Printf("Found %d inconsistencies\n", len(found))
+	if failed > 0 {
+		return fmt.Errorf("%d could not be fixed", failed)
+	}
+	return nil
+}
+
+func (c *adminClient) listPendingStores() error {
+	var pending []pendingStore
+	if err := c.do(http.MethodGet, "/pending-stores", &pending); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSIZE\tATTEMPTS\tNEXT TRY\tLAST ERROR")
+	for _, p := range pending {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", p.Info.ID, p.Name, formatByteSize(p.Info.Size),
+			p.Attempts, p.NextTry.Local().Format(time.DateTime), p.LastError)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) listFailedUploads() error {
+	var failed []failedUpload
+	if err := c.do(http.MethodGet, "/failed-uploads", &failed); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tFAILED\tREASON\tSTORED\tDATA\tFILENAME\tERROR")
+	for _, f := range failed {
+		data := "removed"
+		if f.Data {
+			data = "kept"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s/%s\t%s\t%s\t%s\n", f.ID, f.Failed.Local().Format(time.DateTime), f.Reason,
+			formatByteSize(f.Stored), formatByteSize(f.Size), data, f.Filename, f.Error)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) listReplication() error {
+	var backlog []replicaEntry
+	if err := c.do(http.MethodGet, "/replication", &backlog); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tWAITING\tATTEMPTS\tNEXT TRY\tERROR")
+	for _, e := range backlog {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", e.Name, e.State, (time.Duration(e.Lag) * time.Second).String(), e.Attempts,
+			e.NextTry.Local().Format(time.DateTime), e.LastError)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) listWatchFolder() error {
+	var backlog []watchEntry
+	if err := c.do(http.MethodGet, "/watch-folder", &backlog); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tATTEMPTS\tNEXT TRY\tERROR")
+	for _, e := range backlog {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", e.Name, e.Attempts, e.NextTry.Local().Format(time.DateTime), e.LastError)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) listDeliveries() error {
+	var list []delivery
+	if err := c.do(http.MethodGet, "/deliveries", &list); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DELIVERY\tFILES\tSTORED\tPROGRESS\tUPDATED\tSTATE")
+	for _, d := range list {
+		progress := "-"
+		if d.Size > 0 {
+			progress = fmt.Sprintf("%.1f%%", float64(d.Offset)/float64(d.Size)*100)
+		}
+		state := "uploading"
+		if d.Complete {
+			state = "complete"
+		} else if len(d.Uploads) < d.Files {
+			state = fmt.Sprintf("waiting for %d files", d.Files-len(d.Uploads))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", d.ID, d.Files, d.Stored, progress, d.Updated.Local().Format(time.DateTime), state)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) listJobs() error {
+	var jobs []jobStatus
+	if err := c.do(http.MethodGet, "/scheduler", &jobs); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tSCHEDULE\tLAST RUN\tNEXT RUN\tRESULT")
+	for _, job := range jobs {
+		last, result := "-", job.LastResult
+		if !job.LastStart.IsZero() {
+			last = job.LastStart.Local().Format(time.DateTime)
+		}
+		if job.Running {
+			result = "running"
+		} else if job.LastError != "" {
+			result = "error: " + job.LastError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", job.Name, job.Schedule, last, job.NextRun.Local().Format(time.DateTime), result)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) runJob(args []string) error {
+	if len(args) != 1 {
+		return usageError("run takes one JOB")
+	}
+	var job jobStatus
+	if err := c.do(http.MethodPost, "/scheduler/"+url.PathEscape(args[0]), &job); err != nil || c.raw {
+		return err
+	}
+	if job.LastError != "" {
+		return fmt.Errorf("%s failed after %s: %s", job.Name, job.LastDuration, job.LastError)
+	}
+	result := job.LastResult
+	if result == "" {
+		result = "nothing to do"
+	}
+	fmt.Printf("%s finished in %s: %s\n", job.Name, job.LastDuration, result)
+	return nil
+}
+
+func (c *adminClient) signURL(args []string) error {
+	fs := flag.NewFlagSet("sign-url", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the URL is valid")
+	qr := fs.String("qr", "", "write the QR code of the URL to a .png or .svg file")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid arguments")
+	}
+	if fs.NArg() != 1 {
+		return usageError("sign-url takes one BUCKET/KEY")
+	}
+	var res struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(*qr)), ".")
+	if *qr != "" && format != "png" && format != "svg" {
+		return usageError("--qr takes a .png or .svg file")
+	}
+	query := url.Values{"name": {fs.Arg(0)}, "ttl": {ttl.String()}}
+	body, err := c.fetch(http.MethodPost, "/sign-url?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return err
+	}
+	if *qr != "" {
+		image, err := c.fetch(http.MethodGet, "/qr?"+url.Values{"text": {res.URL}, "format": {format}}.Encode())
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*qr, image, 0644); err != nil {
+			return err
+		}
+	}
+	if c.raw {
+		os.Stdout.Write(body)
+		return nil
+	}
+	if strings.HasPrefix(res.URL, "/") {
+		fmt.Printf("%s\n(valid until %s, relative to the S3 endpoint)\n", res.URL, res.Expires.Local().Format(time.DateTime))
+	} else {
+		fmt.Printf("%s\n(valid until %s)\n", res.URL, res.Expires.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+// drain starts draining the server. With --wait it returns once nothing is
+// in flight anymore, so a deploy script can stop the server next.
+func (c *adminClient) drain(args []string) error {
+	fs := flag.NewFlagSet("drain", flag.ContinueOnError)
+	wait := fs.Bool("wait", false, "wait until the uploads in flight are done")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid arguments")
+	}
+	method := http.MethodPost
+	for {
+		var status drainStatus
+		if err := c.do(method, "/drain", &status); err != nil || c.raw {
+			return err
+		}
+		if status.Drained {
+			fmt.Println("Drained")
+			return nil
+		}
+		fmt.Printf("Waiting for %d uploads and %d stores\n", len(status.ActiveUploads), status.PendingStores)
+		if !*wait {
+			return nil
+		}
+		time.Sleep(5 * time.Second)
+		method = http.MethodGet
+	}
+}
+
+// exportUser saves the export archive of a user, streamed as it is written
+// by the server, to a file named after the pseudonym of the user unless -o
+// is given.
+func (c *adminClient) exportUser(args []string) error {
+	fs := flag.NewFlagSet("export-user", flag.ContinueOnError)
+	out := fs.String("o", "", "the archive to write")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid arguments")
+	}
+	if fs.NArg() != 1 {
+		return usageError("export-user takes one USER")
+	}
+	user := fs.Arg(0)
+	if *out == "" {
+		*out = userPseudonym(user) + ".tar.gz"
+	}
+	res, err := c.client.Get(c.base + "/users/" + url.PathEscape(user) + "/export")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("export-user: %s", errorMessage(body))
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, res.Body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Exported to %s\n", *out)
+	return nil
+}
+
+func (c *adminClient) purgeUser(args []string) error {
+	if len(args) != 1 {
+		return usageError("purge-user takes one USER")
+	}
+	var purge userPurge
+	if err := c.do(http.MethodDelete, "/users/"+url.PathEscape(args[0]), &purge); err != nil || c.raw {
+		return err
+	}
+	fmt.Printf("Purged %s: %d files, %d uploads, %d receipts\n", purge.Pseudonym, len(purge.Files), len(purge.Sessions), purge.Receipts)
+	for _, name := range purge.RemoteCopies {
+		fmt.Printf("  remote copy left: %s\n", name)
+	}
+	return nil
+}
+
+// adminTokenID returns the ID of an upload token given as itself or its ID.
+func adminTokenID(arg string) string {
+	if tokenIDPattern.MatchString(arg) {
+		return arg
+	}
+	return tokenID(arg)
+}
+
+func (c *adminClient) listTokens() error {
+	var list []tokenInfo
+	if err := c.do(http.MethodGet, "/tokens", &list); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOKEN\tROLE\tUSES\tLAST USED\tSTATE")
+	for _, t := range list {
+		last, state := "-", "valid"
+		if !t.LastUsed.IsZero() {
+			last = t.LastUsed.Local().Format(time.DateTime)
+		}
+		if !t.Revoked.IsZero() {
+			state = "revoked " + t.Revoked.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", t.ID, t.Role, t.Uses, last, state)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) inspectToken(args []string) error {
+	if len(args) != 1 {
+		return usageError("inspect-token takes one TOKEN or ID")
+	}
+	var t tokenInfo
+	if err := c.do(http.MethodGet, "/tokens/"+adminTokenID(args[0]), &t); err != nil || c.raw {
+		return err
+	}
+	or := func(v, none string) string {
+		if v == "" {
+			return none
+		}
+		return v
+	}
+	fmt.Printf("Token:          %s\n", t.ID)
+	fmt.Printf("Role:           %s\n", t.Role)
+	fmt.Printf("Max size:       %s\n", or(t.MaxSize, "global limit"))
+	fmt.Printf("Allowed types:  %s\n", or(strings.Join(t.AllowedTypes, ", "), "all but the blocked ones"))
+	fmt.Printf("Folder:         %s\n", or(t.Folder, "-"))
+	if t.RetentionDays > 0 {
+		fmt.Printf("Retention:      %d days\n", t.RetentionDays)
+	}
+	if t.DeadlineHours > 0 {
+		fmt.Printf("Deadline:       %d hours\n", t.DeadlineHours)
+	}
+	expires, remaining := "never", "unlimited"
+	if t.Expires != nil {
+		expires = t.Expires.Local().Format(time.DateTime)
+	}
+	if t.RemainingUses != nil {
+		remaining = fmt.Sprint(*t.RemainingUses)
+	}
+	fmt.Printf("Expires:        %s\n", expires)
+	fmt.Printf("Remaining uses: %s\n", remaining)
+	fmt.Printf("Uses:           %d\n", t.Uses)
+	if !t.LastUsed.IsZero() {
+		fmt.Printf("Last used:      %s\n", t.LastUsed.Local().Format(time.DateTime))
+	}
+	if !t.Revoked.IsZero() {
+		fmt.Printf("Revoked:        %s\n", t.Revoked.Local().Format(time.DateTime))
+	}
+	for _, id := range t.Uploads {
+		fmt.Printf("Upload:         %s\n", id)
+	}
+	return nil
+}
+
+func (c *adminClient) listOverrides(args []string) error {
+	fs := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	pending := fs.Bool("pending", false, "list the pending requests only")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid arguments")
+	}
+	path := "/overrides"
+	if *pending {
+		path += "?pending"
+	}
+	var list []limitOverride
+	if err := c.do(http.MethodGet, path, &list); err != nil || c.raw {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tREQUESTER\tROLE\tLIMIT\tSIZE\tREQUESTED\tSTATUS\tREASON")
+	for _, o := range list {
+		who := o.User
+		if who == "" {
+			who = "token " + o.TokenID
+		}
+		status := o.Status
+		if o.Status == overrideApproved {
+			status = fmt.Sprintf("%s %s until %s", status, formatByteSize(o.MaxSize), o.Until.Local().Format(time.DateTime))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", o.ID, who, o.Role, formatByteSize(o.Limit), formatByteSize(o.Size),
+			o.Requested.Local().Format(time.DateTime), status, o.Reason)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) approveOverride(args []string) error {
+	fs := flag.NewFlagSet("approve-override", flag.ContinueOnError)
+	hours := fs.Int("hours", overrideDefaultHours, "how long the raised limit lasts")
+	maxSize := fs.String("max-size", "", "the raised limit, the size asked for by default")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid arguments")
+	}
+	if fs.NArg() != 1 {
+		return usageError("approve-override takes one ID")
+	}
+	q := url.Values{"hours": {fmt.Sprint(*hours)}}
+	if *maxSize != "" {
+		q.Set("max_size", *maxSize)
+	}
+	var o limitOverride
+	if err := c.do(http.MethodPost, "/overrides/"+url.PathEscape(fs.Arg(0))+"/approve?"+q.Encode(), &o); err != nil || c.raw {
+		return err
+	}
+	fmt.Printf("Approved: limit %s until %s\n", formatByteSize(o.MaxSize), o.Until.Local().Format(time.DateTime))
+	return nil
+}
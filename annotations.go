@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Annotations are attributes of a stored file derived after it was stored,
+// like the duration of a video or the verdict of a scan, written into the
+// file index by the jobs processing the stored files: the built-in jobs
+// with annotateStored, others through the admin API:
+//
+//	GET   /annotations/<name>  the annotations of a stored file
+//	PATCH /annotations/<name>  set annotations, {"<key>": "<value>"}, or
+//	                           remove them, {"<key>": null}
+//
+// With ?sha256, the annotations are only set if the file still has that
+// checksum, so a job does not annotate a file replaced while it worked on
+// it. The annotations are listed with the stored files and GET /files
+// filters on them with ?annotation=<key> or <key>=<value>. They are kept
+// when the index is rebuilt, unless the file changed.
+const (
+	annotationMaxValue = 1024
+	annotationMaxCount = 64
+	// annotationMaxBody bounds the JSON body of PATCH /annotations.
+	annotationMaxBody = 256 << 10
+)
+
+var annotationKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+var (
+	errNotIndexed  = errors.New("file not in the index")
+	errFileChanged = errors.New("file changed")
+)
+
+// annotate sets the annotations of the stored file name, removing those
+// set to nil, unless sum is set and the file no longer has that checksum.
+func (idx *fileIndex) annotate(name, sum string, changes map[string]*string) error {
+	for key, value := range changes {
+		if !annotationKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid annotation key %q", key)
+		}
+		if value != nil && len(*value) > annotationMaxValue {
+			return fmt.Errorf("annotation %s is longer than %d bytes", key, annotationMaxValue)
+		}
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	rec, ok := idx.files[filepath.ToSlash(name)]
+	if !ok {
+		return errNotIndexed
+	}
+	if sum != "" && rec.SHA256 != sum {
+		return errFileChanged
+	}
+	annotations := maps.Clone(rec.Annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(annotations, key)
+		} else {
+			annotations[key] = *value
+		}
+	}
+	if len(annotations) > annotationMaxCount {
+		return fmt.Errorf("more than %d annotations", annotationMaxCount)
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	rec.Annotations = annotations
+	idx.saveLocked()
+	return nil
+}
+
+// annotateStored sets the annotation key of the stored file name for the
+// built-in jobs, if the file index is kept.
+func annotateStored(name, key, value string) {
+	if storedFiles == nil {
+		return
+	}
+	if err := storedFiles.annotate(name, "", map[string]*string{key: &value}); err != nil && !errors.Is(err, errNotIndexed) {
+		log.Printf("Unable to annotate %s: %s", name, err.Error())
+	}
+}
+
+// matchAnnotations reports whether annotations match every filter,
+// "<key>" or "<key>=<value>".
+func matchAnnotations(annotations map[string]string, filters []string) bool {
+	for _, filter := range filters {
+		key, value, hasValue := strings.Cut(filter, "=")
+		v, ok := annotations[key]
+		if !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *adminAPI) annotations(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/annotations"), "/")
+	if storedFiles == nil {
+		httpError(w, "No file index with this storage backend", http.StatusConflict)
+		return
+	}
+	if name == "" || !filepath.IsLocal(filepath.FromSlash(name)) {
+		httpError(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rec, ok := storedFiles.get(name)
+		if !ok {
+			httpError(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if rec.Annotations == nil {
+			rec.Annotations = map[string]string{}
+		}
+		writeJSON(w, http.StatusOK, rec.Annotations)
+	case http.MethodPatch:
+		var changes map[string]*string
+		body, err := io.ReadAll(io.LimitReader(r.Body, annotationMaxBody+1))
+		if err == nil && len(body) > annotationMaxBody {
+			err = errors.New("too large")
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &changes)
+		}
+		if err != nil {
+			httpError(w, "Invalid annotations: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = storedFiles.annotate(name, r.URL.Query().Get("sha256"), changes)
+		switch {
+		case errors.Is(err, errNotIndexed):
+			httpError(w, "File not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errFileChanged):
+			httpError(w, "The file no longer has this checksum", http.StatusConflict)
+			return
+		case err != nil:
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec, _ := storedFiles.get(name)
+		if rec.Annotations == nil {
+			rec.Annotations = map[string]string{}
+		}
+		writeJSON(w, http.StatusOK, rec.Annotations)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
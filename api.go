@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// fingerprintPattern matches the fingerprints computed by fingerprint.js:
+// the size of the file and the SHA-256 of samples of its content.
+var fingerprintPattern = regexp.MustCompile(`^[0-9]+-[0-9a-f]{64}$`)
+
+// uploadRejection returns the error the data store turned an upload down
+// with, a blocked file type, an empty, truncated or too large upload, a
+// failed content scan, a broken image, a draining server, an expired upload,
+// one pinned to another client, one corrupted on disk, an unknown upload
+// token, a failed validation, a full disk, a queued upload or a refused
+// delivery, if err is one.
+func uploadRejection(err error) (tusd.Error, bool) {
+	var e tusd.Error
+	if errors.Is(err, errFileTypeBlocked) || errors.Is(err, errEmptyUpload) || errors.Is(err, errUploadTruncated) ||
+		errors.Is(err, errUploadInfected) || errors.Is(err, errScanUnavailable) || errors.Is(err, errImageInvalid) || errors.Is(err, errUploadTooLarge) ||
+		errors.Is(err, errServerDraining) || errors.Is(err, errUploadExpired) || errors.Is(err, errUploadPinned) ||
+		errors.Is(err, errUploadCorrupted) || errors.Is(err, errUploadTokenInvalid) || errors.Is(err, errUploadTokenRevoked) || errors.Is(err, errUploadRejected) ||
+		errors.Is(err, errValidationUnavailable) || errors.Is(err, errInsufficientSpace) || errors.Is(err, errUploadQueued) ||
+		errors.Is(err, errUploadInProgress) || errors.Is(err, errDeliveryInvalid) || errors.Is(err, errDeliveryForeign) ||
+		errors.Is(err, errDeliveryFull) {
+		return e, errors.As(err, &e)
+	}
+	return e, false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type uploadStatus struct {
+	ID       string `json:"id"`
+	State    string `json:"state"`
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Filename string `json:"filename,omitempty"`
+	// Deadline is when the upload expires if it is not complete by then.
+	Deadline time.Time `json:"deadline,omitzero"`
+	// QueuePosition and Start are the position of an upload in the state
+	// "queued" and when its turn comes.
+	QueuePosition int       `json:"queue_position,omitempty"`
+	Start         time.Time `json:"start,omitzero"`
+	// Chunks are the ranges received so far, in the order they were
+	// written, for uploads looked up by fingerprint.
+	Chunks []chunkHash `json:"chunks,omitempty"`
+}
+
+// setQueued reports the upload as "queued" if it waits for its turn.
+func (s *uploadStatus) setQueued() {
+	if position, start, ok := uploadQueue.position(s.ID, time.Now()); ok {
+		s.State, s.QueuePosition, s.Start = "queued", position, start
+	}
+}
+
+// uploadsStatusHandler reports the state of the given uploads
+// (GET /api/uploads?id=...&id=...), so the upload page can restore the
+// progress of unfinished uploads after a reload. Uploads that are not in the
+// temporary store anymore are reported as "unknown": they either finished or
+// were removed.
+//
+// GET /api/uploads?fingerprint=... instead finds the incomplete uploads of a
+// file from its fingerprint, set in the "fingerprint" metadata when the
+// upload was created, so a file selected again in another browser resumes
+// where it stopped.
+func uploadsStatusHandler(composer *tusd.StoreComposer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fp := r.URL.Query().Get("fingerprint"); fp != "" {
+			if !fingerprintPattern.MatchString(fp) {
+				httpError(w, "Invalid fingerprint", http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, uploadsByFingerprint(r.Context(), composer, fp, clientPin(r.RemoteAddr, r.Header)))
+			return
+		}
+		ids := r.URL.Query()["id"]
+		if len(ids) > 100 {
+			httpError(w, "Too many upload IDs", http.StatusBadRequest)
+			return
+		}
+		result := make([]uploadStatus, 0, len(ids))
+		for _, id := range ids {
+			status := uploadStatus{ID: id, State: "unknown"}
+			if uploadIDPattern.MatchString(id) {
+				if upload, err := composer.Core.GetUpload(r.Context(), id); err == nil {
+					if info, err := upload.GetInfo(r.Context()); err == nil {
+						status.State = "uploading"
+						status.Offset = info.Offset
+						status.Size = info.Size
+						status.Filename = info.MetaData["filename"]
+						status.Deadline = uploadDeadline(info)
+						status.setQueued()
+					}
+				}
+			}
+			result = append(result, status)
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// uploadsByFingerprint returns the incomplete uploads with the fingerprint
+// fp the client with the pin may use, the most recently written first.
+func uploadsByFingerprint(ctx context.Context, composer *tusd.StoreComposer, fp, pin string) []uploadStatus {
+	result := []uploadStatus{}
+	uploads, err := incompleteUploads()
+	if err != nil {
+		return result
+	}
+	ids := slices.SortedFunc(maps.Keys(uploads), func(a, b string) int { return uploads[b].Compare(uploads[a]) })
+	for _, id := range ids {
+		upload, err := composer.Core.GetUpload(ctx, id)
+		if err != nil {
+			continue
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil || info.MetaData["fingerprint"] != fp || info.IsPartial || info.IsFinal || !pinnedTo(info, pin) {
+			continue
+		}
+		status := uploadStatus{ID: id, State: "uploading", Offset: info.Offset, Size: info.Size, Filename: info.MetaData["filename"], Deadline: uploadDeadline(info)}
+		status.setQueued()
+		if hashes, err := loadUploadHashes(id); err == nil {
+			status.Chunks = hashes.Chunks
+		}
+		result = append(result, status)
+	}
+	return result
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// apiError is the body of every error response, of tus requests as well,
+// so clients can tell errors apart by Code rather than by message, and know
+// from Retriable whether sending the same request again may succeed, after
+// the Retry-After delay if the response has one, or whether they should
+// stop or change the request. RequestID is the X-Request-ID of the request,
+// for support.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retriable bool   `json:"retriable"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// retriableCodes are the error codes of client errors that are retriable
+// nonetheless, as the data may be corrupted on the way only.
+var retriableCodes = map[string]bool{
+	"ERR_CHECKSUM_MISMATCH": true,
+}
+
+// retriableError reports whether a request answered with status and code
+// may succeed if sent again: server errors, timeouts, locked uploads, rate
+// limits, and any answer with a Retry-After header.
+func retriableError(status int, code string, header http.Header) bool {
+	switch status {
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	case http.StatusRequestTimeout, http.StatusLocked, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= 500 || retriableCodes[code] || header.Get("Retry-After") != ""
+}
+
+// statusCode returns the generic error code of status, like
+// ERR_NOT_FOUND.
+func statusCode(status int) string {
+	text := strings.ToUpper(http.StatusText(status))
+	if text == "" {
+		return "ERR_HTTP_" + strconv.Itoa(status)
+	}
+	return "ERR_" + strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text)
+}
+
+// httpError answers with status and the error message, like http.Error,
+// in the apiError schema with the generic code of status.
+func httpError(w http.ResponseWriter, message string, status int) {
+	httpErrorCode(w, statusCode(status), message, status)
+}
+
+// notFoundHandler answers the requests no route matches.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	httpError(w, "Not found", http.StatusNotFound)
+}
+
+// httpErrorCode answers with status and the error code and message.
+func httpErrorCode(w http.ResponseWriter, code, message string, status int) {
+	h := w.Header()
+	// Headers meant for the content the error replaces.
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Del("ETag")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{
+		Code:      code,
+		Message:   message,
+		Retriable: retriableError(status, code, h),
+		RequestID: h.Get("X-Request-ID"),
+	})
+}
+
+// errorMessage returns the message of the error response body, for the
+// clients of the commands.
+func errorMessage(body []byte) string {
+	var e apiError
+	if json.Unmarshal(body, &e) == nil && e.Message != "" {
+		return e.Message
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// tusErrorBody matches the plain text bodies of tusd errors.
+var tusErrorBody = regexp.MustCompile(`^(ERR_[A-Z0-9_]+): (.*)\n?$`)
+
+// withErrorSchema rewrites the plain text error responses of tusd,
+// "<code>: <message>", to the apiError schema.
+func withErrorSchema(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorSchemaWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		ew.flush()
+	})
+}
+
+// errorSchemaWriter holds back text/plain error responses until they are
+// complete, to rewrite them.
+type errorSchemaWriter struct {
+	http.ResponseWriter
+	status int
+	held   bool
+	body   bytes.Buffer
+}
+
+func (w *errorSchemaWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.held = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorSchemaWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *errorSchemaWriter) flush() {
+	if !w.held {
+		return
+	}
+	// Bodies that are not tusd errors, and the empty ones of HEAD requests,
+	// are left as they are.
+	m := tusErrorBody.FindSubmatch(w.body.Bytes())
+	if m == nil {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+	httpErrorCode(w.ResponseWriter, string(m[1]), string(m[2]), w.status)
+}
+
+func (w *errorSchemaWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
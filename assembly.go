@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+)
+
+// Assembly strategies for copying upload data between files, selected with
+// ASSEMBLY_MODE. "copy" uses io.Copy, which lets the kernel move the data
+// (copy_file_range/sendfile) where possible. "mmap" maps the source into
+// memory and "vectored" writes batches of buffers with a single pwritev.
+// The latter two are only available on unix systems.
+const (
+	assemblyCopy     = "copy"
+	assemblyMmap     = "mmap"
+	assemblyVectored = "vectored"
+)
+
+// vectoredBatch is the number of buffers submitted per pwritev call.
+const (
+	vectoredBufSize = 1 << 20
+	vectoredBatch   = 16
+)
+
+// copyFileData copies n bytes from the current offset of src to dst using
+// the configured assembly strategy, advancing both files.
+func copyFileData(dst, src *os.File, n int64) (int64, error) {
+	switch AssemblyMode {
+	case assemblyMmap:
+		return copyMmap(dst, src, n)
+	case assemblyVectored:
+		return copyVectored(dst, src, n)
+	}
+	return io.CopyN(dst, src, n)
+}
+
+// assemblySource returns a reader for src using the configured assembly
+// strategy. The returned function releases the resources held by it.
+func assemblySource(src *os.File) (io.Reader, func(), error) {
+	if AssemblyMode == assemblyMmap {
+		return mmapReader(src)
+	}
+	return src, func() {}, nil
+}
+
+// moveChunkSize is the unit in which moves across file systems are copied
+// and their progress recorded.
+const moveChunkSize = 64 << 20
+
+// movePartialSuffix marks the destination of a move across file systems
+// until it is complete.
+const movePartialSuffix = ".move-tmp"
+
+// moveManifest records how much of src was durably copied to the partial
+// destination, in <src>.move next to src.
+type moveManifest struct {
+	Dst    string `json:"dst"`
+	Offset int64  `json:"offset"`
+}
+
+// copyAcrossDevices moves src to dst on another file system. The data is
+// copied in chunks of moveChunkSize, each synced and recorded in the
+// manifest, so a move interrupted by a crash or a full disk resumes from the
+// last complete chunk instead of copying multi-GB files from the start.
+func copyAcrossDevices(src, dst string) error {
+	manifestPath := src + ".move"
+	partial := dst + movePartialSuffix
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	out, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var manifest moveManifest
+	if data, err := os.ReadFile(manifestPath); err == nil {
+		json.Unmarshal(data, &manifest)
+	}
+	offset := int64(0)
+	if partialStat, err := out.Stat(); err == nil && manifest.Dst == dst && manifest.Offset <= partialStat.Size() {
+		offset = manifest.Offset
+	}
+	// Anything past the recorded offset may not have reached the disk.
+	if err := out.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if offset > 0 {
+		log.Printf("Resuming move of %s to %s at %d bytes", src, dst, offset)
+	}
+	for offset < size {
+		n, err := copyFileData(out, in, min(moveChunkSize, size-offset))
+		if n > 0 {
+			if syncErr := out.Sync(); syncErr != nil {
+				return syncErr
+			}
+			offset += n
+			data, _ := json.Marshal(moveManifest{Dst: dst, Offset: offset})
+			if writeErr := os.WriteFile(manifestPath, data, 0644); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, dst); err != nil {
+		return err
+	}
+	os.Remove(manifestPath)
+	return os.Remove(src)
+}
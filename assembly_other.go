@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// assemblyModes lists the strategies available on this system.
+var assemblyModes = []string{assemblyCopy}
+
+func copyMmap(dst, src *os.File, n int64) (int64, error) {
+	return io.CopyN(dst, src, n)
+}
+
+func mmapReader(src *os.File) (io.Reader, func(), error) {
+	return src, func() {}, nil
+}
+
+func copyVectored(dst, src *os.File, n int64) (int64, error) {
+	return io.CopyN(dst, src, n)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// assemblyTestFile writes size random bytes to a file in a temporary
+// directory and returns its path and contents.
+func assemblyTestFile(tb testing.TB, size int) (string, []byte) {
+	tb.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	p := filepath.Join(tb.TempDir(), "src")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return p, data
+}
+
+// withAssemblyMode sets AssemblyMode to mode for the rest of the test,
+// skipping it if the mode is not available here.
+func withAssemblyMode(tb testing.TB, mode string) {
+	tb.Helper()
+	if !slices.Contains(assemblyModes, mode) {
+		tb.Skipf("assembly mode %s is not available", mode)
+	}
+	old := AssemblyMode
+	AssemblyMode = mode
+	tb.Cleanup(func() { AssemblyMode = old })
+}
+
+func TestAssemblyModesRoundTrip(t *testing.T) {
+	// Not a multiple of the buffers or pages, copied from an offset off a
+	// page boundary.
+	const size, skip = 3*vectoredBufSize + 12345, 4097
+	srcPath, data := assemblyTestFile(t, size)
+	for _, mode := range assemblyModes {
+		t.Run(mode, func(t *testing.T) {
+			withAssemblyMode(t, mode)
+			src, err := os.Open(srcPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			if _, err := src.Seek(skip, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			dstPath := filepath.Join(t.TempDir(), "dst")
+			dst, err := os.Create(dstPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+
+			// In two parts, so both files have to be left at the right offset.
+			first := int64(vectoredBufSize + 1)
+			for _, n := range []int64{first, size - skip - first} {
+				written, err := copyFileData(dst, src, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if written != n {
+					t.Fatalf("copied %d bytes, want %d", written, n)
+				}
+			}
+			got, err := os.ReadFile(dstPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data[skip:]) {
+				t.Fatalf("copy differs from the source")
+			}
+
+			if _, err := src.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			r, release, err := assemblySource(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+			got, err = io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("source reads differ from the file")
+			}
+		})
+	}
+}
+
+func benchmarkAssembly(b *testing.B, mode string) {
+	withAssemblyMode(b, mode)
+	const size = 64 << 20
+	srcPath, _ := assemblyTestFile(b, size)
+	dstPath := filepath.Join(b.TempDir(), "dst")
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src, err := os.Open(srcPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		dst, err := os.Create(dstPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := copyFileData(dst, src, size); err != nil {
+			b.Fatal(err)
+		}
+		src.Close()
+		dst.Close()
+	}
+}
+
+func BenchmarkAssemblyCopy(b *testing.B)     { benchmarkAssembly(b, assemblyCopy) }
+func BenchmarkAssemblyMmap(b *testing.B)     { benchmarkAssembly(b, assemblyMmap) }
+func BenchmarkAssemblyVectored(b *testing.B) { benchmarkAssembly(b, assemblyVectored) }
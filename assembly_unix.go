@@ -0,0 +1,113 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// assemblyModes lists the strategies available on this system.
+var assemblyModes = []string{assemblyCopy, assemblyMmap, assemblyVectored}
+
+func mmapFile(f *os.File) ([]byte, error) {
+	stat, err := f.Stat()
+	if err != nil || stat.Size() == 0 {
+		return nil, err
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(stat.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return data, nil
+}
+
+func copyMmap(dst, src *os.File, n int64) (int64, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	off, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	// Mappings start on a page boundary.
+	start := off &^ int64(os.Getpagesize()-1)
+	data, err := unix.Mmap(int(src.Fd()), start, int(off-start+n), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Munmap(data)
+	unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	written, err := dst.Write(data[off-start:])
+	if _, seekErr := src.Seek(off+int64(written), io.SeekStart); err == nil {
+		err = seekErr
+	}
+	return int64(written), err
+}
+
+func mmapReader(src *os.File) (io.Reader, func(), error) {
+	data, err := mmapFile(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if data == nil {
+		return bytes.NewReader(nil), func() {}, nil
+	}
+	return bytes.NewReader(data), func() { unix.Munmap(data) }, nil
+}
+
+func copyVectored(dst, src *os.File, n int64) (int64, error) {
+	r := io.LimitReader(src, n)
+	offset, err := dst.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	bufs := make([][]byte, vectoredBatch)
+	for i := range bufs {
+		bufs[i] = make([]byte, vectoredBufSize)
+	}
+
+	var written int64
+	for {
+		iov := bufs[:0]
+		eof := false
+		for _, buf := range bufs {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				iov = append(iov, buf[:n])
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+		for len(iov) > 0 {
+			n, err := unix.Pwritev(int(dst.Fd()), iov, offset)
+			offset += int64(n)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			for n > 0 && len(iov) > 0 {
+				if n < len(iov[0]) {
+					iov[0] = iov[0][n:]
+					break
+				}
+				n -= len(iov[0])
+				iov = iov[1:]
+			}
+		}
+		if eof {
+			break
+		}
+	}
+	_, err = dst.Seek(offset, io.SeekStart)
+	return written, err
+}
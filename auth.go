@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Principal is who an HTTP upload is made by. User names the uploader,
+// like the FTP and SFTP users, for the policy listing them, receipts and
+// the data export of the user. Role picks a policy directly, and TokenID
+// is the ID of the upload token it was picked with.
+type Principal struct {
+	User    string
+	Role    string
+	TokenID string
+}
+
+// Authenticator authenticates the HTTP requests creating uploads.
+// Authenticate returns errNoCredentials when the request carries none of
+// the credentials it handles, so the next one is asked; any other error
+// refuses the upload. New schemes implement Authenticator and are added to
+// authenticators.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+var errNoCredentials = errors.New("no credentials")
+
+// authenticators are asked in order; requests none of them recognizes are
+// anonymous. The tokens of UPLOAD_POLICIES come first, then the user header
+// of AUTH_USER_HEADER.
+var authenticators []Authenticator
+
+// authenticate returns the principal of r, the zero one for anonymous
+// requests.
+func authenticate(r *http.Request) (Principal, error) {
+	for _, a := range authenticators {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return Principal{}, nil
+}
+
+// authenticateUpload sets the "user", "role" and "token_id" metadata of an
+// upload created by r to its principal, and "limit_override" to the
+// override of its size limit it is granted, replacing whatever the client
+// sent.
+func authenticateUpload(r *http.Request, meta tusd.MetaData) error {
+	delete(meta, "user")
+	delete(meta, "role")
+	delete(meta, "token_id")
+	delete(meta, "limit_override")
+	p, err := authenticate(r)
+	if err != nil {
+		return err
+	}
+	if p.User != "" {
+		meta["user"] = p.User
+	}
+	if p.Role != "" {
+		meta["role"] = p.Role
+	}
+	if p.TokenID != "" {
+		meta["token_id"] = p.TokenID
+		uploadTokens.used(p.TokenID)
+	}
+	if id := limitOverrides.active(p.User, p.TokenID); id != "" {
+		meta["limit_override"] = id
+	}
+	return nil
+}
+
+// hookRequest returns the request of a tusd hook event, for the
+// authenticators.
+func hookRequest(hook tusd.HookEvent) *http.Request {
+	r := &http.Request{
+		Method:     hook.HTTPRequest.Method,
+		RequestURI: hook.HTTPRequest.URI,
+		RemoteAddr: hook.HTTPRequest.RemoteAddr,
+		Header:     hook.HTTPRequest.Header,
+	}
+	if hook.Context != nil {
+		r = r.WithContext(hook.Context)
+	}
+	return r
+}
+
+// createHook returns the hook event of the upload info created by r, for
+// the uploads created without tus.
+func createHook(r *http.Request, info tusd.FileInfo) tusd.HookEvent {
+	return tusd.HookEvent{
+		Context: r.Context(),
+		Upload:  info,
+		HTTPRequest: tusd.HTTPRequest{
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header,
+		},
+	}
+}
+
+// policyTokenAuth gives the role of a policy to requests with one of its
+// tokens as "Authorization: Bearer <token>".
+type policyTokenAuth struct{}
+
+func (policyTokenAuth) Authenticate(r *http.Request) (Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(UploadPolicies) == 0 {
+		return Principal{}, errNoCredentials
+	}
+	p := findPolicy(func(p *uploadPolicy) bool {
+		return slices.ContainsFunc(p.Tokens, func(t string) bool {
+			return subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1
+		})
+	})
+	if p == nil {
+		return Principal{}, errUploadTokenInvalid
+	}
+	id := tokenID(token)
+	if uploadTokens.revoked(id) {
+		return Principal{}, errUploadTokenRevoked
+	}
+	return Principal{Role: p.Role, TokenID: id}, nil
+}
+
+// headerAuth takes the user from a header set by an authenticating reverse
+// proxy, like X-Forwarded-User. The header is only believed from the
+// trusted networks, anyone else could set it.
+type headerAuth struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func (a headerAuth) Authenticate(r *http.Request) (Principal, error) {
+	user := strings.TrimSpace(r.Header.Get(a.header))
+	if user == "" {
+		return Principal{}, errNoCredentials
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if ip == nil || !slices.ContainsFunc(a.trusted, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+		return Principal{}, errNoCredentials
+	}
+	return Principal{User: user}, nil
+}
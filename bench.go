@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchBlockSize is the size of the random block the synthetic upload data
+// is made of.
+const benchBlockSize = 1 << 20
+
+// runBench implements "uploader bench": it uploads synthetic files to a
+// running server with the tus protocol and reports throughput and latency,
+// e.g.
+//
+//	uploader bench --files 10 --size 5G --chunk 64M --concurrency 8
+//
+// The latency of the first and the last tenth of the chunks of every file
+// are reported apart as well: they stay alike as long as writing a chunk
+// costs the same however many were written before. Against a server with
+// STORAGE_BACKEND=discard and many small chunks, e.g. --size 1G --chunk 64K,
+// that isolates the bookkeeping the server does for every chunk.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	endpoint := fs.String("url", "http://localhost:8080/files/", "tus endpoint of the server")
+	files := fs.Int("files", 10, "number of files to upload")
+	sizeFlag := fs.String("size", "100M", "size of every file (K, M, G and T suffixes)")
+	chunkFlag := fs.String("chunk", "8M", "size of every PATCH request")
+	concurrency := fs.Int("concurrency", 4, "number of files uploaded in parallel")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	size, err := parseByteSize(*sizeFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --size: %s\n", err.Error())
+		return 2
+	}
+	chunk, err := parseByteSize(*chunkFlag)
+	if err != nil || chunk <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid --chunk: %s\n", *chunkFlag)
+		return 2
+	}
+	if *files <= 0 || *concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "--files and --concurrency must be positive")
+		return 2
+	}
+
+	b := &bench{
+		endpoint: *endpoint,
+		size:     size,
+		chunk:    chunk,
+		block:    make([]byte, benchBlockSize),
+		client: &http.Client{Transport: &http.Transport{
+			MaxIdleConnsPerHost: *concurrency,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: *insecure},
+		}},
+	}
+	rand.Read(b.block)
+
+	fmt.Printf("Uploading %d files of %s in %s chunks to %s, %d at a time\n",
+		*files, formatByteSize(size), formatByteSize(chunk), *endpoint, *concurrency)
+	start := time.Now()
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				b.upload(n)
+			}
+		}()
+	}
+	for n := 0; n < *files; n++ {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+	b.report(time.Since(start))
+	if b.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type bench struct {
+	endpoint string
+	size     int64
+	chunk    int64
+	block    []byte
+	client   *http.Client
+
+	mu     sync.Mutex
+	bytes  int64
+	chunks []time.Duration
+	// first and last are the latencies of the first and the last tenth of
+	// the chunks of every file.
+	first  []time.Duration
+	last   []time.Duration
+	files  []time.Duration
+	failed int
+}
+
+func (b *bench) upload(n int) {
+	start := time.Now()
+	err := b.uploadFile(n)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.failed++
+		fmt.Fprintf(os.Stderr, "file %d: %s\n", n, err.Error())
+		return
+	}
+	b.files = append(b.files, time.Since(start))
+}
+
+func (b *bench) uploadFile(n int) error {
+	req, err := http.NewRequest(http.MethodPost, b.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	name := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("bench-%d.bin", n)))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", strconv.FormatInt(b.size, 10))
+	req.Header.Set("Upload-Metadata", "filename "+name)
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("create: %s", res.Status)
+	}
+	location, err := res.Location()
+	if err != nil {
+		return err
+	}
+
+	count := (b.size + b.chunk - 1) / b.chunk
+	tenth := count / 10
+	for i, offset := int64(0), int64(0); offset < b.size; i++ {
+		length := min(b.chunk, b.size-offset)
+		body := io.LimitReader(&blockReader{block: b.block, pos: int(offset % benchBlockSize)}, length)
+		req, err := http.NewRequest(http.MethodPatch, location.String(), body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = length
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		start := time.Now()
+		res, err := b.client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("patch at %d: %s", offset, res.Status)
+		}
+		elapsed := time.Since(start)
+		offset += length
+
+		b.mu.Lock()
+		b.bytes += length
+		b.chunks = append(b.chunks, elapsed)
+		if i < tenth {
+			b.first = append(b.first, elapsed)
+		} else if i >= count-tenth {
+			b.last = append(b.last, elapsed)
+		}
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+func (b *bench) report(elapsed time.Duration) {
+	fmt.Printf("Completed %d files, %d failed, %s in %s\n", len(b.files), b.failed, formatByteSize(b.bytes), elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput: %.1f MB/s\n", float64(b.bytes)/elapsed.Seconds()/1e6)
+	for _, s := range []struct {
+		name string
+		d    []time.Duration
+	}{{"Chunk latency", b.chunks}, {"Chunk latency, first tenth", b.first}, {"Chunk latency, last tenth", b.last}, {"File duration", b.files}} {
+		if len(s.d) == 0 {
+			continue
+		}
+		slices.Sort(s.d)
+		fmt.Printf("%s: p50 %s, p90 %s, p99 %s, max %s\n", s.name,
+			percentile(s.d, 0.5), percentile(s.d, 0.9), percentile(s.d, 0.99), percentile(s.d, 1))
+	}
+}
+
+// percentile returns the p-th percentile of the sorted durations d.
+func percentile(d []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(d)))) - 1
+	return d[max(i, 0)].Round(time.Microsecond)
+}
+
+// blockReader endlessly repeats block, starting at pos.
+type blockReader struct {
+	block []byte
+	pos   int
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	n := copy(p, r.block[r.pos:])
+	r.pos = (r.pos + n) % len(r.block)
+	return n, nil
+}
+
+var byteSizeUnits = []string{"", "K", "M", "G", "T"}
+
+// parseByteSize parses sizes like "512", "64M" or "5G" (powers of 1024).
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	shift := 0
+	for i := len(byteSizeUnits) - 1; i > 0; i-- {
+		if strings.HasSuffix(s, byteSizeUnits[i]) {
+			s = strings.TrimSuffix(s, byteSizeUnits[i])
+			shift = 10 * i
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > math.MaxInt64>>shift {
+		return 0, errors.New("size out of range")
+	}
+	return n << shift, nil
+}
+
+func formatByteSize(n int64) string {
+	i := 0
+	for i < len(byteSizeUnits)-1 && n >= 1<<(10*(i+1)) && n%(1<<(10*(i+1))) == 0 {
+		i++
+	}
+	return fmt.Sprintf("%d%sB", n>>(10*i), byteSizeUnits[i])
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"image/color"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultThemeColor is the color of the page, its icons and its manifest
+// without branding, the primary color of Bootstrap.
+const defaultThemeColor = "#0d6efd"
+
+// maxLogoSize bounds the logo file of a brand.
+const maxLogoSize = 1 << 20
+
+var brandColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// brand is the identity the upload page, the receipts and the web app
+// manifest present, read from the JSON file in BRANDING:
+//
+//	{"title": "Acme uploads", "logo": "/etc/uploader/logo.svg",
+//	 "primary_color": "#b00020", "footer": "Acme Corp, support@acme.test",
+//	 "hosts": {"uploads.other.test": {"title": "Other uploads"}}}
+//
+// Every field is optional. The logo is a URL or a file, served at /logo.
+// The brands of hosts apply to the requests to those hosts, the ones of
+// tenants sharing the deployment, and take the fields they leave out from
+// the top-level brand.
+type brand struct {
+	Title           string            `json:"title,omitempty"`
+	Logo            string            `json:"logo,omitempty"`
+	PrimaryColor    string            `json:"primary_color,omitempty"`
+	BackgroundColor string            `json:"background_color,omitempty"`
+	Footer          string            `json:"footer,omitempty"`
+	Hosts           map[string]*brand `json:"hosts,omitempty"`
+
+	logo     []byte
+	logoType string
+}
+
+// loadBranding reads the brand from the JSON object in file.
+func loadBranding(file string) (*brand, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var b *brand
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	if err := b.load(filepath.Dir(file)); err != nil {
+		return nil, err
+	}
+	hosts := map[string]*brand{}
+	for host, hb := range b.Hosts {
+		host = strings.ToLower(host)
+		hosts[host] = hb
+		if hb == nil || len(hb.Hosts) > 0 {
+			return nil, fmt.Errorf("host %s: expected a brand without hosts", host)
+		}
+		if err := hb.load(filepath.Dir(file)); err != nil {
+			return nil, fmt.Errorf("host %s: %w", host, err)
+		}
+		hb.inherit(b)
+	}
+	b.Hosts = hosts
+	return b, nil
+}
+
+// load checks the fields of b and reads its logo file, relative to dir.
+func (b *brand) load(dir string) error {
+	for name, c := range map[string]string{"primary_color": b.PrimaryColor, "background_color": b.BackgroundColor} {
+		if c != "" && !brandColorPattern.MatchString(c) {
+			return fmt.Errorf("invalid %s %q, expected #rrggbb", name, c)
+		}
+	}
+	if b.Logo == "" || strings.HasPrefix(b.Logo, "https://") || strings.HasPrefix(b.Logo, "http://") {
+		return nil
+	}
+	file := b.Logo
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("logo: %w", err)
+	}
+	if len(data) > maxLogoSize {
+		return fmt.Errorf("logo %s is larger than %d bytes", file, maxLogoSize)
+	}
+	b.logo = data
+	b.logoType = mime.TypeByExtension(filepath.Ext(file))
+	if b.logoType == "" {
+		b.logoType = http.DetectContentType(data)
+	}
+	return nil
+}
+
+// inherit takes the fields b leaves out from parent.
+func (b *brand) inherit(parent *brand) {
+	if b.Title == "" {
+		b.Title = parent.Title
+	}
+	if b.Logo == "" {
+		b.Logo, b.logo, b.logoType = parent.Logo, parent.logo, parent.logoType
+	}
+	if b.PrimaryColor == "" {
+		b.PrimaryColor = parent.PrimaryColor
+	}
+	if b.BackgroundColor == "" {
+		b.BackgroundColor = parent.BackgroundColor
+	}
+	if b.Footer == "" {
+		b.Footer = parent.Footer
+	}
+}
+
+// requestBrand returns the brand of the response to r, an empty one
+// without branding.
+func requestBrand(r *http.Request) *brand {
+	if Branding == nil {
+		return &brand{}
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if b := Branding.Hosts[host]; b != nil {
+		return b
+	}
+	return Branding
+}
+
+// title returns the name of the application, fallback without branding.
+func (b *brand) title(fallback string) string {
+	if b.Title != "" {
+		return b.Title
+	}
+	return fallback
+}
+
+// color returns the primary color of the brand.
+func (b *brand) color() string {
+	if b.PrimaryColor != "" {
+		return b.PrimaryColor
+	}
+	return defaultThemeColor
+}
+
+// background returns the background color of the brand.
+func (b *brand) background() string {
+	if b.BackgroundColor != "" {
+		return b.BackgroundColor
+	}
+	return "#ffffff"
+}
+
+// logoURL returns where the logo of the brand is, "" without one.
+func (b *brand) logoURL() string {
+	if b.logo != nil {
+		return "/logo"
+	}
+	return b.Logo
+}
+
+// rgba returns the color "#rrggbb" as an opaque color.
+func rgba(c string) color.RGBA {
+	v, _ := strconv.ParseUint(strings.TrimPrefix(c, "#"), 16, 32)
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+}
+
+// brandPage replaces the "[[brand_...]]" placeholders of the HTML page with
+// the brand of the request; the page title stands for a brand without one.
+func brandPage(page string, b *brand, lang string) string {
+	heading := html.EscapeString(b.title(messages[lang]["page_title"]))
+	var logo, footer, style string
+	if u := b.logoURL(); u != "" {
+		logo = fmt.Sprintf(`<img src="%s" alt="%s" class="brand-logo">`, html.EscapeString(u), heading)
+	}
+	if b.Footer != "" {
+		footer = fmt.Sprintf(`<footer class="container px-3 my-4 text-muted small">%s</footer>`, html.EscapeString(b.Footer))
+	}
+	// Bootstrap draws its primary controls with its own color, which the
+	// variables of the buttons override.
+	if b.PrimaryColor != "" {
+		c := b.PrimaryColor
+		style = fmt.Sprintf(`
+    .btn-primary { --bs-btn-bg: %[1]s; --bs-btn-border-color: %[1]s; --bs-btn-hover-bg: %[1]s;
+      --bs-btn-hover-border-color: %[1]s; --bs-btn-active-bg: %[1]s; --bs-btn-active-border-color: %[1]s;
+      --bs-btn-disabled-bg: %[1]s; --bs-btn-disabled-border-color: %[1]s; }
+    .btn-primary:hover { filter: brightness(90%%); }
+    .btn-outline-primary { --bs-btn-color: %[1]s; --bs-btn-border-color: %[1]s; --bs-btn-hover-bg: %[1]s;
+      --bs-btn-hover-border-color: %[1]s; --bs-btn-active-bg: %[1]s; --bs-btn-active-border-color: %[1]s; }
+    .progress-bar { background-color: %[1]s; }`, c)
+	}
+	return strings.NewReplacer(
+		"[[brand_title]]", html.EscapeString(b.title("TUS Upload")),
+		"[[brand_heading]]", heading,
+		"[[brand_logo]]", logo,
+		"[[brand_footer]]", footer,
+		"[[brand_color]]", b.color(),
+		"[[brand_background]]", b.background(),
+		"[[brand_style]]", style,
+	).Replace(page)
+}
+
+// logoHandler serves the logo file of the brand of the request.
+func logoHandler(w http.ResponseWriter, r *http.Request) {
+	b := requestBrand(r)
+	if b.logo == nil {
+		httpError(w, "Logo not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", b.logoType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(b.logo)
+}
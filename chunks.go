@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// chunkHandler tells clients whether a chunk of an incomplete upload arrived
+// intact, so they can verify it before deciding to send it again:
+//
+//	HEAD /api/uploads/<id>/chunks/<index>
+//
+// answers 200 with the X-Chunk-Offset, X-Chunk-Size and X-Chunk-Digest of
+// the index-th chunk written, counted from 0, or 404 if there is no such
+// chunk or its data is not all stored. GET answers the same as JSON. Chunks
+// are the requests that wrote to the upload, as listed by
+// GET /api/uploads?fingerprint=.
+type chunkHandler struct {
+	composer *tusd.StoreComposer
+}
+
+func (h *chunkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, rest, _ := strings.Cut(r.URL.Path, "/")
+	v, ok := strings.CutPrefix(rest, "chunks/")
+	index, err := strconv.Atoi(v)
+	if !ok || err != nil || index < 0 || !uploadIDPattern.MatchString(id) {
+		httpError(w, "Chunk not found", http.StatusNotFound)
+		return
+	}
+	upload, err := h.composer.Core.GetUpload(r.Context(), id)
+	if err != nil {
+		httpError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	info, err := upload.GetInfo(r.Context())
+	if err != nil {
+		httpError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	hashes, err := loadUploadHashes(id)
+	if err != nil {
+		httpError(w, "Unable to read the chunks", http.StatusInternalServerError)
+		return
+	}
+	// A chunk the store read more of than it persisted is not all there.
+	if index >= len(hashes.Chunks) || hashes.Chunks[index].Offset+hashes.Chunks[index].Size > info.Offset {
+		httpError(w, "Chunk not found", http.StatusNotFound)
+		return
+	}
+	chunk := hashes.Chunks[index]
+	w.Header().Set("Cache-Control", "no-store")
+	chunk.setHeaders(w.Header())
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, http.StatusOK, chunk)
+}
+
+// setHeaders describes c in the X-Chunk-Offset, X-Chunk-Size and
+// X-Chunk-Digest headers of h, the digest as <algorithm>=<hex>, and in
+// X-Chunk-SHA256 as well if c was hashed with SHA-256.
+func (c chunkHash) setHeaders(h http.Header) {
+	h.Set("X-Chunk-Offset", strconv.FormatInt(c.Offset, 10))
+	h.Set("X-Chunk-Size", strconv.FormatInt(c.Size, 10))
+	alg := c.Algorithm
+	if alg == "" {
+		alg = hashSHA256
+		h.Set("X-Chunk-SHA256", c.SHA256)
+	}
+	h.Set("X-Chunk-Digest", alg+"="+c.sum())
+}
+
+// chunkEchoKey is the request context key of the chunkHash that WriteChunk
+// fills in with the chunk it wrote, for withChunkEcho.
+type chunkEchoKey struct{}
+
+// withChunkEcho adds the X-Chunk-Offset, X-Chunk-Size and X-Chunk-Digest of
+// the chunk written by a tus PATCH request to its response when CHUNK_ECHO
+// is set, so clients can compare them with what they sent and resend a
+// corrupted chunk at once, instead of learning about it when the upload
+// fails verification. Nothing is echoed when the store persisted less than
+// it read, the chunk hash does not describe the stored bytes then.
+func withChunkEcho(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ChunkEcho || r.Method != http.MethodPatch {
+			next.ServeHTTP(w, r)
+			return
+		}
+		echo := &chunkHash{Offset: -1}
+		r = r.WithContext(context.WithValue(r.Context(), chunkEchoKey{}, echo))
+		next.ServeHTTP(&echoResponseWriter{ResponseWriter: w, echo: echo}, r)
+	})
+}
+
+type echoResponseWriter struct {
+	http.ResponseWriter
+	echo    *chunkHash
+	written bool
+}
+
+func (w *echoResponseWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		if status >= 200 && status <= 299 && w.echo.Offset >= 0 {
+			w.echo.setHeaders(w.Header())
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *echoResponseWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *echoResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
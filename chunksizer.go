@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// chunkSizerHandler serves the script the upload page and its service
+// worker load their settings with, size their PATCH requests with and run
+// the speed test with.
+func chunkSizerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, chunkSizerJS)
+}
+
+const chunkSizerJS = `// SETTINGS are the client settings of /api/settings, see clientSettings,
+// with these defaults until loadSettings got them.
+var SETTINGS = {
+    chunk_size_min: 256 * 1024,
+    chunk_size_max: 64 * 1024 * 1024,
+    chunk_seconds: 5,
+    concurrency: 0,
+    retry_delays: [0, 1000, 3000, 5000],
+    request_timeout: 0,
+    speed_test_size: 1024 * 1024,
+    speed_test_timeout: 10000,
+    stream_buffer: 0,
+    heartbeat_interval: 30000
+};
+var settingsLoaded = null;
+// loadSettings resolves once SETTINGS are loaded, or left at their defaults
+// when the server could not be asked, to be tried again next time.
+function loadSettings(){
+    if(!settingsLoaded){
+        settingsLoaded = fetch('/api/settings').then(function(res){
+            if(!res.ok){
+                throw new Error('HTTP ' + res.status);
+            }
+            return res.json();
+        }).then(function(settings){
+            Object.keys(settings).forEach(function(k){ SETTINGS[k] = settings[k]; });
+        }, function(){
+            settingsLoaded = null;
+        });
+    }
+    return settingsLoaded;
+}
+
+// ChunkSizer picks the size of the next chunk so that it takes about
+// chunk_seconds to send at the measured throughput: small chunks on slow or
+// flaky connections, where a lost chunk has to be sent again, and large ones
+// on fast links, where every request adds overhead.
+function ChunkSizer(){
+    this.size = this.clamp(8 * 1024 * 1024);
+    this.rate = 0;
+}
+ChunkSizer.prototype.clamp = function(n){
+    return Math.min(Math.max(Math.round(n), SETTINGS.chunk_size_min), SETTINGS.chunk_size_max);
+};
+// measure records that a chunk of bytes took ms to upload.
+ChunkSizer.prototype.measure = function(bytes, ms){
+    if(bytes <= 0){
+        return;
+    }
+    var rate = bytes / Math.max(ms, 1) * 1000;
+    // Smoothed, so a single slow or fast chunk does not swing the size.
+    this.rate = this.rate ? this.rate * 0.7 + rate * 0.3 : rate;
+    // Growing at most twofold per chunk, a brief burst does not produce a
+    // chunk the connection cannot keep up with.
+    this.size = this.clamp(Math.min(this.rate * SETTINGS.chunk_seconds, this.size * 2));
+};
+// failed halves the chunks after a chunk was lost.
+ChunkSizer.prototype.failed = function(){
+    this.rate /= 2;
+    this.size = this.clamp(this.size / 2);
+};
+
+// speedTest loads the settings and uploads speed_test_size throwaway bytes
+// to /api/speedtest, then starts sizer, unless it measured chunks already,
+// with the chunk size the server recommends. It resolves to the number of
+// files to upload at once: the concurrency setting if there is one, 1 on
+// metered connections, which are not tested, and when the test fails.
+function speedTest(sizer){
+    return loadSettings().then(function(){
+        sizer.size = sizer.clamp(sizer.size);
+        var fallback = SETTINGS.concurrency || 1;
+        var c = navigator.connection;
+        if(!SETTINGS.speed_test_size || (c && (c.saveData || c.type === 'cellular'))){
+            return fallback;
+        }
+        var abort = new AbortController();
+        var timer = setTimeout(function(){ abort.abort(); }, SETTINGS.speed_test_timeout);
+        return fetch('/api/speedtest', {method: 'POST', body: new Uint8Array(SETTINGS.speed_test_size), signal: abort.signal}).then(function(res){
+            if(!res.ok){
+                throw new Error('HTTP ' + res.status);
+            }
+            return res.json();
+        }).then(function(result){
+            clearTimeout(timer);
+            if(!sizer.rate){
+                sizer.rate = result.rate;
+                sizer.size = sizer.clamp(result.chunk_size);
+            }
+            return result.concurrency;
+        }).catch(function(){
+            clearTimeout(timer);
+            return fallback;
+        });
+    });
+}
+
+// timedFetch is fetch, aborted after the request_timeout setting.
+function timedFetch(url, options){
+    if(!SETTINGS.request_timeout){
+        return fetch(url, options);
+    }
+    var abort = new AbortController();
+    var timer = setTimeout(function(){ abort.abort(); }, SETTINGS.request_timeout);
+    if(options.signal){
+        options.signal.addEventListener('abort', function(){ abort.abort(); });
+    }
+    options.signal = abort.signal;
+    return fetch(url, options).then(function(res){
+        clearTimeout(timer);
+        return res;
+    }, function(err){
+        clearTimeout(timer);
+        throw err;
+    });
+}
+
+// sendHeartbeat tells the server that the uploads with the given IDs are
+// still followed, however slowly they go, and resolves to the IDs of those
+// the server still has.
+function sendHeartbeat(ids){
+    if(ids.length === 0){
+        return Promise.resolve([]);
+    }
+    return fetch('/api/uploads/heartbeat?' + ids.map(function(id){ return 'id=' + encodeURIComponent(id); }).join('&'), {method: 'POST'}).then(function(res){
+        return res.ok ? res.json() : ids;
+    }, function(){ return ids; });
+}
+
+// Chunks are sent as streams where the browser can, read from the file
+// stream_buffer bytes at a time as the connection takes them: a chunk is
+// never held in memory whole, and a slow link, or a server writing slowly
+// to its disk and reading the request no faster, holds back the reading
+// of the file instead of filling the memory. Browsers stream requests over
+// HTTP/2 and 3 only, so over HTTPS only, and refuse them otherwise: once a
+// streamed chunk fails before any went through, chunks are sent whole.
+var streaming = {supported: null, refused: false, worked: false};
+function streamChunks(){
+    if(!SETTINGS.stream_buffer || streaming.refused || location.protocol !== 'https:' || typeof ReadableStream === 'undefined'){
+        return false;
+    }
+    if(streaming.supported === null){
+        // Browsers that cannot stream requests send the stream as a string,
+        // with a Content-Type, and do not ask for the duplex option.
+        var duplex = false;
+        try {
+            var typed = new Request(location.origin, {
+                method: 'POST',
+                body: new ReadableStream(),
+                get duplex(){ duplex = true; return 'half'; }
+            }).headers.has('Content-Type');
+            streaming.supported = duplex && !typed;
+        } catch(e){
+            streaming.supported = false;
+        }
+    }
+    return streaming.supported;
+}
+// chunkStream reads blob stream_buffer bytes at a time, as the stream is
+// pulled, and reports the bytes handed over so far to onProgress.
+function chunkStream(blob, onProgress){
+    var offset = 0;
+    return new ReadableStream({
+        pull: function(controller){
+            if(offset >= blob.size){
+                controller.close();
+                return;
+            }
+            var end = Math.min(offset + SETTINGS.stream_buffer, blob.size);
+            return blob.slice(offset, end).arrayBuffer().then(function(data){
+                offset = end;
+                controller.enqueue(new Uint8Array(data));
+                if(onProgress){
+                    onProgress(offset);
+                }
+            });
+        }
+    });
+}
+// streamedFetch sends blob as the stream of a timedFetch with options, or
+// resolves to sendWhole() once the browser refused to stream it.
+function streamedFetch(url, options, blob, onProgress, sendWhole){
+    options.body = chunkStream(blob, onProgress);
+    options.duplex = 'half';
+    return timedFetch(url, options).then(function(res){
+        streaming.worked = true;
+        return res;
+    }, function(err){
+        if(streaming.worked){
+            throw err;
+        }
+        streaming.refused = true;
+        return sendWhole();
+    });
+}
+`
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// completionFields are the fields COMPLETION_FIELDS can pick for the
+// response completing an upload.
+var completionFields = []string{"id", "filename", "stored_name", "size", "sha256", "download_url", "receipt_url", "message"}
+
+// completionData is what the templates of COMPLETION_MESSAGE and
+// DOWNLOAD_URL are executed with.
+type completionData struct {
+	ID         string
+	Filename   string
+	StoredName string
+	Size       int64
+	SHA256     string
+	User       string
+	Role       string
+}
+
+var completionFuncs = template.FuncMap{
+	"query": url.QueryEscape,
+	// path escapes every element of a slash separated path.
+	"path": func(p string) string {
+		parts := strings.Split(p, "/")
+		for i, part := range parts {
+			parts[i] = url.PathEscape(part)
+		}
+		return strings.Join(parts, "/")
+	},
+}
+
+// parseCompletionTemplate parses the template of COMPLETION_MESSAGE or
+// DOWNLOAD_URL, nil if text is empty.
+func parseCompletionTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New(name).Funcs(completionFuncs).Option("missingkey=error").Parse(text)
+}
+
+// parseCompletionFields parses the comma separated list of COMPLETION_FIELDS.
+func parseCompletionFields(list string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if !slices.Contains(completionFields, field) {
+			return nil, fmt.Errorf("unknown field %q, expected one of %s", field, strings.Join(completionFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// plannedNames holds the names, relative to UploadPath, that completed
+// uploads are stored under once their completion response announced them.
+var plannedNames sync.Map
+
+// storedFileName returns the name, relative to UploadPath, a completed
+// upload is stored under: the original filename prefixed with a timestamp,
+// in the folder of its routing rule, in the folder of its policy.
+func storedFileName(info tusd.FileInfo, now time.Time) string {
+	// Only the last element of the client supplied name is used, so it
+	// cannot point outside UploadPath.
+	origName := path.Base(strings.ReplaceAll(info.MetaData["filename"], "\\", "/"))
+	if origName == "." || origName == "/" || origName == ".." {
+		origName = "file"
+	}
+	name := fmt.Sprintf("%s_%s", now.Format("20060102_150405"), origName)
+	if rule := routeFor(filepath.Join(TempUploadPath, info.ID), info.MetaData["filename"]); rule != nil && rule.Folder != "" {
+		name = filepath.Join(filepath.FromSlash(rule.Folder), name)
+	}
+	if p := policyFor(info.MetaData); p != nil && p.Folder != "" {
+		name = filepath.Join(filepath.FromSlash(p.Folder), name)
+	}
+	return name
+}
+
+// planStoredName fixes the name the upload info is stored under, so the
+// completion response can report it before the upload is stored.
+func planStoredName(info tusd.FileInfo) string {
+	name := storedFileName(info, time.Now())
+	plannedNames.Store(info.ID, name)
+	return name
+}
+
+// takeStoredName returns the name planned for the upload info, or a new
+// one.
+func takeStoredName(info tusd.FileInfo) string {
+	if name, ok := plannedNames.LoadAndDelete(info.ID); ok {
+		return name.(string)
+	}
+	return storedFileName(info, time.Now())
+}
+
+// How a completed upload is stored when a file has the name storedFileName
+// gave it already, which happens when files of the same name complete
+// within the same second, selected with NAME_COLLISIONS. "overwrite"
+// replaces the file. "random" adds NAME_SUFFIX_BYTES random bytes in hex to
+// the name before its extension, "counter" the first free number from 2 on,
+// e.g. "report-2.pdf". "fail" leaves the upload in TempUploadPath, retried
+// when storing is retried. Names announced in the completion response
+// before the upload was stored may change.
+const (
+	collisionOverwrite = "overwrite"
+	collisionRandom    = "random"
+	collisionCounter   = "counter"
+	collisionFail      = "fail"
+)
+
+var errNameTaken = errors.New("a stored file has this name already")
+
+// storeUploadUnique stores the completed upload info under name, or under
+// another one per NAME_COLLISIONS if a stored file has it already, and
+// returns the resulting path.
+func storeUploadUnique(info tusd.FileInfo, name string) (string, error) {
+	if StorageBackend != storageFile || NameCollisions == collisionOverwrite {
+		return storeUpload(info, name)
+	}
+	claimed, err := claimStoredName(name)
+	if err != nil {
+		return "", err
+	}
+	if claimed != name {
+		log.Printf("Upload %s stored as %s, %s is taken", info.ID, claimed, name)
+	}
+	dstPath, err := storeUpload(info, claimed)
+	if err != nil {
+		// The move failed, the placeholder is still there.
+		os.Remove(filepath.Join(UploadPath, claimed))
+	}
+	return dstPath, err
+}
+
+// claimStoredName returns name, or the first name derived from it per
+// NAME_COLLISIONS no stored file has, and reserves it with an empty file,
+// which other replicas sharing UploadPath see as well, until the upload is
+// moved over it.
+func claimStoredName(name string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(UploadPath, name)), os.ModePerm); err != nil {
+		return "", err
+	}
+	ext := path.Ext(filepath.ToSlash(name))
+	base := strings.TrimSuffix(name, ext)
+	for attempt := 1; ; attempt++ {
+		candidate := name
+		switch {
+		case attempt == 1:
+		case NameCollisions == collisionFail:
+			return "", fmt.Errorf("%s: %w", name, errNameTaken)
+		case NameCollisions == collisionCounter:
+			candidate = fmt.Sprintf("%s-%d%s", base, attempt, ext)
+		case attempt > 10:
+			return "", fmt.Errorf("%s: %w", name, errNameTaken)
+		default:
+			suffix := make([]byte, NameSuffixBytes)
+			rand.Read(suffix)
+			candidate = base + "-" + hex.EncodeToString(suffix) + ext
+		}
+		p := filepath.Join(UploadPath, candidate)
+		// A tiered file keeps its name while its data is elsewhere.
+		if _, err := os.Lstat(p + tieredSuffix); err == nil {
+			continue
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		f.Close()
+		return candidate, nil
+	}
+}
+
+// completionPayload returns the fields of COMPLETION_FIELDS for the
+// completed upload info, nil if none are configured. The stored name is
+// planned for finishUpload to use.
+func completionPayload(info tusd.FileInfo) map[string]any {
+	if len(CompletionFields) == 0 || info.IsPartial {
+		return nil
+	}
+	data := completionData{
+		ID:         info.ID,
+		Filename:   info.MetaData["filename"],
+		StoredName: filepath.ToSlash(planStoredName(info)),
+		Size:       info.Size,
+		User:       info.MetaData["user"],
+		Role:       info.MetaData["role"],
+	}
+	data.SHA256, _ = uploadSHA256(info)
+	payload := map[string]any{}
+	for _, field := range CompletionFields {
+		switch field {
+		case "id":
+			payload[field] = data.ID
+		case "filename":
+			payload[field] = data.Filename
+		case "stored_name":
+			payload[field] = data.StoredName
+		case "size":
+			payload[field] = data.Size
+		case "sha256":
+			payload[field] = data.SHA256
+		case "download_url":
+			if s, ok := executeCompletionTemplate(DownloadURL, data); ok {
+				payload[field] = s
+			}
+		case "receipt_url":
+			if receiptKey != nil {
+				payload[field] = strings.TrimSuffix(BaseURL, "/files/") + "/api/receipts/" + data.ID + ".html"
+			}
+		case "message":
+			if s, ok := executeCompletionTemplate(CompletionMessage, data); ok {
+				payload[field] = s
+			}
+		}
+	}
+	return payload
+}
+
+func executeCompletionTemplate(t *template.Template, data completionData) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", false
+	}
+	return b.String(), true
+}
+
+// completionResponse is the PreFinishResponseCallback part that answers the
+// request completing a tus upload with the COMPLETION_FIELDS as JSON,
+// instead of an empty 204.
+func completionResponse(info tusd.FileInfo) tusd.HTTPResponse {
+	payload := completionPayload(info)
+	if payload == nil {
+		return tusd.HTTPResponse{}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return tusd.HTTPResponse{}
+	}
+	return tusd.HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Header:     tusd.HTTPHeader{"Content-Type": "application/json"},
+	}
+}
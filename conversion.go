@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conversionRule converts the stored files matching it to a house format
+// with ffmpeg. A file matches if its detected type is one of Types, e.g.
+// "video/quicktime", or its extension one of Extensions, and, if Codecs is
+// set, its first video stream has one of the codecs, as ffmpeg names them:
+//
+//	[{"extensions": [".heic", ".heif"], "to": "jpeg"},
+//	 {"types": ["video/quicktime"], "codecs": ["prores"], "to": "dnxhd",
+//	  "keep_original": true}]
+//
+// To is one of conversionPresets, or any name with Extension and Args, the
+// ffmpeg arguments between the input and the output, including -f. The
+// conversion is stored next to the original, with the extension of the
+// format, and the original is deleted unless KeepOriginal is set; a kept
+// original is annotated with the name of its conversion. The first rule
+// matching a file applies.
+type conversionRule struct {
+	Types        []string `json:"types,omitempty"`
+	Extensions   []string `json:"extensions,omitempty"`
+	Codecs       []string `json:"codecs,omitempty"`
+	To           string   `json:"to"`
+	Extension    string   `json:"extension,omitempty"`
+	Args         []string `json:"args,omitempty"`
+	KeepOriginal bool     `json:"keep_original,omitempty"`
+}
+
+// conversionPreset is a house format rules convert to by name.
+type conversionPreset struct {
+	extension string
+	args      []string
+}
+
+var conversionPresets = map[string]conversionPreset{
+	// HEIC and HEIF photos need an ffmpeg built with HEIF support, 7.1
+	// or later for the tiled images of phones.
+	"jpeg": {".jpg", []string{"-map", "0:v:0", "-frames:v", "1", "-c:v", "mjpeg", "-q:v", "2", "-f", "image2"}},
+	"dnxhd": {".mov", []string{"-map", "0:v:0", "-map", "0:a?", "-c:v", "dnxhd", "-profile:v", "dnxhr_hq",
+		"-pix_fmt", "yuv422p", "-c:a", "pcm_s16le", "-f", "mov"}},
+	"h264": {".mp4", []string{"-map", "0:v:0", "-map", "0:a?", "-c:v", "libx264", "-preset", "medium", "-crf", "18",
+		"-c:a", "aac", "-b:a", "192k", "-movflags", "+faststart", "-f", "mp4"}},
+}
+
+// loadConversionRules reads the rules from the JSON array in file.
+func loadConversionRules(file string) ([]*conversionRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*conversionRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules {
+		if len(r.Types) == 0 && len(r.Extensions) == 0 {
+			return nil, fmt.Errorf("rule %d: neither types nor extensions", i+1)
+		}
+		for j, t := range r.Types {
+			r.Types[j] = strings.ToLower(strings.TrimSpace(t))
+		}
+		r.Extensions = parseExtensions(strings.Join(r.Extensions, ","))
+		for j, c := range r.Codecs {
+			r.Codecs[j] = strings.ToLower(strings.TrimSpace(c))
+		}
+		if !validConversionName(r.To) {
+			return nil, fmt.Errorf("rule %d: invalid to %q", i+1, r.To)
+		}
+		if preset, ok := conversionPresets[r.To]; ok {
+			if r.Extension == "" {
+				r.Extension = preset.extension
+			}
+			if len(r.Args) == 0 {
+				r.Args = preset.args
+			}
+		}
+		if len(r.Args) == 0 || !strings.HasPrefix(r.Extension, ".") || strings.Contains(r.Extension, "/") {
+			return nil, fmt.Errorf("rule %d: %q is no preset, it needs extension and args", i+1, r.To)
+		}
+	}
+	return rules, nil
+}
+
+var conversionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+func validConversionName(name string) bool {
+	return conversionNamePattern.MatchString(name)
+}
+
+func (r *conversionRule) matches(mediaType, ext string) bool {
+	return slices.Contains(r.Types, mediaType) || slices.Contains(r.Extensions, strings.TrimPrefix(ext, "."))
+}
+
+// output returns the name of the conversion of the stored file name: the
+// name with the extension of the format, and the name of the format
+// inserted if that is the name itself, clip.mov becoming clip.dnxhd.mov.
+func (r *conversionRule) output(name string) string {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	if out := base + r.Extension; out != name {
+		return out
+	}
+	return base + "." + r.To + r.Extension
+}
+
+var (
+	conversionMu sync.Mutex
+	// conversionChecked remembers the files that were converted, match no
+	// rule, or ffmpeg failed on, so they are not probed again on every run.
+	conversionChecked = map[string]bool{}
+	// conversionKick starts the job once an upload is stored.
+	conversionKick = make(chan struct{}, 1)
+)
+
+// queueConversion has the conversions job look at the stored files soon,
+// for the one just stored.
+func queueConversion() {
+	if len(ConversionRules) == 0 {
+		return
+	}
+	select {
+	case conversionKick <- struct{}{}:
+	default:
+	}
+}
+
+// runConversionsOnStore runs the conversions job whenever an upload is
+// stored, besides its schedule, on the leader.
+func runConversionsOnStore(ctx context.Context, job *scheduledJob) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-conversionKick:
+		}
+		if !leader.isLeader() {
+			continue
+		}
+		// A run in progress may have passed the file already.
+		for job.execute(ctx) == errJobRunning {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(30 * time.Second):
+			}
+		}
+	}
+}
+
+// convertStored is the "conversions" job. It converts the stored files
+// matching ConversionRules that have no conversion yet.
+func convertStored(ctx context.Context) (string, error) {
+	conversionMu.Lock()
+	defer conversionMu.Unlock()
+	converted, failed := 0, 0
+	err := walkStoredFiles(ctx, func(name string, info fs.FileInfo, tiered bool) error {
+		if tiered || conversionChecked[name] {
+			return nil
+		}
+		conversionChecked[name] = true
+		rule := conversionFor(ctx, name)
+		if rule == nil {
+			return nil
+		}
+		out := rule.output(name)
+		if _, err := os.Stat(filepath.Join(UploadPath, filepath.FromSlash(out))); !os.IsNotExist(err) {
+			return nil
+		}
+		if err := convertFile(ctx, name, out, rule); err != nil {
+			if ctx.Err() != nil {
+				delete(conversionChecked, name)
+				return ctx.Err()
+			}
+			log.Printf("Unable to convert %s to %s: %s", name, rule.To, err.Error())
+			failed++
+			return nil
+		}
+		log.Printf("Converted %s to %s", name, out)
+		converted++
+		return nil
+	})
+	if converted == 0 && failed == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("converted %d files, %d failed", converted, failed), err
+}
+
+// conversionFor returns the rule converting the stored file name, nil if
+// none does.
+func conversionFor(ctx context.Context, name string) *conversionRule {
+	p := filepath.Join(UploadPath, filepath.FromSlash(name))
+	mediaType := detectFileType(p, name)
+	ext := strings.ToLower(path.Ext(name))
+	codec := ""
+	for _, r := range ConversionRules {
+		if !r.matches(mediaType, ext) {
+			continue
+		}
+		// Conversions to a format of the same type are not converted again.
+		if strings.HasSuffix(strings.TrimSuffix(name, path.Ext(name)), "."+r.To) {
+			return nil
+		}
+		if len(r.Codecs) == 0 {
+			return r
+		}
+		if codec == "" {
+			codec = videoCodec(ctx, p)
+		}
+		if slices.Contains(r.Codecs, codec) {
+			return r
+		}
+	}
+	return nil
+}
+
+// ffmpegVideoStream matches the first video stream ffmpeg reports of its
+// input, with the name of its codec.
+var ffmpegVideoStream = regexp.MustCompile(`Stream #\d+:\d+.*?: Video: (\w+)`)
+
+// videoCodec returns the codec of the first video stream of the file at p,
+// "" if there is none.
+func videoCodec(ctx context.Context, p string) string {
+	// Without an output ffmpeg fails, after describing its input.
+	out, _ := exec.CommandContext(ctx, FFmpegPath, "-hide_banner", "-nostdin", "-i", p).CombinedOutput()
+	if m := ffmpegVideoStream.FindSubmatch(out); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	return ""
+}
+
+// convertFile writes the conversion out of the stored file name by rule,
+// as a stored file of the same uploader, and deletes name unless the rule
+// keeps it.
+func convertFile(ctx context.Context, name, out string, rule *conversionRule) error {
+	src := filepath.Join(UploadPath, filepath.FromSlash(name))
+	dst := filepath.Join(UploadPath, filepath.FromSlash(out))
+	tmp := dst + ".tmp"
+	defer os.Remove(tmp)
+	args := append([]string{"-hide_banner", "-nostdin", "-y", "-i", src}, rule.Args...)
+	if _, err := runFFmpeg(ctx, append(args, tmp)...); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	conversionChecked[out] = true
+	if storedFiles != nil {
+		stat, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(dst)
+		if err != nil {
+			log.Printf("Unable to hash %s: %s", out, err.Error())
+		}
+		storedFiles.record(out, stat.Size(), sum)
+		if rec, ok := storedFiles.get(name); ok {
+			if rec.User != "" || rec.TokenID != "" || rec.RetentionDays > 0 {
+				storedFiles.setOrigin(out, rec.User, rec.TokenID, rec.RetentionDays)
+			}
+			if rec.UploadID != "" {
+				storedFiles.setUpload(out, rec.UploadID)
+			}
+		}
+	}
+	if replication != nil {
+		replication.enqueue(out)
+		if ChecksumSidecars && storedFiles != nil {
+			replication.enqueue(out + checksumSuffix)
+		}
+	}
+	if rule.KeepOriginal {
+		annotateStored(name, "converted", out)
+		return nil
+	}
+	if err := deleteStored(name, false); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("converted to %s, but the original is left: %w", out, err)
+	}
+	return nil
+}
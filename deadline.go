@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// errUploadExpired rejects data sent to an upload after its deadline.
+var errUploadExpired = tusd.NewError("ERR_UPLOAD_EXPIRED", "upload deadline has passed", http.StatusGone)
+
+// deadlineFor returns how long uploads with the metadata meta have to
+// complete: the deadline of their policy, or UploadDeadline. 0 is no limit.
+func deadlineFor(meta tusd.MetaData) time.Duration {
+	if p := policyFor(meta); p != nil && p.DeadlineHours > 0 {
+		return time.Duration(p.DeadlineHours) * time.Hour
+	}
+	return UploadDeadline
+}
+
+// deadlinesEnabled reports whether any upload can have a deadline.
+func deadlinesEnabled() bool {
+	return UploadDeadline > 0 || findPolicy(func(p *uploadPolicy) bool { return p.DeadlineHours > 0 }) != nil
+}
+
+// setUploadDeadline stores when the new upload must be complete in its
+// "deadline" metadata, replacing a deadline the client set itself. The time
+// a queued upload waits for its upload window does not count. Final
+// concatenations have none, they are complete once created.
+func setUploadDeadline(info *tusd.FileInfo) {
+	if _, ok := info.MetaData["deadline"]; ok {
+		info.MetaData = maps.Clone(info.MetaData)
+		delete(info.MetaData, "deadline")
+	}
+	d := deadlineFor(info.MetaData)
+	if d == 0 || info.IsFinal {
+		return
+	}
+	info.MetaData = maps.Clone(info.MetaData)
+	if info.MetaData == nil {
+		info.MetaData = tusd.MetaData{}
+	}
+	start := time.Now()
+	if s := uploadStart(*info); s.After(start) {
+		start = s
+	}
+	info.MetaData["deadline"] = start.Add(d).UTC().Format(time.RFC3339)
+}
+
+// uploadDeadline returns the deadline of the upload, zero if it has none.
+func uploadDeadline(info tusd.FileInfo) time.Time {
+	t, _ := time.Parse(time.RFC3339, info.MetaData["deadline"])
+	return t
+}
+
+// checkUploadDeadline rejects writes to an upload past its deadline. The
+// upload is removed by the next expiry run.
+func checkUploadDeadline(info tusd.FileInfo) error {
+	if deadline := uploadDeadline(info); !deadline.IsZero() && time.Now().After(deadline) {
+		return errUploadExpired
+	}
+	return nil
+}
+
+// pastDeadline reports whether the upload id is past its deadline.
+func pastDeadline(ctx context.Context, composer *tusd.StoreComposer, id string) bool {
+	upload, err := composer.Core.GetUpload(ctx, id)
+	if err != nil {
+		return false
+	}
+	info, err := upload.GetInfo(ctx)
+	return err == nil && checkUploadDeadline(info) != nil
+}
+
+// withUploadExpires adds the Upload-Expires header of the tus expiration
+// extension to the responses of the tus handler for uploads with a deadline,
+// so clients can warn their user before the upload expires.
+func withUploadExpires(composer *tusd.StoreComposer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !deadlinesEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&expiresResponseWriter{ResponseWriter: w, r: r, composer: composer}, r)
+	})
+}
+
+// expiresResponseWriter sets Upload-Expires when the status is written, once
+// tusd has set the Location of new uploads.
+type expiresResponseWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	composer *tusd.StoreComposer
+	written  bool
+}
+
+func (w *expiresResponseWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		w.setHeaders(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *expiresResponseWriter) setHeaders(status int) {
+	h := w.Header()
+	if w.r.Method == http.MethodOptions {
+		if ext := h.Get("Tus-Extension"); ext != "" {
+			h.Set("Tus-Extension", ext+",expiration")
+		}
+		return
+	}
+	if status < 200 || status > 299 {
+		return
+	}
+	id := strings.Trim(w.r.URL.Path, "/")
+	if location := h.Get("Location"); w.r.Method == http.MethodPost && location != "" {
+		id = path.Base(location)
+	}
+	if id == "" {
+		return
+	}
+	upload, err := w.composer.Core.GetUpload(w.r.Context(), id)
+	if err != nil {
+		return
+	}
+	if info, err := upload.GetInfo(w.r.Context()); err == nil {
+		if deadline := uploadDeadline(info); !deadline.IsZero() && (info.SizeIsDeferred || info.Offset < info.Size) {
+			h.Set("Upload-Expires", deadline.Format(http.TimeFormat))
+		}
+	}
+}
+
+func (w *expiresResponseWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *expiresResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
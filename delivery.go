@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// A delivery is a set of files uploaded together, e.g. the footage of one
+// shoot. Clients declare it with the "delivery" metadata, a random ID of at
+// least 24 characters they choose, and "delivery_files", the number of files
+// in it, on every upload of the delivery. A delivery belongs to the client
+// that declares it first, by its upload token, user or address, and takes
+// no uploads of other clients nor more than its number of files. The
+// combined progress of a delivery, without the uploads and stored names of
+// its files, is served to whoever knows its ID:
+//
+//	GET /api/deliveries/<id>
+//
+// Once as many files as declared are stored, the delivery is complete: it
+// is posted to DELIVERY_WEBHOOK and published to <MQTT_TOPIC_PREFIX>/delivered.
+// Deliveries are tracked by every replica on its own, in deliveries.json in
+// TempUploadPath, and forgotten a week after their last activity.
+
+const (
+	deliveryKeep         = 7 * 24 * time.Hour
+	deliveryMaxFiles     = 10000
+	deliveryWebhookTries = 3
+)
+
+// deliveryIDPattern requires IDs hard enough to guess, like the 24 hex
+// digits the upload page makes up.
+var deliveryIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{24,64}$`)
+
+var (
+	errDeliveryInvalid = tusd.NewError("ERR_DELIVERY_INVALID", "the delivery ID must be 24 to 64 letters, digits, dots, dashes or underscores, with 1 to 10000 files", http.StatusBadRequest)
+	errDeliveryForeign = tusd.NewError("ERR_DELIVERY_FOREIGN", "the delivery belongs to another client", http.StatusForbidden)
+	errDeliveryFull    = tusd.NewError("ERR_DELIVERY_FULL", "the delivery has all of its files already", http.StatusConflict)
+)
+
+// deliveryFile is an upload of a delivery.
+type deliveryFile struct {
+	UploadID string `json:"upload_id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	// Name and SHA256 are set once the upload is stored, Name relative to
+	// UploadPath.
+	Name   string `json:"name,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Stored bool   `json:"stored"`
+	// Error is why the last write or store of the upload failed.
+	Error string `json:"error,omitempty"`
+}
+
+// delivery is the state of a delivery. Size, Offset and Stored sum up its
+// uploads.
+type delivery struct {
+	ID    string `json:"id"`
+	Files int    `json:"files"`
+	// Owner is the "delivery_owner" of its uploads.
+	Owner     string          `json:"owner,omitempty"`
+	Uploads   []*deliveryFile `json:"uploads"`
+	Size      int64           `json:"size"`
+	Offset    int64           `json:"offset"`
+	Stored    int             `json:"stored"`
+	Complete  bool            `json:"complete"`
+	Updated   time.Time       `json:"updated"`
+	Completed time.Time       `json:"completed,omitzero"`
+}
+
+func (d *delivery) upload(id string) *deliveryFile {
+	for _, f := range d.Uploads {
+		if f.UploadID == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// full reports whether d takes no more uploads: it has as many as its
+// files, none of which failed and may be replaced.
+func (d *delivery) full() bool {
+	return len(d.Uploads) >= d.Files && !slices.ContainsFunc(d.Uploads, (*deliveryFile).replaceable)
+}
+
+// add adds the upload f to d, in place of a failed one if d has as many as
+// its files already, and reports whether it could.
+func (d *delivery) add(f *deliveryFile) bool {
+	if len(d.Uploads) >= d.Files {
+		i := slices.IndexFunc(d.Uploads, (*deliveryFile).replaceable)
+		if i < 0 {
+			return false
+		}
+		d.Uploads = slices.Delete(d.Uploads, i, i+1)
+	}
+	d.Uploads = append(d.Uploads, f)
+	return true
+}
+
+func (f *deliveryFile) replaceable() bool {
+	return !f.Stored && f.Error != ""
+}
+
+// sum updates the totals of d from its uploads.
+func (d *delivery) sum() {
+	d.Size, d.Offset, d.Stored = 0, 0, 0
+	for _, f := range d.Uploads {
+		d.Size += f.Size
+		d.Offset += f.Offset
+		if f.Stored {
+			d.Stored++
+		}
+	}
+}
+
+// copy returns a deep copy of d, for use outside of the lock.
+func (d *delivery) copy() delivery {
+	c := *d
+	c.Uploads = make([]*deliveryFile, len(d.Uploads))
+	for i, f := range d.Uploads {
+		file := *f
+		c.Uploads[i] = &file
+	}
+	return c
+}
+
+// deliveryTracker follows the deliveries through the upload hooks.
+type deliveryTracker struct {
+	journal string
+
+	mu         sync.Mutex
+	deliveries map[string]*delivery
+}
+
+// deliveries is nil until main sets it up.
+var deliveries *deliveryTracker
+
+// newDeliveryTracker loads the deliveries from journal, or keeps them in
+// memory only if journal is empty.
+func newDeliveryTracker(journal string) (*deliveryTracker, error) {
+	t := &deliveryTracker{journal: journal, deliveries: map[string]*delivery{}}
+	if journal == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &t.deliveries); err != nil {
+			return nil, fmt.Errorf("%s: %w", journal, err)
+		}
+	}
+	return t, nil
+}
+
+func (t *deliveryTracker) saveLocked() {
+	cutoff := time.Now().Add(-deliveryKeep)
+	for id, d := range t.deliveries {
+		if d.Updated.Before(cutoff) {
+			delete(t.deliveries, id)
+		}
+	}
+	if t.journal == "" {
+		return
+	}
+	data, err := json.Marshal(t.deliveries)
+	if err == nil {
+		tmp := t.journal + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, t.journal)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save deliveries: %s", err.Error())
+	}
+}
+
+// deliveryOf returns the delivery ID and number of files the upload info
+// declares, false if it declares none or an invalid one.
+func deliveryOf(info tusd.FileInfo) (string, int, bool) {
+	id := info.MetaData["delivery"]
+	files, err := strconv.Atoi(info.MetaData["delivery_files"])
+	if id == "" || !deliveryIDPattern.MatchString(id) || err != nil || files < 1 || files > deliveryMaxFiles {
+		return "", 0, false
+	}
+	return id, files, true
+}
+
+// deliveryOwner returns the "delivery_owner" of an upload with the metadata
+// meta made from remoteAddr: a digest of its upload token, else its user,
+// else its address.
+func deliveryOwner(meta tusd.MetaData, remoteAddr string) string {
+	var key string
+	if token := meta["token_id"]; token != "" {
+		key = "token:" + token
+	} else if user := meta["user"]; user != "" {
+		key = "user:" + user
+	} else {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		key = "ip:" + host
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// claimDelivery sets the "delivery_owner" of an upload with the metadata
+// meta, being created from remoteAddr, and refuses it if its delivery is
+// invalid, belongs to another client or is full. A new delivery is taken
+// by the client right away.
+func claimDelivery(meta tusd.MetaData, remoteAddr string) error {
+	delete(meta, "delivery_owner")
+	if deliveries == nil || meta["delivery"] == "" {
+		return nil
+	}
+	id, files, ok := deliveryOf(tusd.FileInfo{MetaData: meta})
+	if !ok {
+		return errDeliveryInvalid
+	}
+	owner := deliveryOwner(meta, remoteAddr)
+	meta["delivery_owner"] = owner
+
+	t := deliveries
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.deliveries[id]
+	switch {
+	case d == nil:
+		t.deliveries[id] = &delivery{ID: id, Files: files, Owner: owner, Updated: time.Now()}
+		t.saveLocked()
+	case d.Owner != owner:
+		return errDeliveryForeign
+	case d.full():
+		return errDeliveryFull
+	}
+	return nil
+}
+
+// file returns the delivery of the upload info and its entry in it, added
+// if new, with t.mu held. It returns nil if info belongs to no delivery, or
+// to one of another owner or without room for it.
+func (t *deliveryTracker) file(info tusd.FileInfo) (*delivery, *deliveryFile) {
+	id, files, ok := deliveryOf(info)
+	if !ok {
+		return nil, nil
+	}
+	owner := info.MetaData["delivery_owner"]
+	d := t.deliveries[id]
+	if d == nil {
+		d = &delivery{ID: id, Files: files, Owner: owner}
+		t.deliveries[id] = d
+	}
+	if d.Owner != owner {
+		return nil, nil
+	}
+	f := d.upload(info.ID)
+	if f == nil {
+		f = &deliveryFile{UploadID: info.ID, Filename: info.MetaData["filename"], Size: info.Size, Offset: info.Offset}
+		if !d.add(f) {
+			return nil, nil
+		}
+	}
+	d.Updated = time.Now()
+	return d, f
+}
+
+func (t *deliveryTracker) created(info tusd.FileInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d, _ := t.file(info); d != nil {
+		t.saveLocked()
+	}
+}
+
+func (t *deliveryTracker) chunk(info tusd.FileInfo, offset, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, f := t.file(info); f != nil {
+		f.Offset, f.Error = offset+size, ""
+		if f.Size < f.Offset {
+			// The size was deferred.
+			f.Size = f.Offset
+		}
+	}
+}
+
+func (t *deliveryTracker) failed(info tusd.FileInfo, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, f := t.file(info); f != nil {
+		f.Error = err.Error()
+		t.saveLocked()
+	}
+}
+
+// stored records the upload info as stored under name, and completes its
+// delivery once every file of it is stored.
+func (t *deliveryTracker) stored(info tusd.FileInfo, name, sum string) {
+	t.mu.Lock()
+	d, f := t.file(info)
+	if f == nil {
+		t.mu.Unlock()
+		return
+	}
+	f.Name, f.SHA256, f.Stored, f.Error = name, sum, true, ""
+	f.Offset = max(f.Offset, info.Size)
+	f.Size = f.Offset
+	d.sum()
+	var done *delivery
+	if !d.Complete && d.Stored >= d.Files {
+		d.Complete, d.Completed = true, time.Now()
+		c := d.copy()
+		done = &c
+	}
+	t.saveLocked()
+	t.mu.Unlock()
+	if done != nil {
+		log.Printf("Delivery %s complete: %d files, %d bytes", done.ID, done.Stored, done.Size)
+		go notifyDelivered(*done)
+	}
+}
+
+// get returns the delivery id.
+func (t *deliveryTracker) get(id string) (delivery, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.deliveries[id]
+	if !ok {
+		return delivery{}, false
+	}
+	d.sum()
+	return d.copy(), true
+}
+
+// list returns the deliveries, the most recently active first.
+func (t *deliveryTracker) list() []delivery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]delivery, 0, len(t.deliveries))
+	for _, d := range t.deliveries {
+		d.sum()
+		list = append(list, d.copy())
+	}
+	slices.SortFunc(list, func(a, b delivery) int { return b.Updated.Compare(a.Updated) })
+	return list
+}
+
+func init() {
+	uploadHooks = append(uploadHooks, UploadHooks{
+		OnSessionCreated: func(info tusd.FileInfo) {
+			if deliveries != nil {
+				deliveries.created(info)
+			}
+		},
+		OnChunk: func(info tusd.FileInfo, offset, size int64) {
+			if deliveries != nil {
+				deliveries.chunk(info, offset, size)
+			}
+		},
+		OnComplete: func(info tusd.FileInfo, name, sum string) {
+			if deliveries != nil {
+				deliveries.stored(info, name, sum)
+			}
+		},
+		OnError: func(info tusd.FileInfo, err error) {
+			if deliveries != nil {
+				deliveries.failed(info, err)
+			}
+		},
+	})
+}
+
+// notifyDelivered posts the complete delivery d to DELIVERY_WEBHOOK, trying
+// again a few times if it fails, and publishes it over MQTT.
+func notifyDelivered(d delivery) {
+	payload, err := json.Marshal(struct {
+		Event string `json:"event"`
+		delivery
+	}{"delivered", d})
+	if err != nil {
+		return
+	}
+	if mqttEvents != nil {
+		mqttEvents.publish(MQTTTopicPrefix+"/delivered", payload)
+	}
+	if DeliveryWebhook == "" {
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := postDelivery(payload)
+		if err == nil {
+			return
+		}
+		if attempt == deliveryWebhookTries {
+			log.Printf("Unable to notify the delivery of %s: %s", d.ID, err.Error())
+			return
+		}
+		time.Sleep(time.Duration(attempt*attempt) * 5 * time.Second)
+	}
+}
+
+func postDelivery(payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, DeliveryWebhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("delivery webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("delivery webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// deliveryHandler serves the combined progress of a delivery, leaving out
+// its owner and the IDs, stored names and digests of its uploads.
+func deliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.Trim(r.URL.Path, "/")
+	if deliveries == nil || !deliveryIDPattern.MatchString(id) {
+		httpError(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	d, ok := deliveries.get(id)
+	if !ok {
+		httpError(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	d.Owner = ""
+	for _, f := range d.Uploads {
+		f.UploadID, f.Name, f.SHA256 = "", "", ""
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, d)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	defaultDeltaBlockSize = 1 << 20
+	minDeltaBlockSize     = 4 << 10
+	maxDeltaBlockSize     = 64 << 20
+)
+
+// storedNamePrefix matches the timestamp finishUpload puts in front of
+// stored filenames.
+var storedNamePrefix = regexp.MustCompile(`^\d{8}_\d{6}_`)
+
+// deltaHandler lets clients upload a changed version of a stored file by
+// transferring only the blocks that differ, in the style of rsync.
+//
+// GET /delta/{name}?block_size=N returns the signature of the stored file: a
+// weak rolling checksum (see rollingChecksum) and the first 16 bytes of the
+// SHA-256 of every block. The client rolls the weak checksum over its new
+// version to find matching blocks and sends
+//
+//	POST /delta/{name}?block_size=N&size=M&filename=new.mp4
+//
+// with a body made of records 'C' <uint32 block> <uint32 count>, copying
+// blocks from the stored file, and 'D' <uint32 length> <data>, carrying
+// literal bytes; integers are big-endian. The reconstructed file, of size
+// bytes exactly, is stored as a new upload through finishUpload. An optional
+// X-Content-SHA256 header is checked against the result. Both requests need
+// the credentials of an upload: the signature gives away the content of the
+// stored file.
+type deltaHandler struct {
+	composer *tusd.StoreComposer
+}
+
+type deltaBlock struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+func (h *deltaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.URL.Path, "/")
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		httpError(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	blockSize := defaultDeltaBlockSize
+	if v := r.URL.Query().Get("block_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minDeltaBlockSize || n > maxDeltaBlockSize {
+			httpError(w, fmt.Sprintf("block_size must be between %d and %d", minDeltaBlockSize, maxDeltaBlockSize), http.StatusBadRequest)
+			return
+		}
+		blockSize = n
+	}
+	p, err := authenticate(r)
+	if err == nil && p == (Principal{}) {
+		err = errNoCredentials
+	}
+	if e, ok := uploadRejection(err); ok {
+		httpErrorCode(w, e.ErrorCode, e.Message, e.HTTPResponse.StatusCode)
+		return
+	}
+	if err != nil {
+		httpErrorCode(w, "ERR_NOT_SIGNED_IN", "Sign in to upload deltas", http.StatusUnauthorized)
+		return
+	}
+
+	base, err := openStored(r.Context(), name)
+	if err != nil {
+		httpError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer base.Close()
+	stat, err := base.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		httpError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.signature(w, base, stat.Size(), blockSize)
+	case http.MethodPost:
+		h.apply(w, r, base, stat.Size(), name, blockSize)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *deltaHandler) signature(w http.ResponseWriter, base *os.File, size int64, blockSize int) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"block_size":%d,"size":%d,"blocks":[`, blockSize, size)
+	buf := make([]byte, blockSize)
+	r := bufio.NewReaderSize(base, blockSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if n == 0 {
+			break
+		}
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		strong := sha256.Sum256(buf[:n])
+		block, _ := json.Marshal(deltaBlock{Weak: rollingChecksum(buf[:n]), Strong: hex.EncodeToString(strong[:16])})
+		w.Write(block)
+		if err != nil {
+			break
+		}
+	}
+	io.WriteString(w, "]}")
+}
+
+func (h *deltaHandler) apply(w http.ResponseWriter, r *http.Request, base *os.File, baseSize int64, name string, blockSize int) {
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		filename = storedNamePrefix.ReplaceAllString(name, "")
+	}
+	filename = path.Base(filename)
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		httpError(w, "size must be the length of the new file", http.StatusBadRequest)
+		return
+	}
+
+	meta := tusd.MetaData{
+		"filename": filename,
+		"filetype": mime.TypeByExtension(path.Ext(filename)),
+		"source":   "delta",
+		"base":     name,
+	}
+	err = authenticateUpload(r, meta)
+	if err == nil {
+		err = checkUploadPolicy(tusd.FileInfo{Size: size, MetaData: meta})
+	}
+	var out *ingestWriter
+	if err == nil {
+		out, err = newIngestWriter(context.Background(), h.composer, meta)
+	}
+	if e, ok := uploadRejection(err); ok {
+		httpErrorCode(w, e.ErrorCode, e.Message, e.HTTPResponse.StatusCode)
+		return
+	}
+	if err != nil {
+		log.Printf("Delta upload of %s failed: %s", name, err.Error())
+		httpError(w, "Unable to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.New()
+	dst := io.MultiWriter(out, sum)
+	reused, received, err := applyDelta(dst, bufio.NewReader(r.Body), base, baseSize, int64(blockSize), size)
+	if err == nil {
+		if want := r.Header.Get("X-Content-SHA256"); want != "" && !strings.EqualFold(want, hex.EncodeToString(sum.Sum(nil))) {
+			err = errors.New("checksum mismatch")
+		}
+	}
+	if err != nil {
+		out.Abort()
+		log.Printf("[%s] Delta upload of %s rejected: %s", requestID(r), name, err.Error())
+		httpError(w, "Invalid delta: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := out.Close(); err != nil {
+		log.Printf("Delta upload of %s failed: %s", name, err.Error())
+		httpError(w, "Unable to store file", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%s] Delta upload %s rebuilt from %s: %d bytes reused, %d bytes received", requestID(r), out.info.ID, name, reused, received)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":       out.info.ID,
+		"name":     filename,
+		"size":     out.info.Size,
+		"reused":   reused,
+		"received": received,
+	})
+}
+
+// applyDelta writes the file of size bytes described by delta to dst and
+// returns how many bytes were copied from base and how many were sent
+// literally. Records going past size are refused before they are applied.
+func applyDelta(dst io.Writer, delta *bufio.Reader, base io.ReaderAt, baseSize, blockSize, size int64) (reused, received int64, err error) {
+	var hdr [8]byte
+	for {
+		op, err := delta.ReadByte()
+		if err == io.EOF {
+			if reused+received != size {
+				return reused, received, fmt.Errorf("%d bytes short of size", size-reused-received)
+			}
+			return reused, received, nil
+		}
+		if err != nil {
+			return reused, received, err
+		}
+		switch op {
+		case 'C':
+			if _, err := io.ReadFull(delta, hdr[:8]); err != nil {
+				return reused, received, io.ErrUnexpectedEOF
+			}
+			start := int64(binary.BigEndian.Uint32(hdr[:4])) * blockSize
+			length := int64(binary.BigEndian.Uint32(hdr[4:])) * blockSize
+			if start >= baseSize || length == 0 {
+				return reused, received, errors.New("block out of range")
+			}
+			length = min(length, baseSize-start)
+			if reused+received+length > size {
+				return reused, received, errDeltaTooLong
+			}
+			n, err := io.Copy(dst, io.NewSectionReader(base, start, length))
+			reused += n
+			if err != nil {
+				return reused, received, err
+			}
+		case 'D':
+			if _, err := io.ReadFull(delta, hdr[:4]); err != nil {
+				return reused, received, io.ErrUnexpectedEOF
+			}
+			length := int64(binary.BigEndian.Uint32(hdr[:4]))
+			if reused+received+length > size {
+				return reused, received, errDeltaTooLong
+			}
+			n, err := io.CopyN(dst, delta, length)
+			received += n
+			if err != nil {
+				return reused, received, io.ErrUnexpectedEOF
+			}
+		default:
+			return reused, received, fmt.Errorf("unknown record %q", op)
+		}
+	}
+}
+
+var errDeltaTooLong = errors.New("longer than size")
+
+// rollingChecksum is the rsync weak checksum: with a the sum of all bytes and
+// b the sum of the prefix sums, both mod 2^16, it returns a | b<<16. It can
+// be rolled forward one byte in constant time on the client.
+func rollingChecksum(p []byte) uint32 {
+	var a, b uint32
+	for i, c := range p {
+		a += uint32(c)
+		b += uint32(len(p)-i) * uint32(c)
+	}
+	return a&0xffff | (b&0xffff)<<16
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Direct uploads send the data of a file straight to the S3 cold storage
+// of TIERING_TARGET, through presigned part URLs, so only the control
+// requests reach the server. With DIRECT_UPLOADS set:
+//
+//	POST   /api/direct                {"filename": ..., "size": ...}
+//	POST   /api/direct/<id>/complete  {"parts": [{"number": 1, "etag": ...}, ...]}
+//	DELETE /api/direct/<id>
+//
+// The first answers with the session id, the name the file is stored under
+// and the parts to upload: every part is PUT to its url, which is valid
+// until expires, and the ETag of the response is sent back to complete the
+// upload. The completed file is recorded as a tiered file, read back from
+// cold storage like any other. The server never sees the data, so the file
+// index has no checksum for it and content checks, scans and receipts do
+// not apply. Sessions are kept in memory: after a restart the client starts
+// over, and the parts left behind in the bucket are removed by its
+// lifecycle rules for incomplete multipart uploads.
+//
+// The bucket needs a CORS rule allowing PUT from the upload page and
+// exposing the ETag header for browsers to upload to it.
+
+// directPartSize is the smallest part of a direct upload. The parts grow
+// for files that would need more than directMaxParts of them.
+const (
+	directPartSize = 16 << 20
+	directMaxParts = 10000
+)
+
+type directSession struct {
+	ID      string
+	Name    string
+	Size    int64
+	Expires time.Time
+	// info holds the metadata of the upload, as a tus upload would have.
+	info     tusd.FileInfo
+	uploadID string
+}
+
+type directPart struct {
+	Number int    `json:"number"`
+	URL    string `json:"url,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	ETag   string `json:"etag,omitempty"`
+}
+
+var (
+	directMu       sync.Mutex
+	directSessions = map[string]*directSession{}
+)
+
+// directTarget returns the S3 target of direct uploads, nil if they are
+// not enabled.
+func directTarget() *s3Target {
+	if !DirectUploads {
+		return nil
+	}
+	target, _ := tiering.(*s3Target)
+	return target
+}
+
+// directUploadTTL is how long the part URLs are valid: the upload deadline,
+// within the week presigned URLs are limited to.
+func directUploadTTL() time.Duration {
+	if UploadDeadline > 0 {
+		return min(UploadDeadline, 7*24*time.Hour)
+	}
+	return 24 * time.Hour
+}
+
+// presign returns a SigV4 presigned URL for method on name, valid for ttl.
+func (s *s3Target) presign(method, name string, query url.Values, ttl time.Duration) string {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := []string{now.Format("20060102"), s.remote.Region, "s3", "aws4_request"}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.remote.AccessKey+"/"+strings.Join(scope, "/"))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u := s.objectURL(name, query)
+	r := &http.Request{Method: method, URL: &u, Header: http.Header{}, Host: u.Host}
+	query.Set("X-Amz-Signature", s3Signature(r, "host", "UNSIGNED-PAYLOAD", amzDate, scope, s.remote.SecretKey))
+	u.RawQuery = query.Encode()
+	u.RawPath = awsURIEncode(u.Path, false)
+	return u.String()
+}
+
+// createMultipart starts a multipart upload of name and returns its id.
+func (s *s3Target) createMultipart(ctx context.Context, name string) (string, error) {
+	res, err := s.doQuery(ctx, http.MethodPost, name, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("POST %s?uploads: %s %s", name, res.Status, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("POST %s?uploads: no upload id in the response", name)
+	}
+	return result.UploadID, nil
+}
+
+// completeMultipart assembles the parts of the multipart upload uploadID.
+func (s *s3Target) completeMultipart(ctx context.Context, name, uploadID string, parts []directPart) error {
+	type xmlPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var req struct {
+		XMLName xml.Name  `xml:"CompleteMultipartUpload"`
+		Parts   []xmlPart `xml:"Part"`
+	}
+	for _, p := range parts {
+		req.Parts = append(req.Parts, xmlPart{PartNumber: p.Number, ETag: p.ETag})
+	}
+	data, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := s.doQuery(ctx, http.MethodPost, name, url.Values{"uploadId": {uploadID}}, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// S3 reports some failures with a 200 and an Error document.
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("completing %s: %s %s", name, res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// abortMultipart drops the parts of the multipart upload uploadID.
+func (s *s3Target) abortMultipart(ctx context.Context, name, uploadID string) error {
+	res, err := s.doQuery(ctx, http.MethodDelete, name, url.Values{"uploadId": {uploadID}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("aborting %s: %s", name, res.Status)
+	}
+	return nil
+}
+
+func directHandler(w http.ResponseWriter, r *http.Request) {
+	target := directTarget()
+	if target == nil {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	id, action, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		createDirect(w, r, target)
+	case id != "" && action == "complete" && r.Method == http.MethodPost:
+		completeDirect(w, r, target, id)
+	case id != "" && action == "" && r.Method == http.MethodDelete:
+		session := takeDirectSession(id)
+		if session == nil {
+			httpError(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		if err := target.abortMultipart(r.Context(), session.Name, session.uploadID); err != nil {
+			log.Printf("[%s] Unable to abort direct upload %s: %s", requestID(r), id, err.Error())
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// directError answers with the rejection of an upload, or 502 when the
+// storage failed.
+func directError(w http.ResponseWriter, r *http.Request, err error) {
+	var e tusd.Error
+	if errors.As(err, &e) {
+		httpErrorCode(w, e.ErrorCode, e.Message, e.HTTPResponse.StatusCode)
+		return
+	}
+	log.Printf("[%s] Direct upload failed: %s", requestID(r), err.Error())
+	httpError(w, "Direct upload failed", http.StatusBadGateway)
+}
+
+func createDirect(w http.ResponseWriter, r *http.Request, target *s3Target) {
+	var body struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&body); err != nil || body.Size <= 0 {
+		httpError(w, "Expected {\"filename\": ..., \"size\": ...}", http.StatusBadRequest)
+		return
+	}
+	info := tusd.FileInfo{Size: body.Size, MetaData: tusd.MetaData{"filename": body.Filename}}
+	// The checks tus uploads go through when they are created; the content
+	// is never seen.
+	changes, err := uploadRole(createHook(r, info))
+	if err != nil {
+		directError(w, r, err)
+		return
+	}
+	if changes.MetaData != nil {
+		info.MetaData = changes.MetaData
+	}
+	if err := checkDraining(info); err != nil {
+		directError(w, r, err)
+		return
+	}
+	if err := validateCreate(r.Context(), info); err != nil {
+		directError(w, r, err)
+		return
+	}
+
+	var raw [16]byte
+	rand.Read(raw[:])
+	session := &directSession{
+		ID:      hex.EncodeToString(raw[:]),
+		Name:    filepath.ToSlash(storedFileName(info, time.Now())),
+		Size:    body.Size,
+		Expires: time.Now().Add(directUploadTTL()),
+		info:    info,
+	}
+	session.info.ID = session.ID
+	session.uploadID, err = target.createMultipart(r.Context(), session.Name)
+	if err != nil {
+		directError(w, r, err)
+		return
+	}
+	partSize := max(int64(directPartSize), (body.Size+directMaxParts-1)/directMaxParts)
+	var parts []directPart
+	for offset, n := int64(0), 1; offset < body.Size; offset, n = offset+partSize, n+1 {
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {session.uploadID}}
+		parts = append(parts, directPart{
+			Number: n,
+			URL:    target.presign(http.MethodPut, session.Name, query, directUploadTTL()),
+			Size:   min(partSize, body.Size-offset),
+		})
+	}
+	directMu.Lock()
+	for id, s := range directSessions {
+		if time.Now().After(s.Expires) {
+			delete(directSessions, id)
+		}
+	}
+	directSessions[session.ID] = session
+	directMu.Unlock()
+	log.Printf("[%s] Direct upload %s of %s started to %s", requestID(r), session.ID, session.Name, target)
+	hookSessionCreated(session.info)
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":      session.ID,
+		"name":    session.Name,
+		"expires": session.Expires,
+		"parts":   parts,
+	})
+}
+
+func takeDirectSession(id string) *directSession {
+	directMu.Lock()
+	defer directMu.Unlock()
+	session := directSessions[id]
+	delete(directSessions, id)
+	return session
+}
+
+func completeDirect(w http.ResponseWriter, r *http.Request, target *s3Target, id string) {
+	var body struct {
+		Parts []directPart `json:"parts"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&body); err != nil || len(body.Parts) == 0 {
+		httpError(w, "Expected {\"parts\": [{\"number\": ..., \"etag\": ...}]}", http.StatusBadRequest)
+		return
+	}
+	session := takeDirectSession(id)
+	if session == nil {
+		httpError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err := target.completeMultipart(r.Context(), session.Name, session.uploadID, body.Parts); err != nil {
+		// The parts stay, the client may complete again with the right ETags.
+		directMu.Lock()
+		directSessions[id] = session
+		directMu.Unlock()
+		directError(w, r, err)
+		return
+	}
+	if size, err := target.Size(r.Context(), session.Name); err != nil || size != session.Size {
+		log.Printf("[%s] Direct upload %s stored %d bytes of %d", requestID(r), id, size, session.Size)
+		// The object was completed already, it is removed so that nothing
+		// but the declared size ends up in the bucket.
+		if err := target.Delete(context.Background(), session.Name); err != nil {
+			log.Printf("[%s] Unable to remove %s: %s", requestID(r), session.Name, err.Error())
+		}
+		hookError(session.info, errUploadTruncated)
+		httpError(w, "The stored object does not have the declared size", http.StatusConflict)
+		return
+	}
+	now := time.Now()
+	if err := writeTieredStub(session.Name, tieredStub{Size: session.Size, ModTime: now, Target: target.String(), TieredAt: now}); err != nil {
+		directError(w, r, err)
+		return
+	}
+	if storedFiles != nil {
+		storedFiles.record(session.Name, session.Size, "")
+		retention := 0
+		if p := policyFor(session.info.MetaData); p != nil {
+			retention = p.RetentionDays
+		}
+		user, tokenID := session.info.MetaData["user"], session.info.MetaData["token_id"]
+		if user != "" || tokenID != "" || retention > 0 {
+			storedFiles.setOrigin(session.Name, user, tokenID, retention)
+		}
+	}
+	countUpload(session.info)
+	publishEvent(eventStored, session.info, session.Name, "")
+	hookComplete(session.info, session.Name, "")
+	log.Printf("[%s] Direct upload %s stored as %s", requestID(r), id, session.Name)
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "name": session.Name, "size": session.Size})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// drainIdle is how long an incomplete upload may go without data before a
+// drain stops waiting for it. Its client can resume it on another instance
+// sharing TempUploadPath, or here after the restart.
+const drainIdle = 5 * time.Minute
+
+// errServerDraining refuses new uploads once the server is draining.
+var errServerDraining = tusd.NewError("ERR_SERVER_DRAINING", "server is shutting down, retry shortly", http.StatusServiceUnavailable)
+
+var (
+	drainMu    sync.Mutex
+	drainSince time.Time
+	// storesInFlight counts the uploads completed through the tus handler
+	// and not stored yet.
+	storesInFlight atomic.Int64
+)
+
+// drainingSince returns when the drain started, zero if it did not.
+func drainingSince() time.Time {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	return drainSince
+}
+
+// checkDraining rejects new uploads while draining. Final concatenations
+// are let through, they complete uploads already in flight.
+func checkDraining(info tusd.FileInfo) error {
+	if !info.IsFinal && !drainingSince().IsZero() {
+		return errServerDraining
+	}
+	return nil
+}
+
+type drainStatus struct {
+	Draining bool      `json:"draining"`
+	Since    time.Time `json:"since,omitzero"`
+	// ActiveUploads are the incomplete uploads written to within the last
+	// few minutes.
+	ActiveUploads []string `json:"active_uploads"`
+	// PendingStores are the completed uploads still being stored.
+	PendingStores int64 `json:"pending_stores"`
+	// Drained is set once draining and nothing is active anymore: the
+	// server can be stopped.
+	Drained bool `json:"drained"`
+}
+
+func currentDrainStatus() (drainStatus, error) {
+	status := drainStatus{Since: drainingSince(), ActiveUploads: []string{}, PendingStores: storesInFlight.Load()}
+	status.Draining = !status.Since.IsZero()
+	uploads, err := incompleteUploads()
+	if err != nil {
+		return status, err
+	}
+	for id, modified := range uploads {
+		if time.Since(modified) < drainIdle {
+			status.ActiveUploads = append(status.ActiveUploads, id)
+		}
+	}
+	slices.Sort(status.ActiveUploads)
+	status.Drained = status.Draining && len(status.ActiveUploads) == 0 && status.PendingStores == 0
+	return status, nil
+}
+
+// startDrain refuses new uploads from now on.
+func startDrain() {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if drainSince.IsZero() {
+		drainSince = time.Now()
+		log.Printf("Draining, new uploads are refused")
+	}
+}
+
+// waitDrained waits up to limit for the uploads in flight to complete, or
+// until another signal arrives on interrupt.
+func waitDrained(limit time.Duration, interrupt <-chan os.Signal) {
+	timeout := time.After(limit)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		if status, err := currentDrainStatus(); err == nil && status.Drained {
+			return
+		}
+		select {
+		case <-timeout:
+			return
+		case <-interrupt:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// drain reports the drain status (GET /drain) or starts draining
+// (POST /drain): new uploads are refused on every protocol, uploads in
+// flight go on and /ready answers 503, so the load balancer sends new
+// clients elsewhere. A drain is not undone other than by a restart.
+func (a *adminAPI) drain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		startDrain()
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := currentDrainStatus()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// readyHandler is the readiness probe of load balancers (GET /ready): 200
+// until the server drains, and while fewer than ReadyMaxPendingStores
+// completed uploads wait to be stored, so a replica busy assembling and
+// moving files gets no new clients until it catches up.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if !drainingSince().IsZero() {
+		httpError(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if n := storesInFlight.Load(); ReadyMaxPendingStores > 0 && n >= int64(ReadyMaxPendingStores) {
+		httpError(w, fmt.Sprintf("busy: %d uploads waiting to be stored", n), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
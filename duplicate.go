@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// duplicateWindow is how long after its creation or its last write an
+// upload counts as in flight, for detecting the same file being uploaded
+// twice at once.
+const duplicateWindow = time.Minute
+
+// errUploadInProgress refuses to create an upload of a file, known by its
+// fingerprint, that is being uploaded already, typically from another tab.
+var errUploadInProgress = tusd.NewError("ERR_UPLOAD_IN_PROGRESS", "the same file is being uploaded already", http.StatusConflict)
+
+var (
+	fingerprintClaimsMu sync.Mutex
+	// fingerprintClaims holds when uploads with each fingerprint were last
+	// created, so creations racing each other are caught before any of
+	// them is in the store.
+	fingerprintClaims = map[string]time.Time{}
+)
+
+// checkDuplicateUpload is the PreUploadCreateCallback part that refuses a
+// new upload when another upload of the same file is in flight: created or
+// written to within duplicateWindow. An idle upload of the file does not
+// count, the client found it through GET /api/uploads?fingerprint= and
+// chose to start anew. Uploads without fingerprint are not checked.
+func checkDuplicateUpload(hook tusd.HookEvent, composer *tusd.StoreComposer) error {
+	fp := hook.Upload.MetaData["fingerprint"]
+	if fp == "" || hook.Upload.IsPartial || hook.Upload.IsFinal {
+		return nil
+	}
+	now := time.Now()
+	if uploads, err := incompleteUploads(); err == nil {
+		for _, found := range uploadsByFingerprint(hook.Context, composer, fp, clientPin(hook.HTTPRequest.RemoteAddr, hook.HTTPRequest.Header)) {
+			if now.Sub(uploads[found.ID]) < duplicateWindow {
+				return errUploadInProgress
+			}
+		}
+	}
+	fingerprintClaimsMu.Lock()
+	defer fingerprintClaimsMu.Unlock()
+	for claimed, at := range fingerprintClaims {
+		if now.Sub(at) > duplicateWindow {
+			delete(fingerprintClaims, claimed)
+		}
+	}
+	if _, ok := fingerprintClaims[fp]; ok {
+		return errUploadInProgress
+	}
+	fingerprintClaims[fp] = now
+	return nil
+}
+
+// releaseFingerprint lets the file with the fingerprint fp be uploaded
+// again right away, once its upload completed.
+func releaseFingerprint(fp string) {
+	if fp == "" {
+		return
+	}
+	fingerprintClaimsMu.Lock()
+	delete(fingerprintClaims, fp)
+	fingerprintClaimsMu.Unlock()
+}
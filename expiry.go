@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// expiryCheckInterval is how often the uploads followed over
+// /api/uploads/events are checked.
+const expiryCheckInterval = 30 * time.Second
+
+// Why an incomplete upload is removed: it was not written to for
+// INCOMPLETE_UPLOAD_EXPIRY_HOURS, which a keep-alive postpones, or it is
+// past its deadline.
+const (
+	expiryIdle     = "idle"
+	expiryDeadline = "deadline"
+)
+
+// uploadExpiry is when an incomplete upload is removed.
+type uploadExpiry struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+	Reason  string    `json:"reason"`
+}
+
+// uploadModTime returns when the upload id was last written to.
+func uploadModTime(id string) time.Time {
+	if StorageBackend != storageFile {
+		return memStore.modTimes()[id]
+	}
+	var modified time.Time
+	for _, name := range []string{id, id + ".info"} {
+		if stat, err := os.Stat(filepath.Join(TempUploadPath, name)); err == nil && stat.ModTime().After(modified) {
+			modified = stat.ModTime()
+		}
+	}
+	return modified
+}
+
+// expiryOf returns when the upload id is removed, false if it is not an
+// incomplete upload the client with the pin may use.
+func expiryOf(ctx context.Context, composer *tusd.StoreComposer, id, pin string) (uploadExpiry, bool) {
+	upload, err := composer.Core.GetUpload(ctx, id)
+	if err != nil {
+		return uploadExpiry{}, false
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil || (!info.SizeIsDeferred && info.Offset >= info.Size) || !pinnedTo(info, pin) {
+		return uploadExpiry{}, false
+	}
+	idle := UploadExpiry
+	if hashes, err := loadUploadHashes(id); err == nil && !hashes.Truncated.IsZero() {
+		idle = TruncatedUploadGrace
+	}
+	expiry := uploadExpiry{ID: id, Expires: uploadModTime(id).Add(idle), Reason: expiryIdle}
+	if deadline := uploadDeadline(info); !deadline.IsZero() && deadline.Before(expiry.Expires) {
+		expiry.Expires, expiry.Reason = deadline, expiryDeadline
+	}
+	return expiry, true
+}
+
+// uploadIDs returns the distinct upload IDs of the "id" parameters of r,
+// false unless there are 1 to 100 valid ones.
+func uploadIDs(r *http.Request) ([]string, bool) {
+	ids := slices.Compact(slices.Sorted(slices.Values(r.URL.Query()["id"])))
+	if len(ids) == 0 || len(ids) > 100 {
+		return nil, false
+	}
+	for _, id := range ids {
+		if !uploadIDPattern.MatchString(id) {
+			return nil, false
+		}
+	}
+	return ids, true
+}
+
+// uploadEventsHandler streams the expiry of the given incomplete uploads as
+// server-sent events (GET /api/uploads/events?id=...&id=...), so a client
+// that paused an upload learns it is about to be removed instead of finding
+// it gone. Once an upload is removed within ExpiryWarning the server sends
+//
+//	event: expiring
+//	data: {"id": "<id>", "expires": "<time>", "reason": "idle" or "deadline"}
+//
+// and again when it nears its expiry anew after a keep-alive. Uploads that
+// completed or were removed are reported with
+//
+//	event: gone
+//	data: {"id": "<id>"}
+//
+// and the stream ends once all of them are gone.
+func uploadEventsHandler(composer *tusd.StoreComposer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, ok := uploadIDs(r)
+		if !ok {
+			httpError(w, "Expected 1 to 100 upload IDs", http.StatusBadRequest)
+			return
+		}
+		pin := clientPin(r.RemoteAddr, r.Header)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		warned := map[string]time.Time{}
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			ids = slices.DeleteFunc(ids, func(id string) bool {
+				expiry, ok := expiryOf(r.Context(), composer, id, pin)
+				if !ok {
+					writeEvent(w, "gone", map[string]string{"id": id})
+					return true
+				}
+				if time.Until(expiry.Expires) <= ExpiryWarning && !warned[id].Equal(expiry.Expires) {
+					warned[id] = expiry.Expires
+					writeEvent(w, "expiring", expiry)
+				}
+				return false
+			})
+			if len(ids) == 0 {
+				rc.Flush()
+				return
+			}
+			// A comment, for a closed connection to be noticed.
+			io.WriteString(w, ": ping\n\n")
+			if rc.Flush() != nil {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// touchUpload postpones the idle expiry of the upload id, as if it was
+// written to.
+func touchUpload(id string) {
+	if StorageBackend != storageFile {
+		memStore.touch(id)
+		return
+	}
+	now := time.Now()
+	os.Chtimes(filepath.Join(TempUploadPath, id+".info"), now, now)
+}
+
+func writeEvent(w io.Writer, event string, v any) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// keepAliveHandler postpones the idle expiry of the given incomplete
+// uploads (POST /api/uploads/keepalive?id=...&id=...), as if they were
+// written to, and answers with their new expiry. Uploads that are gone are
+// left out; their deadline, if they have one, stays.
+func keepAliveHandler(composer *tusd.StoreComposer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ids, ok := uploadIDs(r)
+		if !ok {
+			httpError(w, "Expected 1 to 100 upload IDs", http.StatusBadRequest)
+			return
+		}
+		pin := clientPin(r.RemoteAddr, r.Header)
+		kept := []uploadExpiry{}
+		for _, id := range ids {
+			if _, ok := expiryOf(r.Context(), composer, id, pin); !ok {
+				continue
+			}
+			touchUpload(id)
+			if expiry, ok := expiryOf(r.Context(), composer, id, pin); ok {
+				kept = append(kept, expiry)
+			}
+		}
+		writeJSON(w, http.StatusOK, kept)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// finishQueueSize is how many completed tus uploads may wait to be stored
+// before the requests completing them block.
+const finishQueueSize = 1024
+
+// expressUpload reports whether an upload is small enough, according to
+// EXPRESS_UPLOAD_SIZE, to skip the queues that large uploads wait in: its
+// writes do not wait for a turn of diskScheduler and it is stored as soon
+// as it completes rather than after the uploads that completed before it.
+func expressUpload(info tusd.FileInfo) bool {
+	return ExpressUploadSize > 0 && !info.SizeIsDeferred && info.Size <= ExpressUploadSize
+}
+
+// finishCompleted stores the uploads completed through the tus handler.
+// Uploads are stored one at a time in the order they complete, except for
+// express uploads, which are stored right away, so a small file does not
+// wait for a huge one to be copied across devices first.
+func finishCompleted(events <-chan tusd.HookEvent) {
+	queue := make(chan tusd.FileInfo, finishQueueSize)
+	go func() {
+		for info := range queue {
+			finishUpload(info)
+			storesInFlight.Add(-1)
+		}
+	}()
+	for event := range events {
+		storesInFlight.Add(1)
+		if expressUpload(event.Upload) {
+			go func() {
+				finishUpload(event.Upload)
+				storesInFlight.Add(-1)
+			}()
+			continue
+		}
+		queue <- event.Upload
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// failedBundleRetention is how long the diagnostic bundles of failed
+// uploads are kept, their data is removed after FailedUploadGrace.
+const failedBundleRetention = 30 * 24 * time.Hour
+
+// Why an upload failed for good.
+const (
+	// failedCorrupted: the stored data differed from the received data.
+	failedCorrupted = "corrupted"
+	// failedTruncated: the stored data was shorter than its length and the
+	// client did not resume within TruncatedUploadGrace.
+	failedTruncated = "truncated"
+)
+
+// failedUpload is the diagnostic bundle of an upload that failed to be
+// assembled and cannot be recovered, kept in <TempUploadPath>/failed as
+// <id>.json.gz next to its data, <id>.data.
+type failedUpload struct {
+	ID       string            `json:"id"`
+	Filename string            `json:"filename,omitempty"`
+	Reason   string            `json:"reason"`
+	Error    string            `json:"error"`
+	Failed   time.Time         `json:"failed"`
+	Size     int64             `json:"size"`
+	Offset   int64             `json:"offset"`
+	Stored   int64             `json:"stored"`
+	MetaData map[string]string `json:"metadata,omitempty"`
+	// Manifest is the hash sidecar of the upload: the hash of every chunk
+	// as it was received.
+	Manifest *uploadHashes `json:"manifest,omitempty"`
+	// Data is whether the data of the upload is still kept.
+	Data bool `json:"data"`
+}
+
+func failedUploadsDir() string {
+	return filepath.Join(TempUploadPath, "failed")
+}
+
+// recordFailedUpload writes the diagnostic bundle of the upload info, which
+// failed with err, and moves its data next to it for FailedUploadGrace,
+// before the upload is removed.
+func recordFailedUpload(info tusd.FileInfo, reason string, err error) {
+	if StorageBackend != storageFile {
+		return
+	}
+	dir := failedUploadsDir()
+	if mkErr := os.MkdirAll(dir, os.ModePerm); mkErr != nil {
+		log.Printf("Unable to record failed upload %s: %s", info.ID, mkErr.Error())
+		return
+	}
+	f := failedUpload{
+		ID:       info.ID,
+		Filename: info.MetaData["filename"],
+		Reason:   reason,
+		Error:    err.Error(),
+		Failed:   time.Now(),
+		Size:     info.Size,
+		Offset:   info.Offset,
+		MetaData: info.MetaData,
+	}
+	data := filepath.Join(TempUploadPath, info.ID)
+	if stat, err := os.Stat(data); err == nil {
+		f.Stored = stat.Size()
+	}
+	if hashes, err := loadUploadHashes(info.ID); err == nil {
+		f.Manifest = hashes
+	}
+	if FailedUploadGrace > 0 && os.Rename(data, filepath.Join(dir, info.ID+".data")) == nil {
+		f.Data = true
+	}
+	if err := writeFailedUpload(f); err != nil {
+		log.Printf("Unable to record failed upload %s: %s", info.ID, err.Error())
+		return
+	}
+	log.Printf("Upload %s failed (%s), diagnostics kept in %s", info.ID, reason, dir)
+}
+
+func writeFailedUpload(f failedUpload) error {
+	p := filepath.Join(failedUploadsDir(), f.ID+".json.gz")
+	tmp, err := os.CreateTemp(failedUploadsDir(), f.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	if err := json.NewEncoder(zw).Encode(f); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func readFailedUpload(p string) (failedUpload, error) {
+	var f failedUpload
+	file, err := os.Open(p)
+	if err != nil {
+		return f, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return f, err
+	}
+	err = json.NewDecoder(zr).Decode(&f)
+	return f, err
+}
+
+// failedUploads returns the failed uploads, the most recent first.
+func failedUploads() ([]failedUpload, error) {
+	list := []failedUpload{}
+	entries, err := os.ReadDir(failedUploadsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json.gz") {
+			continue
+		}
+		f, err := readFailedUpload(filepath.Join(failedUploadsDir(), entry.Name()))
+		if err != nil {
+			continue
+		}
+		_, err = os.Stat(filepath.Join(failedUploadsDir(), f.ID+".data"))
+		f.Data = err == nil
+		list = append(list, f)
+	}
+	slices.SortFunc(list, func(a, b failedUpload) int { return b.Failed.Compare(a.Failed) })
+	return list, nil
+}
+
+// collectFailedUploads removes the data of failed uploads after
+// FailedUploadGrace and their bundles after failedBundleRetention. It
+// returns the number of uploads whose data was removed.
+func collectFailedUploads(now time.Time) int {
+	list, err := failedUploads()
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, f := range list {
+		p := filepath.Join(failedUploadsDir(), f.ID)
+		if f.Data && f.Failed.Before(now.Add(-FailedUploadGrace)) && os.Remove(p+".data") == nil {
+			removed++
+		}
+		if f.Failed.Before(now.Add(-failedBundleRetention)) {
+			os.Remove(p + ".data")
+			os.Remove(p + ".json.gz")
+		}
+	}
+	return removed
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// fairSliceSize is how much of a chunk is written to the store per turn
+// when disk writes are scheduled.
+const fairSliceSize = 1 << 20
+
+// fairScheduler hands out turns at writing to the store, at most slots at a
+// time, by start-time fair queueing: every flow (an uploading user, or a
+// single upload) is served in proportion to its weight however much it has
+// left to write, so a small urgent upload is not stuck behind the slices of
+// a huge one that started first.
+type fairScheduler struct {
+	slots int
+
+	mu      sync.Mutex
+	active  int
+	virtual float64
+	// finish is the virtual time at which the last queued turn of a flow
+	// ends.
+	finish  map[string]float64
+	waiting fairQueue
+	seq     uint64
+}
+
+// diskScheduler is nil unless DISK_WRITE_SLOTS is set, in which case
+// uploads write to the store in turns.
+var diskScheduler *fairScheduler
+
+func newFairScheduler(slots int) *fairScheduler {
+	return &fairScheduler{slots: slots, finish: map[string]float64{}}
+}
+
+type fairTurn struct {
+	start float64
+	seq   uint64
+	ready chan struct{}
+	index int
+}
+
+type fairQueue []*fairTurn
+
+func (q fairQueue) Len() int { return len(q) }
+func (q fairQueue) Less(i, j int) bool {
+	if q[i].start != q[j].start {
+		return q[i].start < q[j].start
+	}
+	return q[i].seq < q[j].seq
+}
+func (q fairQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *fairQueue) Push(x any) {
+	t := x.(*fairTurn)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+func (q *fairQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+// acquire waits for the turn of flow to write n bytes and returns the
+// function that ends it.
+func (s *fairScheduler) acquire(ctx context.Context, flow string, weight float64, n int) (func(), error) {
+	s.mu.Lock()
+	start := max(s.virtual, s.finish[flow])
+	s.finish[flow] = start + float64(n)/weight
+	if s.active < s.slots && s.waiting.Len() == 0 {
+		s.active++
+		s.virtual = start
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	s.seq++
+	t := &fairTurn{start: start, seq: s.seq, ready: make(chan struct{})}
+	heap.Push(&s.waiting, t)
+	s.mu.Unlock()
+
+	select {
+	case <-t.ready:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if t.index < 0 {
+			// Granted while giving up, pass the turn on.
+			s.releaseLocked()
+		} else {
+			heap.Remove(&s.waiting, t.index)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *fairScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+func (s *fairScheduler) releaseLocked() {
+	if s.waiting.Len() == 0 {
+		s.active--
+		if s.active == 0 {
+			// Idle, forget the flows rather than keep a tag for every
+			// upload ever written.
+			clear(s.finish)
+		}
+		return
+	}
+	t := heap.Pop(&s.waiting).(*fairTurn)
+	s.virtual = t.start
+	close(t.ready)
+}
+
+// uploadFlow returns the flow an upload's writes are scheduled in and its
+// weight. Uploads of a signed in FTP or SFTP user share one flow, so a user
+// starting many uploads does not get more than their share; other uploads
+// are flows of their own. The weight comes from the "priority" metadata
+// value, see UPLOAD_PRIORITY_WEIGHTS.
+func uploadFlow(info tusd.FileInfo) (string, float64) {
+	flow := "upload:" + info.ID
+	if user := info.MetaData["user"]; user != "" {
+		flow = "user:" + user
+	}
+	weight, ok := UploadPriorityWeights[info.MetaData["priority"]]
+	if !ok {
+		weight = 1
+	}
+	return flow, weight
+}
+
+// writeScheduled writes src to upload at offset in slices of fairSliceSize,
+// waiting for a turn of diskScheduler for each. Reading from src, which
+// waits on the client, is done outside the turn.
+func writeScheduled(ctx context.Context, upload tusd.Upload, info tusd.FileInfo, offset int64, src io.Reader) (int64, error) {
+	flow, weight := uploadFlow(info)
+	buf := make([]byte, fairSliceSize)
+	var n int64
+	for {
+		k, readErr := io.ReadFull(src, buf)
+		if k > 0 {
+			release, err := diskScheduler.acquire(ctx, flow, weight, k)
+			if err != nil {
+				return n, err
+			}
+			w, err := upload.WriteChunk(ctx, offset+n, bytes.NewReader(buf[:k]))
+			release()
+			n += w
+			if err != nil {
+				return n, err
+			}
+		}
+		switch readErr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return n, nil
+		default:
+			return n, readErr
+		}
+	}
+}
+
+// parsePriorityWeights parses a comma separated list of priority=weight
+// pairs.
+func parsePriorityWeights(list string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not priority=weight", pair)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight for %q", name)
+		}
+		weights[strings.TrimSpace(name)] = weight
+	}
+	return weights, nil
+}
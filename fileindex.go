@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileRecord is what is known about a stored file beyond what the file
+// system records: the checksum it had when it was stored and what VirusTotal
+// knows about it.
+type fileRecord struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Algorithm and Digest are the checksum of a file stored without its
+	// SHA-256, of the CHUNK_HASH algorithm it was received with.
+	Algorithm  string     `json:"algorithm,omitempty"`
+	Digest     string     `json:"digest,omitempty"`
+	Stored     time.Time  `json:"stored"`
+	Verified   time.Time  `json:"verified,omitzero"`
+	VirusTotal *vtVerdict `json:"virustotal,omitempty"`
+	// User is the user that uploaded the file, and TokenID the ID of the
+	// upload token it was uploaded with.
+	User    string `json:"user,omitempty"`
+	TokenID string `json:"token_id,omitempty"`
+	// RetentionDays is the retention period of the file when its upload
+	// policy sets one.
+	RetentionDays int `json:"retention_days,omitempty"`
+	// Replicated is when the file was copied to REPLICA_TARGET.
+	Replicated time.Time `json:"replicated,omitzero"`
+	// Route is the target of the routing rule the file is still to be
+	// moved to.
+	Route string `json:"route,omitempty"`
+	// UploadID is the ID of the tus upload the file was stored from.
+	UploadID string `json:"upload_id,omitempty"`
+	// LastModified is the modification time of the file on the device it
+	// was uploaded from.
+	LastModified time.Time `json:"last_modified,omitzero"`
+	// Annotations are the attributes derived from the file by the jobs
+	// processing it.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// fileIndex records every file stored in UploadPath, keyed by its name
+// relative to UploadPath. It is kept in index.json in TempUploadPath and can
+// be rebuilt from the stored files with rebuild.
+type fileIndex struct {
+	path string
+
+	mu    sync.Mutex
+	files map[string]*fileRecord
+}
+
+// storedFiles is nil unless the file storage backend is used.
+var storedFiles *fileIndex
+
+func openFileIndex(path string) (*fileIndex, error) {
+	idx := &fileIndex{path: path, files: map[string]*fileRecord{}}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &idx.files); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return idx, nil
+}
+
+func (idx *fileIndex) saveLocked() {
+	data, err := json.Marshal(idx.files)
+	if err == nil {
+		tmp := idx.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, idx.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save file index: %s", err.Error())
+	}
+}
+
+// record adds or replaces the record of name.
+func (idx *fileIndex) record(name string, size int64, sum string) {
+	idx.mu.Lock()
+	idx.files[filepath.ToSlash(name)] = &fileRecord{Size: size, SHA256: sum, Stored: time.Now()}
+	idx.saveLocked()
+	idx.mu.Unlock()
+	writeChecksumSidecar(name, sum)
+}
+
+// setDigest records the checksum of name in the algorithm alg, for files
+// stored without their SHA-256.
+func (idx *fileIndex) setDigest(name, alg, digest string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if rec, ok := idx.files[filepath.ToSlash(name)]; ok {
+		rec.Algorithm, rec.Digest = alg, digest
+		idx.saveLocked()
+	}
+}
+
+func (idx *fileIndex) remove(name string) {
+	idx.mu.Lock()
+	name = filepath.ToSlash(name)
+	if _, ok := idx.files[name]; ok {
+		delete(idx.files, name)
+		idx.saveLocked()
+	}
+	idx.mu.Unlock()
+	os.Remove(filepath.Join(UploadPath, filepath.FromSlash(name)) + checksumSuffix)
+}
+
+// rename moves the record of name to newName.
+func (idx *fileIndex) rename(name, newName string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	name, newName = filepath.ToSlash(name), filepath.ToSlash(newName)
+	if rec, ok := idx.files[name]; ok {
+		delete(idx.files, name)
+		idx.files[newName] = rec
+		idx.saveLocked()
+	}
+}
+
+// checksumSuffix marks the sidecar next to a stored file that holds its
+// SHA-256 in the format of sha256sum, so archival tools can verify the file
+// with "sha256sum -c" without asking the uploader. The sidecars are written
+// when CHECKSUM_SIDECARS is set.
+const checksumSuffix = ".sha256"
+
+func writeChecksumSidecar(name, sum string) {
+	if !ChecksumSidecars || sum == "" {
+		return
+	}
+	p := filepath.Join(UploadPath, filepath.FromSlash(name)) + checksumSuffix
+	data := fmt.Sprintf("%s  %s\n", sum, path.Base(filepath.ToSlash(name)))
+	tmp := p + ".tmp"
+	err := os.WriteFile(tmp, []byte(data), 0644)
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("Unable to write checksum of %s: %s", name, err.Error())
+	}
+}
+
+// isSidecar reports whether p, a path below UploadPath, is the checksum or
+// metadata sidecar of a stored file rather than a stored file itself: its
+// kind of sidecar is enabled and the file it belongs to is there, or its
+// stub. Uploads named like sidecars are stored files otherwise.
+func isSidecar(p string) bool {
+	file, ok := sidecarOf(p)
+	if !ok {
+		return false
+	}
+	if _, err := os.Stat(file); err == nil {
+		return true
+	}
+	_, err := os.Stat(file + tieredSuffix)
+	return err == nil
+}
+
+// sidecarOf returns the stored file p would be the sidecar of, by the name
+// of p, false if p is named like no enabled kind of sidecar.
+func sidecarOf(p string) (string, bool) {
+	if file, ok := strings.CutSuffix(p, checksumSuffix); ok && ChecksumSidecars {
+		return file, true
+	}
+	if MetadataSidecars != "" {
+		if file, ok := strings.CutSuffix(p, metadataSuffix(MetadataSidecars)); ok {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// get returns a copy of the record of name.
+func (idx *fileIndex) get(name string) (fileRecord, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	rec, ok := idx.files[filepath.ToSlash(name)]
+	if !ok {
+		return fileRecord{}, false
+	}
+	return *rec, true
+}
+
+func (idx *fileIndex) markVerified(name string, at time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if rec, ok := idx.files[filepath.ToSlash(name)]; ok {
+		rec.Verified = at
+		idx.saveLocked()
+	}
+}
+
+// markReplicated records that name, as queued for replication at queued,
+// was copied to the replica at at, unless the file was stored again since.
+func (idx *fileIndex) markReplicated(name string, queued, at time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if rec, ok := idx.files[filepath.ToSlash(name)]; ok && !rec.Stored.After(queued) {
+		rec.Replicated = at
+		idx.saveLocked()
+	}
+}
+
+// setRoute records the target name is to be moved to, "" once it was.
+func (idx *fileIndex) setRoute(name, target string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if rec, ok := idx.files[filepath.ToSlash(name)]; ok && rec.Route != target {
+		rec.Route = target
+		idx.saveLocked()
+	}
+}
+
+// pendingRoutes returns the files still to be moved to the target of their
+// routing rule, with the target.
+func (idx *fileIndex) pendingRoutes() map[string]string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	routes := map[string]string{}
+	for name, rec := range idx.files {
+		if rec.Route != "" {
+			routes[name] = rec.Route
+		}
+	}
+	return routes
+}
+
+// setOrigin records the user and upload token that uploaded name and the
+// retention period of its upload policy.
+func (idx *fileIndex) setOrigin(name, user, tokenID string, retentionDays int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if rec, ok := idx.files[filepath.ToSlash(name)]; ok {
+		rec.User, rec.TokenID, rec.RetentionDays = user, tokenID, retentionDays
+		idx.saveLocked()
+	}
+}
+
+// setUpload records the ID of the tus upload name was stored from.
+func (idx *fileIndex) setUpload(name, id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if rec, ok := idx.files[filepath.ToSlash(name)]; ok {
+		rec.UploadID = id
+		idx.saveLocked()
+	}
+}
+
+// setLastModified records the modification time name had on the device it
+// was uploaded from.
+func (idx *fileIndex) setLastModified(name string, t time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if rec, ok := idx.files[filepath.ToSlash(name)]; ok {
+		rec.LastModified = t.UTC()
+		idx.saveLocked()
+	}
+}
+
+// byUpload returns the name of the file stored from the tus upload id.
+func (idx *fileIndex) byUpload(id string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for name, rec := range idx.files {
+		if rec.UploadID == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// setVerdict records the VirusTotal verdict on name, unless the file was
+// replaced since sum was taken.
+func (idx *fileIndex) setVerdict(name, sum string, verdict vtVerdict) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if rec, ok := idx.files[filepath.ToSlash(name)]; ok && rec.SHA256 == sum {
+		rec.VirusTotal = &verdict
+		idx.saveLocked()
+	}
+}
+
+func (idx *fileIndex) names() []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	names := make([]string, 0, len(idx.files))
+	for name := range idx.files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// rebuild re-creates the index from the files in UploadPath. Local files are
+// hashed again; tiered files keep their previous record, as their data is
+// not at hand, or get one without checksum.
+func (idx *fileIndex) rebuild(ctx context.Context) (int, error) {
+	files := map[string]*fileRecord{}
+	err := walkStoredFiles(ctx, func(name string, info fs.FileInfo, tiered bool) error {
+		if tiered {
+			stub, err := readTieredStub(name)
+			if err != nil {
+				return nil
+			}
+			rec, ok := idx.get(name)
+			if !ok || rec.Size != stub.Size {
+				rec = fileRecord{Size: stub.Size, Stored: stub.ModTime, User: rec.User, TokenID: rec.TokenID, RetentionDays: rec.RetentionDays, UploadID: rec.UploadID, LastModified: rec.LastModified}
+			}
+			files[name] = &rec
+			return nil
+		}
+		sum, err := hashFile(filepath.Join(UploadPath, filepath.FromSlash(name)))
+		if err != nil {
+			log.Printf("Unable to hash %s: %s", name, err.Error())
+			return nil
+		}
+		rec := &fileRecord{Size: info.Size(), SHA256: sum, Stored: info.ModTime(), Verified: time.Now()}
+		if old, ok := idx.get(name); ok {
+			rec.User, rec.TokenID, rec.RetentionDays, rec.UploadID = old.User, old.TokenID, old.RetentionDays, old.UploadID
+			if rec.LastModified = old.LastModified; old.LastModified.Equal(info.ModTime()) {
+				// The file has the modification time of the client.
+				rec.Stored = old.Stored
+			}
+			if old.SHA256 == sum {
+				rec.VirusTotal, rec.Annotations = old.VirusTotal, old.Annotations
+			}
+		}
+		writeChecksumSidecar(name, sum)
+		files[name] = rec
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.files = files
+	idx.saveLocked()
+	return len(files), nil
+}
+
+// walkStoredFiles calls fn for every file in UploadPath with its name
+// relative to UploadPath. Tiered files are reported under their original
+// name with the information of their stub; checksum sidecars are skipped.
+func walkStoredFiles(ctx context.Context, fn func(name string, info fs.FileInfo, tiered bool) error) error {
+	return filepath.WalkDir(UploadPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isSidecar(p) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(UploadPath, p)
+		name, tiered := strings.CutSuffix(filepath.ToSlash(rel), tieredSuffix)
+		return fn(name, info, tiered)
+	})
+}
+
+// checksumResult is the outcome of verifying one stored file.
+type checksumResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+const (
+	checksumOK        = "ok"
+	checksumMismatch  = "mismatch"
+	checksumMissing   = "missing"
+	checksumUnindexed = "unindexed"
+	checksumTiered    = "tiered"
+	checksumFailed    = "error"
+)
+
+// verifyChecksum hashes name again and compares it with its record.
+func (idx *fileIndex) verifyChecksum(name string) checksumResult {
+	res := checksumResult{Name: name}
+	rec, ok := idx.get(name)
+	alg, want := hashSHA256, rec.SHA256
+	if want == "" {
+		alg, want = rec.Algorithm, rec.Digest
+	}
+	if !ok || want == "" {
+		res.Status = checksumUnindexed
+		return res
+	}
+	res.Expected = want
+	sum, err := digestFile(alg, filepath.Join(UploadPath, filepath.FromSlash(name)))
+	switch {
+	case os.IsNotExist(err):
+		res.Status = checksumMissing
+		if _, err := readTieredStub(name); err == nil {
+			res.Status = checksumTiered
+		}
+	case err != nil:
+		res.Status = checksumFailed
+		res.Error = err.Error()
+	case sum != want:
+		res.Status = checksumMismatch
+		res.Actual = sum
+	default:
+		res.Status = checksumOK
+		idx.markVerified(name, time.Now())
+	}
+	return res
+}
+
+// verifyChecksums verifies every indexed file, and reports stored files the
+// index does not know about.
+func (idx *fileIndex) verifyChecksums(ctx context.Context) ([]checksumResult, error) {
+	var results []checksumResult
+	for _, name := range idx.names() {
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		results = append(results, idx.verifyChecksum(name))
+	}
+	err := walkStoredFiles(ctx, func(name string, info fs.FileInfo, tiered bool) error {
+		if _, ok := idx.get(name); !ok {
+			results = append(results, checksumResult{Name: name, Status: checksumUnindexed})
+		}
+		return nil
+	})
+	return results, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// defaultBlockedExtensions are rejected unless BLOCKED_EXTENSIONS says
+// otherwise: executables and scripts that run when opened on a desktop.
+var defaultBlockedExtensions = []string{
+	"exe", "com", "scr", "pif", "msi", "msp", "dll", "cpl", "bat", "cmd",
+	"js", "jse", "vbs", "vbe", "wsf", "wsh", "hta", "ps1", "jar", "lnk",
+	"reg", "app", "sh",
+}
+
+// errFileTypeBlocked is returned, with a more specific message, for uploads
+// whose name or content is not allowed. Use errors.Is to test for it.
+var errFileTypeBlocked = tusd.NewError("ERR_FILE_TYPE_BLOCKED", "file type is not allowed", http.StatusForbidden)
+
+func fileTypeBlocked(format string, args ...any) error {
+	return tusd.NewError(errFileTypeBlocked.ErrorCode, fmt.Sprintf(format, args...), http.StatusForbidden)
+}
+
+// parseExtensions parses a comma separated list of extensions, with or
+// without the leading dot.
+func parseExtensions(list string) []string {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// bidiControls are the Unicode controls that reorder text, used to make
+// "movie\u202egpj.exe" display as "movieexe.jpg".
+const bidiControls = "\u200e\u200f\u202a\u202b\u202c\u202d\u202e\u2066\u2067\u2068\u2069"
+
+// checkUploadName rejects file names whose extension is not in
+// AllowedExtensions (when set) or is in BlockedExtensions, and names made to
+// look like a different type: double extensions ending in a blocked one
+// (movie.mp4.exe) and names containing text direction controls.
+func checkUploadName(name string) error {
+	if strings.ContainsAny(name, bidiControls) {
+		return fileTypeBlocked("%q contains text direction controls", name)
+	}
+	// Windows drops trailing dots and spaces, so "a.exe. " is an .exe.
+	base := strings.TrimRight(path.Base(strings.ReplaceAll(name, "\\", "/")), ". ")
+	exts := strings.Split(strings.ToLower(base), ".")[1:]
+	for i := range exts {
+		exts[i] = strings.TrimSpace(exts[i])
+	}
+	ext := ""
+	if len(exts) > 0 {
+		ext = exts[len(exts)-1]
+	}
+	if slices.Contains(BlockedExtensions, ext) {
+		if len(exts) > 1 {
+			return fileTypeBlocked("%q has a deceptive double extension", name)
+		}
+		return fileTypeBlocked(".%s files are not allowed", ext)
+	}
+	if len(AllowedExtensions) > 0 && !slices.Contains(AllowedExtensions, ext) {
+		return fileTypeBlocked(".%s files are not allowed", ext)
+	}
+	return nil
+}
+
+// svgScriptPattern matches the ways an SVG can run script when opened in a
+// browser: script elements, event handler attributes, javascript: URLs and
+// embedded HTML.
+var svgScriptPattern = regexp.MustCompile(`(?i)<script|<foreignobject|\son[a-z]+\s*=|javascript:`)
+
+// svgScanOverlap is carried over between the chunks scanned for
+// svgScriptPattern, so a match cannot hide across a chunk boundary.
+const svgScanOverlap = 64
+
+// checkUploadContent rejects uploaded SVG images that contain scripts. It
+// runs when an upload is finished, as the content is not known earlier.
+func checkUploadContent(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	name := strings.ToLower(info.MetaData["filename"])
+	if !strings.HasSuffix(name, ".svg") && info.MetaData["filetype"] != "image/svg+xml" {
+		return nil
+	}
+	r, err := upload.GetReader(ctx)
+	if errors.Is(err, errDataDiscarded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	buf := make([]byte, 0, 64<<10)
+	for {
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if svgScriptPattern.Match(buf) {
+			return fileTypeBlocked("%q contains scripts", info.MetaData["filename"])
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(buf) == cap(buf) {
+			buf = append(buf[:0], bytes.Clone(buf[len(buf)-svgScanOverlap:])...)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// fingerprintHandler serves the script the upload page and its service
+// worker fingerprint files with, to find their incomplete uploads through
+// GET /api/uploads?fingerprint=.
+func fingerprintHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, fingerprintJS)
+}
+
+const fingerprintJS = `// fileFingerprint resolves to "<size>-<sha256>", the SHA-256 being of the
+// start, the middle and the end of the file, so that large files are
+// recognized without reading them whole. It resolves to null where Web
+// Crypto is not available, on pages not served over HTTPS.
+var FINGERPRINT_SAMPLE = 64 * 1024;
+function fileFingerprint(file){
+    if(!self.crypto || !crypto.subtle){
+        return Promise.resolve(null);
+    }
+    var n = FINGERPRINT_SAMPLE;
+    var parts = [file];
+    if(file.size > 3 * n){
+        var mid = Math.floor(file.size / 2);
+        parts = [file.slice(0, n), file.slice(mid, mid + n), file.slice(file.size - n)];
+    }
+    return new Blob(parts).arrayBuffer().then(function(data){
+        return crypto.subtle.digest('SHA-256', data);
+    }).then(function(sum){
+        var hex = Array.prototype.map.call(new Uint8Array(sum), function(b){
+            return ('0' + b.toString(16)).slice(-2);
+        }).join('');
+        return file.size + '-' + hex;
+    }, function(){
+        return null;
+    });
+}
+// findUpload resolves to the incomplete upload of file with the
+// fingerprint, {id, offset, size, chunks}, or null. The upload may have been
+// started in another browser or with "uploader upload"; it resolves to false
+// if the chunks the server recorded for it do not match file, which is then
+// another file with the same fingerprint, to be uploaded without it.
+function findUpload(fingerprint, file){
+    if(!fingerprint){
+        return Promise.resolve(null);
+    }
+    return fetch('/api/uploads?fingerprint=' + encodeURIComponent(fingerprint)).then(function(res){
+        return res.ok ? res.json() : [];
+    }).then(function(list){
+        if(list.length === 0){
+            return null;
+        }
+        return matchesChunks(file, list[0].chunks).then(function(matched){
+            return matched ? list[0] : false;
+        });
+    }, function(){
+        return null;
+    });
+}
+// WEB_CRYPTO_DIGESTS maps the CHUNK_HASH algorithms browsers can compute
+// to their Web Crypto names; chunks hashed with the others are not
+// compared.
+var WEB_CRYPTO_DIGESTS = {sha256: 'SHA-256', sha1: 'SHA-1'};
+// chunkDigest resolves to the hex digest of data with the CHUNK_HASH
+// algorithm, or null if the browser cannot compute it.
+function chunkDigest(data, algorithm){
+    var name = WEB_CRYPTO_DIGESTS[algorithm];
+    if(!name || !self.crypto || !crypto.subtle){
+        return Promise.resolve(null);
+    }
+    return crypto.subtle.digest(name, data).then(function(sum){
+        return Array.prototype.map.call(new Uint8Array(sum), function(b){
+            return ('0' + b.toString(16)).slice(-2);
+        }).join('');
+    });
+}
+// CHUNK_SAMPLES is how many of the recorded chunks of an upload, spread
+// over it and including the last, matchesChunks compares, to bound what
+// is read of large files.
+var CHUNK_SAMPLES = 8;
+// matchesChunks resolves to whether the sampled chunks match the data of
+// file.
+function matchesChunks(file, chunks){
+    chunks = (chunks || []).filter(function(c){
+        return !!WEB_CRYPTO_DIGESTS[c.algorithm || 'sha256'];
+    });
+    if(!file || chunks.length === 0){
+        return Promise.resolve(true);
+    }
+    var picks = [];
+    var step = Math.max(1, Math.ceil(chunks.length / CHUNK_SAMPLES));
+    for(var i = chunks.length - 1; i >= 0; i -= step){
+        picks.push(chunks[i]);
+    }
+    return picks.reduce(function(matched, c){
+        return matched.then(function(ok){
+            if(!ok){
+                return false;
+            }
+            return file.slice(c.offset, c.offset + c.size).arrayBuffer().then(function(data){
+                return data.byteLength === c.size ? chunkDigest(data, c.algorithm || 'sha256') : null;
+            }).then(function(sum){
+                return !!sum && sum === (c.sha256 || c.digest);
+            });
+        });
+    }, Promise.resolve(true)).catch(function(){
+        return false;
+    });
+}
+`
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	ftpIdleTimeout = 5 * time.Minute
+	ftpDataTimeout = 30 * time.Second
+)
+
+// startFTP starts the embedded FTP server on FTPAddr. Like the SFTP server
+// it is write-only: every STOR becomes an upload in the tus store which is
+// finalized through finishUpload. When a certificate is configured, clients
+// can upgrade to explicit FTPS with AUTH TLS. Only passive mode is supported.
+func startFTP(composer *tusd.StoreComposer) (net.Listener, error) {
+	if FTPPassword == "" {
+		return nil, errors.New("FTP_PASSWORD must be set")
+	}
+	var tlsConfig *tls.Config
+	if FTPTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(FTPTLSCert, FTPTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	} else if FTPRequireTLS {
+		return nil, errors.New("FTP_REQUIRE_TLS needs FTP_TLS_CERT and FTP_TLS_KEY")
+	}
+	minPort, maxPort, err := parsePortRange(FTPPassivePorts)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := listenTCP(FTPAddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("FTP accept: %s", err.Error())
+				continue
+			}
+			if geoRefused("FTP", conn.RemoteAddr()) {
+				conn.Close()
+				continue
+			}
+			c := &ftpConn{
+				composer: composer,
+				tls:      tlsConfig,
+				minPort:  minPort,
+				maxPort:  maxPort,
+			}
+			go c.serve(conn)
+		}
+	}()
+	log.Printf("FTP server started on %s", listenerAddr(ln.Addr()))
+	return ln, nil
+}
+
+// parsePortRange parses "min-max". An empty range lets the system choose.
+func parsePortRange(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	lo, hi, ok := strings.Cut(s, "-")
+	min, err1 := strconv.Atoi(lo)
+	max, err2 := strconv.Atoi(hi)
+	if !ok || err1 != nil || err2 != nil || min <= 0 || max < min || max > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return min, max, nil
+}
+
+type ftpConn struct {
+	composer *tusd.StoreComposer
+	tls      *tls.Config
+	minPort  int
+	maxPort  int
+
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	user   string
+	authed bool
+	secure bool
+	protP  bool
+	cwd    string
+	pasv   net.Listener
+}
+
+func (c *ftpConn) reply(code int, msg string) {
+	fmt.Fprintf(c.w, "%d %s\r\n", code, msg)
+	c.w.Flush()
+}
+
+func (c *ftpConn) setConn(conn net.Conn) {
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	c.w = bufio.NewWriter(conn)
+}
+
+func (c *ftpConn) serve(conn net.Conn) {
+	c.setConn(conn)
+	c.cwd = "/"
+	defer func() {
+		c.closePassive()
+		c.conn.Close()
+	}()
+
+	c.reply(220, "Uploader FTP ready")
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		cmd = strings.ToUpper(cmd)
+
+		if !c.authed && !ftpPreAuth[cmd] {
+			c.reply(530, "Please login with USER and PASS")
+			continue
+		}
+		if FTPRequireTLS && !c.secure && (cmd == "USER" || cmd == "PASS") {
+			c.reply(534, "TLS is required, use AUTH TLS")
+			continue
+		}
+		if c.handle(cmd, arg) {
+			return
+		}
+	}
+}
+
+var ftpPreAuth = map[string]bool{
+	"USER": true, "PASS": true, "AUTH": true, "PBSZ": true, "PROT": true,
+	"FEAT": true, "SYST": true, "QUIT": true, "NOOP": true, "OPTS": true,
+}
+
+// handle executes a single command and reports whether the session ended.
+func (c *ftpConn) handle(cmd, arg string) bool {
+	switch cmd {
+	case "USER":
+		c.user = arg
+		c.authed = false
+		c.reply(331, "Password required")
+	case "PASS":
+		if logins.locked("FTP", c.conn.RemoteAddr(), c.user) {
+			c.reply(530, "Too many failed logins, try again later")
+		} else if c.user == FTPUser && subtle.ConstantTimeCompare([]byte(arg), []byte(FTPPassword)) == 1 {
+			c.authed = true
+			logins.succeeded("FTP", c.conn.RemoteAddr(), c.user)
+			log.Printf("FTP login from %s as %s", c.conn.RemoteAddr(), c.user)
+			c.reply(230, "Login successful")
+		} else {
+			logins.failed("FTP", c.conn.RemoteAddr(), c.user)
+			c.reply(530, "Login incorrect")
+		}
+	case "AUTH":
+		if c.tls == nil || c.secure || !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "TLS-C") {
+			c.reply(504, "AUTH not supported")
+			break
+		}
+		c.reply(234, "AUTH TLS successful")
+		tlsConn := tls.Server(c.conn, c.tls)
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("FTP TLS handshake with %s failed: %s", c.conn.RemoteAddr(), err.Error())
+			return true
+		}
+		c.setConn(tlsConn)
+		c.secure = true
+	case "PBSZ":
+		c.reply(200, "PBSZ=0")
+	case "PROT":
+		switch strings.ToUpper(arg) {
+		case "P":
+			if !c.secure {
+				c.reply(503, "PROT P requires AUTH TLS")
+				break
+			}
+			c.protP = true
+			c.reply(200, "Protection level set to Private")
+		case "C":
+			if FTPRequireTLS {
+				c.reply(534, "Data connections must be protected")
+				break
+			}
+			c.protP = false
+			c.reply(200, "Protection level set to Clear")
+		default:
+			c.reply(504, "Protection level not supported")
+		}
+	case "FEAT":
+		fmt.Fprint(c.w, "211-Features:\r\n EPSV\r\n PASV\r\n UTF8\r\n")
+		if c.tls != nil {
+			fmt.Fprint(c.w, " AUTH TLS\r\n PBSZ\r\n PROT\r\n")
+		}
+		c.reply(211, "End")
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+	case "OPTS":
+		c.reply(200, "OK")
+	case "NOOP":
+		c.reply(200, "OK")
+	case "QUIT":
+		c.reply(221, "Goodbye")
+		return true
+	case "TYPE", "MODE", "STRU":
+		c.reply(200, "OK")
+	case "PWD", "XPWD":
+		c.reply(257, strconv.Quote(c.cwd)+" is the current directory")
+	case "CWD", "XCWD":
+		c.cwd = path.Join(c.cwd, arg)
+		if path.IsAbs(arg) {
+			c.cwd = path.Clean(arg)
+		}
+		c.reply(250, "Directory changed")
+	case "CDUP", "XCUP":
+		c.cwd = path.Dir(c.cwd)
+		c.reply(250, "Directory changed")
+	case "MKD", "XMKD":
+		c.reply(257, strconv.Quote(arg)+" created")
+	case "PASV", "EPSV":
+		c.passive(cmd == "EPSV")
+	case "LIST", "NLST", "MLSD":
+		c.list()
+	case "STOR":
+		c.store(arg)
+	case "REST":
+		if arg != "0" {
+			c.reply(504, "Resuming uploads is not supported")
+			break
+		}
+		c.reply(350, "Restarting at 0")
+	default:
+		c.reply(502, "Command not implemented")
+	}
+	return false
+}
+
+func (c *ftpConn) closePassive() {
+	if c.pasv != nil {
+		c.pasv.Close()
+		c.pasv = nil
+	}
+}
+
+func (c *ftpConn) listenPassive() (net.Listener, error) {
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	if c.minPort == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+	for port := c.minPort; port <= c.maxPort; port++ {
+		if ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return ln, nil
+		}
+	}
+	return nil, errors.New("no passive port available")
+}
+
+func (c *ftpConn) passive(extended bool) {
+	c.closePassive()
+	ln, err := c.listenPassive()
+	if err != nil {
+		log.Printf("FTP passive listener: %s", err.Error())
+		c.reply(425, "Cannot open data connection")
+		return
+	}
+	c.pasv = ln
+	port := ln.Addr().(*net.TCPAddr).Port
+	if extended {
+		c.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+
+	ip := net.ParseIP(FTPPublicHost)
+	if ip == nil {
+		ip = c.conn.LocalAddr().(*net.TCPAddr).IP
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		c.closePassive()
+		c.reply(522, "Use EPSV for IPv6")
+		return
+	}
+	c.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff))
+}
+
+// dataConn accepts the client's data connection on the passive listener.
+// Connections from other hosts than the control connection are refused.
+func (c *ftpConn) dataConn() (net.Conn, error) {
+	if c.pasv == nil {
+		return nil, errors.New("use PASV or EPSV first")
+	}
+	defer c.closePassive()
+	c.pasv.(*net.TCPListener).SetDeadline(time.Now().Add(ftpDataTimeout))
+	conn, err := c.pasv.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ctrlHost, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	dataHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if ctrlHost != dataHost {
+		conn.Close()
+		return nil, fmt.Errorf("data connection from %s does not match %s", dataHost, ctrlHost)
+	}
+	if c.protP {
+		tlsConn := tls.Server(conn, c.tls)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func (c *ftpConn) list() {
+	if FTPRequireTLS && !c.protP {
+		c.reply(521, "Data connections must be protected")
+		return
+	}
+	c.reply(150, "Opening data connection")
+	conn, err := c.dataConn()
+	if err != nil {
+		c.reply(425, "Cannot open data connection")
+		return
+	}
+	conn.Close()
+	c.reply(226, "Transfer complete")
+}
+
+func (c *ftpConn) store(arg string) {
+	name := path.Base(path.Join(c.cwd, arg))
+	if arg == "" || name == "/" || name == "." {
+		c.reply(553, "File name not allowed")
+		return
+	}
+	if FTPRequireTLS && !c.protP {
+		c.reply(521, "Data connections must be protected")
+		return
+	}
+	c.reply(150, "Ok to send data")
+	conn, err := c.dataConn()
+	if err != nil {
+		log.Printf("FTP data connection: %s", err.Error())
+		c.reply(425, "Cannot open data connection")
+		return
+	}
+	defer conn.Close()
+
+	w, err := newIngestWriter(context.Background(), c.composer, tusd.MetaData{
+		"filename": name,
+		"filetype": mime.TypeByExtension(path.Ext(name)),
+		"source":   "ftp",
+		"user":     c.user,
+		"country":  countryOf(c.conn.RemoteAddr()),
+	})
+	if c.rejectStore(name, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("FTP upload of %s failed: %s", name, err.Error())
+		c.reply(451, "Unable to store file")
+		return
+	}
+	if _, err := io.Copy(w, stalledReader{conn}); errors.Is(err, errUploadTooLarge) {
+		log.Printf("FTP upload of %s rejected: %s", name, err.Error())
+		w.Abort()
+		c.reply(552, "File exceeds the size limit")
+		return
+	} else if err != nil {
+		log.Printf("FTP upload of %s interrupted: %s", name, err.Error())
+		w.Abort()
+		c.reply(426, "Connection closed, transfer aborted")
+		return
+	}
+	if err := w.Close(); errors.Is(err, errFileTypeBlocked) {
+		log.Printf("FTP upload of %s rejected: %s", name, err.Error())
+		c.reply(553, "File type not allowed")
+		return
+	} else if errors.Is(err, errUploadInfected) {
+		log.Printf("FTP upload of %s rejected: %s", name, err.Error())
+		c.reply(553, "File rejected by content scanner")
+		return
+	} else if errors.Is(err, errImageInvalid) {
+		log.Printf("FTP upload of %s rejected: %s", name, err.Error())
+		c.reply(553, "Invalid image")
+		return
+	} else if c.rejectStore(name, err) {
+		return
+	} else if err != nil {
+		log.Printf("FTP upload of %s failed: %s", name, err.Error())
+		c.reply(451, "Unable to store file")
+		return
+	}
+	c.reply(226, "Transfer complete")
+}
+
+// rejectStore answers a STOR the upload checks turned down with err, 552 if
+// the file is too large and 553 otherwise, and reports whether they did.
+func (c *ftpConn) rejectStore(name string, err error) bool {
+	e, ok := uploadRejection(err)
+	if !ok {
+		return false
+	}
+	log.Printf("FTP upload of %s rejected: %s", name, err.Error())
+	if errors.Is(err, errUploadTooLarge) {
+		c.reply(552, "File exceeds the size limit")
+	} else {
+		c.reply(553, e.Message)
+	}
+	return true
+}
+
+// stalledReader reads from a data connection, failing when nothing arrived
+// for ftpIdleTimeout, so a client that stops sending does not hold its
+// upload open for good.
+type stalledReader struct {
+	conn net.Conn
+}
+
+func (r stalledReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+	return r.conn.Read(p)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDBTruncated = errors.New("truncated data")
+
+// geoDB looks up countries in a MaxMind DB file, such as GeoLite2-Country or
+// GeoIP2-City. The whole file is read into memory.
+type geoDB struct {
+	data       []byte
+	nodeCount  int
+	recordSize int
+	ipVersion  int
+	// dataStart is where the data section starts, after the search tree and
+	// its 16 byte separator.
+	dataStart int
+}
+
+// geoDatabase is nil unless GEOIP_DATABASE is set.
+var geoDatabase *geoDB
+
+func openGeoDB(file string) (*geoDB, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta, _, err := decodeMMDB(data[i+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	m, _ := meta.(map[string]any)
+	uintField := func(key string) int {
+		n, _ := m[key].(uint64)
+		return int(n)
+	}
+	db := &geoDB{
+		data:       data[:i],
+		nodeCount:  uintField("node_count"),
+		recordSize: uintField("record_size"),
+		ipVersion:  uintField("ip_version"),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	db.dataStart = db.nodeCount*db.recordSize/4 + 16
+	if db.dataStart > len(db.data) {
+		return nil, errors.New("search tree is truncated")
+	}
+	return db, nil
+}
+
+// country returns the ISO 3166 code of the country of ip, "" if the database
+// has none.
+func (db *geoDB) country(ip net.IP) string {
+	bits := ip.To4()
+	node := 0
+	if bits != nil && db.ipVersion == 6 {
+		// IPv4 addresses are at ::a.b.c.d in IPv6 databases.
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+	} else if bits == nil {
+		if bits = ip.To16(); bits == nil || db.ipVersion == 4 {
+			return ""
+		}
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, int(bits[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return ""
+	}
+	record, _, err := decodeMMDB(db.data[db.dataStart:], node-db.nodeCount-16, 0)
+	if err != nil {
+		return ""
+	}
+	m, _ := record.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := m[key].(map[string]any)
+		if code, _ := country["iso_code"].(string); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a node of the
+// search tree.
+func (db *geoDB) record(node, bit int) int {
+	b := db.data[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	case 28:
+		if bit == 0 {
+			return int(b[3]&0xf0)<<20 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		}
+		return int(b[3]&0x0f)<<24 | int(b[4])<<16 | int(b[5])<<8 | int(b[6])
+	default:
+		return int(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// decodeMMDB decodes the value at offset in a MaxMind DB data section, and
+// returns it along with the offset following it. Maps decode to
+// map[string]any, arrays to []any and unsigned integers to uint64.
+func decodeMMDB(section []byte, offset, depth int) (any, int, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deep")
+	}
+	next := func(n int) ([]byte, error) {
+		if offset < 0 || n < 0 || offset+n > len(section) {
+			return nil, errMMDBTruncated
+		}
+		b := section[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	kind := int(ctrl >> 5)
+	if kind == 1 {
+		// A pointer to a value elsewhere in the section.
+		n := int(ctrl>>3&3) + 1
+		b, err := next(n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr int
+		if n < 4 {
+			ptr = int(ctrl & 7)
+		}
+		for _, c := range b {
+			ptr = ptr<<8 | int(c)
+		}
+		ptr += []int{0, 2048, 526336, 0}[n-1]
+		v, _, err := decodeMMDB(section, ptr, depth+1)
+		return v, offset, err
+	}
+	if kind == 0 {
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + int(b[0])
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		n := 0
+		for _, c := range b {
+			n = n<<8 | int(c)
+		}
+		size = []int{29, 285, 65821}[size-29] + n
+	}
+	switch kind {
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			var k, v any
+			if k, offset, err = decodeMMDB(section, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			if v, offset, err = decodeMMDB(section, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case 11: // array
+		list := make([]any, 0, min(size, 1024))
+		for range size {
+			var v any
+			if v, offset, err = decodeMMDB(section, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			list = append(list, v)
+		}
+		return list, offset, nil
+	case 14: // boolean, the size is the value
+		return size != 0, offset, nil
+	}
+	b, err = next(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch kind {
+	case 2: // string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return slices.Clone(b), offset, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128
+		// uint128 keeps its low 64 bits.
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // int32
+		var n int32
+		for _, c := range b {
+			n = n<<8 | int32(c)
+		}
+		if size > 0 && size < 4 && b[0]&0x80 != 0 {
+			n -= 1 << (8 * size)
+		}
+		return int64(n), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// countryOf returns the country of the client at addr, "" without
+// GEOIP_DATABASE or if the address is unknown to it.
+func countryOf(addr net.Addr) string {
+	if geoDatabase == nil || addr == nil {
+		return ""
+	}
+	return countryOfHost(addrHost(addr))
+}
+
+func countryOfHost(host string) string {
+	ip := net.ParseIP(host)
+	if geoDatabase == nil || ip == nil {
+		return ""
+	}
+	return geoDatabase.country(ip)
+}
+
+// parseCountries parses a comma-separated list of ISO 3166 country codes.
+func parseCountries(list string) []string {
+	var countries []string
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			countries = append(countries, c)
+		}
+	}
+	return countries
+}
+
+// geoAllowed reports whether uploads are accepted from country. Addresses
+// the database has no country for, like those of private networks, are
+// always allowed.
+func geoAllowed(country string) bool {
+	if country == "" {
+		return true
+	}
+	if len(GeoIPAllowCountries) > 0 && !slices.Contains(GeoIPAllowCountries, country) {
+		return false
+	}
+	return !slices.Contains(GeoIPDenyCountries, country)
+}
+
+// withGeoPolicy refuses the requests that may upload, anything but GET, HEAD
+// and OPTIONS, from countries uploads are not accepted from. Downloads stay
+// available everywhere.
+func withGeoPolicy(next http.Handler) http.Handler {
+	if geoDatabase == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upload := true
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			// WebSocket uploads start with a GET.
+			upload = strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+		}
+		if upload {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if country := countryOfHost(host); !geoAllowed(country) {
+				log.Printf("%s %s from %s (%s) refused by the GeoIP policy", r.Method, r.URL.Path, host, country)
+				httpError(w, "Uploads are not accepted from your country", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// geoRefused reports whether the FTP or SFTP client at addr is from a
+// country uploads are not accepted from, logging the refusal.
+func geoRefused(service string, addr net.Addr) bool {
+	if country := countryOf(addr); !geoAllowed(country) {
+		log.Printf("%s connection from %s (%s) refused by the GeoIP policy", service, addr, country)
+		return true
+	}
+	return false
+}
+
+// uploadCountry is the PreUploadCreateCallback part that records the country
+// of the client in the "country" metadata of a tus upload, in place of any
+// the client set.
+func uploadCountry(hook tusd.HookEvent, changes tusd.FileInfoChanges) tusd.FileInfoChanges {
+	if geoDatabase == nil {
+		return changes
+	}
+	if changes.MetaData == nil {
+		changes.MetaData = tusd.MetaData{}
+		for k, v := range hook.Upload.MetaData {
+			changes.MetaData[k] = v
+		}
+	}
+	delete(changes.MetaData, "country")
+	host, _, _ := net.SplitHostPort(hook.HTTPRequest.RemoteAddr)
+	if country := countryOfHost(host); country != "" {
+		changes.MetaData["country"] = country
+	}
+	return changes
+}
+
+var (
+	countryStatsMu sync.Mutex
+	// uploadsByCountry counts the uploads finished since the start by the
+	// country they came from, "" for unknown.
+	uploadsByCountry = map[string]int64{}
+)
+
+// countUpload counts a finished upload towards the statistics of its
+// country.
+func countUpload(info tusd.FileInfo) {
+	if geoDatabase == nil {
+		return
+	}
+	countryStatsMu.Lock()
+	uploadsByCountry[info.MetaData["country"]]++
+	countryStatsMu.Unlock()
+}
@@ -2,9 +2,21 @@ module github.com/lefes/uploader
 
 go 1.24.0
 
-require github.com/tus/tusd/v2 v2.6.0
+require (
+	github.com/pkg/sftp v1.13.10
+	github.com/quic-go/quic-go v0.56.0
+	github.com/tus/tusd/v2 v2.6.0
+	github.com/zeebo/blake3 v0.2.4
+	golang.org/x/crypto v0.46.0
+	golang.org/x/net v0.48.0
+	golang.org/x/sys v0.39.0
+)
 
 require (
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
 	github.com/tus/lockfile v1.2.0 // indirect
 	golang.org/x/exp v0.0.0-20230626212559-97b1e661b5df // indirect
+	golang.org/x/text v0.32.0 // indirect
 )
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"github.com/zeebo/blake3"
+)
+
+// The algorithms uploads are hashed with while they are received, chunk by
+// chunk and whole, see CHUNK_HASH. The whole-file digest is kept in the
+// file index and may be verified by the client. SHA-256, the checksum of
+// the sidecars, receipts, notifications and VirusTotal, is computed over
+// the whole upload when CHUNK_HASH is another algorithm and one of those
+// needs it. SHA-1 is offered for clients that compute it themselves;
+// BLAKE3, vectorized, and XXH64 hash several times faster than SHA-256 on
+// CPUs without SHA extensions, XXH64 detecting corruption but not
+// tampering.
+const (
+	hashSHA256 = "sha256"
+	hashSHA1   = "sha1"
+	hashBLAKE3 = "blake3"
+	hashXXH64  = "xxh64"
+)
+
+var hashAlgorithms = []string{hashSHA256, hashSHA1, hashBLAKE3, hashXXH64}
+
+// newHash returns a new hash of the algorithm alg, SHA-256 if alg is empty
+// or unknown.
+func newHash(alg string) hash.Hash {
+	switch alg {
+	case hashSHA1:
+		return sha1.New()
+	case hashBLAKE3:
+		return blake3.New()
+	case hashXXH64:
+		return newXXH64()
+	default:
+		return sha256.New()
+	}
+}
+
+// hashAlgorithm returns the algorithm of a digest recorded with alg, where
+// an empty one is SHA-256.
+func hashAlgorithm(alg string) string {
+	if alg == "" {
+		return hashSHA256
+	}
+	return alg
+}
+
+// needsSHA256 reports whether the SHA-256 of the upload info is needed when
+// it is stored, for the client to check or a feature handing it out, if it
+// was received with another algorithm.
+func needsSHA256(info tusd.FileInfo) bool {
+	return info.MetaData["sha256"] != "" || ChecksumSidecars || MetadataSidecars != "" || receiptKey != nil ||
+		virusTotal != nil || mqttEvents != nil || info.MetaData["delivery"] != "" || watchFolder != nil
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// hashingStore wraps the tus data store and hashes every chunk while it is
+// streamed to disk, so no separate pass over the file is needed to verify
+// it. The running hash state, of the CHUNK_HASH algorithm, and the digest of
+// every chunk are persisted next to the upload in <id>.hash and survive
+// restarts, which lets uploads be resumed later without losing the hash;
+// the running BLAKE3 hash is computed again from the data instead. See
+// manifest.go for how the sidecar is kept up to date.
+type hashingStore struct {
+	inner tusd.DataStore
+}
+
+// chunkHash records the hash of the bytes written by a single WriteChunk
+// call: SHA256 if the chunk was hashed with SHA-256, otherwise Digest, of
+// the CHUNK_HASH Algorithm at the time.
+type chunkHash struct {
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+func newChunkHash(offset, size int64, alg string, sum []byte) chunkHash {
+	c := chunkHash{Offset: offset, Size: size}
+	if alg == hashSHA256 {
+		c.SHA256 = hex.EncodeToString(sum)
+	} else {
+		c.Algorithm, c.Digest = alg, hex.EncodeToString(sum)
+	}
+	return c
+}
+
+// newHash returns a new hash of the algorithm c was hashed with.
+func (c chunkHash) newHash() hash.Hash {
+	return newHash(c.Algorithm)
+}
+
+// sum returns the hex digest of c.
+func (c chunkHash) sum() string {
+	if c.Algorithm == "" {
+		return c.SHA256
+	}
+	return c.Digest
+}
+
+// matches reports whether h, written the data of c, has its digest.
+func (c chunkHash) matches(h hash.Hash) bool {
+	return hex.EncodeToString(h.Sum(nil)) == c.sum()
+}
+
+// uploadHashes is the content of the <id>.hash sidecar.
+type uploadHashes struct {
+	// Algorithm is the algorithm of the running hash, CHUNK_HASH when the
+	// upload started; SHA-256 if empty.
+	Algorithm string      `json:"algorithm,omitempty"`
+	State     []byte      `json:"state"`
+	Chunks    []chunkHash `json:"chunks"`
+	// Broken is set when the hashed bytes diverged from the stored ones.
+	Broken bool `json:"broken,omitempty"`
+	// Truncated is when the upload was found to be shorter than its
+	// declared length on completion.
+	Truncated time.Time `json:"truncated,omitzero"`
+	// ParityGroup is the number of chunks per parity block in the <id>.parity
+	// sidecar, 0 if no parity is kept. ParityLost is set when the parity
+	// could not be kept up to date, which it is for the chunks before
+	// ParityEnd only. See parity.go.
+	ParityGroup int  `json:"parity_group,omitempty"`
+	ParityLost  bool `json:"parity_lost,omitempty"`
+	ParityEnd   int  `json:"parity_end,omitempty"`
+
+	// running is the running hash of an algorithm whose state cannot be
+	// saved, nil until it has been computed since the manifest was read.
+	running hash.Hash
+}
+
+func newHashingStore(inner tusd.DataStore) *hashingStore {
+	return &hashingStore{inner: inner}
+}
+
+// UseIn registers the store and the extensions of the wrapped store in
+// composer.
+func (s *hashingStore) UseIn(composer *tusd.StoreComposer) {
+	composer.UseCore(s)
+	if _, ok := s.inner.(tusd.TerminaterDataStore); ok {
+		composer.UseTerminater(s)
+	}
+	if _, ok := s.inner.(tusd.LengthDeferrerDataStore); ok {
+		composer.UseLengthDeferrer(s)
+	}
+	composer.UseConcater(s)
+}
+
+// NewUpload rejects uploads the validators turn down, uploads the disk has
+// no space left for, and any upload while draining, before creating the
+// upload, so every protocol refuses them as soon as the session is created.
+// It queues uploads created outside of UPLOAD_WINDOWS or beyond
+// MAX_ACTIVE_UPLOADS and sets the deadline of the upload as well.
+func (s *hashingStore) NewUpload(ctx context.Context, info tusd.FileInfo) (tusd.Upload, error) {
+	if err := checkDraining(info); err != nil {
+		return nil, err
+	}
+	if err := validateCreate(ctx, info); err != nil {
+		return nil, err
+	}
+	reserve := reservations != nil && !info.SizeIsDeferred
+	if reserve {
+		if err := reservations.reserve(info.Size); err != nil {
+			return nil, err
+		}
+	}
+	holdUpload(&info)
+	setUploadDeadline(&info)
+	upload, err := s.inner.NewUpload(ctx, info)
+	if err != nil {
+		if reserve {
+			reservations.cancel(info.Size)
+		}
+		return nil, err
+	}
+	if info, err := upload.GetInfo(ctx); err == nil {
+		if reserve {
+			reservations.assign(info.ID, info.Size)
+		}
+		uploadQueue.add(info)
+		publishEvent(eventCreated, info, "", "")
+		hookSessionCreated(info)
+	}
+	return &hashingUpload{Upload: upload, store: s}, nil
+}
+
+func (s *hashingStore) GetUpload(ctx context.Context, id string) (tusd.Upload, error) {
+	upload, err := s.inner.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &hashingUpload{Upload: upload, store: s}, nil
+}
+
+func (s *hashingStore) AsTerminatableUpload(upload tusd.Upload) tusd.TerminatableUpload {
+	return upload.(*hashingUpload)
+}
+
+func (s *hashingStore) AsLengthDeclarableUpload(upload tusd.Upload) tusd.LengthDeclarableUpload {
+	return s.inner.(tusd.LengthDeferrerDataStore).AsLengthDeclarableUpload(upload.(*hashingUpload).Upload)
+}
+
+func (s *hashingStore) AsConcatableUpload(upload tusd.Upload) tusd.ConcatableUpload {
+	return upload.(*hashingUpload)
+}
+
+type hashingUpload struct {
+	tusd.Upload
+	store *hashingStore
+}
+
+func (u *hashingUpload) id(ctx context.Context) (string, error) {
+	info, err := u.Upload.GetInfo(ctx)
+	return info.ID, err
+}
+
+func (u *hashingUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	info, err := u.Upload.GetInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkUploadDeadline(info); err != nil {
+		return 0, err
+	}
+	if err := checkUploadQueue(info); err != nil {
+		return 0, err
+	}
+	if err := checkUploadToken(info); err != nil {
+		return 0, err
+	}
+	id := info.ID
+	hashes, err := sessionHashes(id)
+	if err != nil {
+		return 0, err
+	}
+	fileAlg, broken := hashes.Algorithm, hashes.Broken
+	if len(hashes.Chunks) == 0 && len(hashes.State) == 0 && ChunkHash != hashSHA256 {
+		hashes.Algorithm = ChunkHash
+	}
+	total, complete, err := hashes.restore()
+	if err != nil {
+		return 0, err
+	}
+	if !complete && !hashes.Broken {
+		if err := rehashUpload(ctx, u.Upload, total, offset); err != nil {
+			log.Printf("Unable to hash upload %s again: %s", id, err.Error())
+			hashes.Broken = true
+		}
+	}
+
+	alg := ChunkHash
+	chunk := newHash(alg)
+	counter := &countingWriter{}
+	parityGroup, parityLost := hashes.ParityGroup, hashes.ParityLost
+	sinks := []io.Writer{total, chunk, counter}
+	parity := startParity(hashes, id)
+	if parity != nil {
+		sinks = append(sinks, parity)
+	}
+	tee := io.TeeReader(limitUploadData(info, offset, src), io.MultiWriter(sinks...))
+	var n int64
+	if diskScheduler != nil && !expressUpload(info) {
+		n, err = writeScheduled(ctx, u.Upload, info, offset, tee)
+	} else {
+		n, err = u.Upload.WriteChunk(ctx, offset, tee)
+	}
+	if n > 0 || counter.n > 0 {
+		// The store may have read more than it managed to persist, in which
+		// case the running hash no longer matches the file.
+		if counter.n != n {
+			hashes.Broken = true
+		}
+		if parity != nil {
+			if parityErr := parity.Close(); parityErr != nil || counter.n != n {
+				if parityErr != nil {
+					log.Printf("Unable to keep the parity of upload %s: %s", id, parityErr.Error())
+				}
+				hashes.loseParity()
+			}
+			parity = nil
+		}
+		if updateErr := hashes.update(total, newChunkHash(offset, n, alg, chunk.Sum(nil))); updateErr != nil {
+			hashes.Broken = true
+		}
+		if echo, ok := ctx.Value(chunkEchoKey{}).(*chunkHash); ok && counter.n == n {
+			*echo = hashes.Chunks[len(hashes.Chunks)-1]
+		}
+		// Only the chunk is appended to the sidecar, unless the hash
+		// broke or the parity started or stopped.
+		var saveErr error
+		if hashes.Broken != broken || hashes.Algorithm != fileAlg || hashes.ParityGroup != parityGroup || hashes.ParityLost != parityLost {
+			saveErr = hashes.save(id)
+		} else {
+			saveErr = hashes.appendChunk(id)
+		}
+		if err == nil {
+			err = saveErr
+		}
+		hookChunk(info, offset, n)
+		if reservations != nil {
+			reservations.written(id, n)
+		}
+	}
+	if parity != nil {
+		parity.Close()
+	}
+	if err != nil {
+		hookError(info, err)
+	}
+	return n, err
+}
+
+// FinishUpload rejects, and removes, uploads the validators turn down.
+// Uploads whose stored data does not add up to their length are rejected as
+// well, but kept for TruncatedUploadGrace so the client can resume from the
+// actual offset. Uploads whose stored data differs from the received data,
+// with ASSEMBLY_VERIFY "chunks" or "full", are removed.
+func (u *hashingUpload) FinishUpload(ctx context.Context) error {
+	info, err := u.Upload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if err := verifyAssembly(ctx, u.Upload, info); err != nil {
+		hookError(info, err)
+		if errors.Is(err, errUploadCorrupted) {
+			recordFailedUpload(info, failedCorrupted, err)
+			u.Terminate(ctx)
+		}
+		return err
+	}
+	if rejected, err := validateFinish(ctx, u.Upload, info); err != nil {
+		hookError(info, err)
+		if rejected {
+			u.Terminate(ctx)
+		}
+		return err
+	}
+	if err := u.Upload.FinishUpload(ctx); err != nil {
+		hookError(info, err)
+		return err
+	}
+	if reservations != nil {
+		reservations.release(info.ID)
+	}
+	uploadQueue.done(info.ID)
+	publishEvent(eventCompleted, info, "", "")
+	return nil
+}
+
+var (
+	errEmptyUpload     = tusd.NewError("ERR_EMPTY_UPLOAD", "empty files are not accepted", http.StatusBadRequest)
+	errUploadTruncated = tusd.NewError("ERR_UPLOAD_TRUNCATED", "upload is incomplete", http.StatusConflict)
+)
+
+// checkStoredSize compares the size of the data file of a completed upload
+// with its declared length. On a mismatch the hash sidecar is marked, as the
+// running hash no longer matches the data, and the error tells the client
+// where to resume.
+func checkStoredSize(info tusd.FileInfo) error {
+	if StorageBackend != storageFile {
+		return nil
+	}
+	p := info.Storage["Path"]
+	if p == "" {
+		p = filepath.Join(TempUploadPath, info.ID)
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if stat.Size() == info.Size {
+		return nil
+	}
+	log.Printf("Upload %s has %d bytes stored of %d, keeping it for %s", info.ID, stat.Size(), info.Size, TruncatedUploadGrace)
+	if hashes, err := loadUploadHashes(info.ID); err == nil {
+		hashes.Broken = true
+		hashes.Truncated = time.Now()
+		hashes.save(info.ID)
+	}
+	msg := fmt.Sprintf("%d of %d bytes were stored", stat.Size(), info.Size)
+	if stat.Size() < info.Size {
+		msg += fmt.Sprintf(", resume from offset %d", stat.Size())
+	}
+	return tusd.NewError(errUploadTruncated.ErrorCode, msg, http.StatusConflict)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// ConcatUploads writes the partial uploads through WriteChunk instead of
+// letting the wrapped store copy them, so the final upload is hashed as well.
+func (u *hashingUpload) ConcatUploads(ctx context.Context, partialUploads []tusd.Upload) error {
+	var offset int64
+	for _, partial := range partialUploads {
+		r, err := partial.GetReader(ctx)
+		if err != nil {
+			return err
+		}
+		var src io.Reader = r
+		release := func() {}
+		if f, ok := r.(*os.File); ok {
+			if src, release, err = assemblySource(f); err != nil {
+				r.Close()
+				return err
+			}
+		}
+		n, err := u.WriteChunk(ctx, offset, src)
+		release()
+		r.Close()
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+func (u *hashingUpload) Terminate(ctx context.Context) error {
+	info, err := u.Upload.GetInfo(ctx)
+	if err == nil {
+		removeUploadHashes(info.ID)
+		if reservations != nil {
+			reservations.release(info.ID)
+		}
+		uploadQueue.remove(info.ID)
+		if StorageBackend == storageFile {
+			os.Remove(filepath.Join(TempUploadPath, info.ID+".move"))
+			os.Remove(paritySidecarPath(info.ID))
+			os.Remove(filepath.Join(TempUploadPath, info.ID+sanitizedSuffix))
+		}
+	}
+	if err := u.store.inner.(tusd.TerminaterDataStore).AsTerminatableUpload(u.Upload).Terminate(ctx); err != nil {
+		return err
+	}
+	if err == nil {
+		publishEvent(eventTerminated, info, "", "")
+	}
+	return nil
+}
+
+// hashSidecarPath returns the path of the <id>.hash sidecar. With the memory
+// storage backend the sidecars are kept in memStore instead.
+func hashSidecarPath(id string) string {
+	return filepath.Join(TempUploadPath, id+".hash")
+}
+
+func loadUploadHashes(id string) (*uploadHashes, error) {
+	hashes, _, err := readUploadHashes(id)
+	return hashes, err
+}
+
+// readUploadHashes returns the manifest of the upload id and the length of
+// its sidecar.
+func readUploadHashes(id string) (*uploadHashes, int64, error) {
+	var data []byte
+	if StorageBackend != storageFile {
+		data = memStore.sidecar(id)
+	} else {
+		var err error
+		data, err = os.ReadFile(hashSidecarPath(id))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+	}
+	if len(data) == 0 {
+		return &uploadHashes{}, 0, nil
+	}
+	hashes, err := parseUploadHashes(data)
+	return hashes, int64(len(data)), err
+}
+
+func removeUploadHashes(id string) {
+	forgetHashes(id)
+	if StorageBackend != storageFile {
+		memStore.setSidecar(id, nil)
+		return
+	}
+	os.Remove(hashSidecarPath(id))
+}
+
+// restore returns the running hash of the data written so far, and false if
+// its state was not saved and it has yet to be written that data.
+func (h *uploadHashes) restore() (hash.Hash, bool, error) {
+	if h.running != nil {
+		return h.running, true, nil
+	}
+	total := newHash(h.Algorithm)
+	if len(h.State) > 0 {
+		if err := total.(encoding.BinaryUnmarshaler).UnmarshalBinary(h.State); err != nil {
+			return nil, false, err
+		}
+		return total, true, nil
+	}
+	return total, len(h.Chunks) == 0, nil
+}
+
+// rehashUpload writes the first n bytes of upload to total.
+func rehashUpload(ctx context.Context, upload tusd.Upload, total hash.Hash, n int64) error {
+	r, err := upload.GetReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.CopyN(total, r, n)
+	return err
+}
+
+func (h *uploadHashes) update(total hash.Hash, chunk chunkHash) error {
+	if m, ok := total.(encoding.BinaryMarshaler); ok {
+		state, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		h.State = state
+	} else {
+		h.running = total
+	}
+	h.Chunks = append(h.Chunks, chunk)
+	return nil
+}
+
+// save writes the whole manifest to the sidecar, replacing the chunks
+// appended to it.
+func (h *uploadHashes) save(id string) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if StorageBackend != storageFile {
+		memStore.setSidecar(id, data)
+		rememberHashes(id, h, int64(len(data)))
+		return nil
+	}
+	path := hashSidecarPath(id)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		forgetHashes(id)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		forgetHashes(id)
+		return err
+	}
+	rememberHashes(id, h, int64(len(data)))
+	return nil
+}
+
+var errHashIncomplete = errors.New("incremental hash is incomplete")
+
+// Digest returns the algorithm and the digest of the whole upload.
+func (h *uploadHashes) Digest() (string, string, error) {
+	if h.Broken {
+		return "", "", errHashIncomplete
+	}
+	total, complete, err := h.restore()
+	if err != nil {
+		return "", "", err
+	}
+	if !complete {
+		return "", "", errHashIncomplete
+	}
+	return hashAlgorithm(h.Algorithm), hex.EncodeToString(total.Sum(nil)), nil
+}
+
+// TreeRoot returns the SHA-256 over the concatenated chunk digests, which
+// allows verifying the file chunk by chunk.
+func (h *uploadHashes) TreeRoot() string {
+	root := sha256.New()
+	for _, c := range h.Chunks {
+		sum, _ := hex.DecodeString(c.sum())
+		root.Write(sum)
+	}
+	return hex.EncodeToString(root.Sum(nil))
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// uploadSHA256 returns the SHA-256 of a completed upload, taken from the
+// incremental hash when it is one and by reading the data otherwise.
+func uploadSHA256(info tusd.FileInfo) (string, error) {
+	alg, sum, err := uploadDigest(info)
+	if err == nil && alg == hashSHA256 {
+		return sum, nil
+	}
+	return hashUploadData(info, hashSHA256)
+}
+
+// uploadDigest returns the algorithm and the digest of a completed upload,
+// taken from the incremental hash when possible and by reading the data
+// with CHUNK_HASH otherwise.
+func uploadDigest(info tusd.FileInfo) (string, string, error) {
+	hashes, err := sessionHashes(info.ID)
+	if err == nil && len(hashes.Chunks) > 0 {
+		if alg, sum, err := hashes.Digest(); err == nil {
+			return alg, sum, nil
+		}
+	}
+	sum, err := hashUploadData(info, ChunkHash)
+	return ChunkHash, sum, err
+}
+
+// hashUploadData reads the data of the upload info to hash it with alg.
+func hashUploadData(info tusd.FileInfo, alg string) (string, error) {
+	if StorageBackend != storageFile {
+		upload, err := memStore.GetUpload(context.Background(), info.ID)
+		if err != nil {
+			return "", err
+		}
+		r, err := upload.GetReader(context.Background())
+		if err != nil {
+			return "", err
+		}
+		return digestReader(alg, r)
+	}
+	return digestFile(alg, filepath.Join(TempUploadPath, info.ID))
+}
+
+// uploadTreeRoot returns the chunk tree root of a completed upload, or an
+// empty string if it was not hashed while being received.
+func uploadTreeRoot(info tusd.FileInfo) string {
+	hashes, err := loadUploadHashes(info.ID)
+	if err != nil || hashes.Broken || len(hashes.Chunks) == 0 {
+		return ""
+	}
+	return hashes.TreeRoot()
+}
+
+// hashFile returns the SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	return digestFile(hashSHA256, path)
+}
+
+func hashReader(r io.Reader) (string, error) {
+	return digestReader(hashSHA256, r)
+}
+
+// digestFile returns the digest of the file at path with alg.
+func digestFile(alg, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digestReader(alg, f)
+}
+
+func digestReader(alg string, r io.Reader) (string, error) {
+	h := newHash(alg)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyUploadChecksum compares the hash of a completed upload with the
+// optional metadata supplied by the client, named after the algorithm:
+// "sha256", or the CHUNK_HASH algorithm the upload was hashed with, which
+// costs no pass over the data.
+func verifyUploadChecksum(info tusd.FileInfo) error {
+	alg, got, err := uploadDigest(info)
+	if want := info.MetaData[alg]; err == nil && want != "" {
+		if !strings.EqualFold(got, want) {
+			return errChecksumMismatch
+		}
+		if alg == hashSHA256 {
+			return nil
+		}
+	}
+	want := info.MetaData["sha256"]
+	if want == "" {
+		return nil
+	}
+	got, err = uploadSHA256(info)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, want) {
+		return errChecksumMismatch
+	}
+	return nil
+}
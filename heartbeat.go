@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// The upload page, and its service worker, send a heartbeat with the IDs
+// of their incomplete uploads, running or paused, every
+// heartbeatInterval while they are open:
+//
+//	POST /api/uploads/heartbeat?id=...&id=...
+//
+// so a session not written to for a while can be told apart: with recent
+// heartbeats it is slow, or waiting, but alive, and its idle expiry is
+// postponed like with a keep-alive; without, it was abandoned, or its
+// client sends no heartbeats. The admin API lists the state of every
+// session. Heartbeats are kept by every replica on its own, in memory.
+const (
+	heartbeatInterval = 30 * time.Second
+	// heartbeatTimeout is how long a session counts as alive after its
+	// last heartbeat, or write.
+	heartbeatTimeout = 3 * heartbeatInterval
+)
+
+// The states of an incomplete upload for the admin API.
+const (
+	sessionUploading = "uploading"
+	sessionAlive     = "alive"
+	sessionAbandoned = "abandoned"
+)
+
+var (
+	heartbeatMu sync.Mutex
+	heartbeats  = map[string]time.Time{}
+)
+
+// lastHeartbeat returns when the last heartbeat for the upload id came.
+func lastHeartbeat(id string) time.Time {
+	heartbeatMu.Lock()
+	defer heartbeatMu.Unlock()
+	return heartbeats[id]
+}
+
+// sessionState returns the state of the incomplete upload id.
+func sessionState(id string, now time.Time) string {
+	switch {
+	case now.Sub(uploadWriteTime(id)) < heartbeatTimeout:
+		return sessionUploading
+	case now.Sub(lastHeartbeat(id)) < heartbeatTimeout:
+		return sessionAlive
+	default:
+		return sessionAbandoned
+	}
+}
+
+// uploadWriteTime returns when data was last written to the upload id,
+// which keep-alives do not change with the file storage backend.
+func uploadWriteTime(id string) time.Time {
+	if StorageBackend != storageFile {
+		return memStore.modTimes()[id]
+	}
+	stat, err := os.Stat(filepath.Join(TempUploadPath, id))
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// heartbeatHandler records a heartbeat for the given incomplete uploads
+// and answers with the IDs of those still there, for the client to stop
+// sending the others.
+func heartbeatHandler(composer *tusd.StoreComposer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ids, ok := uploadIDs(r)
+		if !ok {
+			httpError(w, "Expected 1 to 100 upload IDs", http.StatusBadRequest)
+			return
+		}
+		pin := clientPin(r.RemoteAddr, r.Header)
+		now := time.Now()
+		alive := []string{}
+		heartbeatMu.Lock()
+		for id, at := range heartbeats {
+			if now.Sub(at) > heartbeatTimeout {
+				delete(heartbeats, id)
+			}
+		}
+		heartbeatMu.Unlock()
+		for _, id := range ids {
+			if _, ok := expiryOf(r.Context(), composer, id, pin); !ok {
+				continue
+			}
+			heartbeatMu.Lock()
+			heartbeats[id] = now
+			heartbeatMu.Unlock()
+			touchUpload(id)
+			alive = append(alive, id)
+		}
+		writeJSON(w, http.StatusOK, alive)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Users signed in through AUTH_USER_HEADER find their past uploads, from
+// the file index, and those still in progress on their uploads page:
+//
+//	GET /my               the page
+//	GET /api/my/uploads   the uploads of the user as JSON
+//
+// with the download link of DOWNLOAD_URL and the receipt of every stored
+// file, which the page offers to share again. The FTP and SFTP uploads of
+// a user of the same name are listed too. Anonymous requests get 401.
+
+// The statuses of the uploads of a user, besides the states of incomplete
+// uploads of sessionState.
+const (
+	historyStored  = "stored"
+	historyFlagged = "flagged"
+)
+
+// historyEntry is an upload listed in the history of a user.
+type historyEntry struct {
+	// Name is the stored name of stored files, the file name the client
+	// sent for incomplete uploads.
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Offset   int64     `json:"offset"`
+	Status   string    `json:"status"`
+	Time     time.Time `json:"time"`
+	SHA256   string    `json:"sha256,omitempty"`
+	UploadID string    `json:"upload_id,omitempty"`
+	// DownloadURL and ReceiptURL are set for stored files when the server
+	// hands them out.
+	DownloadURL string `json:"download_url,omitempty"`
+	ReceiptURL  string `json:"receipt_url,omitempty"`
+}
+
+// historyEnabled reports whether users sign in, so they have a history.
+func historyEnabled() bool {
+	return storedFiles != nil && slices.ContainsFunc(authenticators, func(a Authenticator) bool {
+		_, ok := a.(headerAuth)
+		return ok
+	})
+}
+
+// userHistory returns the uploads of user, the latest first.
+func userHistory(r *http.Request, composer *tusd.StoreComposer, user string) []historyEntry {
+	entries := []historyEntry{}
+	now := time.Now()
+	for _, s := range userSessions(r.Context(), composer, user) {
+		entries = append(entries, historyEntry{
+			Name:     s.Filename,
+			Size:     s.Size,
+			Offset:   s.Offset,
+			Status:   sessionState(s.ID, now),
+			Time:     s.Modified,
+			UploadID: s.ID,
+		})
+	}
+	for _, name := range storedFiles.byUser(user) {
+		rec, ok := storedFiles.get(name)
+		if !ok {
+			continue
+		}
+		e := historyEntry{
+			Name:     name,
+			Size:     rec.Size,
+			Offset:   rec.Size,
+			Status:   historyStored,
+			Time:     rec.Stored,
+			SHA256:   rec.SHA256,
+			UploadID: rec.UploadID,
+		}
+		if rec.VirusTotal != nil && rec.VirusTotal.flagged() {
+			e.Status = historyFlagged
+		} else {
+			e.DownloadURL, _ = executeCompletionTemplate(DownloadURL, completionData{
+				ID:         rec.UploadID,
+				Filename:   path.Base(name),
+				StoredName: name,
+				Size:       rec.Size,
+				SHA256:     rec.SHA256,
+				User:       user,
+			})
+		}
+		if receiptKey != nil && rec.UploadID != "" {
+			if _, err := os.Stat(receiptPath(rec.UploadID)); err == nil {
+				e.ReceiptURL = "/api/receipts/" + rec.UploadID + ".html"
+			}
+		}
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b historyEntry) int { return b.Time.Compare(a.Time) })
+	return entries
+}
+
+// historyHandler serves GET /api/my/uploads.
+func historyHandler(composer *tusd.StoreComposer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !historyEnabled() {
+			httpError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		p, err := authenticate(r)
+		if err != nil || p.User == "" {
+			httpErrorCode(w, "ERR_NOT_SIGNED_IN", "Sign in to see your uploads", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		writeJSON(w, http.StatusOK, userHistory(r, composer, p.User))
+	}
+}
+
+// historyPageHandler serves the page of the uploads of the user, /my.
+func historyPageHandler(w http.ResponseWriter, r *http.Request) {
+	if !historyEnabled() {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	lang := requestLanguage(r)
+	w.Header().Set("Content-Type", "text/html")
+	setLanguage(w, lang)
+	fmt.Fprint(w, localizePage(brandPage(historyPage, requestBrand(r), lang), lang))
+}
+
+const historyPage = `<!DOCTYPE html>
+<html lang="[[lang]]">
+<head>
+  <meta charset="UTF-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="theme-color" content="[[brand_color]]">
+  <title>[[my_uploads]] — [[brand_title]]</title>
+  <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
+  <style>
+    .brand-logo { max-height: 3rem; max-width: 100%; margin-bottom: .75rem; }
+    td.name { overflow-wrap: anywhere; }[[brand_style]]
+  </style>
+</head>
+<body style="background-color: [[brand_background]]">
+<div class="container px-3 mt-3 mt-md-5">
+  [[brand_logo]]
+  <h2 class="fs-3">[[my_uploads]]</h2>
+  <p><a href="/">[[brand_heading]]</a></p>
+  <div id="status" aria-live="polite"></div>
+  <table class="table align-middle d-none" id="history">
+    <thead><tr><th scope="col">[[receipt_file]]</th><th scope="col">[[receipt_size]]</th><th scope="col">[[history_status]]</th><th scope="col">[[history_time]]</th><th scope="col"><span class="visually-hidden">[[history_actions]]</span></th></tr></thead>
+    <tbody></tbody>
+  </table>
+</div>
+[[brand_footer]]
+<script src="/messages.js"></script>
+<script>
+function formatBytes(n){
+    var units = t('byte_units').split(' ');
+    var i = 0;
+    while(n >= 1024 && i < units.length - 1){
+        n /= 1024;
+        i++;
+    }
+    return n.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+function showStatus(kind, text){
+    var div = document.createElement('div');
+    div.className = 'alert alert-' + kind;
+    div.textContent = text;
+    document.getElementById('status').textContent = '';
+    document.getElementById('status').appendChild(div);
+}
+// share hands the link to the share sheet of the device, or copies it.
+function share(name, url){
+    url = new URL(url, location.href).href;
+    if(navigator.share){
+        navigator.share({title: name, url: url}).catch(function(){});
+        return;
+    }
+    navigator.clipboard.writeText(url).then(function(){
+        showStatus('success', t('link_copied', {name: name}));
+    });
+}
+function action(cell, label, onClick){
+    var btn = document.createElement('button');
+    btn.className = 'btn btn-sm btn-outline-primary me-1 mb-1';
+    btn.textContent = label;
+    btn.addEventListener('click', onClick);
+    cell.appendChild(btn);
+}
+function link(cell, label, href){
+    var a = document.createElement('a');
+    a.className = 'btn btn-sm btn-outline-secondary me-1 mb-1';
+    a.href = href;
+    a.target = '_blank';
+    a.rel = 'noopener';
+    a.textContent = label;
+    cell.appendChild(a);
+}
+fetch('/api/my/uploads').then(function(r){
+    if(r.status === 401){
+        throw new Error(t('history_sign_in'));
+    }
+    if(!r.ok){
+        throw new Error(r.statusText);
+    }
+    return r.json();
+}).then(function(list){
+    if(list.length === 0){
+        showStatus('secondary', t('history_empty'));
+        return;
+    }
+    var body = document.querySelector('#history tbody');
+    list.forEach(function(e){
+        var tr = body.insertRow();
+        var name = tr.insertCell();
+        name.className = 'name';
+        name.textContent = e.name;
+        tr.insertCell().textContent = formatBytes(e.size);
+        var status = t('history_' + e.status);
+        if(e.offset < e.size){
+            status += ', ' + (e.offset / e.size * 100).toFixed(1) + '%';
+        }
+        tr.insertCell().textContent = status;
+        tr.insertCell().textContent = new Date(e.time).toLocaleString(LANG);
+        var actions = tr.insertCell();
+        if(e.download_url){
+            link(actions, t('history_download'), e.download_url);
+            action(actions, t('history_share'), function(){ share(e.name, e.download_url); });
+        }
+        if(e.receipt_url){
+            link(actions, t('receipt'), e.receipt_url);
+            if(!e.download_url){
+                action(actions, t('history_share'), function(){ share(e.name, e.receipt_url); });
+            }
+        }
+    });
+    document.getElementById('history').classList.remove('d-none');
+}).catch(function(err){
+    showStatus('danger', t('error', {error: err.message}));
+});
+</script>
+</body>
+</html>`
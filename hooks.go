@@ -0,0 +1,75 @@
+package main
+
+import (
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// UploadHooks are callbacks following uploads through their lifecycle, for
+// code built into the uploader that keeps its own records of them, like a
+// database of uploads. Every callback is optional and runs on the goroutine
+// handling the upload, so it should return quickly and hand slow work off.
+// The hooks cannot refuse uploads, validators do that. The parts of
+// concatenated uploads are not reported, like with the MQTT events.
+//
+//   - OnSessionCreated: an upload was created, over any protocol, or a
+//     direct upload started
+//   - OnChunk: size bytes were written at offset; info is from before the
+//     chunk
+//   - OnComplete: the upload was stored under name, relative to UploadPath,
+//     or in the bucket of a direct upload; sha256 is empty when unknown
+//   - OnError: writing, finishing or storing the upload failed; the upload
+//     may be resumed or retried after it
+type UploadHooks struct {
+	OnSessionCreated func(info tusd.FileInfo)
+	OnChunk          func(info tusd.FileInfo, offset, size int64)
+	OnComplete       func(info tusd.FileInfo, name, sha256 string)
+	OnError          func(info tusd.FileInfo, err error)
+}
+
+// uploadHooks are called in order. Code adds its hooks from an init
+// function.
+var uploadHooks []UploadHooks
+
+func hookSessionCreated(info tusd.FileInfo) {
+	if info.IsPartial {
+		return
+	}
+	for _, h := range uploadHooks {
+		if h.OnSessionCreated != nil {
+			h.OnSessionCreated(info)
+		}
+	}
+}
+
+func hookChunk(info tusd.FileInfo, offset, size int64) {
+	if info.IsPartial {
+		return
+	}
+	for _, h := range uploadHooks {
+		if h.OnChunk != nil {
+			h.OnChunk(info, offset, size)
+		}
+	}
+}
+
+func hookComplete(info tusd.FileInfo, name, sum string) {
+	if info.IsPartial {
+		return
+	}
+	for _, h := range uploadHooks {
+		if h.OnComplete != nil {
+			h.OnComplete(info, name, sum)
+		}
+	}
+}
+
+func hookError(info tusd.FileInfo, err error) {
+	if info.IsPartial {
+		return
+	}
+	for _, h := range uploadHooks {
+		if h.OnError != nil {
+			h.OnError(info, err)
+		}
+	}
+}
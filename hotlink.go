@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The object reads of the S3 endpoint can be kept from serving as a free
+// CDN in two ways. S3_ALLOWED_REFERERS lists the sites that may embed or
+// link to objects: browser requests whose Referer or Origin names another
+// site are refused. With S3_DOWNLOAD_SECRET set, objects are only served
+// to requests signed with the S3 credentials or through signed URLs, which
+// carry an expiry time and an HMAC of the object path and expiry in the
+// "expires" and "signature" query parameters. Signed URLs are created with
+// "uploader admin sign-url".
+
+// parseReferers parses a comma separated list of host names. A leading "*."
+// matches all subdomains.
+func parseReferers(list string) []string {
+	var hosts []string
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// refererAllowed reports whether r may read objects according to
+// S3AllowedReferers. Requests without Referer and Origin, such as those of
+// download tools and S3 clients, are allowed.
+func refererAllowed(r *http.Request) bool {
+	if len(S3AllowedReferers) == 0 {
+		return true
+	}
+	for _, header := range []string{"Origin", "Referer"} {
+		v := r.Header.Get(header)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || !hostAllowed(strings.ToLower(u.Hostname())) {
+			return false
+		}
+	}
+	return true
+}
+
+func hostAllowed(host string) bool {
+	for _, allowed := range S3AllowedReferers {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// signDownload returns the query that grants reading the object at p, the
+// URL path /<bucket>/<key>, until expires.
+func signDownload(p string, expires time.Time) url.Values {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{"expires": {exp}, "signature": {downloadSignature(p, exp)}}
+}
+
+func downloadSignature(p, expires string) string {
+	mac := hmac.New(sha256.New, []byte(S3DownloadSecret))
+	mac.Write([]byte(path.Clean(p) + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyDownload checks the signed URL query q for reading the object at p.
+func verifyDownload(p string, q url.Values) error {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return errors.New("malformed expiry")
+	}
+	if time.Now().Unix() > expires {
+		return errors.New("signed URL expired")
+	}
+	expected := downloadSignature(p, q.Get("expires"))
+	if !hmac.Equal([]byte(expected), []byte(q.Get("signature"))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
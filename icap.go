@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// icapDefaultPort is the port of ICAP servers when ICAP_URL does not name one.
+const icapDefaultPort = "1344"
+
+// icapChunkSize is the size of the chunks the upload is sent in.
+const icapChunkSize = 64 << 10
+
+var (
+	// errUploadInfected is returned, with the threat in the message, for
+	// uploads the ICAP server blocked. Use errors.Is to test for it.
+	errUploadInfected = tusd.NewError("ERR_UPLOAD_INFECTED", "upload was blocked by the content scanner", http.StatusForbidden)
+	// errScanUnavailable is returned when the ICAP server could not scan an
+	// upload and ICAP_FAIL_OPEN is not set.
+	errScanUnavailable = tusd.NewError("ERR_SCAN_UNAVAILABLE", "content scanner is unavailable, try again later", http.StatusServiceUnavailable)
+)
+
+// parseICAPURL parses ICAP_URL, icap://host[:port]/service.
+func parseICAPURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icap" || u.Hostname() == "" {
+		return nil, fmt.Errorf("expected icap://host[:port]/service")
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), icapDefaultPort)
+	}
+	return u, nil
+}
+
+// scanUpload sends a completed upload to the ICAP server in ICAPServer, if
+// set, before it is stored. Uploads the server blocks are rejected with
+// errUploadInfected. When the server cannot be reached or fails, the upload
+// is rejected with errScanUnavailable, or accepted unscanned if ICAPFailOpen
+// is set.
+func scanUpload(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	if ICAPServer == nil {
+		return nil
+	}
+	r, err := upload.GetReader(ctx)
+	if errors.Is(err, errDataDiscarded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, ICAPTimeout)
+	defer cancel()
+	threat, err := icapRespmod(ctx, ICAPServer, info, r)
+	if err != nil {
+		if ICAPFailOpen {
+			log.Printf("Unable to scan upload %s, accepting it unscanned: %s", info.ID, err.Error())
+			return nil
+		}
+		log.Printf("Unable to scan upload %s: %s", info.ID, err.Error())
+		return errScanUnavailable
+	}
+	if threat != "" {
+		log.Printf("Upload %s (%s) blocked by the content scanner: %s", info.ID, info.MetaData["filename"], threat)
+		return tusd.NewError(errUploadInfected.ErrorCode, fmt.Sprintf("%q was blocked by the content scanner: %s", info.MetaData["filename"], threat), http.StatusForbidden)
+	}
+	return nil
+}
+
+// icapRespmod submits body to the service at server as the response to a
+// download of the upload (RFC 3507 RESPMOD). It returns the threat the
+// server reported, or "" if the content is clean.
+func icapRespmod(ctx context.Context, server *url.URL, info tusd.FileInfo, body io.Reader) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server.Host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock reads and writes when ctx is cancelled.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	name := info.MetaData["filename"]
+	if name == "" {
+		name = info.ID
+	}
+	contentType := info.MetaData["filetype"]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	reqHdr := fmt.Sprintf("GET /%s HTTP/1.1\r\nHost: %s\r\n\r\n", url.PathEscape(name), server.Hostname())
+	resHdr := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", contentType, info.Size)
+
+	w := bufio.NewWriterSize(conn, icapChunkSize+16)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", server.String())
+	fmt.Fprintf(w, "Host: %s\r\n", server.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", len(reqHdr), len(reqHdr)+len(resHdr))
+	w.WriteString(reqHdr)
+	w.WriteString(resHdr)
+	buf := make([]byte, icapChunkSize)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	proto, status, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(status, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return "", fmt.Errorf("malformed ICAP response %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return "", err
+	}
+	switch code {
+	case "204":
+		return "", nil
+	case "200":
+		// The server replaced the content, usually with a block page.
+		return icapThreat(header), nil
+	}
+	return "", fmt.Errorf("ICAP server answered %q", status)
+}
+
+// icapThreat returns the threat an ICAP server reported in the headers its
+// vendor uses for it.
+func icapThreat(header textproto.MIMEHeader) string {
+	if found := header.Get("X-Infection-Found"); found != "" {
+		// Type=0; Resolution=2; Threat=EICAR-Test-File;
+		for _, field := range strings.Split(found, ";") {
+			if threat, ok := strings.CutPrefix(strings.TrimSpace(field), "Threat="); ok {
+				return threat
+			}
+		}
+		return found
+	}
+	for _, key := range []string{"X-Virus-Id", "X-Violations-Found", "X-Blocked"} {
+		if v := header.Get(key); v != "" {
+			return v
+		}
+	}
+	return "content modified by the scanner"
+}
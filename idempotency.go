@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A request creating or finishing an upload may carry an Idempotency-Key
+// header, a value of the client's choosing unique to the request, and be
+// sent again with the same key when the client does not know whether it
+// went through, e.g. after a timeout. The first response for a key is kept
+// for idempotencyKeep and replayed to the retries, with an
+// Idempotent-Replayed header, instead of creating another upload or storing
+// it, and notifying about it, once more. This applies to the tus POST and
+// PATCH requests, the PATCH completing an upload being the one that
+// finishes it, and to creating and completing direct uploads. A retry while
+// the first request is still being served is answered 409, a key reused for
+// another request 422. Server errors and answers to retry later, such as
+// the upload being locked or queued, are not kept: those requests may be
+// retried as they are. Keys are scoped to the Authorization header of the
+// request and kept by every replica on its own, in memory, at most
+// idempotencyMaxEntries of them and idempotencyMaxBytes of bodies: past
+// that the least recently used responses are forgotten first.
+const (
+	idempotencyKeep       = 24 * time.Hour
+	idempotencyMaxEntries = 10000
+	idempotencyMaxBytes   = 64 << 20
+	idempotencyMaxKey     = 255
+	idempotencyMaxBody    = 64 << 10
+	// idempotencyMaxRequest bounds the JSON bodies read to tell requests
+	// apart; tus requests are told apart by their headers.
+	idempotencyMaxRequest = 4 << 20
+)
+
+// idempotentHeaders are the request headers that tell tus requests with
+// the same key apart.
+var idempotentHeaders = []string{"Upload-Length", "Upload-Defer-Length", "Upload-Metadata", "Upload-Concat", "Upload-Offset", "Upload-Checksum", "Content-Length"}
+
+// idempotentResponse is the response to the first request with a key,
+// complete once done is closed.
+type idempotentResponse struct {
+	id      string
+	elem    *list.Element
+	request string
+	created time.Time
+	done    chan struct{}
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+var (
+	idempotencyMu       sync.Mutex
+	idempotentResponses = map[string]*idempotentResponse{}
+	// idempotencyLRU holds the responses, the most recently used first.
+	idempotencyLRU       = list.New()
+	idempotencyBytes     int
+	idempotencyLastPrune time.Time
+)
+
+// withIdempotency replays the response to the first request with the
+// Idempotency-Key of r to its retries.
+func withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > idempotencyMaxKey {
+			httpError(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		request, err := idempotentRequest(r)
+		if err != nil {
+			httpError(w, "Unable to read the request", http.StatusBadRequest)
+			return
+		}
+		scope := sha256.Sum256([]byte(r.Header.Get("Authorization") + "\n" + key))
+		id := hex.EncodeToString(scope[:])
+
+		idempotencyMu.Lock()
+		pruneIdempotentResponses()
+		first, seen := idempotentResponses[id]
+		if seen {
+			idempotencyLRU.MoveToFront(first.elem)
+		} else {
+			first = &idempotentResponse{id: id, request: request, created: time.Now(), done: make(chan struct{})}
+			first.elem = idempotencyLRU.PushFront(first)
+			idempotentResponses[id] = first
+		}
+		idempotencyMu.Unlock()
+
+		if seen {
+			switch {
+			case first.request != request:
+				httpErrorCode(w, "ERR_IDEMPOTENCY_KEY_REUSED", "Idempotency-Key was used for another request", http.StatusUnprocessableEntity)
+			case !isClosed(first.done):
+				w.Header().Set("Retry-After", "1")
+				httpErrorCode(w, "ERR_IDEMPOTENCY_KEY_IN_PROGRESS", "A request with this Idempotency-Key is in progress", http.StatusConflict)
+			default:
+				log.Printf("[%s] Replaying the response to Idempotency-Key %q", requestID(r), key)
+				for k, v := range first.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(first.status)
+				w.Write(first.body)
+			}
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		served := false
+		defer func() {
+			idempotencyMu.Lock()
+			defer idempotencyMu.Unlock()
+			retryLater := rec.status == http.StatusLocked || w.Header().Get("Retry-After") != ""
+			if !served || rec.status >= 500 || retryLater || rec.overflow {
+				forgetIdempotentResponse(first)
+			} else {
+				first.status, first.body = rec.status, rec.body.Bytes()
+				first.header = w.Header().Clone()
+				first.header.Del("X-Request-ID")
+				first.header.Del("Date")
+				idempotencyBytes += len(first.body)
+			}
+			close(first.done)
+			evictIdempotentResponses()
+		}()
+		next.ServeHTTP(rec, r)
+		served = true
+	})
+}
+
+// idempotentRequest describes r to tell it apart from other requests with
+// the same key: its method, path, tus headers and JSON body.
+func idempotentRequest(r *http.Request) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	for _, name := range idempotentHeaders {
+		io.WriteString(h, name+": "+r.Header.Get(name)+"\n")
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		body, err := io.ReadAll(io.LimitReader(r.Body, idempotencyMaxRequest))
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pruneIdempotentResponses forgets the responses kept longer than
+// idempotencyKeep, with idempotencyMu held.
+func pruneIdempotentResponses() {
+	if time.Since(idempotencyLastPrune) < time.Minute {
+		return
+	}
+	idempotencyLastPrune = time.Now()
+	cutoff := time.Now().Add(-idempotencyKeep)
+	for _, res := range idempotentResponses {
+		if res.created.Before(cutoff) && isClosed(res.done) {
+			forgetIdempotentResponse(res)
+		}
+	}
+}
+
+// evictIdempotentResponses forgets the least recently used responses while
+// more than idempotencyMaxEntries or idempotencyMaxBytes are kept, with
+// idempotencyMu held. Requests still being served are left alone.
+func evictIdempotentResponses() {
+	for e := idempotencyLRU.Back(); e != nil && (len(idempotentResponses) > idempotencyMaxEntries || idempotencyBytes > idempotencyMaxBytes); {
+		res := e.Value.(*idempotentResponse)
+		e = e.Prev()
+		if isClosed(res.done) {
+			forgetIdempotentResponse(res)
+		}
+	}
+}
+
+// forgetIdempotentResponse drops res, with idempotencyMu held.
+func forgetIdempotentResponse(res *idempotentResponse) {
+	if idempotentResponses[res.id] != res {
+		return
+	}
+	delete(idempotentResponses, res.id)
+	idempotencyLRU.Remove(res.elem)
+	idempotencyBytes -= len(res.body)
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// idempotencyRecorder keeps the status and body of a response, unless the
+// body is larger than idempotencyMaxBody.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+	written  bool
+}
+
+func (w *idempotencyRecorder) WriteHeader(status int) {
+	if !w.written {
+		w.written, w.status = true, status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyRecorder) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.body.Len()+len(p) > idempotencyMaxBody {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	// maxPendingWrite bounds the out-of-order data an ingestWriter holds in
+	// memory while waiting for the gap in front of it to be filled.
+	maxPendingWrite = 64 << 20
+	// ingestChunkSize is how much contiguous data is collected before it is
+	// written to the store as one chunk.
+	ingestChunkSize = 8 << 20
+)
+
+var errRandomWrite = errors.New("random access writes are not supported")
+
+// ingestWriter streams a file of unknown length, received through one of the
+// non-HTTP ingest protocols, into a new upload in the tus store. Closing the
+// writer declares the final length and hands the upload to finishUpload, so
+// these files end up exactly like tus uploads. Writes may arrive out of order
+// (SFTP clients pipeline them); data past the current offset is buffered until
+// the gap in front of it has been written.
+type ingestWriter struct {
+	ctx      context.Context
+	composer *tusd.StoreComposer
+	upload   tusd.Upload
+	info     tusd.FileInfo
+
+	mu       sync.Mutex
+	next     int64
+	buf      []byte
+	pending  map[int64][]byte
+	buffered int
+	closed   bool
+}
+
+func newIngestWriter(ctx context.Context, composer *tusd.StoreComposer, meta tusd.MetaData) (*ingestWriter, error) {
+	upload, err := composer.Core.NewUpload(ctx, tusd.FileInfo{SizeIsDeferred: true, MetaData: meta})
+	if err != nil {
+		return nil, err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Ingest upload %s started for %s", info.ID, meta["filename"])
+	return &ingestWriter{
+		ctx:      ctx,
+		composer: composer,
+		upload:   upload,
+		info:     info,
+		pending:  map[int64][]byte{},
+	}, nil
+}
+
+// Write appends p sequentially after the previously written data.
+func (w *ingestWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	off := w.next
+	w.mu.Unlock()
+	n, err := w.WriteAt(p, off)
+	w.mu.Lock()
+	w.next = off + int64(n)
+	w.mu.Unlock()
+	return n, err
+}
+
+func (w *ingestWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, errors.New("upload already closed")
+	}
+
+	end := w.end()
+	if off < end {
+		// Resent data we already have is accepted, rewriting it is not.
+		if off+int64(len(p)) <= end {
+			return len(p), nil
+		}
+		return 0, errRandomWrite
+	}
+	if off > end {
+		if _, ok := w.pending[off]; ok || w.buffered+len(p) > maxPendingWrite {
+			return 0, errRandomWrite
+		}
+		w.pending[off] = bytes.Clone(p)
+		w.buffered += len(p)
+		return len(p), nil
+	}
+
+	if err := w.append(p); err != nil {
+		return 0, err
+	}
+	for {
+		off := w.end()
+		data, ok := w.pending[off]
+		if !ok {
+			break
+		}
+		delete(w.pending, off)
+		w.buffered -= len(data)
+		if err := w.append(data); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// end returns the offset up to which contiguous data has been received.
+func (w *ingestWriter) end() int64 {
+	return w.info.Offset + int64(len(w.buf))
+}
+
+func (w *ingestWriter) append(p []byte) error {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < ingestChunkSize {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *ingestWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.upload.WriteChunk(w.ctx, w.info.Offset, bytes.NewReader(w.buf))
+	w.info.Offset += n
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return err
+}
+
+// Close finalizes the upload. If data is still missing, the upload is
+// discarded instead.
+func (w *ingestWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if len(w.pending) > 0 {
+		w.terminate()
+		return errors.New("upload is missing data")
+	}
+	if err := w.flush(); err != nil {
+		w.terminate()
+		return err
+	}
+	err := w.composer.LengthDeferrer.AsLengthDeclarableUpload(w.upload).DeclareLength(w.ctx, w.info.Offset)
+	if err == nil {
+		err = w.upload.FinishUpload(w.ctx)
+	}
+	if err != nil {
+		w.terminate()
+		return err
+	}
+	w.info.Size = w.info.Offset
+	w.info.SizeIsDeferred = false
+	finishUpload(w.info)
+	return nil
+}
+
+// Abort discards the upload without finalizing it.
+func (w *ingestWriter) Abort() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.terminate()
+}
+
+func (w *ingestWriter) terminate() {
+	log.Printf("Ingest upload %s aborted at %d bytes", w.info.ID, w.info.Offset)
+	if err := w.composer.Terminater.AsTerminatableUpload(w.upload).Terminate(w.ctx); err != nil {
+		log.Printf("Unable to remove upload %s: %s", w.info.ID, err.Error())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Clients send the modification time of the file on their device in the
+// "lastmodified" metadata, in milliseconds since the epoch like the
+// lastModified of a browser File. It is kept in the file index and listed
+// with the stored file, so footage can be sorted by when it was shot rather
+// than when it was uploaded, and with PRESERVE_MTIME it becomes the
+// modification time of the stored file. Tiering and retention still count
+// the age of such files from when they were stored.
+
+// clientLastModified returns the modification time the client sent for the
+// upload, zero if it sent none or one that cannot be right.
+func clientLastModified(meta tusd.MetaData) time.Time {
+	ms, err := strconv.ParseInt(meta["lastmodified"], 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}
+	}
+	t := time.UnixMilli(ms)
+	// Clocks of devices are off, but not by more than a day.
+	if t.After(time.Now().Add(24 * time.Hour)) {
+		return time.Time{}
+	}
+	return t
+}
+
+// keepLastModified records the modification time the client sent for the
+// upload info, stored as name at p, and applies it to the file with
+// PRESERVE_MTIME.
+func keepLastModified(info tusd.FileInfo, name, p string) {
+	t := clientLastModified(info.MetaData)
+	if t.IsZero() {
+		return
+	}
+	if storedFiles != nil {
+		storedFiles.setLastModified(name, t)
+	}
+	if PreserveMTime {
+		os.Chtimes(p, time.Time{}, t)
+	}
+}
+
+// storedSince returns when name, whose file has the modification time
+// modified, was stored: the modification time, unless it is the one the
+// client sent.
+func storedSince(name string, modified time.Time) time.Time {
+	if storedFiles == nil {
+		return modified
+	}
+	if rec, ok := storedFiles.get(name); ok && !rec.LastModified.IsZero() && rec.LastModified.Equal(modified) && !rec.Stored.IsZero() {
+		return rec.Stored
+	}
+	return modified
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Timings of the Kubernetes lease, those of client-go: a leader that could
+// not renew its lease for leaseRenewDeadline steps down, and the others take
+// over leaseDuration after its last renewal.
+const (
+	leaseDuration      = 15 * time.Second
+	leaseRenewDeadline = 10 * time.Second
+	leaseRetry         = 2 * time.Second
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// leaseTimeFormat is the MicroTime format of the Kubernetes API.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// leaderElector holds a coordination.k8s.io/v1 Lease, so that only one of
+// the replicas of a deployment runs the maintenance jobs on the shared
+// storage. It talks to the API server with the service account of the pod,
+// which needs get, create and update on leases in its namespace.
+type leaderElector struct {
+	client   *http.Client
+	url      string
+	name     string
+	identity string
+	leader   atomic.Bool
+}
+
+// lease is the part of a Lease object the elector uses. The metadata is
+// kept as is, so updates do not drop labels or annotations.
+type lease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   map[string]any `json:"metadata"`
+	Spec       leaseSpec      `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// leader is the elector of LEADER_ELECTION, nil without leader election:
+// every replica is then the leader.
+var leader *leaderElector
+
+// newLeaderElector sets up the election of the lease name in the namespace
+// of the pod, from the in-cluster configuration.
+func newLeaderElector(name string) (*leaderElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod")
+	}
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account CA certificate")
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		if identity, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	return &leaderElector{
+		client: &http.Client{
+			Timeout:   leaseRetry * 2,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		url:      fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), strings.TrimSpace(string(namespace))),
+		name:     name,
+		identity: identity,
+	}, nil
+}
+
+// isLeader reports whether this replica runs the maintenance jobs.
+func (e *leaderElector) isLeader() bool {
+	return e == nil || e.leader.Load()
+}
+
+// run keeps trying to acquire the lease, and renews it once held, until ctx
+// is done.
+func (e *leaderElector) run(ctx context.Context) {
+	var renewed time.Time
+	for {
+		held, err := e.tryAcquire(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Unable to renew the lease %s: %s", e.name, err.Error())
+			held = e.leader.Load() && time.Since(renewed) < leaseRenewDeadline
+		case held:
+			renewed = time.Now()
+		}
+		if held != e.leader.Swap(held) {
+			if held {
+				log.Printf("Acquired the lease %s, running the maintenance jobs", e.name)
+			} else {
+				log.Printf("Lost the lease %s, the maintenance jobs run on another replica", e.name)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaseRetry):
+		}
+	}
+}
+
+// tryAcquire creates the lease, takes it over once expired, or renews it,
+// and reports whether this replica holds it. Concurrent updates are refused
+// by the API server thanks to the resourceVersion in the metadata.
+func (e *leaderElector) tryAcquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+	var l lease
+	status, err := e.do(ctx, http.MethodGet, "/"+e.name, nil, &l)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		l = lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease", Metadata: map[string]any{"name": e.name}}
+		l.Spec = leaseSpec{HolderIdentity: e.identity, LeaseDurationSeconds: int(leaseDuration / time.Second),
+			AcquireTime: now.UTC().Format(leaseTimeFormat), RenewTime: now.UTC().Format(leaseTimeFormat)}
+		status, err = e.do(ctx, http.MethodPost, "", l, nil)
+		return status == http.StatusCreated, err
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("GET lease: %s", http.StatusText(status))
+	}
+	if l.Spec.HolderIdentity != e.identity && l.Spec.HolderIdentity != "" {
+		renew, _ := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+		if now.Before(renew.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second)) {
+			return false, nil
+		}
+	}
+	if l.Spec.HolderIdentity != e.identity {
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+	l.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+	status, err = e.do(ctx, http.MethodPut, "/"+e.name, l, nil)
+	if err != nil || status == http.StatusConflict {
+		return false, err
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("PUT lease: %s", http.StatusText(status))
+	}
+	return true, nil
+}
+
+// release gives the lease up on shutdown, so another replica takes over
+// without waiting for it to expire.
+func (e *leaderElector) release(ctx context.Context) {
+	if !e.leader.Swap(false) {
+		return
+	}
+	var l lease
+	if status, err := e.do(ctx, http.MethodGet, "/"+e.name, nil, &l); err != nil || status != http.StatusOK || l.Spec.HolderIdentity != e.identity {
+		return
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.LeaseDurationSeconds = 1
+	l.Spec.RenewTime = time.Now().UTC().Format(leaseTimeFormat)
+	if _, err := e.do(ctx, http.MethodPut, "/"+e.name, l, nil); err != nil {
+		log.Printf("Unable to release the lease %s: %s", e.name, err.Error())
+	}
+}
+
+// do sends a request to the leases endpoint and decodes successful
+// responses into out. The service account token is read on every request,
+// the kubelet rotates it.
+func (e *leaderElector) do(ctx context.Context, method, path string, in, out any) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, e.url+path, body)
+	if err != nil {
+		return 0, err
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 || out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
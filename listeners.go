@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Address families of LISTEN_FAMILY.
+const (
+	familyDual = "dual"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// listenNetwork returns the network of proto, "tcp" or "udp", restricted to
+// the address family of LISTEN_FAMILY. A dual-stack wildcard address like
+// ":8080" accepts both IPv4 and IPv6, where the system allows it; "tcp6"
+// sets IPV6_V6ONLY.
+func listenNetwork(proto string) string {
+	switch ListenFamily {
+	case familyIPv4:
+		return proto + "4"
+	case familyIPv6:
+		return proto + "6"
+	}
+	return proto
+}
+
+// listenTCP listens on the TCP address addr in the address family of
+// LISTEN_FAMILY.
+func listenTCP(addr string) (net.Listener, error) {
+	return net.Listen(listenNetwork("tcp"), addr)
+}
+
+// listenerAddr describes the address a listener got, with the address
+// families it accepts, for the startup log.
+func listenerAddr(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return addr.String()
+	}
+	family := "IPv6"
+	switch {
+	case ip.To4() != nil:
+		family = "IPv4"
+	case ip.IsUnspecified() && ListenFamily != familyIPv6:
+		family = "IPv4 and IPv6"
+	}
+	return addr.String() + " (" + family + ")"
+}
+
+// listenPublic listens on addr for the upload API, behind the PROXY
+// protocol if enabled.
+func listenPublic(addr string) net.Listener {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		log.Fatalf("Listen: %v", err)
+	}
+	if ProxyProtocol {
+		ln = &proxyListener{Listener: ln, trusted: ProxyProtocolTrusted}
+	}
+	return ln
+}
+
+// redirectToHTTPS sends the clients of the plaintext listener to
+// HTTPS_LISTEN with a 308, which keeps the method and body of uploads. The
+// readiness probe is answered as is, probes rarely follow redirects.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ready" {
+		readyHandler(w, r)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if _, port, err := net.SplitHostPort(HTTPSListen); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u := *r.URL
+	u.Scheme = "https"
+	u.Host = host
+	http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+}
+
+// isLoopback reports whether the TCP address addr only accepts local
+// connections.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
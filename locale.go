@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The messages the server writes for people, on the upload page, in its
+// service worker and on the receipts, come in the languages of messages.
+// UI_LANGUAGE picks the language of every response, Russian by default,
+// or "auto" to pick it from the Accept-Language header of every request,
+// falling back on Russian. The messages of the API errors are in English,
+// clients tell them apart by their code. The page and its scripts take
+// their messages from /messages.js, with placeholders like "{name}"
+// replaced by t; the HTML of the page has them as "[[key]]".
+const (
+	languageRussian = "ru"
+	languageEnglish = "en"
+	languageAuto    = "auto"
+)
+
+var messages = map[string]map[string]string{
+	languageRussian: {
+		"page_title":         "Загрузка файлов через TUS",
+		"metered_warning":    "Мобильное соединение: загрузка будет расходовать трафик.",
+		"dropzone":           "Перетащите видео сюда или нажмите, чтобы выбрать файлы",
+		"upload":             "Загрузить",
+		"record_video":       "Записать видео",
+		"byte_units":         "Б КБ МБ ГБ ТБ",
+		"bytes_of":           "{done} из {total}",
+		"deadline_passed":    "— время на загрузку истекло",
+		"deadline_minutes":   "— загрузка должна завершиться через {minutes} мин",
+		"queued_position":    "— в очереди: позиция {position}",
+		"queued_start":       ", старт около {time}",
+		"queued":             "— в очереди",
+		"receipt":            "Квитанция",
+		"receipt_for":        "Квитанция: {name}",
+		"uploads":            "Загрузки",
+		"progress_announce":  "{name}: {percent}%",
+		"files_selected":     "Выбрано файлов: {count}",
+		"choose_again":       ", выберите файл снова",
+		"choose_to_continue": "— выберите файл снова, чтобы продолжить",
+		"removed_by_server":  "— незавершённая загрузка удалена сервером",
+		"choose_files":       "Выберите файл(ы) для загрузки.",
+		"delivery_waiting":   "Отправка из {files} файлов: ожидание",
+		"delivery_progress":  "Отправка: сохранено {stored} из {files} файлов, {percent}% ({done} из {total})",
+		"delivery_complete":  "Отправка из {files} файлов завершена",
+		"metered_confirm":    "Вы подключены через мобильную сеть. Будет передано {size}. Продолжить?",
+		"uploaded":           "Файл {name} загружен успешно!",
+		"in_other_tab":       "Файл {name} уже загружается в другой вкладке или окне.",
+		"file_error":         "Ошибка: {name}: {error}",
+		"error":              "Ошибка: {error}",
+		"offline":            "Нет соединения, загрузка продолжится автоматически.",
+		"uploading_in_tab":   "файл уже загружается в другой вкладке",
+		"wrong_chunk":        "сервер получил не тот фрагмент",
+		"chunk_corrupted":    "фрагмент повреждён при передаче",
+		"my_uploads":         "Мои загрузки",
+		"history_status":     "Состояние",
+		"history_time":       "Время",
+		"history_actions":    "Действия",
+		"history_stored":     "сохранён",
+		"history_flagged":    "заблокирован проверкой",
+		"history_uploading":  "загружается",
+		"history_alive":      "приостановлен",
+		"history_abandoned":  "прерван",
+		"history_download":   "Скачать",
+		"history_share":      "Поделиться",
+		"history_sign_in":    "Войдите, чтобы увидеть свои загрузки.",
+		"history_empty":      "Загрузок пока нет.",
+		"link_copied":        "Ссылка на {name} скопирована.",
+		"override_offer":     "Файл {name} больше разрешённого.",
+		"override_request":   "Попросить увеличить лимит",
+		"override_reason":    "Зачем нужно загрузить {name} ({size})?",
+		"override_requested": "Запрос отправлен администратору.",
+		"override_approved":  "Лимит увеличен до {size} до {until}, загрузите файл снова.",
+		"override_denied":    "Администратор отклонил запрос на увеличение лимита.",
+
+		"receipt_title":     "Квитанция о загрузке",
+		"receipt_file":      "Файл",
+		"receipt_size":      "Размер",
+		"receipt_bytes":     "байт",
+		"receipt_received":  "Получен",
+		"receipt_user":      "Пользователь",
+		"receipt_role":      "Роль",
+		"receipt_country":   "Страна",
+		"receipt_upload":    "Загрузка",
+		"receipt_signature": "Подпись",
+		"receipt_verify":    "Подпись ed25519 проверяется по JSON-версии квитанции и ключу /api/receipts/key.",
+	},
+	languageEnglish: {
+		"page_title":         "File upload via TUS",
+		"metered_warning":    "Mobile connection: the upload will use your data plan.",
+		"dropzone":           "Drop videos here or click to choose files",
+		"upload":             "Upload",
+		"record_video":       "Record video",
+		"byte_units":         "B KB MB GB TB",
+		"bytes_of":           "{done} of {total}",
+		"deadline_passed":    "— the time to upload is over",
+		"deadline_minutes":   "— the upload must complete within {minutes} min",
+		"queued_position":    "— queued: position {position}",
+		"queued_start":       ", starting around {time}",
+		"queued":             "— queued",
+		"receipt":            "Receipt",
+		"receipt_for":        "Receipt: {name}",
+		"uploads":            "Uploads",
+		"progress_announce":  "{name}: {percent}%",
+		"files_selected":     "Files selected: {count}",
+		"choose_again":       ", choose the file again",
+		"choose_to_continue": "— choose the file again to continue",
+		"removed_by_server":  "— the incomplete upload was removed by the server",
+		"choose_files":       "Choose the file(s) to upload.",
+		"delivery_waiting":   "Delivery of {files} files: waiting",
+		"delivery_progress":  "Delivery: {stored} of {files} files stored, {percent}% ({done} of {total})",
+		"delivery_complete":  "Delivery of {files} files complete",
+		"metered_confirm":    "You are on a mobile network. {size} will be sent. Continue?",
+		"uploaded":           "File {name} uploaded successfully!",
+		"in_other_tab":       "File {name} is already being uploaded in another tab or window.",
+		"file_error":         "Error: {name}: {error}",
+		"error":              "Error: {error}",
+		"offline":            "No connection, the upload will continue by itself.",
+		"uploading_in_tab":   "the file is already being uploaded in another tab",
+		"wrong_chunk":        "the server received the wrong chunk",
+		"chunk_corrupted":    "the chunk was corrupted on the way",
+		"my_uploads":         "My uploads",
+		"history_status":     "Status",
+		"history_time":       "Time",
+		"history_actions":    "Actions",
+		"history_stored":     "stored",
+		"history_flagged":    "blocked by the scan",
+		"history_uploading":  "uploading",
+		"history_alive":      "paused",
+		"history_abandoned":  "abandoned",
+		"history_download":   "Download",
+		"history_share":      "Share",
+		"history_sign_in":    "Sign in to see your uploads.",
+		"history_empty":      "No uploads yet.",
+		"link_copied":        "The link to {name} was copied.",
+		"override_offer":     "The file {name} is over the limit.",
+		"override_request":   "Ask for a higher limit",
+		"override_reason":    "Why do you need to upload {name} ({size})?",
+		"override_requested": "The request was sent to an administrator.",
+		"override_approved":  "The limit is raised to {size} until {until}, upload the file again.",
+		"override_denied":    "An administrator refused to raise the limit.",
+
+		"receipt_title":     "Upload receipt",
+		"receipt_file":      "File",
+		"receipt_size":      "Size",
+		"receipt_bytes":     "bytes",
+		"receipt_received":  "Received",
+		"receipt_user":      "User",
+		"receipt_role":      "Role",
+		"receipt_country":   "Country",
+		"receipt_upload":    "Upload",
+		"receipt_signature": "Signature",
+		"receipt_verify":    "The ed25519 signature is verified against the JSON receipt and the key /api/receipts/key.",
+	},
+}
+
+// requestLanguage returns the language of the response to r.
+func requestLanguage(r *http.Request) string {
+	if Language != languageAuto {
+		return Language
+	}
+	// The first language of the header we have messages in; the quality
+	// values are left aside, browsers list the languages by preference.
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), ";")
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := messages[primary]; ok {
+			return primary
+		}
+	}
+	return languageRussian
+}
+
+// setLanguage sets the headers of a response in lang.
+func setLanguage(w http.ResponseWriter, lang string) {
+	w.Header().Set("Content-Language", lang)
+	if Language == languageAuto {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+}
+
+// localizePage replaces the "[[key]]" placeholders of the HTML page with
+// the messages in lang.
+func localizePage(page, lang string) string {
+	pairs := []string{"[[lang]]", lang}
+	for key, text := range messages[lang] {
+		pairs = append(pairs, "[["+key+"]]", html.EscapeString(text))
+	}
+	return strings.NewReplacer(pairs...).Replace(page)
+}
+
+// messagesHandler serves /messages.js, the messages of the page and its
+// service worker in the language of the request.
+func messagesHandler(w http.ResponseWriter, r *http.Request) {
+	lang := requestLanguage(r)
+	data, _ := json.Marshal(messages[lang])
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	setLanguage(w, lang)
+	fmt.Fprintf(w, messagesJS, lang, data)
+}
+
+const messagesJS = `var LANG = %q;
+var MESSAGES = %s;
+// t returns the message key with its {placeholders} replaced by args.
+function t(key, args){
+    var text = MESSAGES[key] || key;
+    return text.replace(/\{(\w+)\}/g, function(m, name){
+        return args && name in args ? String(args[name]) : m;
+    });
+}
+`
+
+// languages are the values of UI_LANGUAGE.
+func languages() []string {
+	langs := []string{languageAuto}
+	for lang := range messages {
+		langs = append(langs, lang)
+	}
+	slices.Sort(langs)
+	return langs
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Login audit events, published to <MQTT_TOPIC_PREFIX>/auth.
+const (
+	authLoginSucceeded = "login_succeeded"
+	authLoginFailed    = "login_failed"
+	authLockedOut      = "locked_out"
+	authLoginBlocked   = "login_blocked"
+)
+
+// authEvent is the JSON payload of a login audit event.
+type authEvent struct {
+	Event    string    `json:"event"`
+	Service  string    `json:"service"`
+	Address  string    `json:"address"`
+	User     string    `json:"user,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	Failures int       `json:"failures,omitempty"`
+	Until    time.Time `json:"until,omitzero"`
+	Time     time.Time `json:"time"`
+}
+
+type loginFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+	// user is the user name of the last failed login.
+	user string
+}
+
+// loginGuard counts the failed password logins of each client address.
+// After LoginMaxFailures failures within LoginLockout the address is locked
+// out for LoginLockout, during which its logins are refused without the
+// password being checked.
+type loginGuard struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+var logins = &loginGuard{failures: map[string]*loginFailures{}}
+
+// locked reports whether the client at addr is locked out. A login refused
+// for it is audited.
+func (g *loginGuard) locked(service string, addr net.Addr, user string) bool {
+	if LoginMaxFailures == 0 {
+		return false
+	}
+	host := addrHost(addr)
+	g.mu.Lock()
+	var until time.Time
+	if f := g.failures[host]; f != nil {
+		until = f.lockedUntil
+	}
+	g.mu.Unlock()
+	locked := time.Now().Before(until)
+	if locked {
+		auditLogin(authEvent{Event: authLoginBlocked, Service: service, Address: host, User: user, Until: until})
+	}
+	return locked
+}
+
+// failed records a failed login from addr, locking the client out when it
+// reaches LoginMaxFailures.
+func (g *loginGuard) failed(service string, addr net.Addr, user string) {
+	host := addrHost(addr)
+	now := time.Now()
+	event := authEvent{Event: authLoginFailed, Service: service, Address: host, User: user}
+	var lockout *authEvent
+	if LoginMaxFailures > 0 {
+		g.mu.Lock()
+		g.pruneLocked(now)
+		f := g.failures[host]
+		if f == nil {
+			f = &loginFailures{first: now}
+			g.failures[host] = f
+		}
+		f.count++
+		f.user = user
+		event.Failures = f.count
+		if f.count >= LoginMaxFailures {
+			f.lockedUntil = now.Add(LoginLockout)
+			lockout = &authEvent{Event: authLockedOut, Service: service, Address: host, User: user, Failures: f.count, Until: f.lockedUntil}
+		}
+		g.mu.Unlock()
+	}
+	auditLogin(event)
+	if lockout != nil {
+		auditLogin(*lockout)
+	}
+}
+
+// succeeded records a successful login from addr, which clears its failures.
+func (g *loginGuard) succeeded(service string, addr net.Addr, user string) {
+	host := addrHost(addr)
+	g.mu.Lock()
+	delete(g.failures, host)
+	g.mu.Unlock()
+	auditLogin(authEvent{Event: authLoginSucceeded, Service: service, Address: host, User: user})
+}
+
+// pruneLocked forgets the failures that no longer count: those older than
+// LoginLockout, unless the client is still locked out.
+func (g *loginGuard) pruneLocked(now time.Time) {
+	for host, f := range g.failures {
+		if now.Sub(f.first) > LoginLockout && now.After(f.lockedUntil) {
+			delete(g.failures, host)
+		}
+	}
+}
+
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// auditLogin logs a login event and publishes it if MQTT_URL is set.
+// Successful logins are left to the services to log. With
+// LOGIN_LOG_FORMAT=fail2ban the failures are logged as
+//
+//	authentication failure for <user> from <address> service=<service>
+//
+// for a fail2ban filter like
+//
+//	failregex = authentication failure for .* from <HOST> service=
+func auditLogin(e authEvent) {
+	e.Time = time.Now()
+	e.Country = countryOfHost(e.Address)
+	address := e.Address
+	if e.Country != "" {
+		address += " (" + e.Country + ")"
+	}
+	switch {
+	case LoginLogFormat == "fail2ban" && (e.Event == authLoginFailed || e.Event == authLoginBlocked):
+		log.Printf("authentication failure for %s from %s service=%s", e.User, e.Address, e.Service)
+	case e.Event == authLoginFailed:
+		log.Printf("%s login from %s as %s rejected", e.Service, address, e.User)
+	case e.Event == authLoginBlocked:
+		log.Printf("%s login from %s as %s refused, locked out until %s", e.Service, address, e.User, e.Until.Format(time.RFC3339))
+	}
+	if e.Event == authLockedOut {
+		log.Printf("%s: %s locked out after %d failed logins until %s", e.Service, address, e.Failures, e.Until.Format(time.RFC3339))
+	}
+	if mqttEvents == nil {
+		return
+	}
+	if payload, err := json.Marshal(e); err == nil {
+		mqttEvents.publish(MQTTTopicPrefix+"/auth", payload)
+	}
+}
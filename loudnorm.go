@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// loudnormInfix is inserted before the extension of a video to name its
+// normalized rendition: clip.mp4 becomes clip.loudnorm.mp4.
+const loudnormInfix = ".loudnorm"
+
+// loudnormFormat is how renditions of videos with an extension are written:
+// the ffmpeg muxer, as the partial file's name does not tell ffmpeg, and the
+// codec the normalized audio is encoded with.
+type loudnormFormat struct {
+	muxer, audioCodec string
+}
+
+var loudnormFormats = map[string]loudnormFormat{
+	".mp4":  {"mp4", "aac"},
+	".m4v":  {"mp4", "aac"},
+	".mov":  {"mov", "aac"},
+	".mkv":  {"matroska", "aac"},
+	".webm": {"webm", "libopus"},
+	".avi":  {"avi", "aac"},
+	".ts":   {"mpegts", "aac"},
+	".mxf":  {"mxf", "pcm_s24le"},
+}
+
+var (
+	loudnormMu sync.Mutex
+	// loudnormFailed remembers the videos ffmpeg failed on, such as videos
+	// without audio, so they are not tried again on every run.
+	loudnormFailed = map[string]bool{}
+)
+
+// normalizeLoudness is the "loudnorm" job. It writes a rendition of every
+// stored video that has none yet, with the loudness of the first audio
+// track normalized to LoudnormTarget LUFS (EBU R128 by default) by ffmpeg's
+// loudnorm filter, next to the original. All other streams are copied
+// unchanged. The renditions are stored files of their own. The original is
+// annotated with its measured "loudness" in LUFS.
+func normalizeLoudness(ctx context.Context) (string, error) {
+	loudnormMu.Lock()
+	defer loudnormMu.Unlock()
+	done := 0
+	err := filepath.WalkDir(UploadPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ext := strings.ToLower(path.Ext(p))
+		if _, ok := loudnormFormats[ext]; !ok || strings.HasSuffix(strings.TrimSuffix(p, path.Ext(p)), loudnormInfix) {
+			return nil
+		}
+		rel, _ := filepath.Rel(UploadPath, p)
+		name := filepath.ToSlash(rel)
+		rendition := loudnormRendition(name)
+		if loudnormFailed[name] {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(UploadPath, filepath.FromSlash(rendition))); !os.IsNotExist(err) {
+			return nil
+		}
+		if err := writeLoudnormRendition(ctx, name, rendition); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Unable to normalize the loudness of %s: %s", name, err.Error())
+			loudnormFailed[name] = true
+			return nil
+		}
+		log.Printf("Wrote loudness normalized rendition %s", rendition)
+		done++
+		return nil
+	})
+	if done == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("normalized %d videos", done), err
+}
+
+// loudnormRendition returns the name of the rendition of the video name.
+func loudnormRendition(name string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + loudnormInfix + ext
+}
+
+// loudnormMeasurement is what the first loudnorm pass reports about the
+// input, fed back into the second pass for a linear normalization.
+type loudnormMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+func writeLoudnormRendition(ctx context.Context, name, rendition string) error {
+	src := filepath.Join(UploadPath, filepath.FromSlash(name))
+	dst := filepath.Join(UploadPath, filepath.FromSlash(rendition))
+	format := loudnormFormats[strings.ToLower(path.Ext(name))]
+	target := fmt.Sprintf("I=%g:TP=%g:LRA=%g", LoudnormTarget, LoudnormTruePeak, LoudnormRange)
+
+	out, err := runFFmpeg(ctx, "-hide_banner", "-nostdin", "-i", src, "-map", "0:a:0",
+		"-af", "loudnorm="+target+":print_format=json", "-f", "null", "-")
+	if err != nil {
+		return err
+	}
+	// The measurement is the last JSON object ffmpeg prints.
+	start, end := bytes.LastIndexByte(out, '{'), bytes.LastIndexByte(out, '}')
+	var m loudnormMeasurement
+	if start < 0 || end < start {
+		return fmt.Errorf("no loudnorm measurement in the ffmpeg output")
+	}
+	if err := json.Unmarshal(out[start:end+1], &m); err != nil {
+		return fmt.Errorf("loudnorm measurement: %w", err)
+	}
+	annotateStored(name, "loudness", m.InputI)
+
+	tmp := dst + ".tmp"
+	defer os.Remove(tmp)
+	filter := fmt.Sprintf("loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		target, m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset)
+	if _, err := runFFmpeg(ctx, "-hide_banner", "-nostdin", "-y", "-i", src, "-map", "0", "-c", "copy",
+		"-filter:a:0", filter, "-c:a:0", format.audioCodec, "-ar:a:0", "48000", "-f", format.muxer, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	if storedFiles != nil {
+		stat, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(dst)
+		if err != nil {
+			log.Printf("Unable to hash %s: %s", rendition, err.Error())
+		}
+		storedFiles.record(rendition, stat.Size(), sum)
+	}
+	if replication != nil {
+		replication.enqueue(rendition)
+		if ChecksumSidecars && storedFiles != nil {
+			replication.enqueue(rendition + checksumSuffix)
+		}
+	}
+	return nil
+}
+
+// runFFmpeg runs FFmpegPath with args and returns what it wrote to stderr,
+// where ffmpeg reports filter output such as the loudnorm measurement.
+func runFFmpeg(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, FFmpegPath, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// The last line usually says what went wrong.
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return nil, fmt.Errorf("%w: %s", err, lines[len(lines)-1])
+	}
+	return stderr.Bytes(), nil
+}
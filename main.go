@@ -2,26 +2,195 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"github.com/tus/tusd/v2/pkg/filelocker"
 	"github.com/tus/tusd/v2/pkg/filestore"
 	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/memorylocker"
 )
 
 var (
 	UploadPath     string
 	TempUploadPath string
 	BaseURL        string
+	ResumableURL   string
+	S3Addr         string
+	S3AccessKey    string
+	S3SecretKey    string
+
+	SFTPAddr           string
+	SFTPHostKey        string
+	SFTPUser           string
+	SFTPPassword       string
+	SFTPAuthorizedKeys string
+
+	FTPAddr         string
+	FTPUser         string
+	FTPPassword     string
+	FTPTLSCert      string
+	FTPTLSKey       string
+	FTPRequireTLS   bool
+	FTPPassivePorts string
+	FTPPublicHost   string
+
+	WebDAVEnabled bool
+
+	AssemblyMode   string
+	AssemblyVerify string
+
+	HTTPListen     string
+	HTTPSListen    string
+	TLSRedirect    bool
+	ListenFamily   string
+	TLSCert        string
+	TLSKey         string
+	HTTP2Cleartext bool
+	HTTP3Enabled   bool
+
+	ProxyProtocol        bool
+	ProxyProtocolTrusted []*net.IPNet
+
+	StorageBackend string
+
+	ReplicaTarget string
+	ReplicaS3     s3Remote
+
+	WatchFolder string
+
+	TieringTarget string
+	TieringS3     s3Remote
+	TieringAfter  time.Duration
+	DirectUploads bool
+
+	UploadExpiry         time.Duration
+	ExpiryWarning        time.Duration
+	UploadDeadline       time.Duration
+	TruncatedUploadGrace time.Duration
+	FailedUploadGrace    time.Duration
+	RetentionPeriod      time.Duration
+	AdminListen          string
+	QuarantinePath       string
+
+	ShutdownDrain         time.Duration
+	ShutdownTimeout       time.Duration
+	ReadyMaxPendingStores int
+	LeaderElectionLease   string
+
+	AllowedExtensions []string
+	BlockedExtensions []string
+
+	ICAPServer   *url.URL
+	ICAPFailOpen bool
+	ICAPTimeout  time.Duration
+
+	VirusTotalAPIKey string
+	VirusTotalRate   int
+
+	SanitizeImages bool
+
+	LoudnormEnabled  bool
+	LoudnormTarget   float64
+	LoudnormTruePeak float64
+	LoudnormRange    float64
+	FFmpegPath       string
+
+	PreviewsEnabled  bool
+	PreviewPath      string
+	PreviewHeight    int
+	PreviewBitrate   int
+	PreviewRetention time.Duration
+
+	ChunkSizeMin         int64
+	ChunkSizeMax         int64
+	ChunkSeconds         int
+	UploadConcurrency    int
+	UploadRetryDelays    []time.Duration
+	UploadRequestTimeout time.Duration
+	SpeedTestSize        int64
+	StreamBuffer         int64
+
+	ChecksumSidecars bool
+	MetadataSidecars string
+	PreserveMTime    bool
+	ChunkEcho        bool
+	ChunkHash        string
+
+	ReceiptsEnabled bool
+	ReceiptKey      string
+
+	CompletionFields  []string
+	CompletionMessage *template.Template
+	DownloadURL       *template.Template
+
+	Language string
+	Branding *brand
+
+	NameCollisions  string
+	NameSuffixBytes int
+
+	S3AllowedReferers []string
+	S3DownloadSecret  string
+	S3PublicURL       string
+
+	DiskWriteSlots        int
+	UploadPriorityWeights map[string]float64
+	ExpressUploadSize     int64
+
+	TempAlertTotal   int64
+	TempAlertSession int64
+	TempAlertWebhook string
+	DeliveryWebhook  string
+
+	SpaceReservation bool
+	SpaceHeadroom    int64
+
+	UploadWindows       []uploadWindow
+	UploadWindowMinSize int64
+	MaxActiveUploads    int
+
+	ParityGroup int
+
+	StatsdAddr     string
+	StatsdPrefix   string
+	StatsdTags     []string
+	StatsdInterval time.Duration
+
+	MQTTBroker      *url.URL
+	MQTTTopicPrefix string
+	MQTTClientID    string
+
+	UploadPolicies  []*uploadPolicy
+	RoutingRules    []*routingRule
+	ConversionRules []*conversionRule
+
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+	LoginLogFormat   string
+
+	GeoIPAllowCountries []string
+	GeoIPDenyCountries  []string
+
+	UploadPinning string
+
+	ValidationWebhook string
 )
 
 func init() {
@@ -37,11 +206,626 @@ func init() {
 	}
 	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
 		BaseURL = baseURL + "/files/"
+		ResumableURL = baseURL + "/resumable/"
 	} else {
 		BaseURL = "/files/"
+		ResumableURL = "/resumable/"
+	}
+	S3Addr = os.Getenv("S3_LISTEN")
+	S3AccessKey = os.Getenv("S3_ACCESS_KEY")
+	S3SecretKey = os.Getenv("S3_SECRET_KEY")
+	if S3Addr != "" && (S3AccessKey == "" || S3SecretKey == "") {
+		log.Fatalf("S3_LISTEN needs S3_ACCESS_KEY and S3_SECRET_KEY")
+	}
+	SFTPAddr = os.Getenv("SFTP_LISTEN")
+	if hostKey := os.Getenv("SFTP_HOST_KEY"); hostKey != "" {
+		SFTPHostKey = hostKey
+	} else {
+		SFTPHostKey = filepath.Join(TempUploadPath, "sftp_host_ed25519_key")
+	}
+	if user := os.Getenv("SFTP_USER"); user != "" {
+		SFTPUser = user
+	} else {
+		SFTPUser = "upload"
+	}
+	SFTPPassword = os.Getenv("SFTP_PASSWORD")
+	SFTPAuthorizedKeys = os.Getenv("SFTP_AUTHORIZED_KEYS")
+	FTPAddr = os.Getenv("FTP_LISTEN")
+	if user := os.Getenv("FTP_USER"); user != "" {
+		FTPUser = user
+	} else {
+		FTPUser = "upload"
+	}
+	FTPPassword = os.Getenv("FTP_PASSWORD")
+	FTPTLSCert = os.Getenv("FTP_TLS_CERT")
+	FTPTLSKey = os.Getenv("FTP_TLS_KEY")
+	FTPRequireTLS = os.Getenv("FTP_REQUIRE_TLS") == "true"
+	FTPPassivePorts = os.Getenv("FTP_PASV_PORTS")
+	FTPPublicHost = os.Getenv("FTP_PUBLIC_HOST")
+	WebDAVEnabled = os.Getenv("WEBDAV_ENABLED") == "true"
+	switch mode := os.Getenv("ASSEMBLY_MODE"); mode {
+	case "", assemblyCopy:
+		AssemblyMode = assemblyCopy
+	case assemblyMmap, assemblyVectored:
+		AssemblyMode = mode
+		if !slices.Contains(assemblyModes, mode) {
+			log.Printf("ASSEMBLY_MODE %s is not supported on this system, using copy", mode)
+			AssemblyMode = assemblyCopy
+		}
+	default:
+		log.Printf("Unknown ASSEMBLY_MODE %s, using copy", mode)
+		AssemblyMode = assemblyCopy
+	}
+	switch level := os.Getenv("ASSEMBLY_VERIFY"); level {
+	case "":
+		AssemblyVerify = verifySize
+	case verifyNone, verifySize, verifyChunks, verifyFull:
+		AssemblyVerify = level
+	default:
+		log.Fatalf("Invalid ASSEMBLY_VERIFY: %s", level)
+	}
+	TLSCert = os.Getenv("TLS_CERT")
+	TLSKey = os.Getenv("TLS_KEY")
+	if HTTPListen = os.Getenv("HTTP_LISTEN"); HTTPListen == "" {
+		HTTPListen = ":8080"
+	}
+	HTTPSListen = os.Getenv("HTTPS_LISTEN")
+	if HTTPSListen != "" && TLSCert == "" {
+		log.Fatalf("HTTPS_LISTEN requires TLS_CERT and TLS_KEY")
+	}
+	TLSRedirect = os.Getenv("TLS_REDIRECT") == "true"
+	switch family := os.Getenv("LISTEN_FAMILY"); family {
+	case "", familyDual:
+		ListenFamily = familyDual
+	case familyIPv4, familyIPv6:
+		ListenFamily = family
+	default:
+		log.Fatalf("Unknown LISTEN_FAMILY %s", family)
+	}
+	if TLSRedirect && HTTPSListen == "" {
+		log.Fatalf("TLS_REDIRECT requires HTTPS_LISTEN")
+	}
+	HTTP2Cleartext = os.Getenv("HTTP2_CLEARTEXT") == "true"
+	HTTP3Enabled = os.Getenv("HTTP3_ENABLED") == "true"
+	ProxyProtocol = os.Getenv("PROXY_PROTOCOL") == "true"
+	if trusted, err := parseCIDRs(os.Getenv("PROXY_PROTOCOL_TRUSTED")); err != nil {
+		log.Fatalf("Invalid PROXY_PROTOCOL_TRUSTED: %s", err.Error())
+	} else {
+		ProxyProtocolTrusted = trusted
+	}
+	// Without them anybody could claim any address, and with it the
+	// policies, pins and limits of another client.
+	if ProxyProtocol && len(ProxyProtocolTrusted) == 0 {
+		log.Fatalf("PROXY_PROTOCOL needs PROXY_PROTOCOL_TRUSTED")
+	}
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", storageFile:
+		StorageBackend = storageFile
+	case storageMemory, storageDiscard:
+		StorageBackend = backend
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %s", backend)
+	}
+	ReplicaTarget = os.Getenv("REPLICA_TARGET")
+	WatchFolder = os.Getenv("WATCH_FOLDER")
+	ReplicaS3 = s3RemoteFromEnv("REPLICA")
+	TieringTarget = os.Getenv("TIERING_TARGET")
+	TieringS3 = s3RemoteFromEnv("TIERING")
+	DirectUploads = os.Getenv("DIRECT_UPLOADS") == "true"
+	if DirectUploads && !strings.HasPrefix(TieringTarget, "s3://") {
+		log.Fatalf("DIRECT_UPLOADS requires an s3:// TIERING_TARGET")
+	}
+	if days := os.Getenv("TIERING_AFTER_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid TIERING_AFTER_DAYS: %s", days)
+		}
+		TieringAfter = time.Duration(n) * 24 * time.Hour
+	} else {
+		TieringAfter = 30 * 24 * time.Hour
+	}
+	if hours := os.Getenv("INCOMPLETE_UPLOAD_EXPIRY_HOURS"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid INCOMPLETE_UPLOAD_EXPIRY_HOURS: %s", hours)
+		}
+		UploadExpiry = time.Duration(n) * time.Hour
+	} else {
+		UploadExpiry = 7 * 24 * time.Hour
+	}
+	if minutes := os.Getenv("EXPIRY_WARNING_MINUTES"); minutes != "" {
+		n, err := strconv.Atoi(minutes)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid EXPIRY_WARNING_MINUTES: %s", minutes)
+		}
+		ExpiryWarning = time.Duration(n) * time.Minute
+	} else {
+		ExpiryWarning = time.Hour
+	}
+	if hours := os.Getenv("UPLOAD_DEADLINE_HOURS"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid UPLOAD_DEADLINE_HOURS: %s", hours)
+		}
+		UploadDeadline = time.Duration(n) * time.Hour
+	}
+	if hours := os.Getenv("TRUNCATED_UPLOAD_GRACE_HOURS"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid TRUNCATED_UPLOAD_GRACE_HOURS: %s", hours)
+		}
+		TruncatedUploadGrace = time.Duration(n) * time.Hour
+	} else {
+		TruncatedUploadGrace = 24 * time.Hour
+	}
+	if hours := os.Getenv("FAILED_UPLOAD_GRACE_HOURS"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid FAILED_UPLOAD_GRACE_HOURS: %s", hours)
+		}
+		FailedUploadGrace = time.Duration(n) * time.Hour
+	} else {
+		FailedUploadGrace = 24 * time.Hour
+	}
+	if days := os.Getenv("RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid RETENTION_DAYS: %s", days)
+		}
+		RetentionPeriod = time.Duration(n) * 24 * time.Hour
+	}
+	AdminListen = os.Getenv("ADMIN_LISTEN")
+	if seconds := os.Getenv("SHUTDOWN_DRAIN_SECONDS"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid SHUTDOWN_DRAIN_SECONDS: %s", seconds)
+		}
+		ShutdownDrain = time.Duration(n) * time.Second
+	}
+	if seconds := os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid SHUTDOWN_TIMEOUT_SECONDS: %s", seconds)
+		}
+		ShutdownTimeout = time.Duration(n) * time.Second
+	} else {
+		ShutdownTimeout = 10 * time.Second
+	}
+	if limit := os.Getenv("READY_MAX_PENDING_STORES"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid READY_MAX_PENDING_STORES: %s", limit)
+		}
+		ReadyMaxPendingStores = n
+	} else {
+		ReadyMaxPendingStores = finishQueueSize
+	}
+	LeaderElectionLease = os.Getenv("LEADER_ELECTION_LEASE")
+	QuarantinePath = os.Getenv("QUARANTINE_PATH")
+	AllowedExtensions = parseExtensions(os.Getenv("ALLOWED_EXTENSIONS"))
+	if blocked, ok := os.LookupEnv("BLOCKED_EXTENSIONS"); ok {
+		BlockedExtensions = parseExtensions(blocked)
+	} else {
+		BlockedExtensions = defaultBlockedExtensions
+	}
+	if raw := os.Getenv("ICAP_URL"); raw != "" {
+		u, err := parseICAPURL(raw)
+		if err != nil {
+			log.Fatalf("Invalid ICAP_URL %s: %s", raw, err.Error())
+		}
+		ICAPServer = u
+	}
+	ICAPFailOpen = os.Getenv("ICAP_FAIL_OPEN") == "true"
+	if seconds := os.Getenv("ICAP_TIMEOUT_SECONDS"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid ICAP_TIMEOUT_SECONDS: %s", seconds)
+		}
+		ICAPTimeout = time.Duration(n) * time.Second
+	} else {
+		ICAPTimeout = 5 * time.Minute
+	}
+	VirusTotalAPIKey = os.Getenv("VIRUSTOTAL_API_KEY")
+	if rate := os.Getenv("VIRUSTOTAL_REQUESTS_PER_MINUTE"); rate != "" {
+		n, err := strconv.Atoi(rate)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid VIRUSTOTAL_REQUESTS_PER_MINUTE: %s", rate)
+		}
+		VirusTotalRate = n
+	} else {
+		// The limit of the free public API.
+		VirusTotalRate = 4
+	}
+	SanitizeImages = os.Getenv("SANITIZE_IMAGES") == "true"
+	LoudnormEnabled = os.Getenv("LOUDNORM_ENABLED") == "true"
+	// EBU R128 unless configured otherwise.
+	LoudnormTarget, LoudnormTruePeak, LoudnormRange = -23, -1, 7
+	if target := os.Getenv("LOUDNORM_TARGET_LUFS"); target != "" {
+		n, err := strconv.ParseFloat(target, 64)
+		if err != nil || n < -70 || n > -5 {
+			log.Fatalf("Invalid LOUDNORM_TARGET_LUFS: %s", target)
+		}
+		LoudnormTarget = n
+	}
+	if peak := os.Getenv("LOUDNORM_TRUE_PEAK"); peak != "" {
+		n, err := strconv.ParseFloat(peak, 64)
+		if err != nil || n < -9 || n > 0 {
+			log.Fatalf("Invalid LOUDNORM_TRUE_PEAK: %s", peak)
+		}
+		LoudnormTruePeak = n
+	}
+	if lra := os.Getenv("LOUDNORM_RANGE"); lra != "" {
+		n, err := strconv.ParseFloat(lra, 64)
+		if err != nil || n < 1 || n > 50 {
+			log.Fatalf("Invalid LOUDNORM_RANGE: %s", lra)
+		}
+		LoudnormRange = n
+	}
+	FFmpegPath = os.Getenv("FFMPEG_PATH")
+	if FFmpegPath == "" {
+		FFmpegPath = "ffmpeg"
+	}
+	PreviewsEnabled = os.Getenv("PREVIEWS_ENABLED") == "true"
+	PreviewPath = os.Getenv("PREVIEW_PATH")
+	if PreviewPath == "" {
+		PreviewPath = "./previews"
+	}
+	PreviewHeight, PreviewBitrate = 360, 500
+	if height := os.Getenv("PREVIEW_HEIGHT"); height != "" {
+		n, err := strconv.Atoi(height)
+		if err != nil || n < 144 || n > 1080 || n%2 != 0 {
+			log.Fatalf("Invalid PREVIEW_HEIGHT: %s", height)
+		}
+		PreviewHeight = n
+	}
+	if rate := os.Getenv("PREVIEW_BITRATE_KBPS"); rate != "" {
+		n, err := strconv.Atoi(rate)
+		if err != nil || n < 100 || n > 10000 {
+			log.Fatalf("Invalid PREVIEW_BITRATE_KBPS: %s", rate)
+		}
+		PreviewBitrate = n
+	}
+	PreviewRetention = 30 * 24 * time.Hour
+	if days := os.Getenv("PREVIEW_RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid PREVIEW_RETENTION_DAYS: %s", days)
+		}
+		PreviewRetention = time.Duration(n) * 24 * time.Hour
+	}
+	ChunkSizeMin, ChunkSizeMax = 256<<10, 64<<20
+	if size := os.Getenv("CHUNK_SIZE_MIN"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid CHUNK_SIZE_MIN: %s", size)
+		}
+		ChunkSizeMin = n
+	}
+	if size := os.Getenv("CHUNK_SIZE_MAX"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || n < ChunkSizeMin {
+			log.Fatalf("Invalid CHUNK_SIZE_MAX: %s", size)
+		}
+		ChunkSizeMax = n
+	}
+	if ChunkSizeMax < ChunkSizeMin {
+		log.Fatalf("CHUNK_SIZE_MAX is below CHUNK_SIZE_MIN")
+	}
+	ChunkSeconds = 5
+	if seconds := os.Getenv("CHUNK_SECONDS"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid CHUNK_SECONDS: %s", seconds)
+		}
+		ChunkSeconds = n
+	}
+	if concurrency := os.Getenv("UPLOAD_CONCURRENCY"); concurrency != "" {
+		n, err := strconv.Atoi(concurrency)
+		if err != nil || n < 0 || n > 16 {
+			log.Fatalf("Invalid UPLOAD_CONCURRENCY: %s", concurrency)
+		}
+		UploadConcurrency = n
+	}
+	UploadRetryDelays = []time.Duration{0, time.Second, 3 * time.Second, 5 * time.Second}
+	if list, ok := os.LookupEnv("UPLOAD_RETRY_DELAYS"); ok {
+		delays, err := parseRetryDelays(list)
+		if err != nil {
+			log.Fatalf("Invalid UPLOAD_RETRY_DELAYS: %s", err.Error())
+		}
+		UploadRetryDelays = delays
+	}
+	if timeout := os.Getenv("UPLOAD_REQUEST_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid UPLOAD_REQUEST_TIMEOUT: %s", timeout)
+		}
+		UploadRequestTimeout = d
+	}
+	SpeedTestSize = 1 << 20
+	if size := os.Getenv("SPEED_TEST_SIZE"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || n < 0 || n > speedTestMaxSize {
+			log.Fatalf("Invalid SPEED_TEST_SIZE: %s", size)
+		}
+		SpeedTestSize = n
+	}
+	StreamBuffer = 1 << 20
+	if size := os.Getenv("STREAM_BUFFER"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || (n != 0 && (n < 64<<10 || n > 16<<20)) {
+			log.Fatalf("Invalid STREAM_BUFFER: %s", size)
+		}
+		StreamBuffer = n
+	}
+	ChecksumSidecars = os.Getenv("CHECKSUM_SIDECARS") == "true"
+	if MetadataSidecars = os.Getenv("METADATA_SIDECARS"); MetadataSidecars != "" {
+		t, err := loadMetadataSidecar(MetadataSidecars, os.Getenv("METADATA_SIDECAR_TEMPLATE"))
+		if err != nil {
+			log.Fatalf("Invalid METADATA_SIDECARS: %s", err.Error())
+		}
+		metadataSidecar = t
+	}
+	PreserveMTime = os.Getenv("PRESERVE_MTIME") == "true"
+	ChunkEcho = os.Getenv("CHUNK_ECHO") == "true"
+	ChunkHash = os.Getenv("CHUNK_HASH")
+	if ChunkHash == "" {
+		ChunkHash = hashSHA256
+	} else if !slices.Contains(hashAlgorithms, ChunkHash) {
+		log.Fatalf("Invalid CHUNK_HASH: %s", ChunkHash)
+	}
+	ReceiptsEnabled = os.Getenv("RECEIPTS_ENABLED") == "true"
+	if key := os.Getenv("RECEIPT_KEY"); key != "" {
+		ReceiptKey = key
+	} else {
+		ReceiptKey = filepath.Join(TempUploadPath, "receipt_ed25519_key")
+	}
+	if fields, err := parseCompletionFields(os.Getenv("COMPLETION_FIELDS")); err != nil {
+		log.Fatalf("Invalid COMPLETION_FIELDS: %s", err.Error())
+	} else {
+		CompletionFields = fields
+	}
+	if t, err := parseCompletionTemplate("COMPLETION_MESSAGE", os.Getenv("COMPLETION_MESSAGE")); err != nil {
+		log.Fatalf("Invalid COMPLETION_MESSAGE: %s", err.Error())
+	} else {
+		CompletionMessage = t
+	}
+	if t, err := parseCompletionTemplate("DOWNLOAD_URL", os.Getenv("DOWNLOAD_URL")); err != nil {
+		log.Fatalf("Invalid DOWNLOAD_URL: %s", err.Error())
+	} else {
+		DownloadURL = t
+	}
+	Language = os.Getenv("UI_LANGUAGE")
+	if Language == "" {
+		Language = languageRussian
+	} else if !slices.Contains(languages(), Language) {
+		log.Fatalf("Invalid UI_LANGUAGE: %s", Language)
+	}
+	if file := os.Getenv("BRANDING"); file != "" {
+		b, err := loadBranding(file)
+		if err != nil {
+			log.Fatalf("Invalid BRANDING %s: %s", file, err.Error())
+		}
+		Branding = b
+	}
+	switch collisions := os.Getenv("NAME_COLLISIONS"); collisions {
+	case "":
+		NameCollisions = collisionOverwrite
+	case collisionOverwrite, collisionRandom, collisionCounter, collisionFail:
+		NameCollisions = collisions
+	default:
+		log.Fatalf("Invalid NAME_COLLISIONS: %s", collisions)
+	}
+	NameSuffixBytes = 4
+	if n := os.Getenv("NAME_SUFFIX_BYTES"); n != "" {
+		v, err := strconv.Atoi(n)
+		if err != nil || v < 1 || v > 16 {
+			log.Fatalf("Invalid NAME_SUFFIX_BYTES: %s", n)
+		}
+		NameSuffixBytes = v
+	}
+	S3AllowedReferers = parseReferers(os.Getenv("S3_ALLOWED_REFERERS"))
+	S3DownloadSecret = os.Getenv("S3_DOWNLOAD_SECRET")
+	S3PublicURL = strings.TrimSuffix(os.Getenv("S3_PUBLIC_URL"), "/")
+	if slots := os.Getenv("DISK_WRITE_SLOTS"); slots != "" {
+		n, err := strconv.Atoi(slots)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid DISK_WRITE_SLOTS: %s", slots)
+		}
+		DiskWriteSlots = n
+	}
+	UploadPriorityWeights = map[string]float64{"high": 4, "low": 0.25}
+	if list := os.Getenv("UPLOAD_PRIORITY_WEIGHTS"); list != "" {
+		weights, err := parsePriorityWeights(list)
+		if err != nil {
+			log.Fatalf("Invalid UPLOAD_PRIORITY_WEIGHTS: %s", err.Error())
+		}
+		UploadPriorityWeights = weights
+	}
+	if size := os.Getenv("EXPRESS_UPLOAD_SIZE"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid EXPRESS_UPLOAD_SIZE: %s", size)
+		}
+		ExpressUploadSize = n
+	}
+	if size := os.Getenv("TEMP_ALERT_TOTAL"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid TEMP_ALERT_TOTAL: %s", size)
+		}
+		TempAlertTotal = n
+	}
+	if size := os.Getenv("TEMP_ALERT_SESSION"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid TEMP_ALERT_SESSION: %s", size)
+		}
+		TempAlertSession = n
+	}
+	TempAlertWebhook = os.Getenv("TEMP_ALERT_WEBHOOK")
+	DeliveryWebhook = os.Getenv("DELIVERY_WEBHOOK")
+	SpaceReservation = os.Getenv("SPACE_RESERVATION") == "true"
+	if size := os.Getenv("SPACE_HEADROOM"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid SPACE_HEADROOM: %s", size)
+		}
+		SpaceHeadroom = n
+	}
+	if list := os.Getenv("UPLOAD_WINDOWS"); list != "" {
+		windows, err := parseUploadWindows(list)
+		if err != nil {
+			log.Fatalf("Invalid UPLOAD_WINDOWS: %s", err.Error())
+		}
+		UploadWindows = windows
+	}
+	if size := os.Getenv("UPLOAD_WINDOW_MIN_SIZE"); size != "" {
+		n, err := parseByteSize(size)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid UPLOAD_WINDOW_MIN_SIZE: %s", size)
+		}
+		UploadWindowMinSize = n
+	}
+	if limit := os.Getenv("MAX_ACTIVE_UPLOADS"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid MAX_ACTIVE_UPLOADS: %s", limit)
+		}
+		MaxActiveUploads = n
+	}
+	if group := os.Getenv("PARITY_GROUP"); group != "" {
+		n, err := strconv.Atoi(group)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid PARITY_GROUP: %s", group)
+		}
+		ParityGroup = n
+	}
+	StatsdAddr = os.Getenv("STATSD_ADDR")
+	StatsdPrefix = "uploader."
+	if prefix, ok := os.LookupEnv("STATSD_PREFIX"); ok {
+		StatsdPrefix = prefix
+	}
+	for _, tag := range strings.Split(os.Getenv("STATSD_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			StatsdTags = append(StatsdTags, tag)
+		}
+	}
+	StatsdInterval = 10 * time.Second
+	if interval := os.Getenv("STATSD_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < time.Second {
+			log.Fatalf("Invalid STATSD_INTERVAL: %s", interval)
+		}
+		StatsdInterval = d
+	}
+	if raw := os.Getenv("MQTT_URL"); raw != "" {
+		u, err := parseMQTTURL(raw)
+		if err != nil {
+			// The URL may hold a password, keep it out of the log.
+			log.Fatalf("Invalid MQTT_URL: %s", err.Error())
+		}
+		MQTTBroker = u
+	}
+	MQTTTopicPrefix = strings.TrimSuffix(os.Getenv("MQTT_TOPIC_PREFIX"), "/")
+	if MQTTTopicPrefix == "" {
+		MQTTTopicPrefix = "uploader"
+	}
+	MQTTClientID = os.Getenv("MQTT_CLIENT_ID")
+	if MQTTClientID == "" {
+		hostname, _ := os.Hostname()
+		MQTTClientID = "uploader-" + hostname
+	}
+	if file := os.Getenv("UPLOAD_POLICIES"); file != "" {
+		policies, err := loadUploadPolicies(file)
+		if err != nil {
+			log.Fatalf("Invalid UPLOAD_POLICIES %s: %s", file, err.Error())
+		}
+		UploadPolicies = policies
+	}
+	if file := os.Getenv("ROUTING_RULES"); file != "" {
+		rules, err := loadRoutingRules(file)
+		if err != nil {
+			log.Fatalf("Invalid ROUTING_RULES %s: %s", file, err.Error())
+		}
+		RoutingRules = rules
+	}
+	if file := os.Getenv("CONVERSION_RULES"); file != "" {
+		rules, err := loadConversionRules(file)
+		if err != nil {
+			log.Fatalf("Invalid CONVERSION_RULES %s: %s", file, err.Error())
+		}
+		ConversionRules = rules
+	}
+	ValidationWebhook = os.Getenv("VALIDATION_WEBHOOK")
+	list := os.Getenv("UPLOAD_VALIDATORS")
+	if list == "" {
+		list = defaultValidators
+		if ValidationWebhook != "" {
+			list += ",webhook"
+		}
+	}
+	chain, err := parseValidators(list)
+	if err != nil {
+		log.Fatalf("Invalid UPLOAD_VALIDATORS: %s", err.Error())
+	}
+	if ValidationWebhook == "" && slices.ContainsFunc(chain, func(v Validator) bool { _, ok := v.(webhookValidator); return ok }) {
+		log.Fatalf("UPLOAD_VALIDATORS webhook needs VALIDATION_WEBHOOK")
+	}
+	validators = chain
+	authenticators = []Authenticator{policyTokenAuth{}}
+	if header := os.Getenv("AUTH_USER_HEADER"); header != "" {
+		trusted, err := parseCIDRs(os.Getenv("AUTH_USER_HEADER_TRUSTED"))
+		if err != nil {
+			log.Fatalf("Invalid AUTH_USER_HEADER_TRUSTED: %s", err.Error())
+		}
+		if len(trusted) == 0 {
+			log.Fatalf("AUTH_USER_HEADER needs AUTH_USER_HEADER_TRUSTED")
+		}
+		authenticators = append(authenticators, headerAuth{header: header, trusted: trusted})
+	}
+	if WebDAVEnabled && len(authenticators) == 1 && !slices.ContainsFunc(UploadPolicies, func(p *uploadPolicy) bool { return len(p.Tokens) > 0 }) {
+		log.Fatalf("WEBDAV_ENABLED needs upload tokens in UPLOAD_POLICIES or AUTH_USER_HEADER")
+	}
+	LoginMaxFailures = 5
+	if n := os.Getenv("LOGIN_MAX_FAILURES"); n != "" {
+		max, err := strconv.Atoi(n)
+		if err != nil || max < 0 {
+			log.Fatalf("Invalid LOGIN_MAX_FAILURES: %s", n)
+		}
+		LoginMaxFailures = max
+	}
+	LoginLockout = 15 * time.Minute
+	if minutes := os.Getenv("LOGIN_LOCKOUT_MINUTES"); minutes != "" {
+		n, err := strconv.Atoi(minutes)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid LOGIN_LOCKOUT_MINUTES: %s", minutes)
+		}
+		LoginLockout = time.Duration(n) * time.Minute
+	}
+	switch format := os.Getenv("LOGIN_LOG_FORMAT"); format {
+	case "", "fail2ban":
+		LoginLogFormat = format
+	default:
+		log.Fatalf("Unknown LOGIN_LOG_FORMAT %s", format)
+	}
+	if file := os.Getenv("GEOIP_DATABASE"); file != "" {
+		db, err := openGeoDB(file)
+		if err != nil {
+			log.Fatalf("Invalid GEOIP_DATABASE %s: %s", file, err.Error())
+		}
+		geoDatabase = db
+	}
+	GeoIPAllowCountries = parseCountries(os.Getenv("GEOIP_ALLOW_COUNTRIES"))
+	GeoIPDenyCountries = parseCountries(os.Getenv("GEOIP_DENY_COUNTRIES"))
+	if geoDatabase == nil && (GeoIPAllowCountries != nil || GeoIPDenyCountries != nil) {
+		log.Fatalf("GEOIP_ALLOW_COUNTRIES and GEOIP_DENY_COUNTRIES need GEOIP_DATABASE")
+	}
+	switch pinning := os.Getenv("UPLOAD_PINNING"); pinning {
+	case "", pinIP, pinToken:
+		UploadPinning = pinning
+	default:
+		log.Fatalf("Invalid UPLOAD_PINNING: %s", pinning)
 	}
-	os.MkdirAll(UploadPath, os.ModePerm)
-	os.MkdirAll(TempUploadPath, os.ModePerm)
 }
 
 func moveFile(src, dst string) error {
@@ -50,90 +834,1054 @@ func moveFile(src, dst string) error {
 		return nil
 	}
 	if errors.Is(err, syscall.EXDEV) {
-		in, err := os.Open(src)
-		if err != nil {
-			return err
+		return copyAcrossDevices(src, dst)
+	}
+	return err
+}
+
+// finishUpload moves a completed upload out of the temporary store into
+// UploadPath, under the name of storedFileName.
+func finishUpload(info tusd.FileInfo) {
+	log.Printf("Upload %s finished", info.ID)
+	countUpload(info)
+	releaseFingerprint(info.MetaData["fingerprint"])
+	newFileName := takeStoredName(info)
+	alg, sum, err := uploadDigest(info)
+	if err != nil {
+		log.Printf("Unable to hash upload %s: %s", info.ID, err.Error())
+	}
+	tree := uploadTreeRoot(info)
+	// The manifest is kept until the upload is stored, which takes the
+	// digest from its running hash.
+	defer forgetHashes(info.ID)
+	if dstPath, err := storeUploadUnique(info, newFileName); err == errUploadDiscarded {
+		log.Printf("Upload %s discarded after %d bytes (%s %s, tree %s)", info.ID, info.Size, alg, sum, tree)
+	} else if err != nil {
+		log.Printf("Error moving file: %s", err.Error())
+		hookError(info, err)
+		if storeRetries != nil {
+			storeRetries.add(info, newFileName, err)
+			log.Printf("Upload %s kept in %s, retrying in %s", info.ID, TempUploadPath, storeRetryMin)
 		}
-		defer in.Close()
-		out, err := os.Create(dst)
-		if err != nil {
-			return err
+	} else {
+		log.Printf("File moved to %s (%s %s, tree %s)", dstPath, alg, sum, tree)
+	}
+}
+
+var errUploadDiscarded = errors.New("upload discarded")
+
+// storeUpload moves the data of a completed upload to name, relative to
+// UploadPath, and returns the resulting path. With the memory and discard
+// storage backends the data is dropped instead and errUploadDiscarded is
+// returned.
+func storeUpload(info tusd.FileInfo, name string) (string, error) {
+	if StorageBackend != storageFile {
+		memStore.remove(info.ID)
+		return "", errUploadDiscarded
+	}
+	srcPath := filepath.Join(TempUploadPath, info.ID)
+	dstPath := filepath.Join(UploadPath, name)
+	dataPath, size := srcPath, info.Size
+	var sum, alg, digest string
+	var err error
+	// Images re-encoded by sanitizeImage are stored instead of the upload.
+	if stat, statErr := os.Stat(srcPath + sanitizedSuffix); statErr == nil {
+		dataPath, size = srcPath+sanitizedSuffix, stat.Size()
+		sum, err = hashFile(dataPath)
+	} else if ChunkHash == hashSHA256 || needsSHA256(info) {
+		sum, err = uploadSHA256(info)
+	} else if alg, digest, err = uploadDigest(info); alg == hashSHA256 {
+		sum, digest = digest, ""
+	}
+	if err != nil {
+		log.Printf("Unable to hash upload %s: %s", info.ID, err.Error())
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := moveFile(dataPath, dstPath); err != nil {
+		return "", err
+	}
+	if dataPath != srcPath {
+		os.Remove(srcPath)
+	}
+	os.Remove(srcPath + ".info")
+	os.Remove(srcPath + ".hash")
+	os.Remove(srcPath + ".parity")
+	// A file stored under the name of a tiered one replaces it.
+	os.Remove(dstPath + tieredSuffix)
+	rule := routeFor(dstPath, info.MetaData["filename"])
+	moving := rule != nil && rule.target != nil && storedFiles != nil
+	if storedFiles != nil {
+		storedFiles.record(name, size, sum)
+		if digest != "" {
+			storedFiles.setDigest(name, alg, digest)
+		}
+		storedFiles.setUpload(name, info.ID)
+		if moving {
+			storedFiles.setRoute(name, rule.Target)
 		}
-		defer out.Close()
-		if _, err = io.Copy(out, in); err != nil {
-			return err
+		retention := 0
+		if p := policyFor(info.MetaData); p != nil {
+			retention = p.RetentionDays
+		}
+		user, tokenID := info.MetaData["user"], info.MetaData["token_id"]
+		if user != "" || tokenID != "" || retention > 0 {
+			storedFiles.setOrigin(name, user, tokenID, retention)
 		}
-		return os.Remove(src)
 	}
-	return err
+	keepLastModified(info, name, dstPath)
+	export := watchExportOf(info, name, size, sum)
+	writeMetadataSidecar(export)
+	if virusTotal != nil {
+		virusTotal.enqueue(filepath.ToSlash(name), sum)
+	}
+	// Files moved to the target of their routing rule are kept there only.
+	if replication != nil && !moving {
+		replication.enqueue(name)
+		if ChecksumSidecars && sum != "" {
+			replication.enqueue(name + checksumSuffix)
+		}
+		if MetadataSidecars != "" {
+			replication.enqueue(name + metadataSuffix(MetadataSidecars))
+		}
+	}
+	publishEvent(eventStored, info, filepath.ToSlash(name), sum)
+	hookComplete(info, filepath.ToSlash(name), sum)
+	issueReceipt(info, size, sum)
+	if watchFolder != nil && !moving {
+		watchFolder.enqueue(export)
+	}
+	queueConversion()
+	if moving {
+		go func() {
+			if err := routeStored(context.Background(), name, rule); err != nil {
+				log.Printf("Unable to route %s to %s, retrying within the hour: %s", name, rule.target, err.Error())
+			}
+		}()
+	}
+	return dstPath, nil
+}
+
+// advertiseHTTP3 adds the Alt-Svc header announcing the HTTP/3 listener to
+// responses served over TCP.
+func advertiseHTTP3(h3srv *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			h3srv.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	htmlStr := `<!DOCTYPE html>
-<html lang="ru">
+<html lang="[[lang]]">
 <head>
   <meta charset="UTF-8">
-  <title>TUS Upload</title>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="theme-color" content="[[brand_color]]">
+  <title>[[brand_title]]</title>
+  <link rel="manifest" href="/manifest.webmanifest">
+  <link rel="apple-touch-icon" href="/icon-180.png">
   <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
+  <style>
+    .dropzone { display: flex; align-items: center; justify-content: center; min-height: 12rem;
+      border: 3px dashed #adb5bd; border-radius: 1rem; padding: 1.5rem; text-align: center;
+      font-size: 1.25rem; cursor: pointer; }
+    .dropzone.dragover { border-color: [[brand_color]]; background: #e7f1ff; }
+    .brand-logo { max-height: 3rem; max-width: 100%; margin-bottom: .75rem; }
+    .upload-row summary { list-style: none; cursor: pointer; }
+    .upload-row summary::-webkit-details-marker { display: none; }
+    .upload-row .name { overflow-wrap: anywhere; }
+    @media (max-width: 576px) {
+      .dropzone { min-height: 40vh; }
+      .btn { padding: .9rem 1rem; font-size: 1.15rem; }
+    }[[brand_style]]
+  </style>
 </head>
-<body>
-<div class="container mt-5">
-  <h2>Загрузка файлов через TUS</h2>
-  <input type="file" id="fileInput" multiple accept="video/*" class="form-control" />
-  <button id="uploadBtn" class="btn btn-primary mt-3">Загрузить</button>
-  <div id="progress" class="progress mt-3" style="display:none;">
-    <div id="progressBar" class="progress-bar" role="progressbar" style="width: 0%;">0%</div>
+<body style="background-color: [[brand_background]]">
+<div class="container px-3 mt-3 mt-md-5">
+  [[brand_logo]]
+  <h2 class="fs-3">[[brand_heading]]</h2>
+  [[history_link]]
+  <div id="meteredWarning" class="alert alert-warning d-none">[[metered_warning]]</div>
+  <label for="fileInput" id="dropzone" class="dropzone" tabindex="0" role="button" aria-controls="fileInput">
+    <span id="dropzoneText" aria-live="polite">[[dropzone]]</span>
+  </label>
+  <input type="file" id="fileInput" multiple accept="video/*" hidden />
+  <div class="d-grid gap-2 d-sm-flex mt-3">
+    <button id="uploadBtn" class="btn btn-primary">[[upload]]</button>
+    <label for="captureInput" class="btn btn-outline-primary" tabindex="0" role="button">
+      [[record_video]]
+      <input type="file" id="captureInput" accept="video/*" capture="environment" hidden />
+    </label>
   </div>
-  <div id="status" class="mt-3"></div>
+  <div id="uploads" class="mt-3" role="region" aria-label="[[uploads]]"></div>
+  <div id="status" class="mt-3" aria-live="polite"></div>
+  <div id="announcer" class="visually-hidden" aria-live="polite" aria-atomic="true"></div>
 </div>
+[[brand_footer]]
 <script src="https://unpkg.com/tus-js-client/dist/tus.js"></script>
+<script src="/messages.js"></script>
+<script src="/chunk-sizer.js"></script>
+<script src="/fingerprint.js"></script>
 <script>
+var STORE_KEY = 'uploader.uploads';
+function loadState(){
+    try { return JSON.parse(localStorage.getItem(STORE_KEY)) || {}; } catch(e) { return {}; }
+}
+function saveState(state){
+    localStorage.setItem(STORE_KEY, JSON.stringify(state));
+}
+function fileKey(file){
+    return [file.name, file.type, file.size, file.lastModified].join('-');
+}
+function formatBytes(n){
+    var units = t('byte_units').split(' ');
+    var i = 0;
+    while(n >= 1024 && i < units.length - 1){
+        n /= 1024;
+        i++;
+    }
+    return n.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+function showStatus(kind, text, replace){
+    var status = document.getElementById('status');
+    var div = document.createElement('div');
+    div.className = 'alert alert-' + kind;
+    if(kind === 'danger'){
+        div.setAttribute('role', 'alert');
+    }
+    div.textContent = text;
+    if(replace){
+        status.textContent = '';
+    }
+    status.appendChild(div);
+}
+// announce has screen readers read text out, once the current speech is
+// over; the progress of the rows is only read out at milestones.
+function announce(text){
+    var announcer = document.getElementById('announcer');
+    announcer.textContent = '';
+    setTimeout(function(){ announcer.textContent = text; }, 100);
+}
+// Every file gets a collapsible row: the summary with the name and the
+// progress bar stays visible, the details open on tap or Enter.
+function uploadRow(key, name){
+    var id = 'upload-' + btoa(unescape(encodeURIComponent(key))).replace(/[^a-zA-Z0-9]/g, '');
+    var row = document.getElementById(id);
+    if(!row){
+        row = document.createElement('details');
+        row.id = id;
+        row.className = 'upload-row border rounded p-2 mb-2';
+        row.innerHTML = "<summary><div class='d-flex justify-content-between'><span class='name me-2'></span><span class='pct'>0%</span></div>" +
+            "<div class='progress mt-1'><div class='progress-bar' role='progressbar' aria-valuemin='0' aria-valuemax='100' aria-valuenow='0' style='width: 0%;'></div></div></summary>" +
+            "<div class='small text-muted mt-1'><span class='bytes'></span> <span class='note'></span></div>";
+        row.querySelector('.name').textContent = name;
+        row.querySelector('.progress-bar').setAttribute('aria-label', name);
+        row.dataset.milestone = '0';
+        document.getElementById('uploads').appendChild(row);
+    }
+    return row;
+}
+function setProgress(key, name, bytesUploaded, bytesTotal, note){
+    var row = uploadRow(key, name);
+    var percentage = bytesTotal ? (bytesUploaded / bytesTotal * 100).toFixed(2) : '0.00';
+    var bytes = t('bytes_of', {done: formatBytes(bytesUploaded), total: formatBytes(bytesTotal)});
+    var bar = row.querySelector('.progress-bar');
+    bar.style.width = percentage + "%";
+    bar.setAttribute('aria-valuenow', Math.floor(percentage));
+    bar.setAttribute('aria-valuetext', percentage + '%, ' + bytes + (note ? ' ' + note : ''));
+    row.querySelector('.pct').textContent = percentage + "%";
+    row.querySelector('.bytes').textContent = bytes;
+    row.querySelector('.note').textContent = note || '';
+    // Every quarter of a file is read out, not every chunk.
+    var milestone = Math.floor(percentage / 25) * 25;
+    if(milestone > Number(row.dataset.milestone) && milestone < 100){
+        row.dataset.milestone = milestone;
+        announce(t('progress_announce', {name: name, percent: milestone}));
+    }
+    if(bytesUploaded < bytesTotal){
+        active[key] = true;
+    } else {
+        delete active[key];
+    }
+    updateWakeLock();
+}
+// deadlineNote warns that the upload expires, from its Upload-Expires
+// header, once less than an hour is left.
+function deadlineNote(expires){
+    var left = expires ? Date.parse(expires) - Date.now() : NaN;
+    if(!(left < 3600 * 1000)){
+        return '';
+    }
+    if(left <= 0){
+        return t('deadline_passed');
+    }
+    return t('deadline_minutes', {minutes: Math.ceil(left / 60000)});
+}
+// queuedNote tells the position of an upload the server queued until its
+// upload window or a free slot, and when it is expected to start, if known.
+function queuedNote(position, start){
+    var note = t('queued_position', {position: position});
+    if(!start){
+        return note;
+    }
+    var at = new Date(start);
+    return note + t('queued_start', {time: ('0' + at.getHours()).slice(-2) + ':' + ('0' + at.getMinutes()).slice(-2)});
+}
+// Receipts are offered when the server issues them.
+var receipts = false;
+fetch('/api/receipts/key', {method: 'HEAD'}).then(function(r){ receipts = r.ok; });
+function finishRow(key, name, failed, id){
+    var row = uploadRow(key, name);
+    var bar = row.querySelector('.progress-bar');
+    bar.classList.add(failed ? 'bg-danger' : 'bg-success');
+    if(!failed){
+        bar.setAttribute('aria-valuenow', '100');
+        bar.setAttribute('aria-valuetext', '100%');
+    }
+    if(!failed && id && receipts){
+        var link = document.createElement('a');
+        link.href = '/api/receipts/' + id + '.html';
+        link.target = '_blank';
+        link.className = 'ms-2';
+        link.textContent = t('receipt');
+        link.setAttribute('aria-label', t('receipt_for', {name: name}));
+        row.querySelector('.note').after(link);
+    }
+    delete active[key];
+    updateWakeLock();
+}
+
+// The screen is kept on while uploads are running, phones would otherwise
+// suspend the page and stall the transfer.
+var active = {};
+var wakeLock = null;
+function updateWakeLock(){
+    if(!('wakeLock' in navigator)){
+        return;
+    }
+    var busy = Object.keys(active).length > 0;
+    if(busy && !wakeLock && document.visibilityState === 'visible'){
+        wakeLock = 'pending';
+        navigator.wakeLock.request('screen').then(function(lock){
+            wakeLock = lock;
+            lock.addEventListener('release', function(){ wakeLock = null; });
+        }, function(){ wakeLock = null; });
+    } else if(!busy && wakeLock && wakeLock !== 'pending'){
+        wakeLock.release();
+        wakeLock = null;
+    }
+}
+document.addEventListener('visibilitychange', updateWakeLock);
+
+function isMetered(){
+    var c = navigator.connection;
+    return !!c && (c.saveData || c.type === 'cellular');
+}
+function updateMeteredWarning(){
+    document.getElementById('meteredWarning').classList.toggle('d-none', !isMetered());
+}
+if(navigator.connection){
+    navigator.connection.addEventListener('change', updateMeteredWarning);
+}
+updateMeteredWarning();
+
+var dropzone = document.getElementById('dropzone');
+function showSelection(files){
+    document.getElementById('dropzoneText').textContent = files.length ?
+        t('files_selected', {count: files.length}) : t('dropzone');
+}
+dropzone.addEventListener('dragover', function(e){
+    e.preventDefault();
+    dropzone.classList.add('dragover');
+});
+dropzone.addEventListener('dragleave', function(){
+    dropzone.classList.remove('dragover');
+});
+dropzone.addEventListener('drop', function(e){
+    e.preventDefault();
+    dropzone.classList.remove('dragover');
+    document.getElementById('fileInput').files = e.dataTransfer.files;
+    showSelection(e.dataTransfer.files);
+});
+document.getElementById('fileInput').addEventListener('change', function(){
+    showSelection(this.files);
+});
+// The labels standing for the hidden file inputs act as buttons for the
+// keyboard too.
+document.querySelectorAll('label[role=button]').forEach(function(label){
+    label.addEventListener('keydown', function(e){
+        if(e.key === 'Enter' || e.key === ' '){
+            e.preventDefault();
+            document.getElementById(label.htmlFor).click();
+        }
+    });
+});
+function reconcile(){
+    var state = loadState();
+    var keys = Object.keys(state);
+    if(keys.length === 0){
+        return;
+    }
+    var query = keys.map(function(k){ return 'id=' + encodeURIComponent(state[k].id); }).join('&');
+    fetch('/api/uploads?' + query).then(function(r){ return r.json(); }).then(function(list){
+        var paused = {};
+        list.forEach(function(item, i){
+            var key = keys[i];
+            if(item.state === 'queued'){
+                setProgress(key, state[key].name, item.offset, item.size, queuedNote(item.queue_position, item.start) + t('choose_again'));
+                delete active[key];
+                updateWakeLock();
+                paused[item.id] = key;
+            } else if(item.state === 'uploading'){
+                setProgress(key, state[key].name, item.offset, item.size, t('choose_to_continue'));
+                // Paused until the file is selected again.
+                delete active[key];
+                updateWakeLock();
+                paused[item.id] = key;
+            } else {
+                delete state[key];
+            }
+        });
+        saveState(state);
+        watchExpiry(paused);
+    });
+}
+// watchExpiry follows the paused uploads, upload ID to key, until they are
+// gone: idle ones are kept alive while the page is open, the others are
+// noted when their deadline nears or they were removed.
+function watchExpiry(paused){
+    var left = Object.keys(paused).length;
+    if(left === 0 || !window.EventSource){
+        return;
+    }
+    var events = new EventSource('/api/uploads/events?' + Object.keys(paused).map(function(id){ return 'id=' + id; }).join('&'));
+    function note(key, text){
+        var state = loadState();
+        if(state[key] && !active[key]){
+            uploadRow(key, state[key].name).querySelector('.note').textContent = text;
+        }
+    }
+    events.addEventListener('expiring', function(e){
+        var msg = JSON.parse(e.data);
+        if(msg.reason === 'idle'){
+            fetch('/api/uploads/keepalive?id=' + msg.id, {method: 'POST'});
+            return;
+        }
+        note(paused[msg.id], deadlineNote(msg.expires) + t('choose_again'));
+    });
+    events.addEventListener('gone', function(e){
+        var key = paused[JSON.parse(e.data).id];
+        note(key, t('removed_by_server'));
+        var state = loadState();
+        if(state[key] && !active[key]){
+            delete state[key];
+            saveState(state);
+        }
+        if(--left === 0){
+            // The server ends the stream, it is not to be reopened.
+            events.close();
+        }
+    });
+}
 document.getElementById('uploadBtn').addEventListener('click', function() {
     var files = document.getElementById('fileInput').files;
     if(files.length === 0){
-        alert("Выберите файл(ы) для загрузки.");
+        alert(t('choose_files'));
         return;
     }
-    for(var i = 0; i < files.length; i++){
-        uploadFile(files[i]);
+    uploadFiles(files);
+});
+document.getElementById('captureInput').addEventListener('change', function() {
+    // Recordings from the camera are uploaded right away.
+    if(this.files.length > 0){
+        uploadFiles(this.files);
     }
 });
+// Files selected together are uploaded as one delivery, whose combined
+// progress the server reports, keyed by the fileKey of its files.
+var deliveries = {};
+function newDelivery(files){
+    var id = '';
+    var bytes = crypto.getRandomValues(new Uint8Array(12));
+    for(var i = 0; i < bytes.length; i++){
+        id += ('0' + bytes[i].toString(16)).slice(-2);
+    }
+    var delivery = {id: id, files: files.length};
+    for(var i = 0; i < files.length; i++){
+        deliveries[fileKey(files[i])] = delivery;
+    }
+    return delivery;
+}
+// watchDelivery shows the combined progress of the delivery until all of
+// its files are stored.
+function watchDelivery(delivery){
+    var row = document.createElement('div');
+    row.className = 'alert alert-secondary';
+    row.setAttribute('role', 'progressbar');
+    row.setAttribute('aria-valuemin', '0');
+    row.setAttribute('aria-valuemax', '100');
+    document.getElementById('uploads').insertBefore(row, document.getElementById('uploads').firstChild);
+    var poll = function(){
+        fetch('/api/deliveries/' + delivery.id).then(function(r){
+            return r.ok ? r.json() : null;
+        }).then(function(d){
+            if(!d){
+                row.textContent = t('delivery_waiting', {files: delivery.files});
+                setTimeout(poll, 5000);
+                return;
+            }
+            var pct = d.size ? (d.offset / d.size * 100).toFixed(1) : '0.0';
+            row.textContent = t('delivery_progress', {stored: d.stored, files: d.files, percent: pct, done: formatBytes(d.offset), total: formatBytes(d.size)});
+            row.setAttribute('aria-valuenow', Math.floor(pct));
+            row.setAttribute('aria-valuetext', row.textContent);
+            if(d.complete){
+                row.className = 'alert alert-success';
+                row.textContent = t('delivery_complete', {files: d.files});
+                row.setAttribute('aria-valuetext', row.textContent);
+                announce(row.textContent);
+                return;
+            }
+            setTimeout(poll, 3000);
+        }).catch(function(){
+            setTimeout(poll, 5000);
+        });
+    };
+    poll();
+}
+function uploadFiles(files){
+    var total = 0;
+    for(var i = 0; i < files.length; i++){
+        total += files[i].size;
+    }
+    if(isMetered() && !confirm(t('metered_confirm', {size: formatBytes(total)}))){
+        return;
+    }
+    var delivery = null;
+    if(files.length > 1){
+        delivery = newDelivery(files);
+        watchDelivery(delivery);
+    }
+    if('serviceWorker' in navigator){
+        var queued = [];
+        for(var i = 0; i < files.length; i++){
+            setProgress(fileKey(files[i]), files[i].name, 0, files[i].size, t('queued'));
+            queued.push({key: fileKey(files[i]), file: files[i], delivery: delivery});
+        }
+        navigator.serviceWorker.ready.then(function(reg){
+            reg.active.postMessage({type: 'enqueue', files: queued});
+        });
+        return;
+    }
+    for(var i = 0; i < files.length; i++){
+        setProgress(fileKey(files[i]), files[i].name, 0, files[i].size, t('queued'));
+        waiting.push(files[i]);
+    }
+    speedTest(chunkSizer).then(function(n){
+        parallel = n;
+        startWaiting();
+    });
+}
+if('serviceWorker' in navigator){
+    // Uploads run in the service worker, so they survive navigation and
+    // continue by themselves once the connection is back.
+    navigator.serviceWorker.register('/sw.js');
+    navigator.serviceWorker.addEventListener('message', function(event){
+        var msg = event.data;
+        if(msg.type === 'progress'){
+            setProgress(msg.key, msg.name, msg.offset, msg.size, deadlineNote(msg.expires));
+        } else if(msg.type === 'done'){
+            finishRow(msg.key, msg.name, false, msg.id);
+            showStatus('success', msg.message || t('uploaded', {name: msg.name}));
+        } else if(msg.type === 'queued'){
+            setProgress(msg.key, msg.name, 0, msg.size, queuedNote(msg.position, msg.start));
+            delete active[msg.key];
+            updateWakeLock();
+        } else if(msg.type === 'error'){
+            finishRow(msg.key, msg.name, true);
+            showStatus('danger', t('file_error', {name: msg.name, error: msg.error}));
+            if(msg.code === 'ERR_UPLOAD_TOO_LARGE'){
+                offerOverride(msg.name, msg.size);
+            }
+        } else if(msg.type === 'offline'){
+            showStatus('warning', t('offline'), true);
+        }
+    });
+    var resume = function(){
+        navigator.serviceWorker.ready.then(function(reg){ reg.active.postMessage({type: 'resume'}); });
+    };
+    window.addEventListener('online', resume);
+    resume();
+}
+// offerOverride offers to ask an admin to raise the size limit for a file
+// refused as too large, and tells when the request is decided.
+function offerOverride(name, size){
+    var div = document.createElement('div');
+    div.className = 'alert alert-warning';
+    var btn = document.createElement('button');
+    btn.className = 'btn btn-sm btn-outline-primary ms-2';
+    btn.textContent = t('override_request');
+    div.textContent = t('override_offer', {name: name});
+    div.appendChild(btn);
+    document.getElementById('status').appendChild(div);
+    btn.addEventListener('click', function(){
+        var reason = prompt(t('override_reason', {name: name, size: formatBytes(size)}));
+        if(reason === null){
+            return;
+        }
+        btn.disabled = true;
+        fetch('/api/overrides', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({filename: name, size: size, reason: reason})
+        }).then(function(r){
+            return r.json().then(function(body){
+                if(!r.ok){
+                    throw new Error(body.message);
+                }
+                return body;
+            });
+        }).then(function(o){
+            div.textContent = t('override_requested');
+            watchOverride(o.id, div);
+        }).catch(function(err){
+            btn.disabled = false;
+            showStatus('danger', t('error', {error: err.message}));
+        });
+    });
+}
+// watchOverride follows the request id until an admin decides it.
+function watchOverride(id, div){
+    fetch('/api/overrides/' + id).then(function(r){
+        return r.ok ? r.json() : null;
+    }).then(function(o){
+        if(o && o.status === 'approved'){
+            div.className = 'alert alert-success';
+            div.textContent = t('override_approved', {size: formatBytes(o.max_size), until: new Date(o.until).toLocaleString(LANG)});
+        } else if(o && o.status === 'denied'){
+            div.className = 'alert alert-danger';
+            div.setAttribute('role', 'alert');
+            div.textContent = t('override_denied');
+        } else {
+            setTimeout(function(){ watchOverride(id, div); }, 30000);
+        }
+    }).catch(function(){
+        setTimeout(function(){ watchOverride(id, div); }, 30000);
+    });
+}
+// completionMessage returns the message of COMPLETION_FIELDS the server
+// completed the upload with, if any.
+function completionMessage(res){
+    try {
+        return res && JSON.parse(res.getBody()).message;
+    } catch(e) {
+        return null;
+    }
+}
+// apiError returns the error the server answered the tus request of err
+// with, {code, message, retriable, request_id}, null if there is none.
+function apiError(err){
+    var res = err && err.originalResponse;
+    try {
+        var e = res && res.getStatus() >= 400 && JSON.parse(res.getBody());
+        return e && e.code ? e : null;
+    } catch(ex) {
+        return null;
+    }
+}
+// inProgressElsewhere reports whether the server refused to create the
+// upload because the same file is being uploaded already, from another tab.
+function inProgressElsewhere(err){
+    var e = apiError(err);
+    return !!e && e.code === 'ERR_UPLOAD_IN_PROGRESS';
+}
+// uploadQueued returns the position of an upload the server queued, when
+// it is expected to start and when to try again, null for other errors.
+function uploadQueued(err){
+    var res = err && err.originalResponse;
+    var position = res && res.getStatus() === 503 && res.getHeader('Upload-Queue-Position');
+    if(!position){
+        return null;
+    }
+    var after = parseInt(res.getHeader('Retry-After'), 10) || 60;
+    var start = res.getHeader('Upload-Queue-Start');
+    return {position: parseInt(position, 10), start: start ? Date.parse(start) : null, retry: Date.now() + after * 1000};
+}
+// Uploads from the tab share the chunk size, they share the connection too.
+var chunkSizer = new ChunkSizer();
+// Files waiting to be uploaded from the tab, as many at once as the speed
+// test suggests.
+var waiting = [];
+var parallel = 1;
+var running = 0;
+function startWaiting(){
+    while(running < parallel && waiting.length > 0){
+        running++;
+        uploadFile(waiting.shift());
+    }
+}
+function uploadDone(){
+    running--;
+    startWaiting();
+}
+// A file with an incomplete upload on the server, from this browser or
+// another one, continues that upload.
 function uploadFile(file){
+    fileFingerprint(file).then(function(fingerprint){
+        return findUpload(fingerprint, file).then(function(found){
+            startUpload(file, found === false ? null : fingerprint, found || null);
+        });
+    });
+}
+// StreamingHttpStack is the HTTP stack of tus-js-client that sends the
+// chunks as streams where the browser can, see streamChunks, and every
+// other request, and the chunks the browser does not stream, with the
+// default stack.
+function StreamingHttpStack(){
+    this.whole = new tus.DefaultHttpStack({});
+}
+StreamingHttpStack.prototype.getName = function(){
+    return 'StreamingHttpStack';
+};
+StreamingHttpStack.prototype.createRequest = function(method, url){
+    return new StreamingRequest(method, url, this.whole.createRequest(method, url));
+};
+function StreamingRequest(method, url, whole){
+    this.method = method;
+    this.url = url;
+    this.whole = whole;
+    this.headers = {};
+    this.onProgress = null;
+    this.controller = null;
+}
+StreamingRequest.prototype.getMethod = function(){ return this.method; };
+StreamingRequest.prototype.getURL = function(){ return this.url; };
+StreamingRequest.prototype.setHeader = function(name, value){
+    this.headers[name] = value;
+    this.whole.setHeader(name, value);
+};
+StreamingRequest.prototype.getHeader = function(name){ return this.headers[name]; };
+StreamingRequest.prototype.setProgressHandler = function(fn){
+    this.onProgress = fn;
+    this.whole.setProgressHandler(fn);
+};
+StreamingRequest.prototype.getUnderlyingObject = function(){ return this.whole.getUnderlyingObject(); };
+StreamingRequest.prototype.abort = function(){
+    if(this.controller){
+        this.controller.abort();
+        return Promise.resolve();
+    }
+    return this.whole.abort();
+};
+StreamingRequest.prototype.send = function(body){
+    var whole = this.whole;
+    if(this.method !== 'PATCH' || !(body instanceof Blob) || !streamChunks()){
+        return whole.send(body);
+    }
+    this.controller = new AbortController();
+    var options = {method: 'PATCH', headers: this.headers, signal: this.controller.signal};
+    var req = this;
+    return streamedFetch(this.url, options, body, this.onProgress, function(){
+        req.controller = null;
+        return whole.send(body);
+    }).then(function(res){
+        if(!(res instanceof Response)){
+            return res;
+        }
+        return res.text().then(function(text){
+            return {
+                getStatus: function(){ return res.status; },
+                getHeader: function(name){ return res.headers.get(name) || undefined; },
+                getBody: function(){ return text; },
+                getUnderlyingObject: function(){ return res; }
+            };
+        });
+    });
+};
+function startUpload(file, fingerprint, found){
+    var key = fileKey(file);
+    var last = Date.now();
+    var expires = null;
+    var metadata = {
+        filename: file.name,
+        filetype: file.type
+    };
+    if(file.lastModified){
+        metadata.lastmodified = String(file.lastModified);
+    }
+    if(deliveries[key]){
+        metadata.delivery = deliveries[key].id;
+        metadata.delivery_files = String(deliveries[key].files);
+    }
+    if(fingerprint){
+        metadata.fingerprint = fingerprint;
+    }
     var upload = new tus.Upload(file, {
         endpoint: window.location.origin + "/files/",
-        retryDelays: [0, 1000, 3000, 5000],
-        metadata: {
-            filename: file.name,
-            filetype: file.type
+        uploadUrl: found ? window.location.origin + "/files/" + found.id : null,
+        retryDelays: SETTINGS.retry_delays,
+        chunkSize: chunkSizer.size,
+        httpStack: new StreamingHttpStack(),
+        metadata: metadata,
+        onUploadUrlAvailable: function(){
+            var state = loadState();
+            state[key] = {id: upload.url.split('/').pop(), name: file.name};
+            saveState(state);
+        },
+        onShouldRetry: function(err){
+            // As tus-js-client does by default, except for the upload of
+            // the file from another tab, which is not retried, and queued
+            // uploads, which wait for their turn.
+            var status = err.originalResponse ? err.originalResponse.getStatus() : 0;
+            if(inProgressElsewhere(err) || uploadQueued(err)){
+                return false;
+            }
+            var e = apiError(err);
+            if(e && e.retriable){
+                return true;
+            }
+            return !(status >= 400 && status < 500) || status === 409 || status === 423;
         },
         onError: function(error){
-            document.getElementById('status').innerHTML += "<div class='alert alert-danger'>Ошибка: " + error + "</div>";
+            uploadDone();
+            var queued = uploadQueued(error);
+            if(queued){
+                // Started again, from where it stopped, once its turn comes.
+                setProgress(key, file.name, 0, file.size, queuedNote(queued.position, queued.start));
+                delete active[key];
+                updateWakeLock();
+                setTimeout(function(){
+                    waiting.push(file);
+                    startWaiting();
+                }, queued.retry - Date.now());
+                return;
+            }
+            finishRow(key, file.name, true);
+            if(inProgressElsewhere(error)){
+                showStatus('warning', t('in_other_tab', {name: file.name}));
+                return;
+            }
+            var e = apiError(error);
+            showStatus('danger', t('error', {error: e ? e.message + " (" + e.request_id + ")" : error}));
+            if(e && e.code === 'ERR_UPLOAD_TOO_LARGE'){
+                offerOverride(file.name, file.size);
+            }
         },
         onProgress: function(bytesUploaded, bytesTotal){
-            var percentage = (bytesUploaded / bytesTotal * 100).toFixed(2);
-            document.getElementById('progress').style.display = 'block';
-            document.getElementById('progressBar').style.width = percentage + "%";
-            document.getElementById('progressBar').textContent = percentage + "%";
+            setProgress(key, file.name, bytesUploaded, bytesTotal, deadlineNote(expires));
+        },
+        onBeforeRequest: function(req){
+            var xhr = req.getUnderlyingObject();
+            if(SETTINGS.request_timeout && xhr && 'timeout' in xhr){
+                xhr.timeout = SETTINGS.request_timeout;
+            }
+        },
+        onAfterResponse: function(req, res){
+            expires = res.getHeader('Upload-Expires') || expires;
+        },
+        onChunkComplete: function(chunkSize){
+            // Failed attempts and their retry delays count towards the time
+            // of the chunk, so lost chunks shrink the next ones.
+            var now = Date.now();
+            chunkSizer.measure(chunkSize, now - last);
+            last = now;
+            upload.options.chunkSize = chunkSizer.size;
         },
-        onSuccess: function(){
-            document.getElementById('status').innerHTML += "<div class='alert alert-success'>Файл " + file.name + " загружен успешно!</div>";
+        onSuccess: function(payload){
+            uploadDone();
+            var state = loadState();
+            delete state[key];
+            saveState(state);
+            finishRow(key, file.name, false, upload.url.split('/').pop());
+            showStatus('success', completionMessage(payload && payload.lastResponse) || t('uploaded', {name: file.name}));
         }
     });
-    upload.start();
+    upload.findPreviousUploads().then(function(previous){
+        if(previous.length > 0 && !found){
+            upload.resumeFromPreviousUpload(previous[0]);
+        }
+        last = Date.now();
+        upload.start();
+    });
+}
+// Heartbeats keep the uploads of the page, running or paused, alive on the
+// server while the page is open, however slowly they go.
+function heartbeat(){
+    var state = loadState();
+    var ids = Object.keys(state).map(function(key){ return state[key].id; }).filter(Boolean);
+    sendHeartbeat(ids).then(function(){
+        setTimeout(heartbeat, SETTINGS.heartbeat_interval);
+    });
 }
+reconcile();
+loadSettings().then(heartbeat);
 </script>
 </body>
 </html>`
+	link := ""
+	if historyEnabled() {
+		link = `<p><a href="/my">[[my_uploads]]</a></p>`
+	}
+	htmlStr = strings.Replace(htmlStr, "[[history_link]]", link, 1)
+	lang := requestLanguage(r)
 	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, htmlStr)
+	setLanguage(w, lang)
+	fmt.Fprint(w, localizePage(brandPage(htmlStr, requestBrand(r), lang), lang))
 }
 
 func main() {
-	store := filestore.New(TempUploadPath)
-	locker := filelocker.New(TempUploadPath)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "speedtest":
+			os.Exit(runSpeedTest(os.Args[2:]))
+		case "upload":
+			os.Exit(runUpload(os.Args[2:]))
+		case "replication-repair":
+			os.Exit(runReplicationRepair(os.Args[2:]))
+		case "admin":
+			os.Exit(runAdmin(os.Args[2:]))
+		}
+	}
+	os.MkdirAll(UploadPath, os.ModePerm)
+	if StorageBackend == storageFile {
+		os.MkdirAll(TempUploadPath, os.ModePerm)
+	}
+
+	if DiskWriteSlots > 0 {
+		diskScheduler = newFairScheduler(DiskWriteSlots)
+	}
 	composer := tusd.NewStoreComposer()
-	store.UseIn(composer)
-	locker.UseIn(composer)
+	if StorageBackend != storageFile {
+		if StorageBackend == storageDiscard {
+			log.Printf("Dry run: upload data is hashed and discarded, nothing is stored")
+			memStore.discard = true
+		} else {
+			log.Printf("Using in-memory storage, completed uploads are discarded")
+		}
+		newHashingStore(memStore).UseIn(composer)
+		memorylocker.New().UseIn(composer)
+	} else {
+		newHashingStore(filestore.New(TempUploadPath)).UseIn(composer)
+		filelocker.New(TempUploadPath).UseIn(composer)
+	}
+
+	if StorageBackend == storageFile {
+		var err error
+		storedFiles, err = openFileIndex(filepath.Join(TempUploadPath, "index.json"))
+		if err != nil {
+			log.Fatalf("Unable to load file index: %s", err.Error())
+		}
+		storeRetries, err = newStoreRetryQueue(filepath.Join(TempUploadPath, "pending-stores.json"))
+		if err != nil {
+			log.Fatalf("Unable to load pending stores: %s", err.Error())
+		}
+		if SpaceReservation {
+			if _, err := diskFree(TempUploadPath); err != nil {
+				log.Fatalf("SPACE_RESERVATION is not available: %s", err.Error())
+			}
+			reservations, err = newSpaceReservations(context.Background(), composer)
+			if err != nil {
+				log.Fatalf("Unable to reserve space for incomplete uploads: %s", err.Error())
+			}
+			total, n := reservations.reserved()
+			log.Printf("Reserved %s of %s for %d incomplete uploads", formatByteSize(total), TempUploadPath, n)
+		}
+		if len(UploadWindows) > 0 || MaxActiveUploads > 0 {
+			if err := uploadQueue.load(context.Background(), composer); err != nil {
+				log.Fatalf("Unable to load queued uploads: %s", err.Error())
+			}
+		}
+		if VirusTotalAPIKey != "" {
+			virusTotal, err = newVTLookupQueue(filepath.Join(TempUploadPath, "virustotal.json"), VirusTotalAPIKey)
+			if err != nil {
+				log.Fatalf("Unable to load VirusTotal queue: %s", err.Error())
+			}
+		}
+		if ReceiptsEnabled {
+			receiptKey, err = loadReceiptKey(ReceiptKey)
+			if err != nil {
+				log.Fatalf("Unable to load RECEIPT_KEY: %s", err.Error())
+			}
+		}
+	}
+	deliveryJournal := ""
+	if StorageBackend == storageFile {
+		deliveryJournal = filepath.Join(TempUploadPath, "deliveries.json")
+	}
+	if tracker, err := newDeliveryTracker(deliveryJournal); err != nil {
+		log.Fatalf("Unable to load deliveries: %s", err.Error())
+	} else {
+		deliveries = tracker
+	}
+	tokenJournal := ""
+	if StorageBackend == storageFile {
+		tokenJournal = filepath.Join(TempUploadPath, "tokens.json")
+	}
+	if registry, err := newTokenRegistry(tokenJournal); err != nil {
+		log.Fatalf("Unable to load upload tokens: %s", err.Error())
+	} else {
+		uploadTokens = registry
+	}
+	overrideJournal := ""
+	if StorageBackend == storageFile {
+		overrideJournal = filepath.Join(TempUploadPath, "overrides.json")
+	}
+	if book, err := newOverrideBook(overrideJournal); err != nil {
+		log.Fatalf("Unable to load override requests: %s", err.Error())
+	} else {
+		limitOverrides = book
+	}
+
+	background, stopBackground := context.WithCancel(context.Background())
+	if storeRetries != nil {
+		go storeRetries.run(background)
+	}
+	if virusTotal != nil {
+		go virusTotal.run(background)
+	}
+	if StatsdAddr != "" {
+		log.Printf("Sending metrics to statsd at %s", StatsdAddr)
+		go runStatsd(background)
+	}
+	if MQTTBroker != nil {
+		mqttEvents = newMQTTPublisher(MQTTBroker, MQTTClientID)
+		go mqttEvents.run(background)
+	}
+	if ReplicaTarget != "" {
+		target, err := newStorageTarget(ReplicaTarget, ReplicaS3)
+		if err != nil {
+			log.Fatalf("Invalid REPLICA_TARGET: %s", err.Error())
+		}
+		replication, err = newReplicator(target, filepath.Join(TempUploadPath, "replication.json"))
+		if err != nil {
+			log.Fatalf("Unable to load replication journal: %s", err.Error())
+		}
+		log.Printf("Replicating stored files to %s", target)
+		go replication.run(background)
+	}
+	if WatchFolder != "" {
+		var err error
+		watchFolder, err = newWatchFolderExporter(WatchFolder, os.Getenv("WATCH_FOLDER_PATH"), os.Getenv("WATCH_FOLDER_SIDECAR_PATH"),
+			os.Getenv("WATCH_FOLDER_SIDECAR"), filepath.Join(TempUploadPath, "watchfolder.json"))
+		if err != nil {
+			log.Fatalf("Invalid WATCH_FOLDER: %s", err.Error())
+		}
+		log.Printf("Exporting stored files to the watch folder %s", WatchFolder)
+		go watchFolder.run(background)
+	}
+	if TieringTarget != "" {
+		target, err := newStorageTarget(TieringTarget, TieringS3)
+		if err != nil {
+			log.Fatalf("Invalid TIERING_TARGET: %s", err.Error())
+		}
+		tiering = target
+		log.Printf("Moving files older than %d days to %s", TieringAfter/(24*time.Hour), tiering)
+	}
 
 	config := tusd.Config{
 		BasePath:              BaseURL,
@@ -142,38 +1890,253 @@ func main() {
 		DisableDownload:       true,
 		MaxSize:               0,
 		NetworkTimeout:        30 * time.Minute,
+		PreUploadCreateCallback: func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+			changes, err := prepareUpload(hook, composer)
+			return tusd.HTTPResponse{}, changes, err
+		},
+		PreFinishResponseCallback: func(hook tusd.HookEvent) (tusd.HTTPResponse, error) {
+			if err := verifyUploadChecksum(hook.Upload); err != nil {
+				log.Printf("Upload %s rejected: %s", hook.Upload.ID, err.Error())
+				if upload, err := composer.Core.GetUpload(hook.Context, hook.Upload.ID); err == nil {
+					composer.Terminater.AsTerminatableUpload(upload).Terminate(hook.Context)
+				}
+				return tusd.HTTPResponse{}, tusd.NewError("ERR_CHECKSUM_MISMATCH", "upload checksum mismatch", 460)
+			}
+			return completionResponse(hook.Upload), nil
+		},
 	}
 	tusHandler, err := tusd.NewHandler(config)
 	if err != nil {
 		log.Fatalf("Unable to create tus handler: %s", err.Error())
 	}
 
-	go func() {
-		for {
-			event := <-tusHandler.CompleteUploads
-			log.Printf("Upload %s finished", event.Upload.ID)
-			srcPath := filepath.Join(TempUploadPath, event.Upload.ID)
-			origName := event.Upload.MetaData["filename"]
-			if origName == "" {
-				origName = "file"
-			}
-			newFileName := fmt.Sprintf("%s_%s", time.Now().Format("20060102_150405"), origName)
-			dstPath := filepath.Join(UploadPath, newFileName)
-			if err := moveFile(srcPath, dstPath); err != nil {
-				log.Printf("Error moving file: %s", err.Error())
-			} else {
-				log.Printf("File moved to %s", dstPath)
+	if LoudnormEnabled {
+		if _, err := exec.LookPath(FFmpegPath); err != nil {
+			log.Fatalf("LOUDNORM_ENABLED needs ffmpeg: %s", err.Error())
+		}
+	}
+	if len(ConversionRules) > 0 {
+		if _, err := exec.LookPath(FFmpegPath); err != nil {
+			log.Fatalf("CONVERSION_RULES needs ffmpeg: %s", err.Error())
+		}
+	}
+	if PreviewsEnabled {
+		if _, err := exec.LookPath(FFmpegPath); err != nil {
+			log.Fatalf("PREVIEWS_ENABLED needs ffmpeg: %s", err.Error())
+		}
+		if err := os.MkdirAll(PreviewPath, 0755); err != nil {
+			log.Fatalf("Unable to create the preview directory: %s", err.Error())
+		}
+	}
+
+	sched := &scheduler{}
+	// Upload policies may set a retention period without a global one.
+	policyRetention := slices.ContainsFunc(UploadPolicies, func(p *uploadPolicy) bool { return p.RetentionDays > 0 })
+	// Jobs working on the shared storage run on the leader only, when
+	// replicas elect one.
+	jobs := []struct {
+		name, schedule string
+		enabled        bool
+		leaderOnly     bool
+		run            func(ctx context.Context) (string, error)
+	}{
+		{"gc", "@hourly", true, true, func(ctx context.Context) (string, error) {
+			return collectExpiredUploads(ctx, composer, time.Now().Add(-UploadExpiry), time.Now().Add(-TruncatedUploadGrace))
+		}},
+		{"retention", "@daily", RetentionPeriod > 0 || policyRetention, true, applyRetention},
+		{"tiering", "@hourly", tiering != nil, true, func(ctx context.Context) (string, error) {
+			moved, err := tierOldFiles(ctx, time.Now().Add(-TieringAfter))
+			if moved == 0 {
+				return "", err
 			}
+			return fmt.Sprintf("moved %d files to %s", moved, tiering), err
+		}},
+		{"scrub", "@weekly", storedFiles != nil, true, scrubStoredFiles},
+		{"routing", "@hourly", storedFiles != nil && slices.ContainsFunc(RoutingRules, func(r *routingRule) bool { return r.target != nil }), true, routePendingFiles},
+		{"loudnorm", "*/15 * * * *", LoudnormEnabled && StorageBackend == storageFile, true, normalizeLoudness},
+		{"previews", "*/15 * * * *", PreviewsEnabled && StorageBackend == storageFile, true, writePreviews},
+		{"conversions", "@hourly", len(ConversionRules) > 0 && StorageBackend == storageFile, true, convertStored},
+		{"stats", "*/5 * * * *", true, false, collectStats},
+		{"healthcheck", "@every 1m", true, false, checkHealth},
+		{"temp-usage", "@every 1m", StorageBackend == storageFile, false, measureTempUsage},
+	}
+	for _, job := range jobs {
+		if !job.enabled {
+			continue
 		}
-	}()
+		if err := sched.add(job.name, job.schedule, job.leaderOnly, job.run); err != nil {
+			log.Fatalf("Invalid schedule: %s", err.Error())
+		}
+	}
+	if LeaderElectionLease != "" {
+		elector, err := newLeaderElector(LeaderElectionLease)
+		if err != nil {
+			log.Fatalf("Unable to set up leader election: %s", err.Error())
+		}
+		leader = elector
+		go leader.run(background)
+	}
+	sched.start(background)
+	if job := sched.job("conversions"); job != nil {
+		go runConversionsOnStore(background, job)
+	}
+
+	go finishCompleted(tusHandler.CompleteUploads)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", indexHandler)
-	mux.Handle("/files/", http.StripPrefix("/files/", tusHandler))
+	mux.HandleFunc("/{$}", withETag(indexHandler))
+	mux.HandleFunc("/", notFoundHandler)
+	mux.HandleFunc("/sw.js", withETag(serviceWorkerHandler))
+	mux.HandleFunc("/chunk-sizer.js", withETag(chunkSizerHandler))
+	mux.HandleFunc("/messages.js", withETag(messagesHandler))
+	mux.HandleFunc("/fingerprint.js", withETag(fingerprintHandler))
+	mux.HandleFunc("/manifest.webmanifest", withETag(manifestHandler))
+	mux.HandleFunc("/logo", withETag(logoHandler))
+	for _, size := range append([]int{appleTouchIconSize}, iconSizes...) {
+		mux.HandleFunc(fmt.Sprintf("/icon-%d.png", size), withETag(iconHandler))
+	}
+	mux.Handle("/files/", withIdempotency(withErrorSchema(http.StripPrefix("/files/", withStoredVerify(withUploadPin(composer, withChunkEcho(withUploadExpires(composer, tusHandler))))))))
+	mux.Handle("/resumable/", http.StripPrefix("/resumable/", &resumableHandler{composer: composer}))
+	mux.Handle("/ws/", http.StripPrefix("/ws/", &wsHandler{composer: composer}))
+	mux.HandleFunc("/api/uploads", uploadsStatusHandler(composer))
+	mux.HandleFunc("/api/uploads/events", uploadEventsHandler(composer))
+	mux.HandleFunc("/api/uploads/keepalive", keepAliveHandler(composer))
+	mux.HandleFunc("/api/uploads/heartbeat", heartbeatHandler(composer))
+	mux.HandleFunc("/api/my/uploads", historyHandler(composer))
+	mux.HandleFunc("/my", withETag(historyPageHandler))
+	mux.Handle("/api/overrides", http.StripPrefix("/api/overrides", http.HandlerFunc(overrideHandler)))
+	mux.Handle("/api/overrides/", http.StripPrefix("/api/overrides", http.HandlerFunc(overrideHandler)))
+	mux.Handle("/api/uploads/", http.StripPrefix("/api/uploads/", &chunkHandler{composer: composer}))
+	mux.HandleFunc("/api/speedtest", speedTestHandler)
+	mux.HandleFunc("/api/settings", clientSettingsHandler)
+	mux.Handle("/api/direct/", withIdempotency(http.StripPrefix("/api/direct", http.HandlerFunc(directHandler))))
+	mux.Handle("/api/deliveries/", http.StripPrefix("/api/deliveries/", http.HandlerFunc(deliveryHandler)))
+	mux.Handle("/api/receipts/", http.StripPrefix("/api/receipts/", http.HandlerFunc(receiptHandler)))
+	mux.HandleFunc("/ready", readyHandler)
+	mux.Handle("/delta/", http.StripPrefix("/delta/", &deltaHandler{composer: composer}))
+	if WebDAVEnabled {
+		mux.Handle("/webdav/", newWebDAVHandler("/webdav", composer))
+	}
+
+	handler := withRequestID(withGeoPolicy(withCompression(mux)))
+	var shutdowners []interface{ Shutdown(context.Context) error }
+
+	// The API is served over TLS on HTTPS_LISTEN if set, on HTTP_LISTEN
+	// otherwise.
+	tlsAddr := HTTPListen
+	if HTTPSListen != "" {
+		tlsAddr = HTTPSListen
+	}
+	if HTTP3Enabled {
+		if TLSCert == "" {
+			log.Fatalf("HTTP3_ENABLED requires TLS_CERT and TLS_KEY")
+		}
+		cert, err := tls.LoadX509KeyPair(TLSCert, TLSKey)
+		if err != nil {
+			log.Fatalf("Unable to load TLS_CERT and TLS_KEY: %s", err.Error())
+		}
+		h3srv := &http3.Server{
+			Addr:      tlsAddr,
+			Handler:   handler,
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+		if conn, err := net.ListenPacket(listenNetwork("udp"), tlsAddr); err != nil {
+			log.Printf("HTTP/3 Listen: %v", err)
+		} else {
+			shutdowners = append(shutdowners, h3srv)
+			handler = advertiseHTTP3(h3srv, handler)
+			go func() {
+				log.Printf("Experimental HTTP/3 server started on udp %s", listenerAddr(conn.LocalAddr()))
+				if err := h3srv.Serve(conn); err != nil && err != http.ErrServerClosed {
+					log.Printf("HTTP/3 Serve: %v", err)
+				}
+			}()
+		}
+	}
 
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+		Addr:    HTTPListen,
+		Handler: handler,
+	}
+	if HTTPSListen != "" {
+		// The TLS listener is the main one, HTTP_LISTEN serves plaintext
+		// alongside it, or redirects to it.
+		plain := srv
+		srv = &http.Server{
+			Addr:    HTTPSListen,
+			Handler: handler,
+		}
+		if TLSRedirect {
+			plain.Handler = withRequestID(http.HandlerFunc(redirectToHTTPS))
+		} else if HTTP2Cleartext {
+			plain.Protocols = new(http.Protocols)
+			plain.Protocols.SetHTTP1(true)
+			plain.Protocols.SetUnencryptedHTTP2(true)
+		}
+		shutdowners = append(shutdowners, plain)
+		plainLn := listenPublic(plain.Addr)
+		go func() {
+			if TLSRedirect {
+				log.Printf("Redirecting %s to HTTPS", listenerAddr(plainLn.Addr()))
+			} else {
+				log.Printf("Server started on %s", listenerAddr(plainLn.Addr()))
+			}
+			if err := plain.Serve(plainLn); err != http.ErrServerClosed {
+				log.Fatalf("ListenAndServe: %v", err)
+			}
+		}()
+	} else if HTTP2Cleartext {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	shutdowners = append(shutdowners, srv)
+
+	if S3Addr != "" {
+		s3srv := &http.Server{
+			Addr:    S3Addr,
+			Handler: withRequestID(withGeoPolicy(&s3Handler{composer: composer})),
+		}
+		shutdowners = append(shutdowners, s3srv)
+		ln, err := listenTCP(S3Addr)
+		if err != nil {
+			log.Fatalf("S3 Listen: %v", err)
+		}
+		go func() {
+			log.Printf("S3 API started on %s", listenerAddr(ln.Addr()))
+			if err := s3srv.Serve(ln); err != http.ErrServerClosed {
+				log.Fatalf("S3 ListenAndServe: %v", err)
+			}
+		}()
+	}
+
+	if AdminListen != "" {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/", notFoundHandler)
+		adminMux.Handle("/scheduler", sched)
+		adminMux.Handle("/scheduler/", sched)
+		(&adminAPI{composer: composer}).register(adminMux)
+		adminSrv, err := startAdmin(adminMux)
+		if err != nil {
+			log.Fatalf("Unable to start admin API: %s", err.Error())
+		}
+		shutdowners = append(shutdowners, adminSrv)
+	}
+
+	var listeners []net.Listener
+	if SFTPAddr != "" {
+		ln, err := startSFTP(composer)
+		if err != nil {
+			log.Fatalf("Unable to start SFTP server: %s", err.Error())
+		}
+		listeners = append(listeners, ln)
+	}
+	if FTPAddr != "" {
+		ln, err := startFTP(composer)
+		if err != nil {
+			log.Fatalf("Unable to start FTP server: %s", err.Error())
+		}
+		listeners = append(listeners, ln)
 	}
 
 	idleConnsClosed := make(chan struct{})
@@ -181,14 +2144,37 @@ func main() {
 		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		<-sigint
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		// Kubernetes sends SIGTERM while it takes the pod out of the
+		// service: /ready fails from now on, uploads in flight get
+		// SHUTDOWN_DRAIN_SECONDS to complete. A second signal cuts it short.
+		if ShutdownDrain > 0 {
+			startDrain()
+			waitDrained(ShutdownDrain, sigint)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
 		defer cancel()
-		srv.Shutdown(ctx)
+		stopBackground()
+		if leader != nil {
+			leader.release(ctx)
+		}
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		for _, s := range shutdowners {
+			s.Shutdown(ctx)
+		}
 		close(idleConnsClosed)
 	}()
 
-	log.Println("Server started on :8080")
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	ln := listenPublic(srv.Addr)
+	if TLSCert != "" {
+		log.Printf("Server started on %s with TLS and HTTP/2", listenerAddr(ln.Addr()))
+		err = srv.ServeTLS(ln, TLSCert, TLSKey)
+	} else {
+		log.Printf("Server started on %s", listenerAddr(ln.Addr()))
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		log.Fatalf("ListenAndServe: %v", err)
 	}
 	<-idleConnsClosed
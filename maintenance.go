@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// incompleteUploads returns the IDs of the uploads in the temporary store
+// with the time they were last written to.
+func incompleteUploads() (map[string]time.Time, error) {
+	if StorageBackend != storageFile {
+		return memStore.modTimes(), nil
+	}
+	entries, err := os.ReadDir(TempUploadPath)
+	if err != nil {
+		return nil, err
+	}
+	uploads := map[string]time.Time{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		uploads[id] = uploadModTime(id)
+	}
+	return uploads, nil
+}
+
+// collectExpiredUploads removes incomplete uploads that were not written to
+// since cutoff, or since truncatedCutoff for uploads found truncated on
+// completion, incomplete uploads past their deadline, temporary files left
+// behind by interrupted writes and the data of failed uploads past
+// FailedUploadGrace. Truncated uploads are recorded as failed uploads.
+func collectExpiredUploads(ctx context.Context, composer *tusd.StoreComposer, cutoff, truncatedCutoff time.Time) (string, error) {
+	uploads, err := incompleteUploads()
+	if err != nil {
+		return "", err
+	}
+	removed := 0
+	for id, modified := range uploads {
+		if storeRetries != nil && storeRetries.has(id) {
+			// Complete, waiting for space in UploadPath.
+			continue
+		}
+		expiry := cutoff
+		truncated := false
+		if hashes, err := loadUploadHashes(id); err == nil && !hashes.Truncated.IsZero() {
+			expiry, truncated = truncatedCutoff, true
+		}
+		if modified.After(expiry) && !pastDeadline(ctx, composer, id) {
+			continue
+		}
+		err := withUploadLock(ctx, composer, id, func(upload tusd.Upload) error {
+			if info, err := upload.GetInfo(ctx); err == nil && truncated {
+				recordFailedUpload(info, failedTruncated, errUploadTruncated)
+			}
+			return composer.Terminater.AsTerminatableUpload(upload).Terminate(ctx)
+		})
+		if err != nil {
+			log.Printf("Unable to remove expired upload %s: %s", id, err.Error())
+			continue
+		}
+		removed++
+	}
+
+	stale := 0
+	if StorageBackend == storageFile {
+		entries, _ := os.ReadDir(TempUploadPath)
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".tmp") {
+				continue
+			}
+			if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+				if os.Remove(filepath.Join(TempUploadPath, entry.Name())) == nil {
+					stale++
+				}
+			}
+		}
+	}
+	failed := 0
+	if StorageBackend == storageFile {
+		failed = collectFailedUploads(time.Now())
+	}
+	if removed == 0 && stale == 0 && failed == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("removed %d expired uploads, %d stale temporary files and the data of %d failed uploads", removed, stale, failed), nil
+}
+
+// terminateUpload removes an incomplete upload while holding its lock, so
+// it cannot be removed while a client is writing to it.
+func terminateUpload(ctx context.Context, composer *tusd.StoreComposer, id string) error {
+	return withUploadLock(ctx, composer, id, func(upload tusd.Upload) error {
+		return composer.Terminater.AsTerminatableUpload(upload).Terminate(ctx)
+	})
+}
+
+// withUploadLock calls fn with the upload id while holding its lock.
+func withUploadLock(ctx context.Context, composer *tusd.StoreComposer, id string, fn func(upload tusd.Upload) error) error {
+	lockCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	lock, err := composer.Locker.NewLock(id)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(lockCtx, func() {}); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	upload, err := composer.Core.GetUpload(ctx, id)
+	if err != nil {
+		return err
+	}
+	return fn(upload)
+}
+
+// applyRetention deletes stored files, tiered or not, that are older than
+// their retention period: RetentionPeriod, unless the policy of their upload
+// set another.
+func applyRetention(ctx context.Context) (string, error) {
+	now := time.Now()
+	deleted := 0
+	err := walkStoredFiles(ctx, func(name string, info fs.FileInfo, tiered bool) error {
+		modified := storedSince(name, info.ModTime())
+		if tiered {
+			stub, err := readTieredStub(name)
+			if err != nil {
+				return nil
+			}
+			modified = storedSince(name, stub.ModTime)
+		}
+		if retention := retentionFor(name); retention == 0 || modified.After(now.Add(-retention)) {
+			return nil
+		}
+		if err := deleteStored(name, tiered); err != nil {
+			log.Printf("Unable to delete %s: %s", name, err.Error())
+			return nil
+		}
+		deleted++
+		return nil
+	})
+	if deleted == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("deleted %d files past their retention period", deleted), err
+}
+
+// deleteStored deletes name, relative to UploadPath, or its stub if it was
+// tiered, and forgets it in the file index. The cold storage copy of a
+// tiered file is left alone.
+func deleteStored(name string, tiered bool) error {
+	p := filepath.Join(UploadPath, filepath.FromSlash(name))
+	if tiered {
+		p += tieredSuffix
+	}
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	if storedFiles != nil {
+		storedFiles.remove(name)
+	}
+	removeMetadataSidecar(name)
+	removePreview(name)
+	return nil
+}
+
+// renameStored moves the stored file name, relative to UploadPath, to
+// newName.
+func renameStored(name, newName string) error {
+	if err := os.Rename(filepath.Join(UploadPath, filepath.FromSlash(name)), filepath.Join(UploadPath, filepath.FromSlash(newName))); err != nil {
+		return err
+	}
+	storedRenamed(name, newName)
+	return nil
+}
+
+// storedRenamed moves the record and the sidecars of the stored file name,
+// moved to newName, and replicates it under its new name.
+func storedRenamed(name, newName string) {
+	src := filepath.Join(UploadPath, filepath.FromSlash(name))
+	dst := filepath.Join(UploadPath, filepath.FromSlash(newName))
+	if MetadataSidecars != "" {
+		os.Rename(src+metadataSuffix(MetadataSidecars), dst+metadataSuffix(MetadataSidecars))
+	}
+	removePreview(name)
+	sum := ""
+	if storedFiles != nil {
+		storedFiles.rename(name, newName)
+		if rec, ok := storedFiles.get(newName); ok {
+			sum = rec.SHA256
+		}
+		// The checksum sidecar names the file.
+		os.Remove(src + checksumSuffix)
+		writeChecksumSidecar(newName, sum)
+	}
+	if replication != nil {
+		replication.enqueue(newName)
+		if ChecksumSidecars && sum != "" {
+			replication.enqueue(newName + checksumSuffix)
+		}
+		if MetadataSidecars != "" {
+			replication.enqueue(newName + metadataSuffix(MetadataSidecars))
+		}
+	}
+}
+
+// storageStats is a snapshot of the storage usage, refreshed by the stats
+// job.
+type storageStats struct {
+	Files             int       `json:"files"`
+	Bytes             int64     `json:"bytes"`
+	TieredFiles       int       `json:"tiered_files"`
+	TieredBytes       int64     `json:"tiered_bytes"`
+	IncompleteUploads int       `json:"incomplete_uploads"`
+	Updated           time.Time `json:"updated"`
+}
+
+var (
+	statsMu     sync.Mutex
+	latestStats storageStats
+)
+
+func collectStats(ctx context.Context) (string, error) {
+	var stats storageStats
+	err := filepath.WalkDir(UploadPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() || isSidecar(p) {
+			return nil
+		}
+		if name, ok := strings.CutSuffix(p, tieredSuffix); ok {
+			rel, _ := filepath.Rel(UploadPath, name)
+			if stub, err := readTieredStub(filepath.ToSlash(rel)); err == nil {
+				stats.TieredFiles++
+				stats.TieredBytes += stub.Size
+			}
+			return nil
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	uploads, err := incompleteUploads()
+	if err != nil {
+		return "", err
+	}
+	stats.IncompleteUploads = len(uploads)
+	stats.Updated = time.Now()
+
+	statsMu.Lock()
+	latestStats = stats
+	statsMu.Unlock()
+	return fmt.Sprintf("%d files (%s), %d tiered (%s), %d incomplete uploads",
+		stats.Files, formatByteSize(stats.Bytes), stats.TieredFiles, formatByteSize(stats.TieredBytes), stats.IncompleteUploads), nil
+}
+
+// checkHealth verifies that the storage directories are writable and the
+// remote targets are reachable.
+func checkHealth(ctx context.Context) (string, error) {
+	var errs []error
+	dirs := []string{UploadPath}
+	if StorageBackend == storageFile {
+		dirs = append(dirs, TempUploadPath)
+	}
+	for _, dir := range dirs {
+		probe := filepath.Join(dir, ".healthcheck.tmp")
+		if err := os.WriteFile(probe, []byte("ok"), 0644); err != nil {
+			errs = append(errs, fmt.Errorf("%s is not writable: %w", dir, err))
+			continue
+		}
+		os.Remove(probe)
+	}
+	targets := map[string]storageTarget{}
+	if replication != nil {
+		targets["replica"] = replication.target
+	}
+	if tiering != nil {
+		targets["cold storage"] = tiering
+	}
+	for i, r := range RoutingRules {
+		if r.target != nil {
+			targets[fmt.Sprintf("routing rule %d target", i+1)] = r.target
+		}
+	}
+	for name, target := range targets {
+		checkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, err := target.Size(checkCtx, ".healthcheck")
+		cancel()
+		if err != nil && err != errRemoteMissing {
+			errs = append(errs, fmt.Errorf("%s %s is unreachable: %w", name, target, err))
+		}
+	}
+	return "", errors.Join(errs...)
+}
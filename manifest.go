@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// The <id>.hash sidecar is appended to while an upload is received: its
+// first line is the manifest as uploadHashes.save wrote it, and every chunk
+// written since adds a line with its hash and the running hash state after
+// it. Recording a chunk thus costs the same however many chunks came
+// before, instead of rewriting the whole manifest. The manifest of an
+// upload being written is kept in memory as well, so it is not read and
+// parsed again for every chunk; the length of the sidecar is compared first,
+// in case another instance sharing TempUploadPath wrote to the upload.
+
+// chunkLogEntry is a line appended to the sidecar for a chunk.
+type chunkLogEntry struct {
+	chunkHash
+	State []byte `json:"state"`
+}
+
+// sessionManifest is the manifest of an upload as of a sidecar of size
+// bytes.
+type sessionManifest struct {
+	hashes *uploadHashes
+	size   int64
+}
+
+var (
+	sessionManifestsMu sync.Mutex
+	sessionManifests   = map[string]sessionManifest{}
+)
+
+// parseUploadHashes parses the sidecar data: the manifest and the chunk
+// lines appended to it. A line cut short by a crash marks the hash broken,
+// the data of its chunk was written without it.
+func parseUploadHashes(data []byte) (*uploadHashes, error) {
+	hashes := &uploadHashes{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(hashes); err != nil {
+		return hashes, err
+	}
+	for {
+		var entry chunkLogEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			hashes.Broken = true
+			break
+		}
+		hashes.Chunks = append(hashes.Chunks, entry.chunkHash)
+		hashes.State = entry.State
+	}
+	return hashes, nil
+}
+
+// hashSidecarSize returns the length of the sidecar of id, 0 if there is
+// none.
+func hashSidecarSize(id string) int64 {
+	if StorageBackend != storageFile {
+		return memStore.sidecarSize(id)
+	}
+	stat, err := os.Stat(hashSidecarPath(id))
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// sessionHashes returns the manifest of the upload id to record a chunk in,
+// from memory when the sidecar did not change since.
+func sessionHashes(id string) (*uploadHashes, error) {
+	size := hashSidecarSize(id)
+	sessionManifestsMu.Lock()
+	m, ok := sessionManifests[id]
+	sessionManifestsMu.Unlock()
+	if ok && m.size == size {
+		return m.hashes, nil
+	}
+	hashes, size, err := readUploadHashes(id)
+	if err != nil {
+		return nil, err
+	}
+	rememberHashes(id, hashes, size)
+	return hashes, nil
+}
+
+func rememberHashes(id string, hashes *uploadHashes, size int64) {
+	sessionManifestsMu.Lock()
+	sessionManifests[id] = sessionManifest{hashes: hashes, size: size}
+	sessionManifestsMu.Unlock()
+}
+
+// forgetHashes drops the manifest of the upload id from memory.
+func forgetHashes(id string) {
+	sessionManifestsMu.Lock()
+	delete(sessionManifests, id)
+	sessionManifestsMu.Unlock()
+}
+
+// appendChunk records the last chunk of h in the sidecar of id. The
+// manifest is saved whole if the sidecar is missing.
+func (h *uploadHashes) appendChunk(id string) error {
+	if hashSidecarSize(id) == 0 {
+		return h.save(id)
+	}
+	line, err := json.Marshal(chunkLogEntry{chunkHash: h.Chunks[len(h.Chunks)-1], State: h.State})
+	if err != nil {
+		return err
+	}
+	line = append([]byte{'\n'}, line...)
+	if StorageBackend != storageFile {
+		rememberHashes(id, h, memStore.appendSidecar(id, line))
+		return nil
+	}
+	f, err := os.OpenFile(hashSidecarPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		forgetHashes(id)
+		return err
+	}
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		forgetHashes(id)
+		return err
+	}
+	rememberHashes(id, h, hashSidecarSize(id))
+	return nil
+}
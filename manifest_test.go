@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// withManifestStore keeps the hash sidecars in a temporary directory for
+// the rest of the test.
+func withManifestStore(tb testing.TB) {
+	tb.Helper()
+	oldBackend, oldPath := StorageBackend, TempUploadPath
+	StorageBackend, TempUploadPath = storageFile, tb.TempDir()
+	tb.Cleanup(func() {
+		StorageBackend, TempUploadPath = oldBackend, oldPath
+	})
+}
+
+// recordTestChunk records a chunk of 1 MiB after those of id, as
+// WriteChunk does.
+func recordTestChunk(tb testing.TB, id string) {
+	tb.Helper()
+	hashes, err := sessionHashes(id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	offset := int64(len(hashes.Chunks)) << 20
+	hashes.Chunks = append(hashes.Chunks, chunkHash{Offset: offset, Size: 1 << 20, SHA256: fmt.Sprintf("%064x", offset)})
+	hashes.State = []byte(fmt.Sprintf("state %d", offset))
+	if err := hashes.appendChunk(id); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestManifestAppendChunk(t *testing.T) {
+	withManifestStore(t)
+	const id = "manifest"
+	if err := (&uploadHashes{}).save(id); err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		recordTestChunk(t, id)
+	}
+	forgetHashes(id)
+	hashes, err := loadUploadHashes(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes.Chunks) != 10 || hashes.Broken {
+		t.Fatalf("read %d chunks back, broken %v, want 10", len(hashes.Chunks), hashes.Broken)
+	}
+	for i, c := range hashes.Chunks {
+		if c.Offset != int64(i)<<20 {
+			t.Fatalf("chunk %d at offset %d", i, c.Offset)
+		}
+	}
+	if want := fmt.Sprintf("state %d", 9<<20); string(hashes.State) != want {
+		t.Fatalf("state %q, want %q", hashes.State, want)
+	}
+}
+
+// BenchmarkManifestAppendChunk records chunk N of uploads that already
+// have N-1 chunks, which should cost the same for every N.
+func BenchmarkManifestAppendChunk(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			withManifestStore(b)
+			const id = "manifest"
+			hashes := &uploadHashes{}
+			for i := range n - 1 {
+				hashes.Chunks = append(hashes.Chunks, chunkHash{Offset: int64(i) << 20, Size: 1 << 20, SHA256: fmt.Sprintf("%064x", i)})
+			}
+			if err := hashes.save(id); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				recordTestChunk(b, id)
+			}
+			b.StopTimer()
+			forgetHashes(id)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	storageFile    = "file"
+	storageMemory  = "memory"
+	storageDiscard = "discard"
+)
+
+var errDataDiscarded = errors.New("upload data was discarded")
+
+// memoryStore keeps uploads and their hash sidecars in memory. It is meant
+// for integration and load tests: the whole upload protocol runs as usual,
+// but nothing touches the disk and completed uploads are discarded instead
+// of being moved to UploadPath. Everything is lost on restart.
+//
+// With discard set, chunks are only counted and hashed (by the hashingStore
+// wrapping this store) and the data itself is thrown away. That dry-run mode
+// measures network and handler overhead independent of disk and memory
+// speed; protocols that need to read the data back, such as S3 multipart
+// uploads and delta uploads, fail in it.
+type memoryStore struct {
+	discard bool
+
+	mu       sync.Mutex
+	uploads  map[string]*memoryUpload
+	sidecars map[string][]byte
+}
+
+// memStore is the store used when STORAGE_BACKEND is "memory" or "discard".
+var memStore = &memoryStore{
+	uploads:  map[string]*memoryUpload{},
+	sidecars: map[string][]byte{},
+}
+
+func (s *memoryStore) NewUpload(ctx context.Context, info tusd.FileInfo) (tusd.Upload, error) {
+	if info.ID == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		info.ID = hex.EncodeToString(b)
+	}
+	info.Storage = map[string]string{"Type": "memorystore"}
+	upload := &memoryUpload{store: s, info: info, modified: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[info.ID]; ok {
+		return nil, fmt.Errorf("upload %s already exists", info.ID)
+	}
+	s.uploads[info.ID] = upload
+	return upload, nil
+}
+
+func (s *memoryStore) GetUpload(ctx context.Context, id string) (tusd.Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[id]
+	if !ok {
+		return nil, tusd.ErrNotFound
+	}
+	return upload, nil
+}
+
+func (s *memoryStore) AsTerminatableUpload(upload tusd.Upload) tusd.TerminatableUpload {
+	return upload.(*memoryUpload)
+}
+
+func (s *memoryStore) AsLengthDeclarableUpload(upload tusd.Upload) tusd.LengthDeclarableUpload {
+	return upload.(*memoryUpload)
+}
+
+// remove drops an upload and its sidecar.
+func (s *memoryStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, id)
+	delete(s.sidecars, id)
+}
+
+// modTimes returns the time of the last write to every upload.
+func (s *memoryStore) modTimes() map[string]time.Time {
+	s.mu.Lock()
+	uploads := make([]*memoryUpload, 0, len(s.uploads))
+	for _, upload := range s.uploads {
+		uploads = append(uploads, upload)
+	}
+	s.mu.Unlock()
+	times := make(map[string]time.Time, len(uploads))
+	for _, upload := range uploads {
+		upload.mu.Lock()
+		times[upload.info.ID] = upload.modified
+		upload.mu.Unlock()
+	}
+	return times
+}
+
+// touch marks the upload id as written to now.
+func (s *memoryStore) touch(id string) {
+	s.mu.Lock()
+	upload := s.uploads[id]
+	s.mu.Unlock()
+	if upload != nil {
+		upload.mu.Lock()
+		upload.modified = time.Now()
+		upload.mu.Unlock()
+	}
+}
+
+func (s *memoryStore) sidecar(id string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sidecars[id]
+}
+
+func (s *memoryStore) setSidecar(id string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sidecars[id] = data
+}
+
+// appendSidecar appends data to the sidecar of id and returns its new
+// length.
+func (s *memoryStore) appendSidecar(id string, data []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sidecars[id] = append(s.sidecars[id], data...)
+	return int64(len(s.sidecars[id]))
+}
+
+func (s *memoryStore) sidecarSize(id string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.sidecars[id]))
+}
+
+type memoryUpload struct {
+	store *memoryStore
+
+	mu       sync.Mutex
+	info     tusd.FileInfo
+	data     []byte
+	modified time.Time
+}
+
+func (u *memoryUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if offset != u.info.Offset {
+		return 0, fmt.Errorf("upload %s: write at %d, expected %d", u.info.ID, offset, u.info.Offset)
+	}
+	u.modified = time.Now()
+	if u.store.discard {
+		n, err := io.Copy(io.Discard, src)
+		u.info.Offset += n
+		return n, err
+	}
+	// Like the file store, keep whatever was read before an error.
+	buf := bytes.NewBuffer(u.data)
+	n, err := buf.ReadFrom(src)
+	u.data = buf.Bytes()
+	u.info.Offset += n
+	return n, err
+}
+
+func (u *memoryUpload) GetInfo(ctx context.Context) (tusd.FileInfo, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.info, nil
+}
+
+func (u *memoryUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	if u.store.discard {
+		return nil, errDataDiscarded
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(u.data)), nil
+}
+
+func (u *memoryUpload) FinishUpload(ctx context.Context) error {
+	return nil
+}
+
+func (u *memoryUpload) Terminate(ctx context.Context) error {
+	u.store.remove(u.info.ID)
+	return nil
+}
+
+func (u *memoryUpload) DeclareLength(ctx context.Context, length int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.info.Size = length
+	u.info.SizeIsDeferred = false
+	return nil
+}
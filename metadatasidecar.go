@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Metadata sidecars describe every stored file for archive tools, in a file
+// next to it: its original name, uploader, checksum and the metadata the
+// client sent. METADATA_SIDECARS selects the format, "json", the watchExport
+// as JSON, or "xml", defaultSidecar; the file METADATA_SIDECAR_TEMPLATE
+// replaces the document with a template of exportTemplate. The sidecar of
+// clip.mp4 is clip.mp4.meta.json, or clip.mp4.meta.xml, and Path is the
+// name of the file it describes.
+const (
+	sidecarJSON = "json"
+	sidecarXML  = "xml"
+)
+
+// metadataSuffix returns the suffix of the metadata sidecars of the format.
+func metadataSuffix(format string) string {
+	return ".meta." + format
+}
+
+// metadataSidecar is the template of the metadata sidecars, nil for the
+// JSON of the watchExport.
+var metadataSidecar *template.Template
+
+// exportTemplate parses a template of an export of stored files, with the
+// functions of the completion templates, "xml" to escape text for XML and
+// "date" to format the time the file was received.
+func exportTemplate(name, text string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"xml": func(s string) (string, error) {
+			var b bytes.Buffer
+			err := xml.EscapeText(&b, []byte(s))
+			return b.String(), err
+		},
+		// date is replaced by the time received when executed.
+		"date": func(layout string) string { return "" },
+	}
+	return template.New(name).Funcs(template.FuncMap(completionFuncs)).Funcs(funcs).Option("missingkey=error").Parse(text)
+}
+
+// executeExport runs t for e, with "date" formatting the time e was
+// received.
+func executeExport(t *template.Template, e watchExport) (string, error) {
+	t, err := t.Clone()
+	if err != nil {
+		return "", err
+	}
+	t.Funcs(template.FuncMap{"date": e.Received.Format})
+	var b strings.Builder
+	if err := t.Execute(&b, e); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// loadMetadataSidecar checks the format of the metadata sidecars and parses
+// their template, from file if set.
+func loadMetadataSidecar(format, file string) (*template.Template, error) {
+	var text string
+	switch format {
+	case sidecarJSON:
+	case sidecarXML:
+		text = defaultSidecar
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected json or xml", format)
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return nil, nil
+	}
+	t, err := exportTemplate("METADATA_SIDECAR_TEMPLATE", text)
+	if err != nil {
+		return nil, err
+	}
+	example := watchExport{ID: "example", Filename: "example.mp4", StoredName: "example.mp4", Received: time.Now(), Path: "example.mp4"}
+	if _, err := executeExport(t, example); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// writeMetadataSidecar writes the metadata sidecar of the stored file of e,
+// if they are enabled.
+func writeMetadataSidecar(e watchExport) {
+	if MetadataSidecars == "" {
+		return
+	}
+	e.Path = path.Base(e.StoredName)
+	var data bytes.Buffer
+	var err error
+	if metadataSidecar != nil {
+		var text string
+		text, err = executeExport(metadataSidecar, e)
+		data.WriteString(text)
+	} else {
+		enc := json.NewEncoder(&data)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(e)
+	}
+	p := filepath.Join(UploadPath, filepath.FromSlash(e.StoredName)) + metadataSuffix(MetadataSidecars)
+	tmp := p + ".tmp"
+	if err == nil {
+		if err = os.WriteFile(tmp, data.Bytes(), 0644); err == nil {
+			err = os.Rename(tmp, p)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("Unable to write metadata of %s: %s", e.StoredName, err.Error())
+	}
+}
+
+// removeMetadataSidecar removes the metadata sidecar of the stored file
+// name.
+func removeMetadataSidecar(name string) {
+	if MetadataSidecars != "" {
+		os.Remove(filepath.Join(UploadPath, filepath.FromSlash(name)) + metadataSuffix(MetadataSidecars))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// gauge is a metric reported both on the Prometheus endpoint and to statsd.
+type gauge struct {
+	// name is without the "uploader_" or STATSD_PREFIX prefix.
+	name  string
+	help  string
+	tags  map[string]string
+	value int64
+}
+
+// gauges returns the current value of every metric.
+func gauges() []gauge {
+	tempUsageMu.Lock()
+	usage := latestTempUsage
+	tempUsageMu.Unlock()
+	statsMu.Lock()
+	stats := latestStats
+	statsMu.Unlock()
+
+	list := []gauge{
+		{name: "stored_files", help: "Files in the upload directory.", value: int64(stats.Files)},
+		{name: "stored_bytes", help: "Size of the files in the upload directory.", value: stats.Bytes},
+		{name: "tiered_files", help: "Files moved to cold storage.", value: int64(stats.TieredFiles)},
+		{name: "tiered_bytes", help: "Size of the files moved to cold storage.", value: stats.TieredBytes},
+		{name: "temp_bytes", help: "Disk space used in the temporary upload directory.", value: usage.Bytes},
+		{name: "temp_sessions", help: "Incomplete uploads in the temporary upload directory.", value: int64(len(usage.Sessions))},
+		{name: "pending_stores", help: "Completed uploads waiting to be stored.", value: storesInFlight.Load()},
+	}
+	if reservations != nil {
+		reserved, _ := reservations.reserved()
+		list = append(list, gauge{name: "reserved_bytes", help: "Disk space reserved for the rest of the incomplete uploads.", value: reserved})
+	}
+	if replication != nil {
+		var pending, failed, lag int64
+		for _, e := range replication.backlog() {
+			if e.State == replicaFailed {
+				failed++
+			} else {
+				pending++
+			}
+			lag = max(lag, e.Lag)
+		}
+		list = append(list,
+			gauge{name: "replication_pending", help: "Stored files waiting for their first attempt to be replicated.", value: pending},
+			gauge{name: "replication_failed", help: "Stored files whose replication failed and is retried.", value: failed},
+			gauge{name: "replication_lag_seconds", help: "How long the longest waiting file has waited for replication.", value: lag},
+		)
+	}
+	if len(UploadWindows) > 0 || MaxActiveUploads > 0 {
+		list = append(list, gauge{name: "queued_uploads", help: "Uploads waiting for their upload window or a free slot.", value: int64(uploadQueue.queued())})
+	}
+	if leader != nil {
+		isLeader := int64(0)
+		if leader.isLeader() {
+			isLeader = 1
+		}
+		list = append(list, gauge{name: "leader", help: "1 on the replica holding the leader lease, 0 on the others.", value: isLeader})
+	}
+	countryStatsMu.Lock()
+	countries := make([]string, 0, len(uploadsByCountry))
+	for country := range uploadsByCountry {
+		countries = append(countries, country)
+	}
+	slices.Sort(countries)
+	for _, country := range countries {
+		list = append(list, gauge{name: "uploads_by_country", help: "Uploads finished since the start, by the country of the client.",
+			tags: map[string]string{"country": country}, value: uploadsByCountry[country]})
+	}
+	countryStatsMu.Unlock()
+	ids := make([]string, 0, len(usage.Sessions))
+	for id := range usage.Sessions {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		list = append(list, gauge{name: "temp_session_bytes", help: "Disk space used by an incomplete upload.",
+			tags: map[string]string{"upload": id}, value: usage.Sessions[id]})
+	}
+	return list
+}
+
+// metricsHandler serves the gauges in the Prometheus text format on the
+// admin listener.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	last := ""
+	for _, g := range gauges() {
+		name := "uploader_" + g.name
+		if g.name != last {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, g.help, name)
+			last = g.name
+		}
+		var labels []string
+		for k, v := range g.tags {
+			labels = append(labels, fmt.Sprintf("%s=%q", k, v))
+		}
+		if len(labels) > 0 {
+			slices.Sort(labels)
+			name += "{" + strings.Join(labels, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s %d\n", name, g.value)
+	}
+}
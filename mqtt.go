@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	mqttKeepAlive  = 60 * time.Second
+	mqttAckTimeout = 30 * time.Second
+	mqttQueueSize  = 1024
+	mqttRetryMin   = time.Second
+	mqttRetryMax   = time.Minute
+)
+
+// MQTT 3.1.1 control packet types, shifted into the first header byte.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttPingreq    = 12 << 4
+	mqttPingresp   = 13 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// Upload lifecycle events. Each is published to <MQTT_TOPIC_PREFIX>/<event>.
+const (
+	eventCreated    = "created"
+	eventCompleted  = "completed"
+	eventStored     = "stored"
+	eventTerminated = "terminated"
+)
+
+// uploadEvent is the JSON payload of an event.
+type uploadEvent struct {
+	Event    string `json:"event"`
+	ID       string `json:"id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size"`
+	Source   string `json:"source,omitempty"`
+	User     string `json:"user,omitempty"`
+	Country  string `json:"country,omitempty"`
+	// Name and SHA256 are set once the upload is stored, Name relative to
+	// UploadPath.
+	Name   string    `json:"name,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// publishEvent publishes an event about the upload info, if MQTT_URL is set.
+// The parts of concatenated uploads are not reported.
+func publishEvent(event string, info tusd.FileInfo, name, sum string) {
+	if mqttEvents == nil || info.IsPartial {
+		return
+	}
+	source := info.MetaData["source"]
+	if source == "" && info.MetaData["bucket"] != "" {
+		source = "s3"
+	}
+	payload, err := json.Marshal(uploadEvent{
+		Event:    event,
+		ID:       info.ID,
+		Filename: info.MetaData["filename"],
+		Size:     info.Size,
+		Source:   source,
+		User:     info.MetaData["user"],
+		Country:  info.MetaData["country"],
+		Name:     name,
+		SHA256:   sum,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	mqttEvents.publish(MQTTTopicPrefix+"/"+event, payload)
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttPublisher publishes messages to an MQTT broker with QoS 1, so the
+// broker acknowledges every message, reconnecting whenever the connection
+// is lost. Messages are queued in memory: those still queued when the
+// process exits are lost.
+type mqttPublisher struct {
+	broker   *url.URL
+	clientID string
+	queue    chan mqttMessage
+}
+
+// mqttEvents is nil unless MQTT_URL is set.
+var mqttEvents *mqttPublisher
+
+func newMQTTPublisher(broker *url.URL, clientID string) *mqttPublisher {
+	return &mqttPublisher{broker: broker, clientID: clientID, queue: make(chan mqttMessage, mqttQueueSize)}
+}
+
+// parseMQTTURL parses mqtt://[user:password@]host[:port], or mqtts:// for
+// MQTT over TLS.
+func parseMQTTURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	port := map[string]string{"mqtt": "1883", "mqtts": "8883"}[u.Scheme]
+	if port == "" || u.Hostname() == "" {
+		return nil, fmt.Errorf("expected mqtt://host[:port] or mqtts://host[:port]")
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// publish queues a message without blocking. When the broker is
+// unreachable for long, new messages are dropped once the queue is full.
+func (p *mqttPublisher) publish(topic string, payload []byte) {
+	select {
+	case p.queue <- mqttMessage{topic, payload}:
+	default:
+		log.Printf("MQTT queue full, dropping message to %s", topic)
+	}
+}
+
+// run keeps a connection to the broker and publishes the queued messages
+// until ctx is done.
+func (p *mqttPublisher) run(ctx context.Context) {
+	var pending *mqttMessage
+	failures := 0
+	for ctx.Err() == nil {
+		conn, err := p.connect(ctx)
+		if err == nil {
+			failures = 0
+			log.Printf("Connected to MQTT broker %s", p.broker.Host)
+			pending, err = p.serve(ctx, conn, pending)
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		failures++
+		wait := min(mqttRetryMin<<min(failures-1, 10), mqttRetryMax)
+		log.Printf("MQTT broker %s: %s, reconnecting in %s", p.broker.Host, err.Error(), wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (p *mqttPublisher) connect(ctx context.Context) (*mqttConn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if p.broker.Scheme == "mqtts" {
+		conn, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", p.broker.Host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", p.broker.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte = 0x02 // clean session
+	payload := mqttString(p.clientID)
+	if user := p.broker.User; user != nil {
+		flags |= 0x80
+		payload = append(payload, mqttString(user.Username())...)
+		if password, ok := user.Password(); ok {
+			flags |= 0x40
+			payload = append(payload, mqttString(password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+
+	conn.SetDeadline(time.Now().Add(mqttAckTimeout))
+	r := bufio.NewReader(conn)
+	if err := writeMQTTPacket(conn, mqttConnect, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	kind, ack, err := readMQTTPacket(r)
+	if err == nil && (kind&0xf0 != mqttConnack || len(ack) != 2) {
+		err = errors.New("unexpected reply to CONNECT")
+	}
+	if err == nil && ack[1] != 0 {
+		reasons := []string{1: "unacceptable protocol version", 2: "client identifier rejected",
+			3: "server unavailable", 4: "bad user name or password", 5: "not authorized"}
+		reason := fmt.Sprintf("return code %d", ack[1])
+		if int(ack[1]) < len(reasons) {
+			reason = reasons[ack[1]]
+		}
+		err = fmt.Errorf("connection refused: %s", reason)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &mqttConn{Conn: conn, r: r}, nil
+}
+
+// mqttConn keeps the reader the CONNACK was read with, which may have
+// buffered more.
+type mqttConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// serve publishes pending, a message whose delivery was interrupted by the
+// last connection loss, and then the queued messages one at a time, waiting
+// for each to be acknowledged. It returns the message in flight when the
+// connection fails.
+func (p *mqttPublisher) serve(ctx context.Context, c *mqttConn, pending *mqttMessage) (*mqttMessage, error) {
+	defer func() {
+		c.SetDeadline(time.Now().Add(time.Second))
+		writeMQTTPacket(c, mqttDisconnect, nil)
+	}()
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	var packetID uint16
+	dup := pending != nil
+	for {
+		if pending == nil {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case msg := <-p.queue:
+				pending = &msg
+			case <-ping.C:
+				c.SetDeadline(time.Now().Add(mqttAckTimeout))
+				if err := writeMQTTPacket(c, mqttPingreq, nil); err != nil {
+					return nil, err
+				}
+				if err := expectMQTTPacket(c.r, mqttPingresp, nil); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		packetID = packetID%0xffff + 1
+		body := append(mqttString(pending.topic), byte(packetID>>8), byte(packetID))
+		body = append(body, pending.payload...)
+		header := byte(mqttPublish | 1<<1) // QoS 1
+		if dup {
+			header |= 0x08
+		}
+		c.SetDeadline(time.Now().Add(mqttAckTimeout))
+		if err := writeMQTTPacket(c, header, body); err != nil {
+			return pending, err
+		}
+		if err := expectMQTTPacket(c.r, mqttPuback, []byte{byte(packetID >> 8), byte(packetID)}); err != nil {
+			return pending, err
+		}
+		pending, dup = nil, false
+	}
+}
+
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	// The remaining length is a variable length integer, 7 bits per byte.
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed packet length")
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// expectMQTTPacket reads the reply of the given type and, if body is not
+// nil, with the given body.
+func expectMQTTPacket(r *bufio.Reader, kind byte, body []byte) error {
+	header, got, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if header&0xf0 != kind || (body != nil && string(got) != string(body)) {
+		return fmt.Errorf("unexpected packet type %d", header>>4)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// The size limits of UPLOAD_POLICIES are soft: a user refused a file over
+// the limit of their policy asks for more from the upload page,
+//
+//	POST /api/overrides       {"filename": ..., "size": ..., "reason": ...}
+//	GET  /api/overrides/<id>  the state of the request, for its requester
+//
+// and an admin grants the request, with one call of the admin API:
+//
+//	GET  /overrides               the requests, the pending ones with ?pending
+//	POST /overrides/<id>/approve  raise the limit of the requester to the
+//	                              size asked for, or ?max_size, for ?hours
+//	POST /overrides/<id>/deny     refuse the request
+//
+// Requests are made by signed in users or with an upload token, one
+// pending request each; a new one replaces it. An approved request raises
+// the limit of the uploads its requester creates until it expires, which
+// keep the raised limit until they complete. Requests and decisions are
+// audited in the log, and published to <MQTT_TOPIC_PREFIX>/overrides.
+// They are kept by every replica on its own, in overrides.json in
+// TempUploadPath, for overrideRetention once decided.
+const (
+	overridePending  = "pending"
+	overrideApproved = "approved"
+	overrideDenied   = "denied"
+
+	overrideDefaultHours = 24
+	overrideMaxHours     = 24 * 30
+	overrideRetention    = 30 * 24 * time.Hour
+	overrideMaxReason    = 1000
+)
+
+var errOverrideNotFound = errors.New("override request not found")
+
+// limitOverride is a request for a higher size limit.
+type limitOverride struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user,omitempty"`
+	TokenID   string    `json:"token_id,omitempty"`
+	Role      string    `json:"role"`
+	Filename  string    `json:"filename,omitempty"`
+	Size      int64     `json:"size"`
+	Limit     int64     `json:"limit"`
+	Reason    string    `json:"reason,omitempty"`
+	Requested time.Time `json:"requested"`
+	Status    string    `json:"status"`
+	Decided   time.Time `json:"decided,omitzero"`
+	// MaxSize is the size limit granted until Until.
+	MaxSize int64     `json:"max_size,omitempty"`
+	Until   time.Time `json:"until,omitzero"`
+}
+
+// requestedBy reports whether the request was made by the principal p.
+func (o *limitOverride) requestedBy(p Principal) bool {
+	return o.User == p.User && o.TokenID == p.TokenID
+}
+
+// overrideEvent is the JSON payload of an override audit event.
+type overrideEvent struct {
+	Event string `json:"event"`
+	limitOverride
+	Time time.Time `json:"time"`
+}
+
+// overrideBook keeps the override requests.
+type overrideBook struct {
+	journal string
+
+	mu        sync.Mutex
+	overrides map[string]*limitOverride
+}
+
+var limitOverrides = &overrideBook{overrides: map[string]*limitOverride{}}
+
+// newOverrideBook loads the override requests from journal, or keeps them
+// in memory only if journal is empty.
+func newOverrideBook(journal string) (*overrideBook, error) {
+	b := &overrideBook{journal: journal, overrides: map[string]*limitOverride{}}
+	if journal == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &b.overrides); err != nil {
+			return nil, fmt.Errorf("%s: %w", journal, err)
+		}
+	}
+	return b, nil
+}
+
+func (b *overrideBook) saveLocked() {
+	now := time.Now()
+	for id, o := range b.overrides {
+		end := o.Decided
+		if o.Until.After(end) {
+			end = o.Until
+		}
+		if o.Status != overridePending && now.Sub(end) > overrideRetention {
+			delete(b.overrides, id)
+		}
+	}
+	if b.journal == "" {
+		return
+	}
+	data, err := json.Marshal(b.overrides)
+	if err == nil {
+		tmp := b.journal + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, b.journal)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save override requests: %s", err.Error())
+	}
+}
+
+// request files the request of p for size bytes, replacing its pending
+// request if it has one.
+func (b *overrideBook) request(p Principal, role string, limit int64, filename string, size int64, reason string) limitOverride {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var o *limitOverride
+	for _, pending := range b.overrides {
+		if pending.Status == overridePending && pending.requestedBy(p) {
+			o = pending
+			break
+		}
+	}
+	if o == nil {
+		o = &limitOverride{ID: newRequestID(), User: p.User, TokenID: p.TokenID, Status: overridePending}
+		b.overrides[o.ID] = o
+	}
+	o.Role, o.Limit, o.Filename, o.Size, o.Reason, o.Requested = role, limit, filename, size, reason, time.Now()
+	b.saveLocked()
+	return *o
+}
+
+func (b *overrideBook) get(id string) (limitOverride, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if o := b.overrides[id]; o != nil {
+		return *o, true
+	}
+	return limitOverride{}, false
+}
+
+// list returns the requests, the latest first, only the pending ones if
+// pending is set.
+func (b *overrideBook) list(pending bool) []limitOverride {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := []limitOverride{}
+	for _, o := range b.overrides {
+		if !pending || o.Status == overridePending {
+			list = append(list, *o)
+		}
+	}
+	slices.SortFunc(list, func(a, b limitOverride) int { return b.Requested.Compare(a.Requested) })
+	return list
+}
+
+// decide approves the pending request id, raising the limit to maxSize,
+// or the size asked for if 0, for the duration valid, or denies it.
+func (b *overrideBook) decide(id string, approve bool, maxSize int64, valid time.Duration) (limitOverride, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o := b.overrides[id]
+	if o == nil {
+		return limitOverride{}, errOverrideNotFound
+	}
+	if o.Status != overridePending {
+		return *o, fmt.Errorf("the request is %s already", o.Status)
+	}
+	o.Decided = time.Now()
+	o.Status = overrideDenied
+	if approve {
+		o.Status = overrideApproved
+		o.MaxSize = maxSize
+		if o.MaxSize == 0 {
+			o.MaxSize = o.Size
+		}
+		o.Until = o.Decided.Add(valid)
+	}
+	b.saveLocked()
+	return *o, nil
+}
+
+// active returns the ID of the approved request of the user or token that
+// grants the highest limit now, "" if none does.
+func (b *overrideBook) active(user, tokenID string) string {
+	if user == "" && tokenID == "" {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var best *limitOverride
+	for _, o := range b.overrides {
+		if o.Status == overrideApproved && now.Before(o.Until) && o.User == user && o.TokenID == tokenID &&
+			(best == nil || o.MaxSize > best.MaxSize) {
+			best = o
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.ID
+}
+
+// granted returns the size limit the approved request id grants, 0 if
+// there is none.
+func (b *overrideBook) granted(id string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if o := b.overrides[id]; o != nil && o.Status == overrideApproved {
+		return o.MaxSize
+	}
+	return 0
+}
+
+// uploadSizeLimit returns the size limit of an upload with the metadata
+// meta under the policy p, 0 for none: the limit of the policy, raised by
+// the override the upload was created under, or, for uploads not made
+// over HTTP, the one active for their user.
+func uploadSizeLimit(p *uploadPolicy, meta tusd.MetaData) int64 {
+	if p.maxSize == 0 {
+		return 0
+	}
+	id := meta["limit_override"]
+	if id == "" {
+		id = limitOverrides.active(meta["user"], meta["token_id"])
+	}
+	return max(p.maxSize, limitOverrides.granted(id))
+}
+
+// auditOverride logs an override event and publishes it if MQTT_URL is
+// set.
+func auditOverride(event string, o limitOverride) {
+	who := o.User
+	if who == "" {
+		who = "token " + o.TokenID
+	}
+	switch event {
+	case overridePending:
+		log.Printf("Override %s requested by %s (%s): %s for %q over the limit of %s: %q", o.ID, who, o.Role, formatByteSize(o.Size), o.Filename, formatByteSize(o.Limit), o.Reason)
+	case overrideApproved:
+		log.Printf("Override %s for %s approved by admin: limit %s until %s", o.ID, who, formatByteSize(o.MaxSize), o.Until.Format(time.RFC3339))
+	case overrideDenied:
+		log.Printf("Override %s for %s denied by admin", o.ID, who)
+	}
+	if mqttEvents == nil {
+		return
+	}
+	if payload, err := json.Marshal(overrideEvent{Event: "override_" + event, limitOverride: o, Time: time.Now()}); err == nil {
+		mqttEvents.publish(MQTTTopicPrefix+"/overrides", payload)
+	}
+}
+
+// overrideHandler serves the requests of users, /api/overrides.
+func overrideHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(r.URL.Path, "/")
+	p, err := authenticate(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if p.User == "" && p.TokenID == "" {
+		httpErrorCode(w, "ERR_NOT_SIGNED_IN", "Sign in, or upload with a token, to ask for a higher limit", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			Filename string `json:"filename"`
+			Size     int64  `json:"size"`
+			Reason   string `json:"reason"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			httpError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Reason) > overrideMaxReason {
+			httpError(w, fmt.Sprintf("The reason is longer than %d bytes", overrideMaxReason), http.StatusBadRequest)
+			return
+		}
+		meta := tusd.MetaData{"user": p.User, "role": p.Role}
+		policy := policyFor(meta)
+		if policy == nil || policy.maxSize == 0 {
+			httpError(w, "No size limit applies", http.StatusConflict)
+			return
+		}
+		limit := policy.maxSize
+		if id := limitOverrides.active(p.User, p.TokenID); id != "" {
+			limit = max(limit, limitOverrides.granted(id))
+		}
+		if req.Size <= limit {
+			httpError(w, "The size is within the limit", http.StatusConflict)
+			return
+		}
+		o := limitOverrides.request(p, policy.Role, limit, req.Filename, req.Size, strings.TrimSpace(req.Reason))
+		auditOverride(overridePending, o)
+		writeJSON(w, http.StatusAccepted, o)
+	case id != "" && r.Method == http.MethodGet:
+		o, ok := limitOverrides.get(id)
+		if !ok || !o.requestedBy(p) {
+			httpError(w, "Request not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, o)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *adminAPI) overrides(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/overrides"), "/")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, limitOverrides.list(r.URL.Query().Has("pending")))
+	case r.Method == http.MethodPost:
+		id, decision, _ := strings.Cut(rest, "/")
+		if decision != "approve" && decision != "deny" {
+			httpError(w, "Expected /overrides/<id>/approve or deny", http.StatusNotFound)
+			return
+		}
+		hours := overrideDefaultHours
+		if v := r.URL.Query().Get("hours"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > overrideMaxHours {
+				httpError(w, fmt.Sprintf("Invalid hours, expected 1 to %d", overrideMaxHours), http.StatusBadRequest)
+				return
+			}
+			hours = n
+		}
+		var maxSize int64
+		if v := r.URL.Query().Get("max_size"); v != "" {
+			n, err := parseByteSize(v)
+			if err != nil || n <= 0 {
+				httpError(w, "Invalid max_size", http.StatusBadRequest)
+				return
+			}
+			maxSize = n
+		}
+		o, err := limitOverrides.decide(id, decision == "approve", maxSize, time.Duration(hours)*time.Hour)
+		switch {
+		case errors.Is(err, errOverrideNotFound):
+			httpError(w, "Request not found", http.StatusNotFound)
+			return
+		case err != nil:
+			httpError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		auditOverride(o.Status, o)
+		writeJSON(w, http.StatusOK, o)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Parity blocks let a chunk of an upload corrupted on the temporary disk be
+// rebuilt on the server instead of failing the upload. With PARITY_GROUP
+// set, the chunks written to an upload are grouped by that many, in the
+// order they were written, and every group gets the XOR of its chunks, as
+// long as the longest one, in the <id>.parity sidecar. When the upload is
+// verified on completion, a group with a single corrupted chunk is repaired
+// from its parity and the other chunks of the group. Keeping the parity
+// costs a read and a write of it for every chunk written, and about
+// 1/PARITY_GROUP of the upload in disk space.
+
+// parityBuffer is the size of the windows the parity is updated and chunks
+// rebuilt in.
+const parityBuffer = 64 << 10
+
+func paritySidecarPath(id string) string {
+	return filepath.Join(TempUploadPath, id+".parity")
+}
+
+// parityOffset returns where the parity of the group-th group of chunks
+// starts in the parity sidecar: after the parity of the groups before it.
+func (h *uploadHashes) parityOffset(group int) int64 {
+	var offset int64
+	for g := 0; g < group; g++ {
+		offset += h.paritySize(g)
+	}
+	return offset
+}
+
+// paritySize returns the size of the parity of the group-th group of
+// chunks, the size of its longest chunk.
+func (h *uploadHashes) paritySize(group int) int64 {
+	var size int64
+	for _, c := range h.parityMembers(group) {
+		size = max(size, c.Size)
+	}
+	return size
+}
+
+func (h *uploadHashes) parityMembers(group int) []chunkHash {
+	from := min(group*h.ParityGroup, len(h.Chunks))
+	return h.Chunks[from:min(from+h.ParityGroup, len(h.Chunks))]
+}
+
+// parityCovered returns the number of chunks, from the first, whose group
+// has a parity block.
+func (h *uploadHashes) parityCovered() int {
+	switch {
+	case h.ParityGroup == 0:
+		return 0
+	case h.ParityLost:
+		return h.ParityEnd
+	}
+	return len(h.Chunks)
+}
+
+// loseParity stops keeping the parity of the upload, from the group of the
+// chunk about to be written on: that group has a part of the chunk in its
+// parity already.
+func (h *uploadHashes) loseParity() {
+	h.ParityLost = true
+	h.ParityEnd = len(h.Chunks) / h.ParityGroup * h.ParityGroup
+}
+
+// parityWriter adds the chunk written to an upload to the parity of its
+// group. It never fails the write: errors are kept in err and the upload
+// goes on without parity.
+type parityWriter struct {
+	f      *os.File
+	offset int64
+	buf    []byte
+	err    error
+}
+
+// startParity returns the writer of the parity of the next chunk of the
+// upload id, nil if no parity is kept for it. The first chunk decides,
+// from PARITY_GROUP.
+func startParity(h *uploadHashes, id string) *parityWriter {
+	if StorageBackend != storageFile || h.Broken || h.ParityLost {
+		return nil
+	}
+	if len(h.Chunks) == 0 {
+		h.ParityGroup = ParityGroup
+	}
+	if h.ParityGroup == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(paritySidecarPath(id), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("Unable to keep the parity of upload %s: %s", id, err.Error())
+		h.loseParity()
+		return nil
+	}
+	return &parityWriter{f: f, offset: h.parityOffset(len(h.Chunks) / h.ParityGroup), buf: make([]byte, parityBuffer)}
+}
+
+func (w *parityWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && w.err == nil {
+		b := w.buf[:min(len(p), len(w.buf))]
+		read, err := w.f.ReadAt(b, w.offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			w.err = err
+			break
+		}
+		clear(b[read:])
+		for i := range b {
+			b[i] ^= p[i]
+		}
+		if _, err := w.f.WriteAt(b, w.offset); err != nil {
+			w.err = err
+			break
+		}
+		w.offset += int64(len(b))
+		p = p[len(b):]
+	}
+	return n, nil
+}
+
+// Close closes the parity sidecar and returns the first error met.
+func (w *parityWriter) Close() error {
+	if err := w.f.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+// repairChunks rebuilds the corrupted chunks of the completed upload info
+// from their parity, and fails with errUploadCorrupted unless every
+// corrupted chunk could be rebuilt.
+func repairChunks(info tusd.FileInfo, hashes *uploadHashes) error {
+	covered := hashes.parityCovered()
+	if StorageBackend != storageFile || covered == 0 {
+		return errUploadCorrupted
+	}
+	p := info.Storage["Path"]
+	if p == "" {
+		p = filepath.Join(TempUploadPath, info.ID)
+	}
+	data, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	parity, err := os.Open(paritySidecarPath(info.ID))
+	if err != nil {
+		return errUploadCorrupted
+	}
+	defer parity.Close()
+
+	var bad []int
+	for i, c := range hashes.Chunks {
+		h := c.newHash()
+		if _, err := io.Copy(h, io.NewSectionReader(data, c.Offset, c.Size)); err != nil {
+			return err
+		}
+		if !c.matches(h) {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 {
+		return errUploadCorrupted
+	}
+	for i, index := range bad {
+		group := index / hashes.ParityGroup
+		if index >= covered || (i > 0 && bad[i-1]/hashes.ParityGroup == group) || (i+1 < len(bad) && bad[i+1]/hashes.ParityGroup == group) {
+			log.Printf("Upload %s has a corrupted chunk at %d that its parity cannot rebuild", info.ID, hashes.Chunks[index].Offset)
+			return errUploadCorrupted
+		}
+	}
+	for _, index := range bad {
+		// The rebuilt chunk is only written once its hash matches.
+		if err := rebuildChunk(data, parity, hashes, index, false); err != nil {
+			if errors.Is(err, errUploadCorrupted) {
+				log.Printf("Upload %s has a corrupted chunk at %d and parity that does not rebuild it", info.ID, hashes.Chunks[index].Offset)
+			}
+			return err
+		}
+		if err := rebuildChunk(data, parity, hashes, index, true); err != nil {
+			return err
+		}
+		log.Printf("Upload %s had a corrupted chunk at %d, rebuilt from its parity", info.ID, hashes.Chunks[index].Offset)
+	}
+	return nil
+}
+
+// rebuildChunk computes the index-th chunk from the parity of its group and
+// the other chunks of the group, and writes it to data if write is set, or
+// compares it with its hash otherwise.
+func rebuildChunk(data, parity *os.File, hashes *uploadHashes, index int, write bool) error {
+	c := hashes.Chunks[index]
+	group := index / hashes.ParityGroup
+	base := hashes.parityOffset(group)
+	h := c.newHash()
+	buf := make([]byte, parityBuffer)
+	other := make([]byte, parityBuffer)
+	for pos := int64(0); pos < c.Size; pos += parityBuffer {
+		b := buf[:min(c.Size-pos, parityBuffer)]
+		if _, err := parity.ReadAt(b, base+pos); err != nil {
+			return errUploadCorrupted
+		}
+		for j, m := range hashes.parityMembers(group) {
+			if group*hashes.ParityGroup+j == index || pos >= m.Size {
+				continue
+			}
+			o := other[:min(int64(len(b)), m.Size-pos)]
+			if _, err := data.ReadAt(o, m.Offset+pos); err != nil {
+				return err
+			}
+			for k := range o {
+				b[k] ^= o[k]
+			}
+		}
+		if write {
+			if _, err := data.WriteAt(b, c.Offset+pos); err != nil {
+				return err
+			}
+		} else {
+			h.Write(b)
+		}
+	}
+	if write {
+		return data.Sync()
+	}
+	if !c.matches(h) {
+		return errUploadCorrupted
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// With UPLOAD_PINNING an upload belongs to the client that created it: its
+// IP address ("ip"), or the Bearer token it authenticated with ("token",
+// the IP address for clients without one). The hash of either is kept in
+// the "pin" metadata, and requests from other clients for the upload are
+// refused, so an upload whose ID was guessed or leaked cannot be written
+// to, read or cancelled. Clients that change their address, like phones
+// switching networks, have to start their uploads again with "ip".
+const (
+	pinIP    = "ip"
+	pinToken = "token"
+)
+
+// errUploadPinned refuses requests for an upload from another client than
+// the one that created it.
+var errUploadPinned = tusd.NewError("ERR_UPLOAD_PINNED", "the upload belongs to another client", http.StatusForbidden)
+
+// clientPin returns the pin of the client with the address remoteAddr and
+// the request header, "" without UPLOAD_PINNING.
+func clientPin(remoteAddr string, header http.Header) string {
+	var key string
+	switch UploadPinning {
+	case pinToken:
+		if token, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer "); ok && token != "" {
+			key = "token:" + token
+			break
+		}
+		fallthrough
+	case pinIP:
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		key = "ip:" + host
+	default:
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// pinnedTo reports whether the upload info may be used by the client with
+// the pin: it is not pinned, or pinned to that client.
+func pinnedTo(info tusd.FileInfo, pin string) bool {
+	want := info.MetaData["pin"]
+	if UploadPinning == "" || want == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(pin)) == 1
+}
+
+// pinUpload is the PreUploadCreateCallback part that pins the upload to the
+// client creating it. A pin sent by the client is dropped.
+func pinUpload(hook tusd.HookEvent, changes tusd.FileInfoChanges) tusd.FileInfoChanges {
+	if UploadPinning == "" {
+		return changes
+	}
+	if changes.MetaData == nil {
+		changes.MetaData = tusd.MetaData{}
+		for k, v := range hook.Upload.MetaData {
+			changes.MetaData[k] = v
+		}
+	}
+	changes.MetaData["pin"] = clientPin(hook.HTTPRequest.RemoteAddr, hook.HTTPRequest.Header)
+	return changes
+}
+
+// withUploadPin refuses the tus requests for an existing upload, sent by
+// another client than the one the upload is pinned to.
+func withUploadPin(composer *tusd.StoreComposer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(r.URL.Path, "/")
+		if UploadPinning == "" || id == "" || r.Method == http.MethodPost || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Unknown uploads are left to tusd to answer.
+		if upload, err := composer.Core.GetUpload(r.Context(), id); err == nil {
+			if info, err := upload.GetInfo(r.Context()); err == nil && !pinnedTo(info, clientPin(r.RemoteAddr, r.Header)) {
+				log.Printf("[%s] Upload %s refused to another client", requestID(r), id)
+				res := errUploadPinned.HTTPResponse
+				for k, v := range res.Header {
+					w.Header().Set(k, v)
+				}
+				w.Header().Set("Tus-Resumable", "1.0.0")
+				w.WriteHeader(res.StatusCode)
+				io.WriteString(w, res.Body)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// defaultPolicyRole names the policy of uploads no other policy applies to.
+const defaultPolicyRole = "default"
+
+// errUploadTooLarge is returned for uploads over the size limit of their
+// policy. Use errors.Is to test for it.
+var errUploadTooLarge = tusd.NewError("ERR_UPLOAD_TOO_LARGE", "upload exceeds the size limit", http.StatusRequestEntityTooLarge)
+
+// errUploadTokenInvalid is returned for HTTP uploads presenting a token no
+// policy knows.
+var errUploadTokenInvalid = tusd.NewError("ERR_UPLOAD_TOKEN_INVALID", "unknown upload token", http.StatusUnauthorized)
+
+// uploadPolicy sets the limits of the uploads of a role, in place of the
+// global ones. HTTP clients take on a role with one of its tokens, sent as
+// "Authorization: Bearer <token>" when creating a tus upload; FTP and SFTP
+// uploads take on the role their user is listed in.
+type uploadPolicy struct {
+	Role   string   `json:"role"`
+	Tokens []string `json:"tokens,omitempty"`
+	Users  []string `json:"users,omitempty"`
+	// MaxSize is a size like "20G".
+	MaxSize string `json:"max_size,omitempty"`
+	// AllowedTypes are the extensions allowed, all but BlockedExtensions if
+	// empty.
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+	// Folder is where in UploadPath the uploads are stored.
+	Folder string `json:"folder,omitempty"`
+	// RetentionDays overrides RETENTION_DAYS for the stored files.
+	RetentionDays int `json:"retention_days,omitempty"`
+	// DeadlineHours overrides UPLOAD_DEADLINE_HOURS.
+	DeadlineHours int `json:"deadline_hours,omitempty"`
+
+	maxSize int64
+}
+
+// loadUploadPolicies reads the policies from the JSON array in file.
+func loadUploadPolicies(file string) ([]*uploadPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var policies []*uploadPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, err
+	}
+	roles := map[string]bool{}
+	for _, p := range policies {
+		if p.Role == "" || roles[p.Role] {
+			return nil, fmt.Errorf("missing or repeated role %q", p.Role)
+		}
+		roles[p.Role] = true
+		if p.MaxSize != "" {
+			if p.maxSize, err = parseByteSize(p.MaxSize); err != nil || p.maxSize <= 0 {
+				return nil, fmt.Errorf("role %s: invalid max_size %q", p.Role, p.MaxSize)
+			}
+		}
+		p.AllowedTypes = parseExtensions(strings.Join(p.AllowedTypes, ","))
+		if p.Folder != "" && !filepath.IsLocal(filepath.FromSlash(p.Folder)) {
+			return nil, fmt.Errorf("role %s: folder %q is outside the upload directory", p.Role, p.Folder)
+		}
+		if p.RetentionDays < 0 {
+			return nil, fmt.Errorf("role %s: invalid retention_days", p.Role)
+		}
+		if p.DeadlineHours < 0 {
+			return nil, fmt.Errorf("role %s: invalid deadline_hours", p.Role)
+		}
+	}
+	return policies, nil
+}
+
+// policyFor returns the policy of the upload with the given metadata, or nil
+// if there is none.
+func policyFor(meta tusd.MetaData) *uploadPolicy {
+	if role := meta["role"]; role != "" {
+		return findPolicy(func(p *uploadPolicy) bool { return p.Role == role })
+	}
+	if user := meta["user"]; user != "" {
+		if p := findPolicy(func(p *uploadPolicy) bool { return slices.Contains(p.Users, user) }); p != nil {
+			return p
+		}
+	}
+	return findPolicy(func(p *uploadPolicy) bool { return p.Role == defaultPolicyRole })
+}
+
+func findPolicy(match func(*uploadPolicy) bool) *uploadPolicy {
+	for _, p := range UploadPolicies {
+		if match(p) {
+			return p
+		}
+	}
+	return nil
+}
+
+// uploadRole is the PreUploadCreateCallback part that authenticates a tus
+// upload. Its user and role are kept in the metadata, where those the client
+// set itself are dropped.
+func uploadRole(hook tusd.HookEvent) (tusd.FileInfoChanges, error) {
+	meta := tusd.MetaData{}
+	for k, v := range hook.Upload.MetaData {
+		meta[k] = v
+	}
+	if err := authenticateUpload(hookRequest(hook), meta); err != nil {
+		return tusd.FileInfoChanges{}, err
+	}
+	return tusd.FileInfoChanges{MetaData: meta}, nil
+}
+
+// prepareUpload does what uploads go through when they are created, in the
+// tus creation callback and where uploads are created without tus: their
+// principal, the check for duplicates, their delivery, their country and
+// their pin. It returns the changes to the metadata of the upload.
+func prepareUpload(hook tusd.HookEvent, composer *tusd.StoreComposer) (tusd.FileInfoChanges, error) {
+	changes, err := uploadRole(hook)
+	if err != nil {
+		return changes, err
+	}
+	if err := checkDuplicateUpload(hook, composer); err != nil {
+		return changes, err
+	}
+	if err := claimDelivery(changes.MetaData, hook.HTTPRequest.RemoteAddr); err != nil {
+		return changes, err
+	}
+	return pinUpload(hook, uploadCountry(hook, changes)), nil
+}
+
+// checkUploadPolicy rejects uploads when they are created if their type is
+// not allowed by their policy or their declared length is over its limit.
+func checkUploadPolicy(info tusd.FileInfo) error {
+	p := policyFor(info.MetaData)
+	if p == nil {
+		return nil
+	}
+	if len(p.AllowedTypes) > 0 {
+		ext := strings.TrimPrefix(strings.ToLower(path.Ext(info.MetaData["filename"])), ".")
+		if !slices.Contains(p.AllowedTypes, ext) {
+			return fileTypeBlocked(".%s files are not allowed for %s uploads", ext, p.Role)
+		}
+	}
+	if limit := uploadSizeLimit(p, info.MetaData); limit > 0 && !info.SizeIsDeferred && info.Size > limit {
+		return policyTooLarge(p, limit)
+	}
+	return nil
+}
+
+func policyTooLarge(p *uploadPolicy, limit int64) error {
+	return tusd.NewError(errUploadTooLarge.ErrorCode, fmt.Sprintf("%s uploads are limited to %s", p.Role, formatByteSize(limit)), http.StatusRequestEntityTooLarge)
+}
+
+// policyLimitReader fails with errUploadTooLarge once more than n bytes are
+// read, for uploads whose length is not known in advance.
+type policyLimitReader struct {
+	r      io.Reader
+	n      int64
+	policy *uploadPolicy
+	limit  int64
+}
+
+func (l *policyLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = 0
+		return n, policyTooLarge(l.policy, l.limit)
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// limitUploadData returns src limited to what the policy of info allows to
+// be written at offset.
+func limitUploadData(info tusd.FileInfo, offset int64, src io.Reader) io.Reader {
+	p := policyFor(info.MetaData)
+	if p == nil || p.maxSize == 0 {
+		return src
+	}
+	limit := uploadSizeLimit(p, info.MetaData)
+	return &policyLimitReader{r: src, n: max(limit-offset, 0), policy: p, limit: limit}
+}
+
+// retentionFor returns how long the stored file name is kept, 0 for ever.
+func retentionFor(name string) time.Duration {
+	if storedFiles != nil {
+		if rec, ok := storedFiles.get(name); ok && rec.RetentionDays > 0 {
+			return time.Duration(rec.RetentionDays) * 24 * time.Hour
+		}
+	}
+	return RetentionPeriod
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Previews are low bitrate H.264 proxies of the stored videos, small enough
+// to be played while browsing the stored files. They are written to
+// PreviewPath by the "previews" job, as <name>.mp4 for the stored video
+// name, and are not stored files: they are neither indexed nor replicated.
+// Writing a preview annotates the video with its "duration" in seconds.
+// A preview is removed once its video was stored PREVIEW_RETENTION_DAYS
+// ago, or is deleted, whatever the retention of the video itself. Videos
+// moved to cold storage keep their preview until then.
+const previewExt = ".mp4"
+
+var (
+	previewMu sync.Mutex
+	// previewFailed remembers the videos ffmpeg failed on, so they are not
+	// tried again on every run.
+	previewFailed = map[string]bool{}
+)
+
+// previewFile returns the path of the preview of the stored video name.
+func previewFile(name string) string {
+	return filepath.Join(PreviewPath, filepath.FromSlash(name)+previewExt)
+}
+
+// writePreviews is the "previews" job. It writes the preview of every
+// stored video within the preview retention that has none yet, then
+// removes the previews past it.
+func writePreviews(ctx context.Context) (string, error) {
+	previewMu.Lock()
+	defer previewMu.Unlock()
+	var cutoff time.Time
+	if PreviewRetention > 0 {
+		cutoff = time.Now().Add(-PreviewRetention)
+	}
+	written := 0
+	err := walkStoredFiles(ctx, func(name string, info fs.FileInfo, tiered bool) error {
+		ext := strings.ToLower(path.Ext(name))
+		if _, ok := loudnormFormats[ext]; !ok || tiered || previewFailed[name] {
+			return nil
+		}
+		// Renditions look like their original.
+		if strings.HasSuffix(strings.TrimSuffix(name, path.Ext(name)), loudnormInfix) {
+			return nil
+		}
+		if !cutoff.IsZero() && storedSince(name, info.ModTime()).Before(cutoff) {
+			return nil
+		}
+		if _, err := os.Stat(previewFile(name)); !os.IsNotExist(err) {
+			return nil
+		}
+		if err := writePreview(ctx, name); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Unable to write the preview of %s: %s", name, err.Error())
+			previewFailed[name] = true
+			return nil
+		}
+		log.Printf("Wrote preview of %s", name)
+		written++
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	removed, err := prunePreviews(ctx, cutoff)
+	if written == 0 && removed == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("wrote %d previews, removed %d", written, removed), err
+}
+
+func writePreview(ctx context.Context, name string) error {
+	src := filepath.Join(UploadPath, filepath.FromSlash(name))
+	dst := previewFile(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	defer os.Remove(tmp)
+	rate := fmt.Sprintf("%dk", PreviewBitrate)
+	out, err := runFFmpeg(ctx, "-hide_banner", "-nostdin", "-y", "-i", src,
+		"-map", "0:v:0", "-map", "0:a:0?", "-vf", fmt.Sprintf("scale=-2:%d", PreviewHeight),
+		"-c:v", "libx264", "-preset", "veryfast", "-b:v", rate, "-maxrate", rate, "-bufsize", fmt.Sprintf("%dk", 2*PreviewBitrate),
+		"-c:a", "aac", "-b:a", "64k", "-ac", "2", "-movflags", "+faststart", "-f", "mp4", tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	if d, ok := ffmpegDuration(out); ok {
+		annotateStored(name, "duration", strconv.FormatFloat(d.Seconds(), 'f', 2, 64))
+	}
+	return nil
+}
+
+// ffmpegDurationLine matches the duration ffmpeg reports of its input.
+var ffmpegDurationLine = regexp.MustCompile(`Duration: (\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// ffmpegDuration returns the duration of the input in the ffmpeg output
+// out, false if it reports none.
+func ffmpegDuration(out []byte) (time.Duration, bool) {
+	m := ffmpegDurationLine.FindSubmatch(out)
+	if m == nil {
+		return 0, false
+	}
+	hours, _ := strconv.Atoi(string(m[1]))
+	minutes, _ := strconv.Atoi(string(m[2]))
+	seconds, _ := strconv.ParseFloat(string(m[3]), 64)
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
+
+// prunePreviews removes the previews of videos deleted, or stored before
+// cutoff unless it is zero, and returns how many it removed.
+func prunePreviews(ctx context.Context, cutoff time.Time) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(PreviewPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, _ := filepath.Rel(PreviewPath, p)
+		name, ok := strings.CutSuffix(filepath.ToSlash(rel), previewExt)
+		if !ok {
+			return nil
+		}
+		stored, exists := previewedStored(name)
+		if exists && (cutoff.IsZero() || !stored.Before(cutoff)) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			log.Printf("Unable to remove the preview of %s: %s", name, err.Error())
+			return nil
+		}
+		delete(previewFailed, name)
+		removed++
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return removed, err
+}
+
+// previewedStored returns when the stored video name was stored, false if
+// it no longer is, in cold storage or not.
+func previewedStored(name string) (time.Time, bool) {
+	if info, err := os.Stat(filepath.Join(UploadPath, filepath.FromSlash(name))); err == nil {
+		return storedSince(name, info.ModTime()), true
+	}
+	if stub, err := readTieredStub(name); err == nil {
+		return storedSince(name, stub.ModTime), true
+	}
+	return time.Time{}, false
+}
+
+// removePreview removes the preview of the stored video name, if any.
+func removePreview(name string) {
+	if !PreviewsEnabled {
+		return
+	}
+	if err := os.Remove(previewFile(name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove the preview of %s: %s", name, err.Error())
+	}
+}
+
+// hasPreview reports whether the stored video name has a preview.
+func hasPreview(name string) bool {
+	if !PreviewsEnabled {
+		return false
+	}
+	_, err := os.Stat(previewFile(name))
+	return err == nil
+}
+
+// servePreview serves the preview of the stored video name, with range
+// requests for seeking.
+func servePreview(w http.ResponseWriter, r *http.Request, name string) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		httpError(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(previewFile(name))
+	if os.IsNotExist(err) {
+		httpError(w, "No preview of this file", http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
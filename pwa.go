@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// iconSizes are the PNG icon sizes referenced by the web app manifest;
+// browsers require 192 and 512 pixel icons to offer installation.
+var iconSizes = []int{192, 512}
+
+var iconArrowColor = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+// manifestHandler serves the web app manifest that makes the upload page
+// installable on phones and tablets, under the name and in the colors of
+// the brand of the request.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	b := requestBrand(r)
+	var icons []map[string]string
+	for _, size := range iconSizes {
+		s := strconv.Itoa(size)
+		icons = append(icons, map[string]string{
+			"src":     "/icon-" + s + ".png",
+			"sizes":   s + "x" + s,
+			"type":    "image/png",
+			"purpose": "any maskable",
+		})
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":             b.title("TUS Upload"),
+		"short_name":       b.title("Upload"),
+		"start_url":        "/",
+		"scope":            "/",
+		"display":          "standalone",
+		"background_color": b.background(),
+		"theme_color":      b.color(),
+		"icons":            icons,
+	})
+}
+
+var (
+	iconMu    sync.Mutex
+	iconCache = map[string][]byte{}
+)
+
+// iconHandler serves /icon-<size>.png for the sizes in iconSizes and the
+// apple-touch-icon size, in the primary color of the brand of the request.
+// The icons are drawn on first use, so the binary does not need to carry
+// image files.
+func iconHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/icon-"), ".png")
+	size, err := strconv.Atoi(name)
+	if err != nil || !validIconSize(size) {
+		httpError(w, "Icon not found", http.StatusNotFound)
+		return
+	}
+	fill := requestBrand(r).color()
+	key := fill + "/" + name
+	iconMu.Lock()
+	data, ok := iconCache[key]
+	if !ok {
+		var buf bytes.Buffer
+		png.Encode(&buf, drawIcon(size, rgba(fill)))
+		data = buf.Bytes()
+		iconCache[key] = data
+	}
+	iconMu.Unlock()
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
+
+// appleTouchIconSize is the icon size iOS uses for home screen shortcuts.
+const appleTouchIconSize = 180
+
+func validIconSize(size int) bool {
+	return size == appleTouchIconSize || slices.Contains(iconSizes, size)
+}
+
+// drawIcon draws an upward arrow on a square filled with fill. The arrow
+// stays inside the central safe zone, so the icon also works when masked to
+// a circle.
+func drawIcon(size int, fill color.RGBA) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	u := float64(size) / 100
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			fx, fy := float64(x)/u, float64(y)/u
+			c := fill
+			// Arrow head: a triangle from (50,25) down to y=50, 25 units wide
+			// on each side; shaft: 16 units wide from y=50 to y=75.
+			dx := fx - 50
+			if dx < 0 {
+				dx = -dx
+			}
+			if fy >= 25 && fy < 50 && dx <= fy-25 || fy >= 50 && fy <= 75 && dx <= 8 {
+				c = iconArrowColor
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
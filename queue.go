@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// errUploadQueued refuses data sent to a queued upload before its turn. The
+// refusal tells the position of the upload in the queue, in the message and
+// the Upload-Queue-Position header, when it is expected to start in
+// Upload-Queue-Start, if known, and when to try again in Retry-After.
+var errUploadQueued = tusd.NewError("ERR_UPLOAD_QUEUED", "upload is queued", http.StatusServiceUnavailable)
+
+// uploadWindow is a time of day, in minutes since midnight in the local
+// time of the server, uploads run in. Windows with to before from span
+// midnight.
+type uploadWindow struct {
+	from, to int
+}
+
+// parseUploadWindows parses the comma separated "HH:MM-HH:MM" windows of
+// UPLOAD_WINDOWS, e.g. "20:00-07:00".
+func parseUploadWindows(list string) ([]uploadWindow, error) {
+	var windows []uploadWindow
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(s, "-")
+		if !ok {
+			return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+		}
+		var w uploadWindow
+		var err error
+		if w.from, err = parseTimeOfDay(from); err != nil {
+			return nil, err
+		}
+		if w.to, err = parseTimeOfDay(to); err != nil {
+			return nil, err
+		}
+		if w.from == w.to || w.from == 24*60 {
+			return nil, fmt.Errorf("empty window %q", s)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseTimeOfDay parses "HH:MM", 00:00 to 24:00, into minutes since
+// midnight.
+func parseTimeOfDay(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+func (w uploadWindow) contains(minute int) bool {
+	if w.from < w.to {
+		return minute >= w.from && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+// nextUploadWindow returns when the next of UploadWindows opens, t itself
+// if one is open at t.
+func nextUploadWindow(t time.Time) time.Time {
+	minute := t.Hour()*60 + t.Minute()
+	var next time.Time
+	for _, w := range UploadWindows {
+		if w.contains(minute) {
+			return t
+		}
+		start := time.Date(t.Year(), t.Month(), t.Day(), w.from/60, w.from%60, 0, 0, t.Location())
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// queueRecheck is the longest a client waiting for a free slot is told to
+// wait before trying again.
+const queueRecheck = 30 * time.Second
+
+// holdUpload queues a new upload created outside of UploadWindows, unless
+// it is smaller than UploadWindowMinSize, and every new upload when
+// MaxActiveUploads is set, which starts right away if a slot is free: its
+// "queued" metadata records when it was queued, its "start" metadata when
+// its upload window opens. Metadata of these names set by the client are
+// dropped.
+func holdUpload(info *tusd.FileInfo) {
+	if _, ok := info.MetaData["queued"]; ok {
+		info.MetaData = maps.Clone(info.MetaData)
+		delete(info.MetaData, "queued")
+	}
+	if _, ok := info.MetaData["start"]; ok {
+		info.MetaData = maps.Clone(info.MetaData)
+		delete(info.MetaData, "start")
+	}
+	// Final concatenations are written to as they are created.
+	if info.IsFinal {
+		return
+	}
+	now := time.Now()
+	var start time.Time
+	if len(UploadWindows) > 0 && (info.SizeIsDeferred || info.Size >= UploadWindowMinSize) {
+		if next := nextUploadWindow(now); next.After(now) {
+			start = next
+		}
+	}
+	if start.IsZero() && MaxActiveUploads == 0 {
+		return
+	}
+	info.MetaData = maps.Clone(info.MetaData)
+	if info.MetaData == nil {
+		info.MetaData = tusd.MetaData{}
+	}
+	info.MetaData["queued"] = now.UTC().Format(time.RFC3339Nano)
+	if !start.IsZero() {
+		info.MetaData["start"] = start.UTC().Format(time.RFC3339)
+	}
+}
+
+// uploadStart returns when the upload window of the queued upload opens,
+// zero if it was not queued until one.
+func uploadStart(info tusd.FileInfo) time.Time {
+	t, _ := time.Parse(time.RFC3339, info.MetaData["start"])
+	return t
+}
+
+// queuedUpload is an upload waiting for its turn.
+type queuedUpload struct {
+	ID     string
+	Queued time.Time
+	// Start is when the upload window of the upload opens, zero if it only
+	// waits for a slot.
+	Start time.Time
+}
+
+// admissionQueue holds the queued uploads in the order they were queued,
+// until their upload window opens and, with MaxActiveUploads, one of the
+// slots is free. Uploads started take a slot until they complete, are
+// removed, or go without data for drainIdle. The slots are counted by
+// every replica on its own.
+type admissionQueue struct {
+	mu      sync.Mutex
+	entries []queuedUpload
+	// admitted are the uploads holding a slot, with when they started.
+	admitted map[string]time.Time
+	// session is the moving average of the time uploads take from their
+	// start to their completion, for the expected start of queued uploads.
+	session time.Duration
+}
+
+var uploadQueue = &admissionQueue{admitted: map[string]time.Time{}}
+
+// load queues the incomplete uploads waiting for their turn and gives the
+// others their slot back, after a restart.
+func (q *admissionQueue) load(ctx context.Context, composer *tusd.StoreComposer) error {
+	uploads, err := incompleteUploads()
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, modified := range uploads {
+		upload, err := composer.Core.GetUpload(ctx, id)
+		if err != nil {
+			continue
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil || info.IsFinal {
+			continue
+		}
+		if info.Offset > 0 || info.MetaData["queued"] == "" {
+			if MaxActiveUploads > 0 {
+				q.admitted[id] = modified
+			}
+			continue
+		}
+		q.insert(info)
+	}
+	q.admit(time.Now())
+	return nil
+}
+
+// add queues the upload info if it has to wait for its turn.
+func (q *admissionQueue) add(info tusd.FileInfo) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.insert(info)
+	q.admit(time.Now())
+}
+
+func (q *admissionQueue) insert(info tusd.FileInfo) {
+	queued, err := time.Parse(time.RFC3339Nano, info.MetaData["queued"])
+	if err != nil || (MaxActiveUploads == 0 && !time.Now().Before(uploadStart(info))) {
+		return
+	}
+	if slices.ContainsFunc(q.entries, func(e queuedUpload) bool { return e.ID == info.ID }) {
+		return
+	}
+	i, _ := slices.BinarySearchFunc(q.entries, queued, func(e queuedUpload, t time.Time) int { return e.Queued.Compare(t) })
+	q.entries = slices.Insert(q.entries, i, queuedUpload{ID: info.ID, Queued: queued, Start: uploadStart(info)})
+}
+
+// admit starts the queued uploads whose upload window is open, first come
+// first served, as long as there are free slots.
+func (q *admissionQueue) admit(now time.Time) {
+	if len(q.entries) == 0 {
+		return
+	}
+	active := q.active(now)
+	for i := 0; i < len(q.entries); {
+		e := q.entries[i]
+		if now.Before(e.Start) {
+			i++
+			continue
+		}
+		if MaxActiveUploads > 0 && active >= MaxActiveUploads {
+			return
+		}
+		q.entries = slices.Delete(q.entries, i, i+1)
+		if MaxActiveUploads > 0 {
+			q.admitted[e.ID] = now
+			active++
+		}
+	}
+}
+
+// active returns the number of slots taken: the uploads started or written
+// to within drainIdle.
+func (q *admissionQueue) active(now time.Time) int {
+	n := 0
+	for id, started := range q.admitted {
+		if modified := uploadModTime(id); modified.After(started) {
+			started = modified
+		}
+		if now.Sub(started) < drainIdle {
+			n++
+		}
+	}
+	return n
+}
+
+// done frees the slot of the completed upload id.
+func (q *admissionQueue) done(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if started, ok := q.admitted[id]; ok {
+		d := now.Sub(started)
+		if q.session == 0 {
+			q.session = d
+		} else {
+			q.session = (4*q.session + d) / 5
+		}
+		delete(q.admitted, id)
+	}
+	q.admit(now)
+}
+
+// remove forgets the removed upload id, queued or not.
+func (q *admissionQueue) remove(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = slices.DeleteFunc(q.entries, func(e queuedUpload) bool { return e.ID == id })
+	delete(q.admitted, id)
+	q.admit(time.Now())
+}
+
+// queued returns the number of queued uploads.
+func (q *admissionQueue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.admit(time.Now())
+	return len(q.entries)
+}
+
+// position returns the position of the upload id in the queue, counting
+// from 1, and when it is expected to start: when its upload window opens,
+// or as many average uploads later as there are rounds of slots ahead of
+// it, zero if that is not known yet. Uploads whose turn came are started.
+func (q *admissionQueue) position(id string, now time.Time) (int, time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.admit(now)
+	for i, e := range q.entries {
+		if e.ID != id {
+			continue
+		}
+		eta := e.Start
+		if MaxActiveUploads > 0 {
+			if q.session == 0 {
+				return i + 1, time.Time{}, true
+			}
+			if slot := now.Add(q.session * time.Duration(i/MaxActiveUploads+1)); slot.After(eta) {
+				eta = slot
+			}
+		}
+		return i + 1, eta, true
+	}
+	return 0, time.Time{}, false
+}
+
+// checkUploadQueue refuses writes to a queued upload before its turn.
+// Uploads queued before UPLOAD_WINDOWS and MAX_ACTIVE_UPLOADS were unset
+// start right away.
+func checkUploadQueue(info tusd.FileInfo) error {
+	if info.MetaData["queued"] == "" || (len(UploadWindows) == 0 && MaxActiveUploads == 0) {
+		return nil
+	}
+	now := time.Now()
+	position, eta, ok := uploadQueue.position(info.ID, now)
+	if !ok {
+		if !now.Before(uploadStart(info)) {
+			return nil
+		}
+		// Queued by another replica.
+		uploadQueue.add(info)
+		if position, eta, ok = uploadQueue.position(info.ID, now); !ok {
+			return nil
+		}
+	}
+	msg := fmt.Sprintf("upload is queued at position %d", position)
+	if !eta.IsZero() {
+		msg += ", it is expected to start at " + eta.Format(time.RFC3339)
+	}
+	err := tusd.NewError(errUploadQueued.ErrorCode, msg, http.StatusServiceUnavailable)
+	retry := queueRecheck
+	switch start := uploadStart(info); {
+	case eta.IsZero():
+	case now.Before(start) && !eta.After(start):
+		// Waiting for its upload window.
+		retry = eta.Sub(now)
+	default:
+		// Waiting for a slot, which may free up any time.
+		retry = min(max(eta.Sub(now), time.Second), queueRecheck)
+	}
+	err.HTTPResponse.Header["Retry-After"] = strconv.Itoa(int(math.Ceil(retry.Seconds())))
+	err.HTTPResponse.Header["Upload-Queue-Position"] = strconv.Itoa(position)
+	if !eta.IsZero() {
+		err.HTTPResponse.Header["Upload-Queue-Start"] = eta.UTC().Format(time.RFC3339)
+	}
+	return err
+}
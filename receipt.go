@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// receiptKey signs the receipts of stored uploads, nil if RECEIPTS_ENABLED
+// is not set.
+var receiptKey ed25519.PrivateKey
+
+// uploadReceipt is the proof of delivery of a stored upload. Signature is
+// the base64 ed25519 signature of the compact JSON encoding of the receipt
+// without it, made with the key served at /api/receipts/key. Size and SHA256
+// are those of the stored file.
+type uploadReceipt struct {
+	UploadID string    `json:"upload_id"`
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Received time.Time `json:"received"`
+	// User and Role identify the uploader: the FTP or SFTP user, the role
+	// of the upload token.
+	User      string `json:"user,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Country   string `json:"country,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+func receiptPath(id string) string {
+	return filepath.Join(TempUploadPath, "receipts", id+".json")
+}
+
+// loadReceiptKey loads the signing key from keyPath, generating and saving
+// a new ed25519 key on first start.
+func loadReceiptKey(keyPath string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM data")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 key")
+		}
+		return edKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Receipt signing key generated at %s", keyPath)
+	return key, nil
+}
+
+// issueReceipt signs and saves the receipt of the upload info, stored with
+// the checksum sum. Parts of concatenated uploads get none.
+func issueReceipt(info tusd.FileInfo, size int64, sum string) {
+	if receiptKey == nil || info.IsPartial {
+		return
+	}
+	receipt := uploadReceipt{
+		UploadID: info.ID,
+		Filename: info.MetaData["filename"],
+		Size:     size,
+		SHA256:   sum,
+		Received: time.Now().UTC().Truncate(time.Second),
+		User:     info.MetaData["user"],
+		Role:     info.MetaData["role"],
+		Country:  info.MetaData["country"],
+	}
+	unsigned, err := json.Marshal(receipt)
+	if err != nil {
+		return
+	}
+	receipt.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(receiptKey, unsigned))
+	data, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return
+	}
+	p := receiptPath(info.ID)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		log.Printf("Unable to save the receipt of upload %s: %s", info.ID, err.Error())
+		return
+	}
+	tmp := p + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		log.Printf("Unable to save the receipt of upload %s: %s", info.ID, err.Error())
+	}
+}
+
+// receiptView is a receipt on the printable page, with the messages of
+// the page in its language and the brand it is issued under.
+type receiptView struct {
+	uploadReceipt
+	Lang   string
+	T      map[string]string
+	Brand  string
+	Logo   string
+	Color  string
+	Footer string
+}
+
+var receiptPage = template.Must(template.New("receipt").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+  <meta charset="UTF-8">
+  <title>{{.T.receipt_title}} {{.Filename}}</title>
+  <style>
+    body { font-family: sans-serif; max-width: 40rem; margin: 2rem auto; }
+    th { text-align: left; padding-right: 1rem; vertical-align: top; }
+    td { overflow-wrap: anywhere; }
+    .sig { font-family: monospace; font-size: .8rem; }
+    h2 { color: {{.Color}}; }
+    .logo { max-height: 3rem; }
+  </style>
+</head>
+<body>
+{{if .Logo}}<img src="{{.Logo}}" alt="{{.Brand}}" class="logo">{{end}}
+<h2>{{.T.receipt_title}}</h2>
+<table>
+  <tr><th>{{.T.receipt_file}}</th><td>{{.Filename}}</td></tr>
+  <tr><th>{{.T.receipt_size}}</th><td>{{.Size}} {{.T.receipt_bytes}}</td></tr>
+  <tr><th>SHA-256</th><td class="sig">{{.SHA256}}</td></tr>
+  <tr><th>{{.T.receipt_received}}</th><td>{{.Received.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+  {{if .User}}<tr><th>{{.T.receipt_user}}</th><td>{{.User}}</td></tr>{{end}}
+  {{if .Role}}<tr><th>{{.T.receipt_role}}</th><td>{{.Role}}</td></tr>{{end}}
+  {{if .Country}}<tr><th>{{.T.receipt_country}}</th><td>{{.Country}}</td></tr>{{end}}
+  <tr><th>{{.T.receipt_upload}}</th><td class="sig">{{.UploadID}}</td></tr>
+  <tr><th>{{.T.receipt_signature}}</th><td class="sig">{{.Signature}}</td></tr>
+</table>
+<p><small>{{.T.receipt_verify}}</small></p>
+{{if .Footer}}<footer><small>{{.Footer}}</small></footer>{{end}}
+</body>
+</html>
+`))
+
+// receiptHandler serves the receipts of stored uploads to their uploader,
+// who knows the upload ID:
+//
+//	GET /api/receipts/<id>       the signed receipt as JSON
+//	GET /api/receipts/<id>.html  a printable page
+//	GET /api/receipts/key        the PEM public key verifying receipts
+func receiptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if receiptKey == nil {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.URL.Path == "key" {
+		der, err := x509.MarshalPKIXPublicKey(receiptKey.Public())
+		if err != nil {
+			httpError(w, "Unable to encode the key", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		return
+	}
+	id, asHTML := strings.CutSuffix(r.URL.Path, ".html")
+	if !uploadIDPattern.MatchString(id) {
+		httpError(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	data, err := os.ReadFile(receiptPath(id))
+	if err != nil {
+		// The receipt is issued once the upload is stored, shortly after it
+		// completed.
+		httpError(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if !asHTML {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="receipt-`+id+`.json"`)
+		w.Write(data)
+		return
+	}
+	var receipt uploadReceipt
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		httpError(w, "Unable to read the receipt", http.StatusInternalServerError)
+		return
+	}
+	lang := requestLanguage(r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setLanguage(w, lang)
+	b := requestBrand(r)
+	receiptPage.Execute(w, receiptView{
+		uploadReceipt: receipt,
+		Lang:          lang,
+		T:             messages[lang],
+		Brand:         b.title("TUS Upload"),
+		Logo:          b.logoURL(),
+		Color:         b.color(),
+		Footer:        b.Footer,
+	})
+}
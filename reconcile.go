@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Classes of inconsistencies found by reconcile.
+const (
+	// inconsistencyUnindexed is a stored file without a file index record.
+	inconsistencyUnindexed = "unindexed"
+	// inconsistencyMissing is a file index record without a stored file.
+	inconsistencyMissing = "missing"
+	// inconsistencyOrphan is a piece of an incomplete upload (data, hash
+	// sidecar, lock file, move manifest or sanitized image) whose <id>.info
+	// is gone, an <id>.info whose data is gone, or the checksum sidecar of a
+	// stored file that is gone.
+	inconsistencyOrphan = "orphan"
+	// inconsistencyTemp is a temporary file left behind by an interrupted
+	// write, or an empty directory in UploadPath.
+	inconsistencyTemp = "temp"
+)
+
+const (
+	reconcileReport = "report"
+	reconcileDelete = "delete"
+	// reconcileAdopt hashes an unindexed file and adds it to the index.
+	reconcileAdopt = "adopt"
+)
+
+// reconcileMinAge keeps reconcile away from files that may still be in the
+// middle of being written.
+const reconcileMinAge = time.Hour
+
+// tempSuffixes are the suffixes of the temporary files written next to their
+// final name.
+var tempSuffixes = []string{".tmp", ".remote-tmp", ".restore-tmp", movePartialSuffix}
+
+// inconsistency is a single finding of reconcile and what was done about it.
+type inconsistency struct {
+	Class  string `json:"class"`
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// reconcileActions maps every class to the action taken for it. Classes
+// that are not listed are reported.
+type reconcileActions map[string]string
+
+func (a reconcileActions) validate() error {
+	for class, action := range a {
+		switch class {
+		case inconsistencyUnindexed:
+			if action == reconcileAdopt {
+				continue
+			}
+		case inconsistencyMissing, inconsistencyOrphan, inconsistencyTemp:
+		default:
+			return fmt.Errorf("unknown class %q", class)
+		}
+		if action != reconcileReport && action != reconcileDelete {
+			return fmt.Errorf("invalid action %q for %s", action, class)
+		}
+	}
+	return nil
+}
+
+// reconcile compares UploadPath, TempUploadPath and the file index with each
+// other and reports, deletes or adopts what does not add up.
+func reconcile(ctx context.Context, actions reconcileActions) ([]inconsistency, error) {
+	if storedFiles == nil {
+		return nil, fmt.Errorf("reconcile needs the %s storage backend", storageFile)
+	}
+	if err := actions.validate(); err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-reconcileMinAge)
+	var found []inconsistency
+	handle := func(class, path string, fix func() error) {
+		item := inconsistency{Class: class, Path: path, Action: reconcileReport}
+		if action := actions[class]; action != "" && action != reconcileReport {
+			if err := fix(); err != nil {
+				item.Error = err.Error()
+			} else {
+				item.Action = action
+			}
+		}
+		found = append(found, item)
+	}
+
+	// Stored files against the index.
+	seen := map[string]bool{}
+	var dirs []string
+	err := filepath.WalkDir(UploadPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() {
+			if p != UploadPath {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(UploadPath, p)
+		if isStoredTempFile(p) {
+			if info.ModTime().Before(cutoff) {
+				handle(inconsistencyTemp, filepath.Join(UploadPath, rel), func() error { return os.Remove(p) })
+			}
+			return nil
+		}
+		// A sidecar is an orphan without its file, unless it is an
+		// upload named like one.
+		_, indexed := storedFiles.get(rel)
+		if file, ok := sidecarOf(p); ok && !indexed {
+			_, err := os.Stat(file)
+			if _, stubErr := os.Stat(file + tieredSuffix); os.IsNotExist(err) && os.IsNotExist(stubErr) && info.ModTime().Before(cutoff) {
+				handle(inconsistencyOrphan, p, func() error { return os.Remove(p) })
+			}
+			return nil
+		}
+		name, _ := strings.CutSuffix(filepath.ToSlash(rel), tieredSuffix)
+		seen[name] = true
+		if _, ok := storedFiles.get(name); ok {
+			return nil
+		}
+		tiered := strings.HasSuffix(p, tieredSuffix)
+		if !tiered && info.ModTime().After(cutoff) {
+			// Possibly being stored right now.
+			return nil
+		}
+		handle(inconsistencyUnindexed, name, func() error {
+			if actions[inconsistencyUnindexed] == reconcileDelete {
+				return deleteStored(name, tiered)
+			}
+			if tiered {
+				stub, err := readTieredStub(name)
+				if err != nil {
+					return err
+				}
+				storedFiles.record(name, stub.Size, "")
+				return nil
+			}
+			sum, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			storedFiles.record(name, info.Size(), sum)
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		return found, err
+	}
+	for _, name := range storedFiles.names() {
+		if !seen[name] {
+			handle(inconsistencyMissing, name, func() error {
+				storedFiles.remove(name)
+				return nil
+			})
+		}
+	}
+	// Deepest first, so parents emptied by removing their children go too.
+	slices.Reverse(dirs)
+	for _, dir := range dirs {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+			handle(inconsistencyTemp, dir, func() error { return os.Remove(dir) })
+		}
+	}
+
+	// Pieces of incomplete uploads.
+	entries, err := os.ReadDir(TempUploadPath)
+	if err != nil {
+		return found, err
+	}
+	present := map[string]bool{}
+	for _, entry := range entries {
+		present[entry.Name()] = true
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		p := filepath.Join(TempUploadPath, name)
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if isTempFile(name) {
+			handle(inconsistencyTemp, p, func() error { return os.Remove(p) })
+			continue
+		}
+		id, ext, _ := strings.Cut(name, ".")
+		if !uploadIDPattern.MatchString(id) {
+			continue
+		}
+		orphan := false
+		switch ext {
+		case "":
+			orphan = !present[id+".info"]
+		case "info":
+			orphan = !present[id]
+		case "hash", "lock", "move", "sanitized":
+			orphan = !present[id+".info"]
+		}
+		if orphan {
+			handle(inconsistencyOrphan, p, func() error { return os.Remove(p) })
+		}
+	}
+	return found, nil
+}
+
+func isTempFile(name string) bool {
+	return slices.ContainsFunc(tempSuffixes, func(suffix string) bool { return strings.HasSuffix(name, suffix) })
+}
+
+// isStoredTempFile reports whether p, a path below UploadPath, is a
+// temporary file written next to its final name: named like one, not a
+// stored file, and its final name is a file there, its stub, or a sidecar
+// of one. Uploads may be named like temporary files too.
+func isStoredTempFile(p string) bool {
+	for _, suffix := range tempSuffixes {
+		final, ok := strings.CutSuffix(p, suffix)
+		if !ok {
+			continue
+		}
+		rel, _ := filepath.Rel(UploadPath, p)
+		if _, indexed := storedFiles.get(rel); indexed {
+			return false
+		}
+		if _, err := os.Stat(final); err == nil {
+			return true
+		}
+		if _, err := os.Stat(final + tieredSuffix); err == nil {
+			return true
+		}
+		return isSidecar(final)
+	}
+	return false
+}
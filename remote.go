@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errRemoteMissing = errors.New("remote file missing")
+
+// storageTarget is a storage outside UploadPath that stored files are copied
+// to, for replication and tiering. Names are relative to UploadPath and use
+// forward slashes.
+type storageTarget interface {
+	// Put copies the local file f of the given size to name.
+	Put(ctx context.Context, name string, f *os.File, size int64) error
+	// Get opens the remote copy of name.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// Size returns the size of the remote copy of name, or errRemoteMissing.
+	Size(ctx context.Context, name string) (int64, error)
+	String() string
+}
+
+// s3Remote holds the connection settings of an S3 compatible service, read
+// from <PREFIX>_S3_ENDPOINT, _REGION, _ACCESS_KEY and _SECRET_KEY.
+type s3Remote struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+func s3RemoteFromEnv(prefix string) s3Remote {
+	remote := s3Remote{
+		Endpoint:  os.Getenv(prefix + "_S3_ENDPOINT"),
+		Region:    os.Getenv(prefix + "_S3_REGION"),
+		AccessKey: os.Getenv(prefix + "_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv(prefix + "_S3_SECRET_KEY"),
+	}
+	if remote.Endpoint == "" {
+		remote.Endpoint = "https://s3.amazonaws.com"
+	}
+	if remote.Region == "" {
+		remote.Region = "us-east-1"
+	}
+	return remote
+}
+
+// newStorageTarget returns the target described by spec: either a local
+// directory (a mounted network share, typically) or s3://bucket/prefix on
+// the service described by remote.
+func newStorageTarget(spec string, remote s3Remote) (storageTarget, error) {
+	bucket, ok := strings.CutPrefix(spec, "s3://")
+	if !ok {
+		return dirTarget(spec), nil
+	}
+	bucket, prefix, _ := strings.Cut(bucket, "/")
+	if bucket == "" {
+		return nil, errors.New("missing bucket")
+	}
+	endpoint, err := url.Parse(remote.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", remote.Endpoint)
+	}
+	return &s3Target{
+		endpoint: endpoint,
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		remote:   remote,
+	}, nil
+}
+
+type dirTarget string
+
+func (d dirTarget) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+func (d dirTarget) Put(ctx context.Context, name string, f *os.File, size int64) error {
+	dst := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := dst + ".remote-tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, f)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (d dirTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(name))
+	if os.IsNotExist(err) {
+		return nil, errRemoteMissing
+	}
+	return f, err
+}
+
+func (d dirTarget) Size(ctx context.Context, name string) (int64, error) {
+	stat, err := os.Stat(d.path(name))
+	if os.IsNotExist(err) {
+		return 0, errRemoteMissing
+	}
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (d dirTarget) String() string {
+	return string(d)
+}
+
+type s3Target struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	remote   s3Remote
+}
+
+func (s *s3Target) do(ctx context.Context, method, name string, body io.Reader, size int64) (*http.Response, error) {
+	return s.doQuery(ctx, method, name, nil, body, size)
+}
+
+func (s *s3Target) objectURL(name string, query url.Values) url.URL {
+	u := *s.endpoint
+	u.Path = "/" + path.Join(s.bucket, s.prefix, name)
+	u.RawQuery = query.Encode()
+	return u
+}
+
+func (s *s3Target) doQuery(ctx context.Context, method, name string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := s.objectURL(name, query)
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		r.ContentLength = size
+	}
+	signS3Request(r, s.remote.Region, s.remote.AccessKey, s.remote.SecretKey)
+	return http.DefaultClient.Do(r)
+}
+
+func (s *s3Target) Put(ctx context.Context, name string, f *os.File, size int64) error {
+	res, err := s.do(ctx, http.MethodPut, name, f, size)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("PUT %s: %s %s", name, res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *s3Target) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, name, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, errRemoteMissing
+	}
+	res.Body.Close()
+	return nil, fmt.Errorf("GET %s: %s", name, res.Status)
+}
+
+func (s *s3Target) Size(ctx context.Context, name string) (int64, error) {
+	res, err := s.do(ctx, http.MethodHead, name, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, errRemoteMissing
+	}
+	return 0, fmt.Errorf("HEAD %s: %s", name, res.Status)
+}
+
+// Delete removes the object name, if it exists.
+func (s *s3Target) Delete(ctx context.Context, name string) error {
+	res, err := s.do(ctx, http.MethodDelete, name, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("DELETE %s: %s", name, res.Status)
+	}
+	return nil
+}
+
+func (s *s3Target) String() string {
+	return "s3://" + path.Join(s.bucket, s.prefix) + " at " + s.endpoint.String()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	replicaRetryMin = time.Minute
+	replicaRetryMax = time.Hour
+	// replicaCatchUp is how often pending replicas are looked at even when
+	// nothing new was stored.
+	replicaCatchUp = time.Minute
+)
+
+var errLocalMissing = errors.New("file no longer exists")
+
+// Replication states of a stored file. Files stored before replication was
+// enabled are "unknown" until replication-repair copies them.
+const (
+	replicaPending = "pending"
+	replicaFailed  = "failed"
+	replicaSynced  = "synced"
+	replicaUnknown = "unknown"
+)
+
+// replicaState is the replication state of a stored file, as reported by
+// the admin API.
+type replicaState struct {
+	State string `json:"state"`
+	// Lag is how long a pending or failed file has waited for its copy,
+	// in seconds.
+	Lag       int64     `json:"lag"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	NextTry   time.Time `json:"next_try,omitzero"`
+	// Synced is when the file was copied to the replica.
+	Synced time.Time `json:"synced,omitzero"`
+}
+
+// replicaEntry is a file waiting for replication, for GET /replication.
+type replicaEntry struct {
+	Name string `json:"name"`
+	replicaState
+}
+
+// replicaStatus tracks a file that still has to be replicated.
+type replicaStatus struct {
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	NextTry   time.Time `json:"next_try"`
+	Queued    time.Time `json:"queued"`
+}
+
+// replicator copies stored files to the replica target in the background.
+// Files waiting for replication are journaled in replication.json in
+// TempUploadPath, so a restart or an unavailable target only delays them.
+// Failed copies are retried with exponential backoff.
+type replicator struct {
+	target  storageTarget
+	journal string
+	wake    chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*replicaStatus
+}
+
+// replication is nil unless REPLICA_TARGET is set.
+var replication *replicator
+
+func newReplicator(target storageTarget, journal string) (*replicator, error) {
+	r := &replicator{
+		target:  target,
+		journal: journal,
+		wake:    make(chan struct{}, 1),
+		pending: map[string]*replicaStatus{},
+	}
+	data, err := os.ReadFile(journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &r.pending); err != nil {
+			return nil, fmt.Errorf("%s: %w", journal, err)
+		}
+	}
+	return r, nil
+}
+
+// enqueue schedules name, relative to UploadPath, for replication.
+func (r *replicator) enqueue(name string) {
+	r.mu.Lock()
+	now := time.Now()
+	r.pending[filepath.ToSlash(name)] = &replicaStatus{Queued: now, NextTry: now}
+	r.saveLocked()
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *replicator) saveLocked() {
+	data, err := json.Marshal(r.pending)
+	if err == nil {
+		tmp := r.journal + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, r.journal)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save replication journal: %s", err.Error())
+	}
+}
+
+// run replicates pending files until ctx is done.
+func (r *replicator) run(ctx context.Context) {
+	ticker := time.NewTicker(replicaCatchUp)
+	defer ticker.Stop()
+	for {
+		r.catchUp(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *replicator) catchUp(ctx context.Context) {
+	r.mu.Lock()
+	due := map[string]time.Time{}
+	now := time.Now()
+	for name, status := range r.pending {
+		if !status.NextTry.After(now) {
+			due[name] = status.Queued
+		}
+	}
+	r.mu.Unlock()
+
+	for name, queued := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		err := replicateFile(ctx, r.target, name)
+		r.mu.Lock()
+		status, ok := r.pending[name]
+		switch {
+		case !ok || !status.Queued.Equal(queued):
+			// Stored again while it was copied, the new version is due.
+		case err == nil:
+			delete(r.pending, name)
+			if storedFiles != nil {
+				storedFiles.markReplicated(name, queued, time.Now())
+			}
+			log.Printf("Replicated %s to %s", name, r.target)
+		case errors.Is(err, errLocalMissing):
+			delete(r.pending, name)
+			log.Printf("Not replicating %s, it was deleted", name)
+		default:
+			status.Attempts++
+			status.LastError = err.Error()
+			status.NextTry = time.Now().Add(min(replicaRetryMin<<min(status.Attempts-1, 10), replicaRetryMax))
+			log.Printf("Replication of %s failed (attempt %d): %s", name, status.Attempts, err.Error())
+		}
+		r.saveLocked()
+		r.mu.Unlock()
+	}
+}
+
+// state returns the replication state of the stored file name.
+func (r *replicator) state(name string) replicaState {
+	r.mu.Lock()
+	status, ok := r.pending[filepath.ToSlash(name)]
+	var copied replicaStatus
+	if ok {
+		copied = *status
+	}
+	r.mu.Unlock()
+	if ok {
+		return pendingState(copied, time.Now())
+	}
+	if storedFiles != nil {
+		if rec, ok := storedFiles.get(name); ok && !rec.Replicated.IsZero() {
+			return replicaState{State: replicaSynced, Synced: rec.Replicated}
+		}
+	}
+	return replicaState{State: replicaUnknown}
+}
+
+// pendingState returns the state of a file waiting for replication: failed
+// once an attempt to copy it failed.
+func pendingState(status replicaStatus, now time.Time) replicaState {
+	state := replicaState{
+		State:     replicaPending,
+		Lag:       int64(now.Sub(status.Queued).Seconds()),
+		Attempts:  status.Attempts,
+		LastError: status.LastError,
+		NextTry:   status.NextTry,
+	}
+	if status.Attempts > 0 {
+		state.State = replicaFailed
+	}
+	return state
+}
+
+// backlog returns the files waiting for replication, the longest waiting
+// first.
+func (r *replicator) backlog() []replicaEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	list := make([]replicaEntry, 0, len(r.pending))
+	for name, status := range r.pending {
+		list = append(list, replicaEntry{Name: name, replicaState: pendingState(*status, now)})
+	}
+	slices.SortFunc(list, func(a, b replicaEntry) int { return cmp.Or(cmp.Compare(b.Lag, a.Lag), strings.Compare(a.Name, b.Name)) })
+	return list
+}
+
+// replicateFile copies name from UploadPath to target.
+func replicateFile(ctx context.Context, target storageTarget, name string) error {
+	f, err := os.Open(filepath.Join(UploadPath, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return errLocalMissing
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return target.Put(ctx, name, f, stat.Size())
+}
+
+// runReplicationRepair implements "uploader replication-repair": it compares
+// every file in UploadPath with its replica and copies the ones that are
+// missing or differ in size.
+func runReplicationRepair(args []string) int {
+	if ReplicaTarget == "" {
+		fmt.Fprintln(os.Stderr, "REPLICA_TARGET is not set")
+		return 2
+	}
+	target, err := newStorageTarget(ReplicaTarget, ReplicaS3)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid REPLICA_TARGET: %s\n", err.Error())
+		return 2
+	}
+	ctx := context.Background()
+	var checked, repaired, failed int
+	err = filepath.WalkDir(UploadPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, tieredSuffix) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(UploadPath, p)
+		name := filepath.ToSlash(rel)
+		checked++
+		size, err := target.Size(ctx, name)
+		if err == nil && size == info.Size() {
+			return nil
+		}
+		reason := "missing"
+		if err == nil {
+			reason = "size " + strconv.FormatInt(size, 10) + ", expected " + strconv.FormatInt(info.Size(), 10)
+		} else if err != errRemoteMissing {
+			reason = err.Error()
+		}
+		if err := replicateFile(ctx, target, name); err != nil {
+			failed++
+			fmt.Printf("%s: %s, repair failed: %s\n", name, reason, err.Error())
+			return nil
+		}
+		repaired++
+		fmt.Printf("%s: %s, repaired\n", name, reason)
+		return nil
+	})
+	fmt.Printf("Checked %d files against %s: %d repaired, %d failed\n", checked, target, repaired, failed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
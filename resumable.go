@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// resumableHandler implements the Content-Range based resumable upload
+// protocol used by Google Cloud Storage and YouTube. A session is started
+// with a POST, after which the returned session URL accepts the file through
+// one or more PUT requests. Every incomplete PUT is answered with
+// 308 Resume Incomplete and a Range header holding the bytes received so far.
+// Sessions are stored in the same tus store, so finished files go through
+// finishUpload like regular tus uploads.
+type resumableHandler struct {
+	composer *tusd.StoreComposer
+}
+
+func (h *resumableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(r.URL.Path, "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		h.create(w, r)
+	case id != "" && r.Method == http.MethodPut:
+		h.put(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		h.cancel(w, r, id)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *resumableHandler) create(w http.ResponseWriter, r *http.Request) {
+	info := tusd.FileInfo{SizeIsDeferred: true}
+	if v := r.Header.Get("X-Upload-Content-Length"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			httpError(w, "Invalid X-Upload-Content-Length", http.StatusBadRequest)
+			return
+		}
+		info.Size = size
+		info.SizeIsDeferred = false
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" && r.ContentLength != 0 {
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&body); err != nil && err != io.EOF {
+			httpError(w, "Invalid session metadata", http.StatusBadRequest)
+			return
+		}
+		name = body.Name
+	}
+	info.MetaData = tusd.MetaData{
+		"filename": name,
+		"filetype": r.Header.Get("X-Upload-Content-Type"),
+	}
+	changes, err := prepareUpload(createHook(r, info), h.composer)
+	if err != nil {
+		h.sessionError(w, err)
+		return
+	}
+	if changes.MetaData != nil {
+		info.MetaData = changes.MetaData
+	}
+
+	upload, err := h.composer.Core.NewUpload(r.Context(), info)
+	if e, ok := uploadRejection(err); ok {
+		httpErrorCode(w, e.ErrorCode, e.Message, e.HTTPResponse.StatusCode)
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to create resumable session: %s", err.Error())
+		httpError(w, "Unable to create upload session", http.StatusInternalServerError)
+		return
+	}
+	info, err = upload.GetInfo(r.Context())
+	if err != nil {
+		log.Printf("Unable to read resumable session: %s", err.Error())
+		httpError(w, "Unable to create upload session", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%s] Resumable session %s created", requestID(r), info.ID)
+	w.Header().Set("Location", ResumableURL+info.ID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *resumableHandler) put(w http.ResponseWriter, r *http.Request, id string) {
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"), r.ContentLength)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lock, err := h.lock(r.Context(), id)
+	if err != nil {
+		httpError(w, "Upload session is busy", http.StatusServiceUnavailable)
+		return
+	}
+	defer lock.Unlock()
+
+	upload, err := h.composer.Core.GetUpload(r.Context(), id)
+	if err != nil {
+		h.sessionError(w, err)
+		return
+	}
+	info, err := upload.GetInfo(r.Context())
+	if err != nil {
+		h.sessionError(w, err)
+		return
+	}
+	if !pinnedTo(info, clientPin(r.RemoteAddr, r.Header)) {
+		h.sessionError(w, errUploadPinned)
+		return
+	}
+
+	if total >= 0 {
+		if info.SizeIsDeferred {
+			if total < info.Offset {
+				httpError(w, "Content-Range total is smaller than the received data", http.StatusBadRequest)
+				return
+			}
+			if err := h.composer.LengthDeferrer.AsLengthDeclarableUpload(upload).DeclareLength(r.Context(), total); err != nil {
+				h.sessionError(w, err)
+				return
+			}
+			info.Size = total
+			info.SizeIsDeferred = false
+		} else if total != info.Size {
+			httpError(w, "Content-Range total does not match the upload length", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Bytes the server already has are skipped, a gap in front of the
+	// current offset makes the client resend from the reported range.
+	if start >= 0 && start <= info.Offset && end >= info.Offset {
+		if _, err := io.CopyN(io.Discard, r.Body, info.Offset-start); err != nil {
+			resumeIncomplete(w, info.Offset)
+			return
+		}
+		length := end - info.Offset + 1
+		if !info.SizeIsDeferred && info.Offset+length > info.Size {
+			httpError(w, "Content-Range exceeds the upload length", http.StatusBadRequest)
+			return
+		}
+		n, err := upload.WriteChunk(r.Context(), info.Offset, io.LimitReader(r.Body, length))
+		info.Offset += n
+		if err != nil {
+			log.Printf("[%s] Resumable session %s interrupted at %d: %s", requestID(r), id, info.Offset, err.Error())
+			resumeIncomplete(w, info.Offset)
+			return
+		}
+	}
+
+	if info.SizeIsDeferred || info.Offset < info.Size {
+		resumeIncomplete(w, info.Offset)
+		return
+	}
+
+	if err := upload.FinishUpload(r.Context()); err != nil {
+		h.sessionError(w, err)
+		return
+	}
+	// The COMPLETION_FIELDS are added to those the protocol answers with.
+	payload := completionPayload(info)
+	if payload == nil {
+		payload = map[string]any{}
+	}
+	payload["id"], payload["name"], payload["size"] = info.ID, info.MetaData["filename"], info.Size
+	finishUpload(info)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payload)
+}
+
+func (h *resumableHandler) cancel(w http.ResponseWriter, r *http.Request, id string) {
+	lock, err := h.lock(r.Context(), id)
+	if err != nil {
+		httpError(w, "Upload session is busy", http.StatusServiceUnavailable)
+		return
+	}
+	defer lock.Unlock()
+
+	upload, err := h.composer.Core.GetUpload(r.Context(), id)
+	if err != nil {
+		h.sessionError(w, err)
+		return
+	}
+	if info, err := upload.GetInfo(r.Context()); err == nil && !pinnedTo(info, clientPin(r.RemoteAddr, r.Header)) {
+		h.sessionError(w, errUploadPinned)
+		return
+	}
+	if err := h.composer.Terminater.AsTerminatableUpload(upload).Terminate(r.Context()); err != nil {
+		h.sessionError(w, err)
+		return
+	}
+	log.Printf("Resumable session %s cancelled", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *resumableHandler) lock(ctx context.Context, id string) (tusd.Lock, error) {
+	return lockUpload(ctx, h.composer, id)
+}
+
+// lockUpload takes the lock of the upload id, as the tus handler does before
+// touching an upload, waiting up to 20 seconds for it.
+func lockUpload(ctx context.Context, composer *tusd.StoreComposer, id string) (tusd.Lock, error) {
+	lock, err := composer.Locker.NewLock(id)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	if err := lock.Lock(ctx, func() {}); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (h *resumableHandler) sessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, tusd.ErrNotFound) {
+		httpErrorCode(w, tusd.ErrNotFound.ErrorCode, "Upload session not found", http.StatusNotFound)
+		return
+	}
+	if e, ok := uploadRejection(err); ok {
+		// Retry-After and the queue position of a queued upload.
+		for k, v := range e.HTTPResponse.Header {
+			if k != "Content-Type" {
+				w.Header().Set(k, v)
+			}
+		}
+		httpErrorCode(w, e.ErrorCode, e.Message, e.HTTPResponse.StatusCode)
+		return
+	}
+	log.Printf("Resumable session error: %s", err.Error())
+	httpError(w, "Upload session error", http.StatusInternalServerError)
+}
+
+// resumeIncomplete answers with 308 and the range of bytes persisted so far.
+func resumeIncomplete(w http.ResponseWriter, offset int64) {
+	if offset > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", offset-1))
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// parseContentRange parses "bytes start-end/total", "bytes */total" and the
+// "*" total placeholder. A start of -1 denotes a status query and a total of
+// -1 an unknown length. Without a header the body is the whole file.
+func parseContentRange(header string, contentLength int64) (start, end, total int64, err error) {
+	if header == "" {
+		if contentLength < 0 {
+			return 0, 0, 0, errors.New("Content-Length or Content-Range is required")
+		}
+		if contentLength == 0 {
+			return -1, -1, 0, nil
+		}
+		return 0, contentLength - 1, contentLength, nil
+	}
+
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, errors.New("Invalid Content-Range")
+	}
+	rng, size, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return 0, 0, 0, errors.New("Invalid Content-Range")
+	}
+
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total < 0 {
+			return 0, 0, 0, errors.New("Invalid Content-Range total")
+		}
+	}
+
+	if rng == "*" {
+		return -1, -1, total, nil
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, errors.New("Invalid Content-Range")
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, errors.New("Invalid Content-Range start")
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, errors.New("Invalid Content-Range end")
+	}
+	if total >= 0 && end >= total {
+		return 0, 0, 0, errors.New("Content-Range end exceeds total")
+	}
+	if contentLength >= 0 && contentLength != end-start+1 {
+		return 0, 0, 0, errors.New("Content-Length does not match Content-Range")
+	}
+	return start, end, total, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// routingRule routes the stored files whose detected type matches one of
+// Types, e.g. "video/*" or "application/pdf": they are stored in Folder,
+// within the folder of their upload policy, and moved to Target, a
+// directory like a mounted NAS share or s3://bucket/prefix on the service
+// set by the ROUTING_S3_* variables, once stored. Moved files leave a stub
+// and are brought back when read, like files in cold storage.
+type routingRule struct {
+	Types  []string `json:"types"`
+	Folder string   `json:"folder,omitempty"`
+	Target string   `json:"target,omitempty"`
+
+	target storageTarget
+}
+
+// routingMu serializes the moves of routed files, so a retry does not race
+// the first attempt.
+var routingMu sync.Mutex
+
+// loadRoutingRules reads the rules from the JSON array in file, e.g.
+//
+//	[{"types": ["video/*"], "target": "/mnt/nas/video"},
+//	 {"types": ["image/*"], "target": "s3://photos/incoming"},
+//	 {"types": ["application/pdf", "text/*"], "folder": "documents"}]
+//
+// The first rule matching a file applies.
+func loadRoutingRules(file string) ([]*routingRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*routingRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules {
+		if len(r.Types) == 0 {
+			return nil, fmt.Errorf("rule %d: no types", i+1)
+		}
+		for j, t := range r.Types {
+			r.Types[j] = strings.ToLower(strings.TrimSpace(t))
+			if t != "*" && !strings.Contains(t, "/") {
+				return nil, fmt.Errorf("rule %d: invalid type %q", i+1, t)
+			}
+		}
+		if r.Folder == "" && r.Target == "" {
+			return nil, fmt.Errorf("rule %d: neither folder nor target", i+1)
+		}
+		if r.Folder != "" && !filepath.IsLocal(filepath.FromSlash(r.Folder)) {
+			return nil, fmt.Errorf("rule %d: folder %q is outside the upload directory", i+1, r.Folder)
+		}
+		if r.Target != "" {
+			if r.target, err = newStorageTarget(r.Target, s3RemoteFromEnv("ROUTING")); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid target: %w", i+1, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (r *routingRule) matches(mediaType string) bool {
+	for _, t := range r.Types {
+		if t == "*" || t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectFileType returns the media type of the file at p, from its content,
+// or from the extension of filename when the content tells nothing more
+// than text or binary data.
+func detectFileType(p, filename string) string {
+	f, err := os.Open(p)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if detected == "application/octet-stream" || detected == "text/plain" {
+		if byExt, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(filename))); err == nil {
+			return byExt
+		}
+	}
+	return detected
+}
+
+// routeFor returns the rule routing the file at p, uploaded as filename,
+// nil if none does.
+func routeFor(p, filename string) *routingRule {
+	if len(RoutingRules) == 0 || StorageBackend != storageFile {
+		return nil
+	}
+	mediaType := detectFileType(p, filename)
+	if mediaType == "" {
+		return nil
+	}
+	for _, r := range RoutingRules {
+		if r.matches(mediaType) {
+			return r
+		}
+	}
+	return nil
+}
+
+// routeStored moves the stored file name to the target of its rule. The
+// file index keeps the target until the move succeeds, so the "routing"
+// job retries failed moves.
+func routeStored(ctx context.Context, name string, r *routingRule) error {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+	info, err := os.Stat(filepath.Join(UploadPath, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		// Moved already, or deleted.
+		storedFiles.setRoute(name, "")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := tierFile(ctx, r.target, name, info); err != nil {
+		return err
+	}
+	storedFiles.setRoute(name, "")
+	log.Printf("Routed %s to %s", name, r.target)
+	return nil
+}
+
+// routePendingFiles retries the moves of routed files that failed. It runs
+// as the "routing" scheduler job.
+func routePendingFiles(ctx context.Context) (string, error) {
+	moved, failed := 0, 0
+	for name, target := range storedFiles.pendingRoutes() {
+		if ctx.Err() != nil {
+			break
+		}
+		var rule *routingRule
+		for _, r := range RoutingRules {
+			if r.Target == target {
+				rule = r
+				break
+			}
+		}
+		if rule == nil {
+			log.Printf("Not routing %s, no rule has the target %s anymore", name, target)
+			storedFiles.setRoute(name, "")
+			continue
+		}
+		if err := routeStored(ctx, name, rule); err != nil {
+			log.Printf("Unable to route %s to %s: %s", name, rule.target, err.Error())
+			failed++
+			continue
+		}
+		moved++
+	}
+	if moved == 0 && failed == 0 {
+		return "", ctx.Err()
+	}
+	return fmt.Sprintf("routed %d files, %d failed", moved, failed), ctx.Err()
+}
+
+// routedTarget returns the target holding the file of stub: the cold
+// storage or the target of a routing rule, nil if neither is configured.
+func routedTarget(stub tieredStub) storageTarget {
+	for _, r := range RoutingRules {
+		if r.target != nil && r.target.String() == stub.Target {
+			return r.target
+		}
+	}
+	// Stubs written before the target was renamed are looked for in cold
+	// storage.
+	return tiering
+}
@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// s3Handler exposes a minimal S3-compatible API (path-style addressing) on
+// top of the tus store, so tools such as rclone and aws-cli can push files
+// directly. Buckets map to directories below UploadPath and object keys to
+// paths inside them. Multipart uploads keep every part as a separate tus
+// upload which is concatenated when the upload is completed.
+type s3Handler struct {
+	composer *tusd.StoreComposer
+}
+
+var s3BucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	RequestID string   `xml:"RequestId,omitempty"`
+	status    int
+}
+
+var (
+	errS3AccessDenied     = s3Error{Code: "AccessDenied", Message: "Access Denied", status: http.StatusForbidden}
+	errS3SignatureMatch   = s3Error{Code: "SignatureDoesNotMatch", Message: "The request signature does not match", status: http.StatusForbidden}
+	errS3InvalidBucket    = s3Error{Code: "InvalidBucketName", Message: "The specified bucket is not valid", status: http.StatusBadRequest}
+	errS3InvalidKey       = s3Error{Code: "InvalidArgument", Message: "The specified key is not valid", status: http.StatusBadRequest}
+	errS3NoSuchKey        = s3Error{Code: "NoSuchKey", Message: "The specified key does not exist", status: http.StatusNotFound}
+	errS3NoSuchUpload     = s3Error{Code: "NoSuchUpload", Message: "The specified multipart upload does not exist", status: http.StatusNotFound}
+	errS3InvalidPart      = s3Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found", status: http.StatusBadRequest}
+	errS3InvalidOrder     = s3Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order", status: http.StatusBadRequest}
+	errS3MalformedXML     = s3Error{Code: "MalformedXML", Message: "The XML you provided was not well-formed", status: http.StatusBadRequest}
+	errS3MissingLength    = s3Error{Code: "MissingContentLength", Message: "You must provide the Content-Length HTTP header", status: http.StatusLengthRequired}
+	errS3IncompleteBody   = s3Error{Code: "IncompleteBody", Message: "You did not provide the number of bytes specified by the Content-Length HTTP header", status: http.StatusBadRequest}
+	errS3NotImplemented   = s3Error{Code: "NotImplemented", Message: "A header or operation you provided is not implemented", status: http.StatusNotImplemented}
+	errS3ContentSHA256    = s3Error{Code: "XAmzContentSHA256Mismatch", Message: "The provided 'x-amz-content-sha256' header does not match what was computed", status: http.StatusBadRequest}
+	errS3InternalError    = s3Error{Code: "InternalError", Message: "We encountered an internal error. Please try again", status: http.StatusInternalServerError}
+	errS3MethodNotAllowed = s3Error{Code: "MethodNotAllowed", Message: "The specified method is not allowed against this resource", status: http.StatusMethodNotAllowed}
+)
+
+func (e s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func writeS3Error(w http.ResponseWriter, e s3Error) {
+	e.RequestID = w.Header().Get("X-Request-ID")
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(e)
+}
+
+func writeS3XML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (h *s3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	// A signed URL stands in for the credentials when reading.
+	signedURL := false
+	if read && S3DownloadSecret != "" && r.URL.Query().Has("signature") {
+		if err := verifyDownload(r.URL.Path, r.URL.Query()); err != nil {
+			log.Printf("S3 signed URL rejected: %s", err.Error())
+			writeS3Error(w, errS3AccessDenied)
+			return
+		}
+		signedURL = true
+	}
+	if !signedURL {
+		if err := verifyS3Signature(r); err != nil {
+			log.Printf("S3 request rejected: %s", err.Error())
+			writeS3Error(w, errS3SignatureMatch)
+			return
+		}
+		if sum, err := hex.DecodeString(r.Header.Get("X-Amz-Content-Sha256")); err == nil && len(sum) == sha256.Size {
+			r.Body = &s3PayloadReader{r: r.Body, n: r.ContentLength, want: sum, hash: sha256.New()}
+		}
+	}
+	if read && !refererAllowed(r) {
+		log.Printf("S3 request for %s refused, linked from %s", r.URL.Path, r.Header.Get("Referer")+r.Header.Get("Origin"))
+		writeS3Error(w, errS3AccessDenied)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		writeS3Error(w, errS3AccessDenied)
+		return
+	}
+	if !s3BucketName.MatchString(bucket) {
+		writeS3Error(w, errS3InvalidBucket)
+		return
+	}
+
+	q := r.URL.Query()
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead, http.MethodPut:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			h.listObjects(w, r, bucket)
+		default:
+			writeS3Error(w, errS3MethodNotAllowed)
+		}
+		return
+	}
+
+	dst, ok := s3ObjectPath(bucket, key)
+	if !ok {
+		writeS3Error(w, errS3InvalidKey)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		h.createMultipart(w, r, bucket, key)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		h.uploadPart(w, r, q.Get("uploadId"), q.Get("partNumber"), bucket, key)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		h.completeMultipart(w, r, q.Get("uploadId"), bucket, key, dst)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		h.abortMultipart(w, r, q.Get("uploadId"), bucket, key)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			writeS3Error(w, errS3NotImplemented)
+			return
+		}
+		h.putObject(w, r, bucket, key, dst)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		h.getObject(w, r, dst)
+	default:
+		writeS3Error(w, errS3MethodNotAllowed)
+	}
+}
+
+// s3ObjectPath maps a bucket and key to a path relative to UploadPath,
+// refusing keys which would escape the bucket directory.
+func s3ObjectPath(bucket, key string) (string, bool) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.HasSuffix(key, "/") {
+		return "", false
+	}
+	return filepath.Join(bucket, filepath.FromSlash(clean)), true
+}
+
+// s3Body returns the decoded request body and its length, unwrapping the
+// aws-chunked encoding used for streaming signatures.
+func s3Body(r *http.Request) (io.Reader, int64, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		if r.ContentLength < 0 {
+			return nil, 0, errS3MissingLength
+		}
+		return r.Body, r.ContentLength, nil
+	}
+	size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return nil, 0, errS3MissingLength
+	}
+	return &awsChunkedReader{r: bufio.NewReader(r.Body)}, size, nil
+}
+
+// receive writes body into a new upload of exactly size bytes and returns
+// the finished upload together with the hex MD5 of its content.
+func (h *s3Handler) receive(r *http.Request, info tusd.FileInfo) (tusd.Upload, tusd.FileInfo, string, error) {
+	body, size, err := s3Body(r)
+	if err != nil {
+		return nil, info, "", err
+	}
+	info.Size = size
+	upload, err := h.composer.Core.NewUpload(r.Context(), info)
+	if err != nil {
+		return nil, info, "", err
+	}
+	if info, err = upload.GetInfo(r.Context()); err != nil {
+		return nil, info, "", err
+	}
+
+	sum := md5.New()
+	n, err := upload.WriteChunk(r.Context(), 0, io.TeeReader(io.LimitReader(body, size), sum))
+	if err == nil && n != size {
+		err = errS3IncompleteBody
+	}
+	if err == nil {
+		err = upload.FinishUpload(r.Context())
+	}
+	if err != nil {
+		h.terminate(r, upload)
+		return nil, info, "", err
+	}
+	info.Offset = n
+	return upload, info, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+func (h *s3Handler) terminate(r *http.Request, upload tusd.Upload) {
+	if err := h.composer.Terminater.AsTerminatableUpload(upload).Terminate(r.Context()); err != nil {
+		log.Printf("S3: unable to remove upload: %s", err.Error())
+	}
+}
+
+func (h *s3Handler) fail(w http.ResponseWriter, op string, err error) {
+	var e s3Error
+	if errors.As(err, &e) {
+		writeS3Error(w, e)
+		return
+	}
+	if e, ok := uploadRejection(err); ok {
+		code := "InvalidRequest"
+		if e.HTTPResponse.StatusCode == http.StatusForbidden {
+			code = "AccessDenied"
+		}
+		writeS3Error(w, s3Error{Code: code, Message: e.Message, status: e.HTTPResponse.StatusCode})
+		return
+	}
+	log.Printf("S3 %s failed: %s", op, err.Error())
+	writeS3Error(w, errS3InternalError)
+}
+
+func (h *s3Handler) putObject(w http.ResponseWriter, r *http.Request, bucket, key, dst string) {
+	_, info, etag, err := h.receive(r, tusd.FileInfo{MetaData: tusd.MetaData{
+		"filename": path.Base(key),
+		"filetype": r.Header.Get("Content-Type"),
+		"bucket":   bucket,
+		"key":      key,
+	}})
+	if err != nil {
+		h.fail(w, "PutObject", err)
+		return
+	}
+	if _, err := storeUpload(info, dst); err != nil && err != errUploadDiscarded {
+		h.fail(w, "PutObject", err)
+		return
+	}
+	log.Printf("S3 object %s/%s stored", bucket, key)
+	w.Header().Set("ETag", strconv.Quote(etag))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *s3Handler) getObject(w http.ResponseWriter, r *http.Request, dst string) {
+	f, err := openStored(r.Context(), dst)
+	if os.IsNotExist(err) {
+		writeS3Error(w, errS3NoSuchKey)
+		return
+	}
+	if err != nil {
+		h.fail(w, "GetObject", err)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		writeS3Error(w, errS3NoSuchKey)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResult struct {
+	XMLName        xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string     `xml:"Name"`
+	Prefix         string     `xml:"Prefix"`
+	Delimiter      string     `xml:"Delimiter,omitempty"`
+	KeyCount       int        `xml:"KeyCount"`
+	MaxKeys        int        `xml:"MaxKeys"`
+	IsTruncated    bool       `xml:"IsTruncated"`
+	Contents       []s3Object `xml:"Contents"`
+	CommonPrefixes []s3Prefix `xml:"CommonPrefixes"`
+}
+
+// listObjects implements a non-paginated ListObjectsV2, enough for tools
+// that check the destination before copying.
+func (h *s3Handler) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	result := s3ListResult{
+		Name:      bucket,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   1000,
+	}
+	seen := map[string]bool{}
+	root := filepath.Join(UploadPath, bucket)
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, result.Prefix) {
+			return nil
+		}
+		if result.Delimiter != "" {
+			if i := strings.Index(key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				prefix := key[:len(result.Prefix)+i+len(result.Delimiter)]
+				if !seen[prefix] {
+					seen[prefix] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{prefix})
+				}
+				return nil
+			}
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		object := s3Object{
+			Key:          key,
+			LastModified: stat.ModTime().UTC().Format(time.RFC3339),
+			Size:         stat.Size(),
+			StorageClass: "STANDARD",
+		}
+		if tiered, ok := strings.CutSuffix(key, tieredSuffix); ok {
+			// Tiered objects are restored on access, list them as usual.
+			stub, err := readTieredStub(path.Join(bucket, tiered))
+			if err != nil {
+				return nil
+			}
+			object.Key = tiered
+			object.LastModified = stub.ModTime.UTC().Format(time.RFC3339)
+			object.Size = stub.Size
+		}
+		result.Contents = append(result.Contents, object)
+		return nil
+	})
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeS3XML(w, result)
+}
+
+func s3PartID(uploadID string, part int) string {
+	return fmt.Sprintf("%s-part%05d", uploadID, part)
+}
+
+func (h *s3Handler) createMultipart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	// The session itself is an empty upload holding the object metadata,
+	// partial like the parts so it is not refused for being empty.
+	upload, err := h.composer.Core.NewUpload(r.Context(), tusd.FileInfo{IsPartial: true, MetaData: tusd.MetaData{
+		"filename": path.Base(key),
+		"filetype": r.Header.Get("Content-Type"),
+		"bucket":   bucket,
+		"key":      key,
+	}})
+	if err == nil {
+		var info tusd.FileInfo
+		if info, err = upload.GetInfo(r.Context()); err == nil {
+			log.Printf("S3 multipart upload %s created for %s/%s", info.ID, bucket, key)
+			writeS3XML(w, struct {
+				XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+				Bucket   string   `xml:"Bucket"`
+				Key      string   `xml:"Key"`
+				UploadID string   `xml:"UploadId"`
+			}{Bucket: bucket, Key: key, UploadID: info.ID})
+			return
+		}
+	}
+	h.fail(w, "CreateMultipartUpload", err)
+}
+
+// session returns the metadata upload of a multipart upload of the object
+// bucket/key. Uploads of other objects do not exist for the request: the
+// object is checked against the rules when the upload is created.
+func (h *s3Handler) session(r *http.Request, uploadID, bucket, key string) (tusd.Upload, tusd.FileInfo, error) {
+	if uploadID == "" || strings.ContainsAny(uploadID, `/\.`) {
+		return nil, tusd.FileInfo{}, errS3NoSuchUpload
+	}
+	upload, err := h.composer.Core.GetUpload(r.Context(), uploadID)
+	if errors.Is(err, tusd.ErrNotFound) {
+		return nil, tusd.FileInfo{}, errS3NoSuchUpload
+	}
+	if err != nil {
+		return nil, tusd.FileInfo{}, err
+	}
+	info, err := upload.GetInfo(r.Context())
+	if err == nil && (info.MetaData["key"] == "" || info.MetaData["bucket"] != bucket || info.MetaData["key"] != key) {
+		err = errS3NoSuchUpload
+	}
+	return upload, info, err
+}
+
+func (h *s3Handler) uploadPart(w http.ResponseWriter, r *http.Request, uploadID, partNumber, bucket, key string) {
+	part, err := strconv.Atoi(partNumber)
+	if err != nil || part < 1 || part > 10000 {
+		writeS3Error(w, s3Error{Code: "InvalidArgument", Message: "Part number must be an integer between 1 and 10000", status: http.StatusBadRequest})
+		return
+	}
+	if _, _, err := h.session(r, uploadID, bucket, key); err != nil {
+		h.fail(w, "UploadPart", err)
+		return
+	}
+
+	id := s3PartID(uploadID, part)
+	if old, err := h.composer.Core.GetUpload(r.Context(), id); err == nil {
+		h.terminate(r, old)
+	}
+	_, _, etag, err := h.receive(r, tusd.FileInfo{ID: id, IsPartial: true})
+	if err != nil {
+		h.fail(w, "UploadPart", err)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(etag))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *s3Handler) completeMultipart(w http.ResponseWriter, r *http.Request, uploadID, bucket, key, dst string) {
+	session, sessionInfo, err := h.session(r, uploadID, bucket, key)
+	if err != nil {
+		h.fail(w, "CompleteMultipartUpload", err)
+		return
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeS3Error(w, errS3MalformedXML)
+		return
+	}
+
+	var (
+		parts []tusd.Upload
+		ids   []string
+		size  int64
+		sums  = md5.New()
+	)
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			writeS3Error(w, errS3InvalidOrder)
+			return
+		}
+		upload, err := h.composer.Core.GetUpload(r.Context(), s3PartID(uploadID, p.PartNumber))
+		if err != nil {
+			writeS3Error(w, errS3InvalidPart)
+			return
+		}
+		info, err := upload.GetInfo(r.Context())
+		if err != nil {
+			h.fail(w, "CompleteMultipartUpload", err)
+			return
+		}
+		etag, err := h.partETag(r, upload)
+		if err != nil {
+			h.fail(w, "CompleteMultipartUpload", err)
+			return
+		}
+		if !strings.EqualFold(strings.Trim(p.ETag, `"`), etag) {
+			writeS3Error(w, errS3InvalidPart)
+			return
+		}
+		raw, _ := hex.DecodeString(etag)
+		sums.Write(raw)
+		parts = append(parts, upload)
+		ids = append(ids, info.ID)
+		size += info.Offset
+	}
+
+	final, err := h.composer.Core.NewUpload(r.Context(), tusd.FileInfo{
+		Size:           size,
+		IsFinal:        true,
+		PartialUploads: ids,
+		MetaData:       sessionInfo.MetaData,
+	})
+	if err != nil {
+		h.fail(w, "CompleteMultipartUpload", err)
+		return
+	}
+	if err := h.composer.Concater.AsConcatableUpload(final).ConcatUploads(r.Context(), parts); err != nil {
+		h.terminate(r, final)
+		h.fail(w, "CompleteMultipartUpload", err)
+		return
+	}
+	info, err := final.GetInfo(r.Context())
+	if err == nil {
+		err = final.FinishUpload(r.Context())
+	}
+	if err == nil {
+		if _, err = storeUpload(info, dst); err == errUploadDiscarded {
+			err = nil
+		}
+	}
+	if err != nil {
+		h.terminate(r, final)
+		h.fail(w, "CompleteMultipartUpload", err)
+		return
+	}
+
+	for _, part := range parts {
+		h.terminate(r, part)
+	}
+	h.terminate(r, session)
+	log.Printf("S3 multipart upload %s completed as %s/%s", uploadID, bucket, key)
+
+	writeS3XML(w, struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     strconv.Quote(fmt.Sprintf("%x-%d", sums.Sum(nil), len(parts))),
+	})
+}
+
+// partETag returns the ETag of a part, the hex MD5 of its content, for
+// CompleteMultipartUpload to check the parts listed against.
+func (h *s3Handler) partETag(r *http.Request, part tusd.Upload) (string, error) {
+	src, err := part.GetReader(r.Context())
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	sum := md5.New()
+	if _, err := io.Copy(sum, src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+func (h *s3Handler) abortMultipart(w http.ResponseWriter, r *http.Request, uploadID, bucket, key string) {
+	session, _, err := h.session(r, uploadID, bucket, key)
+	if err != nil {
+		h.fail(w, "AbortMultipartUpload", err)
+		return
+	}
+	for part := 1; part <= 10000; part++ {
+		if upload, err := h.composer.Core.GetUpload(r.Context(), s3PartID(uploadID, part)); err == nil {
+			h.terminate(r, upload)
+		}
+	}
+	h.terminate(r, session)
+	log.Printf("S3 multipart upload %s aborted", uploadID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// awsChunkedReader decodes the aws-chunked content encoding. Chunk
+// signatures are not verified, the request signature already covers the
+// headers and the seed signature.
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		sizeStr, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil || size < 0 {
+			return 0, errors.New("invalid aws-chunked chunk size")
+		}
+		if size == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining == 0 && err == nil {
+		if _, err := c.r.Discard(2); err != nil {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// s3MaxClockSkew is how far the X-Amz-Date of a request may be from now,
+// as AWS allows, so captured requests cannot be replayed later.
+const s3MaxClockSkew = 15 * time.Minute
+
+// s3PayloadReader fails the read completing the body of a request if its
+// SHA-256 is not the signed X-Amz-Content-Sha256, so a body cannot be
+// swapped under a valid signature. n is the length of the body, -1 if
+// unknown, when the hash is checked at EOF.
+type s3PayloadReader struct {
+	r    io.ReadCloser
+	n    int64
+	want []byte
+	hash hash.Hash
+	read int64
+}
+
+func (p *s3PayloadReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.hash.Write(b[:n])
+	p.read += int64(n)
+	if err == io.EOF || p.read == p.n {
+		if !hmac.Equal(p.hash.Sum(nil), p.want) {
+			return n, errS3ContentSHA256
+		}
+	}
+	return n, err
+}
+
+func (p *s3PayloadReader) Close() error {
+	return p.r.Close()
+}
+
+// verifyS3Signature checks an AWS Signature Version 4 Authorization header
+// against S3AccessKey and S3SecretKey.
+func verifyS3Signature(r *http.Request) error {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return errors.New("missing AWS4-HMAC-SHA256 authorization")
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(auth, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[k] = v
+	}
+	scope := strings.Split(fields["Credential"], "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" {
+		return errors.New("malformed credential")
+	}
+	if scope[0] != S3AccessKey {
+		return errors.New("unknown access key")
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		return errors.New("missing X-Amz-Date")
+	}
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, scope[1]) {
+		return errors.New("malformed X-Amz-Date")
+	}
+	if skew := time.Since(t); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return fmt.Errorf("X-Amz-Date %s is too far from now", amzDate)
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = "UNSIGNED-PAYLOAD"
+	}
+	expected := s3Signature(r, fields["SignedHeaders"], payload, amzDate, scope[1:], S3SecretKey)
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// signS3Request signs a request to a remote S3 compatible service with
+// SigV4. The payload is not signed.
+func signS3Request(r *http.Request, region, accessKey, secretKey string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	// Send the path exactly as it is signed.
+	r.URL.RawPath = awsURIEncode(r.URL.Path, false)
+	scope := []string{now.Format("20060102"), region, "s3", "aws4_request"}
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	signature := s3Signature(r, signed, "UNSIGNED-PAYLOAD", amzDate, scope, secretKey)
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, strings.Join(scope, "/"), signed, signature))
+}
+
+// s3Signature computes the SigV4 signature of r. scope is the credential
+// scope without the access key: date, region, service and "aws4_request".
+func s3Signature(r *http.Request, signedHeaders, payload, amzDate string, scope []string, secret string) string {
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+			if value == "" {
+				value = r.URL.Host
+			}
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		strings.Join(params, "&"),
+		headers.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	credentialScope := strings.Join(scope, "/")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + credentialScope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secret)
+	for _, s := range scope {
+		key = hmacSHA256(key, s)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes s as required for SigV4 canonical requests.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// sanitizedSuffix marks the re-encoded copy of an image upload, stored in
+// place of the uploaded data.
+const sanitizedSuffix = ".sanitized"
+
+// maxImagePixels rejects images that would take gigabytes to decode.
+const maxImagePixels = 100 << 20
+
+// sanitizeJPEGQuality is the quality JPEG images are re-encoded with.
+const sanitizeJPEGQuality = 90
+
+// errImageInvalid is returned, with the reason in the message, for image
+// uploads that cannot be decoded. Use errors.Is to test for it.
+var errImageInvalid = tusd.NewError("ERR_IMAGE_INVALID", "image could not be decoded", http.StatusUnprocessableEntity)
+
+func imageInvalid(format string, args ...any) error {
+	return tusd.NewError(errImageInvalid.ErrorCode, fmt.Sprintf(format, args...), http.StatusUnprocessableEntity)
+}
+
+// sanitizeImage re-encodes a completed JPEG, PNG or GIF upload into
+// <id>.sanitized, which storeUpload stores instead of the uploaded data.
+// Decoding with the Go decoders and encoding the pixels again drops EXIF, GPS
+// and every other piece of metadata, as well as anything hidden in or
+// appended to the image data that could exploit a vulnerable viewer. The
+// EXIF orientation of JPEG images is applied to the pixels so they still
+// display the right way up. Images that do not decode are rejected with
+// errImageInvalid. Other uploads are left alone.
+func sanitizeImage(info tusd.FileInfo) error {
+	if !SanitizeImages || StorageBackend != storageFile {
+		return nil
+	}
+	p := info.Storage["Path"]
+	if p == "" {
+		p = filepath.Join(TempUploadPath, info.ID)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	format := http.DetectContentType(head[:n])
+	if format != "image/jpeg" && format != "image/png" && format != "image/gif" {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(bufio.NewReader(f))
+	if err != nil {
+		return imageInvalid("%q is not a valid image: %s", info.MetaData["filename"], err.Error())
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return imageInvalid("%q is too large, %dx%d pixels", info.MetaData["filename"], config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Decode fully before writing anything, so broken images are rejected
+	// rather than stored.
+	var encode func(io.Writer) error
+	switch format {
+	case "image/gif":
+		g, decodeErr := gif.DecodeAll(bufio.NewReader(f))
+		err = decodeErr
+		encode = func(w io.Writer) error { return gif.EncodeAll(w, g) }
+	case "image/png":
+		img, decodeErr := png.Decode(bufio.NewReader(f))
+		err = decodeErr
+		encode = func(w io.Writer) error { return png.Encode(w, img) }
+	case "image/jpeg":
+		orientation := jpegOrientation(f)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		img, decodeErr := jpeg.Decode(bufio.NewReader(f))
+		err = decodeErr
+		encode = func(w io.Writer) error {
+			return jpeg.Encode(w, orient(img, orientation), &jpeg.Options{Quality: sanitizeJPEGQuality})
+		}
+	}
+	if err != nil {
+		return imageInvalid("%q is not a valid image: %s", info.MetaData["filename"], err.Error())
+	}
+
+	dst := filepath.Join(TempUploadPath, info.ID+sanitizedSuffix)
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(out)
+	err = encode(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Upload %s re-encoded to strip image metadata", info.ID)
+	return os.Rename(tmp, dst)
+}
+
+// jpegOrientation returns the EXIF orientation (1 to 8) of the JPEG image in
+// r, or 1 if it has none.
+func jpegOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	var marker [4]byte
+	if _, err := io.ReadFull(br, marker[:2]); err != nil || marker[0] != 0xff || marker[1] != 0xd8 {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xff {
+			return 1
+		}
+		// Metadata segments come before the image data.
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if size < 0 {
+			return 1
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+		if marker[1] == 0xe1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag from the first IFD of the TIFF
+// structure of an EXIF segment.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := range entries {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient returns img transformed according to the EXIF orientation, so it
+// displays correctly without it.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range h {
+		for x := range w {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronSchedule is a parsed schedule: either a classic five field cron
+// expression (minute, hour, day of month, month, day of week) with lists,
+// ranges and steps, or a fixed interval written as "@every <duration>".
+// @hourly, @daily, @weekly and @monthly are accepted as well.
+type cronSchedule struct {
+	every time.Duration
+
+	minute, hour, dom, month, dow []bool
+	// domAny and dowAny record unrestricted day fields: as in cron, a day
+	// matches if either restricted day field matches.
+	domAny, dowAny bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if d, ok := strings.CutPrefix(expr, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("invalid interval %q", d)
+		}
+		return &cronSchedule{every: every}, nil
+	}
+	if alias, ok := cronAliases[expr]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	s := &cronSchedule{}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// Both 0 and 7 are Sunday.
+	s.dow[0] = s.dow[0] || s.dow[7]
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of "*", "n" and "a-b", each
+// optionally followed by "/step".
+func parseCronField(field string, lo, hi int) ([]bool, error) {
+	set := make([]bool, hi+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return nil, fmt.Errorf("invalid value %q", a)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return nil, fmt.Errorf("invalid value %q", b)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// next returns the first time after t the schedule fires.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every valid expression fires at least once in four years (Feb 29).
+	for end := t.AddDate(4, 0, 1); t.Before(end); t = t.Add(time.Minute) {
+		if !s.month[t.Month()] || !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 0, 0, t.Location())
+			continue
+		}
+		if !s.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 59, 0, 0, t.Location())
+			continue
+		}
+		if s.minute[t.Minute()] {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[t.Weekday()]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// jobStatus is the last-run status of a scheduled job.
+type jobStatus struct {
+	Name         string    `json:"name"`
+	Schedule     string    `json:"schedule"`
+	Runs         int       `json:"runs"`
+	Running      bool      `json:"running"`
+	LastStart    time.Time `json:"last_start,omitzero"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastResult   string    `json:"last_result,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run,omitzero"`
+	// Standby is set when the last scheduled run was skipped because
+	// another replica holds the leader lease.
+	Standby bool `json:"standby,omitempty"`
+}
+
+// scheduledJob is a periodic maintenance task. run returns a short summary
+// of what it did.
+type scheduledJob struct {
+	name     string
+	schedule *cronSchedule
+	run      func(ctx context.Context) (string, error)
+	// leaderOnly jobs work on the storage shared by the replicas, and only
+	// run on the leader.
+	leaderOnly bool
+
+	mu     sync.Mutex
+	status jobStatus
+}
+
+// scheduler runs the maintenance jobs on their schedules. Every job runs in
+// its own goroutine, so a slow job only delays its own next run.
+type scheduler struct {
+	jobs []*scheduledJob
+}
+
+// add registers a job. The schedule is read from SCHEDULE_<NAME>, falling
+// back to def; "off" disables the job.
+func (s *scheduler) add(name, def string, leaderOnly bool, run func(ctx context.Context) (string, error)) error {
+	expr := os.Getenv("SCHEDULE_" + strings.ToUpper(name))
+	if expr == "" {
+		expr = def
+	}
+	if expr == "off" {
+		return nil
+	}
+	schedule, err := parseCronSchedule(expr)
+	if err != nil {
+		return fmt.Errorf("SCHEDULE_%s: %w", strings.ToUpper(name), err)
+	}
+	s.jobs = append(s.jobs, &scheduledJob{
+		name:       name,
+		schedule:   schedule,
+		run:        run,
+		leaderOnly: leaderOnly,
+		status:     jobStatus{Name: name, Schedule: expr},
+	})
+	return nil
+}
+
+func (s *scheduler) start(ctx context.Context) {
+	for _, job := range s.jobs {
+		go job.loop(ctx)
+	}
+}
+
+func (j *scheduledJob) loop(ctx context.Context) {
+	for {
+		next := j.schedule.next(time.Now())
+		if next.IsZero() {
+			log.Printf("Job %s has no future run", j.name)
+			return
+		}
+		j.mu.Lock()
+		j.status.NextRun = next
+		j.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		standby := j.leaderOnly && !leader.isLeader()
+		j.mu.Lock()
+		j.status.Standby = standby
+		j.mu.Unlock()
+		if !standby {
+			j.execute(ctx)
+		}
+	}
+}
+
+var errJobRunning = errors.New("job is already running")
+
+// execute runs the job now, unless it is already running.
+func (j *scheduledJob) execute(ctx context.Context) error {
+	j.mu.Lock()
+	if j.status.Running {
+		j.mu.Unlock()
+		return errJobRunning
+	}
+	j.status.Running = true
+	j.status.LastStart = time.Now()
+	j.mu.Unlock()
+
+	result, err := j.run(ctx)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastDuration = time.Since(j.status.LastStart).Round(time.Millisecond).String()
+	j.status.LastResult = result
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+		log.Printf("Job %s failed: %s", j.name, err.Error())
+	} else if result != "" {
+		log.Printf("Job %s: %s", j.name, result)
+	}
+	return err
+}
+
+func (s *scheduler) status() []jobStatus {
+	list := make([]jobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		list = append(list, job.status)
+		job.mu.Unlock()
+	}
+	return list
+}
+
+func (s *scheduler) job(name string) *scheduledJob {
+	i := slices.IndexFunc(s.jobs, func(j *scheduledJob) bool { return j.name == name })
+	if i < 0 {
+		return nil
+	}
+	return s.jobs[i]
+}
+
+// ServeHTTP serves the job status (GET /scheduler) and runs a job on demand
+// (POST /scheduler/<name>).
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scheduler"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.status())
+	case name != "" && r.Method == http.MethodPost:
+		job := s.job(name)
+		if job == nil {
+			httpError(w, "Unknown job", http.StatusNotFound)
+			return
+		}
+		if err := job.execute(r.Context()); err == errJobRunning {
+			httpError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		writeJSON(w, http.StatusOK, job.status)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
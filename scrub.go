@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// quarantineRecord is written next to a quarantined file as <name>.json.
+type quarantineRecord struct {
+	checksumResult
+	Quarantined time.Time `json:"quarantined"`
+}
+
+// scrubStoredFiles re-hashes every indexed file and compares it with the
+// checksum recorded when it was stored, to catch silent corruption on the
+// storage. Corrupted files are moved to QuarantinePath when it is set and
+// only reported otherwise. It runs as the "scrub" scheduler job.
+func scrubStoredFiles(ctx context.Context) (string, error) {
+	results, err := storedFiles.verifyChecksums(ctx)
+	var verified, corrupted, quarantined, missing int
+	for _, res := range results {
+		switch res.Status {
+		case checksumOK:
+			verified++
+		case checksumMismatch:
+			corrupted++
+			log.Printf("Scrub: %s is corrupted, sha256 %s, expected %s", res.Name, res.Actual, res.Expected)
+			if QuarantinePath == "" {
+				continue
+			}
+			if err := quarantineFile(res); err != nil {
+				log.Printf("Scrub: unable to quarantine %s: %s", res.Name, err.Error())
+				continue
+			}
+			quarantined++
+		case checksumMissing:
+			missing++
+			log.Printf("Scrub: %s is in the index but not on disk", res.Name)
+		case checksumFailed:
+			log.Printf("Scrub: unable to verify %s: %s", res.Name, res.Error)
+		}
+	}
+	summary := fmt.Sprintf("verified %d files, %d corrupted", verified, corrupted)
+	if QuarantinePath != "" {
+		summary += fmt.Sprintf(" (%d quarantined)", quarantined)
+	}
+	if missing > 0 {
+		summary += fmt.Sprintf(", %d missing", missing)
+	}
+	if err == nil && corrupted+missing > 0 {
+		err = fmt.Errorf("%d corrupted and %d missing files", corrupted, missing)
+	}
+	return summary, err
+}
+
+// quarantineFile moves a corrupted file out of UploadPath into
+// QuarantinePath, under the same name, and records why next to it.
+func quarantineFile(res checksumResult) error {
+	src := filepath.Join(UploadPath, filepath.FromSlash(res.Name))
+	dst := filepath.Join(QuarantinePath, filepath.FromSlash(res.Name))
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	record, err := json.Marshal(quarantineRecord{checksumResult: res, Quarantined: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst+".json", record, 0644); err != nil {
+		return err
+	}
+	if err := moveFile(src, dst); err != nil {
+		return err
+	}
+	storedFiles.remove(res.Name)
+	log.Printf("Scrub: %s moved to %s", res.Name, dst)
+	return nil
+}
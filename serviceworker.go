@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// serviceWorkerHandler serves the service worker of the upload page. The
+// worker keeps the selected files in IndexedDB and uploads them with the tus
+// protocol itself, so uploads continue while the user navigates between
+// pages and pick up where they stopped once the connection comes back
+// (through Background Sync where the browser supports it, by polling
+// otherwise). It also caches the page shell for the installed app. Browsers
+// only allow service workers in secure contexts; on plain HTTP the page
+// falls back to uploading from the tab.
+func serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, serviceWorkerJS)
+}
+
+const serviceWorkerJS = `importScripts('/messages.js', '/chunk-sizer.js', '/fingerprint.js');
+
+var DB_NAME = 'uploader';
+var STORE = 'queue';
+var sizer = new ChunkSizer();
+var running = null;
+
+var SHELL_CACHE = 'uploader-shell-v3';
+var SHELL = ['/', '/messages.js', '/chunk-sizer.js', '/fingerprint.js', '/manifest.webmanifest', '/icon-192.png', '/icon-512.png'];
+
+self.addEventListener('install', function(event){
+    event.waitUntil(caches.open(SHELL_CACHE).then(function(cache){ return cache.addAll(SHELL); }));
+    self.skipWaiting();
+});
+self.addEventListener('activate', function(event){
+    event.waitUntil(self.clients.claim());
+});
+// The page shell is served from the network when possible and from the
+// cache otherwise, so the installed app opens without a connection.
+self.addEventListener('fetch', function(event){
+    var url = new URL(event.request.url);
+    if(event.request.method !== 'GET' || url.origin !== self.location.origin || SHELL.indexOf(url.pathname) < 0){
+        return;
+    }
+    event.respondWith(fetch(event.request).then(function(res){
+        var copy = res.clone();
+        caches.open(SHELL_CACHE).then(function(cache){ cache.put(event.request, copy); });
+        return res;
+    }).catch(function(){
+        return caches.match(event.request);
+    }));
+});
+self.addEventListener('message', function(event){
+    var msg = event.data || {};
+    if(msg.type === 'enqueue'){
+        event.waitUntil(enqueue(msg.files).then(run));
+    } else if(msg.type === 'resume'){
+        event.waitUntil(run());
+    }
+});
+self.addEventListener('sync', function(event){
+    if(event.tag === 'uploads'){
+        event.waitUntil(run());
+    }
+});
+
+function openDB(){
+    return new Promise(function(resolve, reject){
+        var req = indexedDB.open(DB_NAME, 1);
+        req.onupgradeneeded = function(){ req.result.createObjectStore(STORE, {keyPath: 'key'}); };
+        req.onsuccess = function(){ resolve(req.result); };
+        req.onerror = function(){ reject(req.error); };
+    });
+}
+function tx(mode, fn){
+    return openDB().then(function(db){
+        return new Promise(function(resolve, reject){
+            var t = db.transaction(STORE, mode);
+            var req = fn(t.objectStore(STORE));
+            t.oncomplete = function(){ resolve(req && req.result); };
+            t.onerror = function(){ reject(t.error); };
+        });
+    });
+}
+function enqueue(files){
+    return tx('readwrite', function(store){
+        files.forEach(function(f){ store.put({key: f.key, file: f.file, delivery: f.delivery || null, url: null}); });
+    });
+}
+function save(item){
+    return tx('readwrite', function(store){ return store.put(item); });
+}
+function remove(key){
+    return tx('readwrite', function(store){ return store.delete(key); });
+}
+function list(){
+    return tx('readonly', function(store){ return store.getAll(); });
+}
+function notify(msg){
+    return self.clients.matchAll({includeUncontrolled: true}).then(function(clients){
+        clients.forEach(function(c){ c.postMessage(msg); });
+    });
+}
+
+// run works through the queue. Network failures keep the queue intact and
+// schedule another attempt; only uploads rejected by the server are dropped.
+function run(){
+    if(running){
+        return running;
+    }
+    var beat = setInterval(heartbeat, SETTINGS.heartbeat_interval);
+    running = processQueue().then(function(){
+        clearInterval(beat);
+        running = null;
+    }, function(err){
+        clearInterval(beat);
+        running = null;
+        notify({type: 'offline', error: String(err)});
+        if(self.registration.sync){
+            return self.registration.sync.register('uploads');
+        }
+        return new Promise(function(resolve){ setTimeout(resolve, retryDelay()); }).then(run);
+    });
+    return running;
+}
+// heartbeat keeps the uploads of the queue alive on the server while it is
+// worked through, those waiting for their turn as well.
+function heartbeat(){
+    return list().then(function(items){
+        return sendHeartbeat(items.filter(function(item){ return item.url; }).map(function(item){
+            return item.url.split('/').pop();
+        }));
+    });
+}
+// retryDelay is how long to wait before working through the queue again
+// after a network failure: the last of the retry_delays setting.
+function retryDelay(){
+    var delays = SETTINGS.retry_delays;
+    return delays.length > 0 ? delays[delays.length - 1] : 5000;
+}
+// processQueue uploads as many files at once as the speed test suggests.
+// After a network failure no further upload is started, and the failure is
+// reported once the running ones have stopped. Uploads the server queued
+// until an upload window wait for their turn.
+function processQueue(){
+    var items;
+    return list().then(function(queued){
+        var now = Date.now();
+        items = queued.filter(function(item){ return !(item.notBefore > now); });
+        var later = queued.filter(function(item){ return item.notBefore > now; });
+        if(later.length > 0){
+            var next = Math.min.apply(null, later.map(function(item){ return item.notBefore; }));
+            setTimeout(run, next - now);
+        }
+        // The page asks to resume on every load, mostly with nothing to do.
+        return items.length > 0 ? speedTest(sizer) : 0;
+    }).then(function(parallel){
+        var failure = null;
+        function lane(){
+            if(failure || items.length === 0){
+                return Promise.resolve();
+            }
+            return uploadItem(items.shift()).then(lane, function(err){
+                failure = failure || err;
+            });
+        }
+        var lanes = [];
+        for(var i = 0; i < parallel; i++){
+            lanes.push(lane());
+        }
+        return Promise.all(lanes).then(function(){
+            if(failure){
+                throw failure;
+            }
+        });
+    });
+}
+
+function UploadError(message, code){
+    this.message = message;
+    this.code = code;
+}
+UploadError.prototype.toString = function(){ return this.message; };
+
+// QueuedError is the refusal of a queued upload before its turn, with its
+// position in the queue, when it is expected to start, if known, and when
+// to try again.
+function QueuedError(position, start, until){
+    this.position = position;
+    this.start = start;
+    this.until = until;
+}
+
+function check(res){
+    var position = res.headers.get('Upload-Queue-Position');
+    if(res.status === 503 && position){
+        var after = parseInt(res.headers.get('Retry-After'), 10) || 60;
+        var start = res.headers.get('Upload-Queue-Start');
+        throw new QueuedError(parseInt(position, 10), start ? Date.parse(start) : null, Date.now() + after * 1000);
+    }
+    if(res.status >= 500){
+        throw new Error('HTTP ' + res.status);
+    }
+    // 413 is only answered for uploads over the size limit of their
+    // policy, which the user may ask to raise.
+    if(!res.ok){
+        throw new UploadError('HTTP ' + res.status, res.status === 413 ? 'ERR_UPLOAD_TOO_LARGE' : null);
+    }
+    return res;
+}
+function b64(s){
+    return btoa(unescape(encodeURIComponent(s)));
+}
+
+function uploadItem(item){
+    return ensureUpload(item).then(function(offset){
+        return sendChunks(item, offset);
+    }).then(function(){
+        return remove(item.key).then(function(){
+            return notify({type: 'done', key: item.key, name: item.file.name, id: item.url.split('/').pop(), message: item.message});
+        });
+    }, function(err){
+        if(err instanceof QueuedError){
+            item.notBefore = err.until;
+            return save(item).then(function(){
+                return notify({type: 'queued', key: item.key, name: item.file.name, size: item.file.size, position: err.position, start: err.start});
+            });
+        }
+        if(err instanceof UploadError){
+            return remove(item.key).then(function(){
+                return notify({type: 'error', key: item.key, name: item.file.name, size: item.file.size, error: err.message, code: err.code});
+            });
+        }
+        throw err;
+    });
+}
+
+// ensureUpload creates the upload on the server or asks for the offset of
+// an existing one. Uploads the server does not take anymore are started again. A
+// file with an incomplete upload on the server, started from another
+// browser or before the queue was lost, continues that upload.
+function ensureUpload(item){
+    if(item.url){
+        return timedFetch(item.url, {method: 'HEAD', headers: {'Tus-Resumable': '1.0.0'}}).then(function(res){
+            // Uploads that expired, or are pinned to the address the
+            // browser had before, are started again.
+            if(res.status === 404 || res.status === 410 || res.status === 403){
+                item.url = null;
+                return ensureUpload(item);
+            }
+            check(res);
+            item.expires = res.headers.get('Upload-Expires');
+            return parseInt(res.headers.get('Upload-Offset'), 10);
+        });
+    }
+    var fingerprint = null;
+    return fileFingerprint(item.file).then(function(fp){
+        fingerprint = fp;
+        return findUpload(fp, item.file);
+    }).then(function(found){
+        if(found === false){
+            fingerprint = null;
+        }
+        if(found){
+            item.url = self.location.origin + '/files/' + found.id;
+            return save(item).then(function(){ return found.offset; });
+        }
+        var metadata = 'filename ' + b64(item.file.name);
+        if(item.file.type){
+            metadata += ',filetype ' + b64(item.file.type);
+        }
+        if(item.delivery){
+            metadata += ',delivery ' + b64(item.delivery.id) + ',delivery_files ' + b64(String(item.delivery.files));
+        }
+        if(item.file.lastModified){
+            metadata += ',lastmodified ' + b64(String(item.file.lastModified));
+        }
+        if(fingerprint){
+            metadata += ',fingerprint ' + b64(fingerprint);
+        }
+        return timedFetch(self.location.origin + '/files/', {method: 'POST', headers: {
+            'Tus-Resumable': '1.0.0',
+            'Upload-Length': String(item.file.size),
+            'Upload-Metadata': metadata
+        }}).then(function(res){
+            if(res.status === 409){
+                // The file is being uploaded from a tab already.
+                throw new UploadError(t('uploading_in_tab'));
+            }
+            return check(res);
+        }).then(function(res){
+            item.url = new URL(res.headers.get('Location'), res.url).href;
+            item.expires = res.headers.get('Upload-Expires');
+            return save(item).then(function(){ return 0; });
+        });
+    });
+}
+// verifyChunk compares the bytes of file from offset to next with the
+// chunk the server echoes with CHUNK_ECHO, failing the upload right away
+// when they were corrupted on the way. Chunks hashed with an algorithm the
+// browser cannot compute are not compared.
+function verifyChunk(file, offset, next, res){
+    var echoed = (res.headers.get('X-Chunk-Digest') || '').split('=');
+    if(echoed.length !== 2 || !WEB_CRYPTO_DIGESTS[echoed[0]] || !self.crypto || !crypto.subtle){
+        return Promise.resolve();
+    }
+    if(parseInt(res.headers.get('X-Chunk-Offset'), 10) !== offset || parseInt(res.headers.get('X-Chunk-Size'), 10) !== next - offset){
+        return Promise.reject(new UploadError(t('wrong_chunk')));
+    }
+    return file.slice(offset, next).arrayBuffer().then(function(data){
+        return chunkDigest(data, echoed[0]);
+    }).then(function(hex){
+        if(hex !== echoed[1]){
+            throw new UploadError(t('chunk_corrupted'));
+        }
+    });
+}
+function sendChunks(item, offset){
+    notify({type: 'progress', key: item.key, name: item.file.name, offset: offset, size: item.file.size, expires: item.expires});
+    if(offset >= item.file.size){
+        return Promise.resolve();
+    }
+    var end = Math.min(offset + sizer.size, item.file.size);
+    var started = Date.now();
+    var chunk = item.file.slice(offset, end);
+    function request(){
+        return {method: 'PATCH', headers: {
+            'Tus-Resumable': '1.0.0',
+            'Upload-Offset': String(offset),
+            'Content-Type': 'application/offset+octet-stream'
+        }};
+    }
+    function sendWhole(){
+        var options = request();
+        options.body = chunk;
+        return timedFetch(item.url, options);
+    }
+    var sent = streamChunks() ? streamedFetch(item.url, request(), chunk, null, sendWhole) : sendWhole();
+    return sent.catch(function(err){
+        // Lost on the way, the next attempt sends less.
+        sizer.failed();
+        throw err;
+    }).then(function(res){
+        if(res.status === 409){
+            // The offset is out of date, ask the server where to continue.
+            return ensureUpload(item);
+        }
+        check(res);
+        sizer.measure(end - offset, Date.now() - started);
+        var next = parseInt(res.headers.get('Upload-Offset'), 10);
+        return verifyChunk(item.file, offset, next, res).then(function(){
+            if((res.headers.get('Content-Type') || '').indexOf('application/json') === 0){
+                // The response completing the upload, with the COMPLETION_FIELDS.
+                return res.json().then(function(payload){
+                    item.message = payload.message;
+                    return next;
+                }, function(){ return next; });
+            }
+            return next;
+        });
+    }).then(function(next){
+        return sendChunks(item, next);
+    });
+}
+`
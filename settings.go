@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// speedTestTimeout is how long the upload page waits for the speed test
+// before it starts uploading without it.
+const speedTestTimeout = 10 * time.Second
+
+// clientSettings are the tunables of the upload page and its service
+// worker, served on /api/settings. Durations are in milliseconds.
+type clientSettings struct {
+	// ChunkSizeMin and ChunkSizeMax bound the chunks, which are sized to
+	// take ChunkSeconds at the measured throughput.
+	ChunkSizeMin int64 `json:"chunk_size_min"`
+	ChunkSizeMax int64 `json:"chunk_size_max"`
+	ChunkSeconds int   `json:"chunk_seconds"`
+	// Concurrency is the number of files uploaded at once, 0 to go by the
+	// speed test.
+	Concurrency int `json:"concurrency"`
+	// RetryDelays are the delays before every retry of a failed request
+	// from the tab, as many as there are retries. The service worker, which
+	// retries until the upload completes, waits the last one.
+	RetryDelays []int64 `json:"retry_delays"`
+	// RequestTimeout aborts requests that take longer, 0 for none.
+	RequestTimeout int64 `json:"request_timeout"`
+	// SpeedTestSize is the data sent by the speed test, 0 to skip it.
+	SpeedTestSize    int64 `json:"speed_test_size"`
+	SpeedTestTimeout int64 `json:"speed_test_timeout"`
+	// StreamBuffer is how much of a chunk is read from the file at a time
+	// when chunks are sent as streams, 0 to send them whole.
+	StreamBuffer int64 `json:"stream_buffer"`
+	// HeartbeatInterval is how often clients send a heartbeat for their
+	// incomplete uploads.
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+}
+
+func currentClientSettings() clientSettings {
+	delays := make([]int64, len(UploadRetryDelays))
+	for i, d := range UploadRetryDelays {
+		delays[i] = d.Milliseconds()
+	}
+	return clientSettings{
+		ChunkSizeMin:      ChunkSizeMin,
+		ChunkSizeMax:      ChunkSizeMax,
+		ChunkSeconds:      ChunkSeconds,
+		Concurrency:       UploadConcurrency,
+		RetryDelays:       delays,
+		RequestTimeout:    UploadRequestTimeout.Milliseconds(),
+		SpeedTestSize:     SpeedTestSize,
+		SpeedTestTimeout:  speedTestTimeout.Milliseconds(),
+		StreamBuffer:      StreamBuffer,
+		HeartbeatInterval: heartbeatInterval.Milliseconds(),
+	}
+}
+
+// clientSettingsHandler serves the settings of the upload page and its
+// service worker (GET /api/settings), loaded by chunk-sizer.js.
+func clientSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, currentClientSettings())
+}
+
+// parseRetryDelays parses the comma separated durations of
+// UPLOAD_RETRY_DELAYS.
+func parseRetryDelays(list string) ([]time.Duration, error) {
+	delays := []time.Duration{}
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("negative delay %s", s)
+		}
+		delays = append(delays, d)
+	}
+	if len(delays) > 20 {
+		return nil, fmt.Errorf("%d delays, at most 20 retries are allowed", len(delays))
+	}
+	return delays, nil
+}
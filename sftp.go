@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSFTP starts the embedded SFTP server on SFTPAddr. It only accepts
+// uploads: every file written by a client becomes an upload in the tus store
+// and is finalized through finishUpload once the client closes it.
+func startSFTP(composer *tusd.StoreComposer) (net.Listener, error) {
+	config, err := sftpServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listenTCP(SFTPAddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("SFTP accept: %s", err.Error())
+				continue
+			}
+			if geoRefused("SFTP", conn.RemoteAddr()) {
+				conn.Close()
+				continue
+			}
+			go serveSFTPConn(conn, config, composer)
+		}
+	}()
+	log.Printf("SFTP server started on %s", listenerAddr(ln.Addr()))
+	return ln, nil
+}
+
+func sftpServerConfig() (*ssh.ServerConfig, error) {
+	config := &ssh.ServerConfig{}
+	if SFTPPassword != "" {
+		config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if logins.locked("SFTP", c.RemoteAddr(), c.User()) {
+				return nil, fmt.Errorf("%s is locked out", c.RemoteAddr())
+			}
+			if c.User() == SFTPUser && subtle.ConstantTimeCompare(pass, []byte(SFTPPassword)) == 1 {
+				logins.succeeded("SFTP", c.RemoteAddr(), c.User())
+				return nil, nil
+			}
+			logins.failed("SFTP", c.RemoteAddr(), c.User())
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		}
+	}
+	if SFTPAuthorizedKeys != "" {
+		data, err := os.ReadFile(SFTPAuthorizedKeys)
+		if err != nil {
+			return nil, err
+		}
+		var keys [][]byte
+		for len(bytes.TrimSpace(data)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %w", SFTPAuthorizedKeys, err)
+			}
+			keys = append(keys, key.Marshal())
+			data = rest
+		}
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range keys {
+				if c.User() == SFTPUser && bytes.Equal(k, key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown public key for %q", c.User())
+		}
+	}
+	if config.PasswordCallback == nil && config.PublicKeyCallback == nil {
+		return nil, errors.New("SFTP_PASSWORD or SFTP_AUTHORIZED_KEYS must be set")
+	}
+
+	signer, err := sftpHostKey(SFTPHostKey)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(signer)
+	return config, nil
+}
+
+// sftpHostKey loads the host key from keyPath, generating and saving a new
+// ed25519 key on first start.
+func sftpHostKey(keyPath string) (ssh.Signer, error) {
+	data, err := os.ReadFile(keyPath)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("SFTP host key generated at %s", keyPath)
+	return ssh.NewSignerFromKey(key)
+}
+
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig, composer *tusd.StoreComposer) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Printf("SFTP handshake from %s failed: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+	defer sconn.Close()
+	log.Printf("SFTP login from %s as %s", sconn.RemoteAddr(), sconn.User())
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("SFTP channel: %s", err.Error())
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				handler := &sftpIngest{composer: composer, user: sconn.User(), country: countryOf(sconn.RemoteAddr()), dirs: map[string]bool{"/": true}}
+				server := sftp.NewRequestServer(channel, sftp.Handlers{
+					FileGet:  handler,
+					FilePut:  handler,
+					FileCmd:  handler,
+					FileList: handler,
+				})
+				if err := server.Serve(); err != nil && err != io.EOF {
+					log.Printf("SFTP session: %s", err.Error())
+				}
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+// sftpIngest is a write-only view of the upload area. Directories created by
+// the client are remembered for the session so that recursive uploads work,
+// but files always land flat in UploadPath.
+type sftpIngest struct {
+	composer *tusd.StoreComposer
+	user     string
+	country  string
+
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+func (h *sftpIngest) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return nil, sftp.ErrSSHFxPermissionDenied
+}
+
+func (h *sftpIngest) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	name := path.Base(r.Filepath)
+	if name == "/" || name == "." {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	w, err := newIngestWriter(context.Background(), h.composer, tusd.MetaData{
+		"filename": name,
+		"filetype": mime.TypeByExtension(path.Ext(name)),
+		"source":   "sftp",
+		"user":     h.user,
+		"country":  h.country,
+	})
+	if _, ok := uploadRejection(err); ok {
+		log.Printf("SFTP upload of %s rejected: %s", r.Filepath, err.Error())
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	if err != nil {
+		log.Printf("SFTP upload of %s failed: %s", r.Filepath, err.Error())
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return &sftpWriter{w}, nil
+}
+
+func (h *sftpIngest) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return nil
+	case "Mkdir":
+		h.mu.Lock()
+		h.dirs[path.Clean(r.Filepath)] = true
+		h.mu.Unlock()
+		return nil
+	}
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+func (h *sftpIngest) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		return sftpListing(nil), nil
+	case "Stat":
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		p := path.Clean(r.Filepath)
+		if h.dirs[p] {
+			return sftpListing{sftpDir(path.Base(p))}, nil
+		}
+		return nil, sftp.ErrSSHFxNoSuchFile
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpWriter discards the upload when the transfer breaks off instead of
+// finalizing a truncated file.
+type sftpWriter struct {
+	*ingestWriter
+}
+
+func (w *sftpWriter) TransferError(err error) {
+	w.Abort()
+}
+
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(f []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(f, l[offset:])
+	if n < len(f) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type sftpDir string
+
+func (d sftpDir) Name() string       { return string(d) }
+func (d sftpDir) Size() int64        { return 0 }
+func (d sftpDir) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d sftpDir) ModTime() time.Time { return time.Now() }
+func (d sftpDir) IsDir() bool        { return true }
+func (d sftpDir) Sys() any           { return nil }
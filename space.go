@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// errInsufficientSpace refuses uploads that do not fit in TempUploadPath
+// next to the incomplete ones, rather than letting all of them fail once the
+// disk is full.
+var errInsufficientSpace = tusd.NewError("ERR_INSUFFICIENT_SPACE", "not enough disk space for the upload, retry later", http.StatusInsufficientStorage)
+
+// spaceReservations, with SPACE_RESERVATION, accounts for the bytes the
+// incomplete uploads in TempUploadPath still have to write. An upload is
+// only created if its length fits in the free space minus the reserved
+// bytes and SpaceHeadroom. Uploads of deferred length are not accounted
+// for until they complete.
+type spaceReservations struct {
+	mu sync.Mutex
+	// remaining is what each upload has left to write.
+	remaining map[string]int64
+	// total includes the reservations of uploads still being created.
+	total int64
+}
+
+// reservations is nil without SPACE_RESERVATION.
+var reservations *spaceReservations
+
+// newSpaceReservations reserves the space the incomplete uploads already in
+// the temporary store still need.
+func newSpaceReservations(ctx context.Context, composer *tusd.StoreComposer) (*spaceReservations, error) {
+	s := &spaceReservations{remaining: map[string]int64{}}
+	uploads, err := incompleteUploads()
+	if err != nil {
+		return nil, err
+	}
+	for id := range uploads {
+		upload, err := composer.Core.GetUpload(ctx, id)
+		if err != nil {
+			continue
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil || info.SizeIsDeferred || info.Offset >= info.Size {
+			continue
+		}
+		s.remaining[id] = info.Size - info.Offset
+		s.total += info.Size - info.Offset
+	}
+	return s, nil
+}
+
+// reserve reserves size bytes for an upload being created, to be assigned
+// to it once created or cancelled.
+func (s *spaceReservations) reserve(size int64) error {
+	free, err := diskFree(TempUploadPath)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.total+size+SpaceHeadroom > free {
+		log.Printf("Refusing an upload of %d bytes: %s free, %s reserved for incomplete uploads", size, formatByteSize(free), formatByteSize(s.total))
+		return errInsufficientSpace
+	}
+	s.total += size
+	return nil
+}
+
+func (s *spaceReservations) assign(id string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remaining[id] = size
+}
+
+func (s *spaceReservations) cancel(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total -= size
+}
+
+// written releases the reservation of n bytes the upload id wrote.
+func (s *spaceReservations) written(id string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.remaining[id]
+	if !ok {
+		return
+	}
+	n = min(n, r)
+	s.remaining[id] = r - n
+	s.total -= n
+}
+
+// release releases what is left of the reservation of the upload id, once
+// it is complete or removed.
+func (s *spaceReservations) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total -= s.remaining[id]
+	delete(s.remaining, id)
+}
+
+// reserved returns the bytes reserved and the number of uploads they are
+// reserved for.
+func (s *spaceReservations) reserved() (int64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total, len(s.remaining)
+}
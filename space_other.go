@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// diskFree is not available on this system, SPACE_RESERVATION cannot be
+// used.
+func diskFree(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// speedTestMaxSize bounds the body of a speed test.
+	speedTestMaxSize = 64 << 20
+	// speedTestSlots is how many speed tests run at once, more are refused.
+	speedTestSlots = 4
+)
+
+var speedTestSem = make(chan struct{}, speedTestSlots)
+
+// speedTestResult is the answer to a speed test: the throughput the body
+// was received at, in bytes per second, and the chunk size and number of
+// uploads at once the client should start with.
+type speedTestResult struct {
+	Bytes       int64 `json:"bytes"`
+	Millis      int64 `json:"ms"`
+	Rate        int64 `json:"rate"`
+	ChunkSize   int64 `json:"chunk_size"`
+	Concurrency int   `json:"concurrency"`
+}
+
+// speedTestHandler measures how fast the client uploads
+// (POST /api/speedtest with up to 64 MiB of throwaway data). The upload
+// page and its service worker run it before uploading to pick their first
+// chunk size and how many files to upload at once.
+func speedTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case speedTestSem <- struct{}{}:
+		defer func() { <-speedTestSem }()
+	default:
+		httpError(w, "Too many speed tests, retry shortly", http.StatusServiceUnavailable)
+		return
+	}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, speedTestMaxSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, "Speed test data too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		httpError(w, "Speed test interrupted", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, recommendTransfer(n, time.Since(start)))
+}
+
+// recommendTransfer sizes chunks like chunk-sizer.js does, to take
+// ChunkSeconds at the throughput of n bytes in elapsed. Parallel uploads only slow each other
+// down on slow links; on fast ones they make up for the round trip every
+// chunk of a single upload waits for. UPLOAD_CONCURRENCY overrides the
+// number of uploads.
+func recommendTransfer(n int64, elapsed time.Duration) speedTestResult {
+	elapsed = max(elapsed, time.Millisecond)
+	rate := int64(float64(n) / elapsed.Seconds())
+	res := speedTestResult{
+		Bytes:       n,
+		Millis:      elapsed.Milliseconds(),
+		Rate:        rate,
+		ChunkSize:   min(max(rate*int64(ChunkSeconds), ChunkSizeMin), ChunkSizeMax),
+		Concurrency: 1,
+	}
+	switch {
+	case UploadConcurrency > 0:
+		res.Concurrency = UploadConcurrency
+	case rate >= 10<<20:
+		res.Concurrency = 4
+	case rate >= 1<<20:
+		res.Concurrency = 2
+	}
+	return res
+}
+
+// runSpeedTest implements "uploader speedtest": it runs the speed test of
+// the upload page against a server, for troubleshooting slow links, e.g.
+//
+//	uploader speedtest --url https://upload.example.com --size 16M
+func runSpeedTest(args []string) int {
+	fs := flag.NewFlagSet("speedtest", flag.ContinueOnError)
+	base := fs.String("url", "http://localhost:8080", "address of the server")
+	sizeFlag := fs.String("size", "8M", "data sent by every run (K and M suffixes, at most 64M)")
+	runs := fs.Int("runs", 3, "number of runs")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	size, err := parseByteSize(*sizeFlag)
+	if err != nil || size <= 0 || size > speedTestMaxSize {
+		fmt.Fprintf(os.Stderr, "invalid --size: %s\n", *sizeFlag)
+		return 2
+	}
+	if *runs <= 0 {
+		fmt.Fprintln(os.Stderr, "--runs must be positive")
+		return 2
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure}}}
+	endpoint := strings.TrimSuffix(*base, "/") + "/api/speedtest"
+	data := make([]byte, size)
+
+	var best speedTestResult
+	for i := 1; i <= *runs; i++ {
+		start := time.Now()
+		res, err := client.Post(endpoint, "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		var result speedTestResult
+		if res.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+			res.Body.Close()
+			fmt.Fprintf(os.Stderr, "%s: %s %s\n", endpoint, res.Status, errorMessage(body))
+			return 1
+		}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		total := time.Since(start)
+		fmt.Printf("Run %d: %s in %s, %.1f MB/s as received by the server in %dms\n",
+			i, formatByteSize(size), total.Round(time.Millisecond), float64(result.Rate)/1e6, result.Millis)
+		if result.Rate > best.Rate {
+			best = result
+		}
+	}
+	fmt.Printf("Best %.1f MB/s: chunks of %s, %d uploads at once\n", float64(best.Rate)/1e6, formatByteSize(best.ChunkSize), best.Concurrency)
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps the datagrams below the MTU of most networks.
+const statsdMaxPacket = 1432
+
+// runStatsd sends the gauges to the statsd server at StatsdAddr every
+// StatsdInterval until ctx is done. Tags, the configured StatsdTags and
+// those of the gauge, are sent in the DogStatsD format Datadog agents
+// understand.
+func runStatsd(ctx context.Context) {
+	conn, err := net.Dial("udp", StatsdAddr)
+	if err != nil {
+		log.Printf("Unable to reach statsd at %s: %s", StatsdAddr, err.Error())
+		return
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(StatsdInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, packet := range statsdPackets(gauges()) {
+			// statsd is fire and forget, a lost datagram is a gap in the
+			// graphs until the next interval.
+			conn.Write(packet)
+		}
+	}
+}
+
+// statsdPackets formats gauges as statsd lines, several to a datagram.
+func statsdPackets(list []gauge) [][]byte {
+	var packets [][]byte
+	var buf bytes.Buffer
+	for _, g := range list {
+		tags := slices.Clone(StatsdTags)
+		for k, v := range g.tags {
+			tags = append(tags, k+":"+v)
+		}
+		line := fmt.Sprintf("%s%s:%d|g", StatsdPrefix, g.name, g.value)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			packets = append(packets, slices.Clone(buf.Bytes()))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
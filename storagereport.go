@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// storageUsage sums up a group of stored files. Tiered files count with
+// their original size.
+type storageUsage struct {
+	Name   string    `json:"name"`
+	Files  int       `json:"files"`
+	Bytes  int64     `json:"bytes"`
+	Oldest time.Time `json:"oldest,omitzero"`
+	Newest time.Time `json:"newest,omitzero"`
+	// ReclaimableFiles and ReclaimableBytes are what the retention rules
+	// delete by the projection time. Only local data counts towards the
+	// bytes: deleting a tiered file leaves its cold storage copy alone.
+	ReclaimableFiles int   `json:"reclaimable_files,omitempty"`
+	ReclaimableBytes int64 `json:"reclaimable_bytes,omitempty"`
+}
+
+func (u *storageUsage) add(size int64, modified time.Time, local, reclaimable bool) {
+	u.Files++
+	u.Bytes += size
+	if u.Oldest.IsZero() || modified.Before(u.Oldest) {
+		u.Oldest = modified
+	}
+	if modified.After(u.Newest) {
+		u.Newest = modified
+	}
+	if reclaimable {
+		u.ReclaimableFiles++
+		if local {
+			u.ReclaimableBytes += size
+		}
+	}
+}
+
+type storageReport struct {
+	Total storageUsage `json:"total"`
+	// Folders are the directories of UploadPath, "." for files stored at
+	// the top.
+	Folders []storageUsage `json:"folders"`
+	// Users are the FTP and SFTP users files were uploaded by; files
+	// uploaded otherwise are under "".
+	Users []storageUsage `json:"users"`
+	// RetentionDays is the retention period of files whose upload policy
+	// sets none, 0 if they are kept forever.
+	RetentionDays int       `json:"retention_days"`
+	ProjectedAt   time.Time `json:"projected_at"`
+}
+
+// storage reports the space used by the stored files, in total, per folder
+// and per user, and how much of it the retention rules reclaim. By default
+// the projection is of what the retention job would delete now;
+// ?within=<duration> projects further ahead.
+func (a *adminAPI) storage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	at := time.Now()
+	if v := r.URL.Query().Get("within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			httpError(w, "Invalid within", http.StatusBadRequest)
+			return
+		}
+		at = at.Add(d)
+	}
+	report := storageReport{
+		Total:         storageUsage{Name: "total"},
+		RetentionDays: int(RetentionPeriod / (24 * time.Hour)),
+		ProjectedAt:   at,
+	}
+	folders := map[string]*storageUsage{}
+	users := map[string]*storageUsage{}
+	err := walkStoredFiles(r.Context(), func(name string, info fs.FileInfo, tiered bool) error {
+		size, modified := info.Size(), info.ModTime()
+		if tiered {
+			stub, err := readTieredStub(name)
+			if err != nil {
+				return nil
+			}
+			size, modified = stub.Size, stub.ModTime
+		}
+		// The same rule as applyRetention.
+		retention := retentionFor(name)
+		reclaimable := retention > 0 && !modified.After(at.Add(-retention))
+		var user string
+		if storedFiles != nil {
+			if rec, ok := storedFiles.get(name); ok {
+				user = rec.User
+			}
+		}
+		folder := path.Dir(name)
+		for _, group := range []struct {
+			m   map[string]*storageUsage
+			key string
+		}{{folders, folder}, {users, user}} {
+			u, ok := group.m[group.key]
+			if !ok {
+				u = &storageUsage{Name: group.key}
+				group.m[group.key] = u
+			}
+			u.add(size, modified, !tiered, reclaimable)
+		}
+		report.Total.add(size, modified, !tiered, reclaimable)
+		return nil
+	})
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report.Folders = sortedUsage(folders)
+	report.Users = sortedUsage(users)
+	writeJSON(w, http.StatusOK, report)
+}
+
+func sortedUsage(m map[string]*storageUsage) []storageUsage {
+	list := make([]storageUsage, 0, len(m))
+	for _, u := range m {
+		list = append(list, *u)
+	}
+	slices.SortFunc(list, func(a, b storageUsage) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	storeRetryMin = time.Minute
+	storeRetryMax = time.Hour
+)
+
+// pendingStore is a completed upload that could not be moved to UploadPath.
+type pendingStore struct {
+	Info      tusd.FileInfo `json:"info"`
+	Name      string        `json:"name"`
+	Attempts  int           `json:"attempts"`
+	LastError string        `json:"last_error"`
+	NextTry   time.Time     `json:"next_try"`
+}
+
+// storeRetryQueue retries storing completed uploads whose move to UploadPath
+// failed, typically because the disk was full, so the client does not have
+// to upload them again. The data stays in TempUploadPath until it is stored;
+// the queue is journaled in pending-stores.json there.
+type storeRetryQueue struct {
+	journal string
+	wake    chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*pendingStore
+}
+
+// storeRetries is nil unless the file storage backend is used.
+var storeRetries *storeRetryQueue
+
+func newStoreRetryQueue(journal string) (*storeRetryQueue, error) {
+	q := &storeRetryQueue{
+		journal: journal,
+		wake:    make(chan struct{}, 1),
+		pending: map[string]*pendingStore{},
+	}
+	data, err := os.ReadFile(journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &q.pending); err != nil {
+			return nil, fmt.Errorf("%s: %w", journal, err)
+		}
+	}
+	return q, nil
+}
+
+// add queues an upload whose first store attempt failed with err.
+func (q *storeRetryQueue) add(info tusd.FileInfo, name string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending[info.ID] = &pendingStore{
+		Info:      info,
+		Name:      name,
+		Attempts:  1,
+		LastError: err.Error(),
+		NextTry:   time.Now().Add(storeRetryMin),
+	}
+	q.saveLocked()
+}
+
+func (q *storeRetryQueue) saveLocked() {
+	data, err := json.Marshal(q.pending)
+	if err == nil {
+		tmp := q.journal + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, q.journal)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save pending stores: %s", err.Error())
+	}
+}
+
+// has reports whether the upload id is waiting to be stored, so it must not
+// be collected as expired.
+func (q *storeRetryQueue) has(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.pending[id]
+	return ok
+}
+
+func (q *storeRetryQueue) list() []pendingStore {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]pendingStore, 0, len(q.pending))
+	for _, p := range q.pending {
+		list = append(list, *p)
+	}
+	slices.SortFunc(list, func(a, b pendingStore) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// retryNow makes id due immediately. It reports false if id is not queued.
+func (q *storeRetryQueue) retryNow(id string) bool {
+	q.mu.Lock()
+	p, ok := q.pending[id]
+	if ok {
+		p.NextTry = time.Now()
+	}
+	q.mu.Unlock()
+	if ok {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// run retries due uploads until ctx is done.
+func (q *storeRetryQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(storeRetryMin)
+	defer ticker.Stop()
+	for {
+		q.retryDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *storeRetryQueue) retryDue() {
+	q.mu.Lock()
+	var due []pendingStore
+	now := time.Now()
+	for _, p := range q.pending {
+		if !p.NextTry.After(now) {
+			due = append(due, *p)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, p := range due {
+		dstPath, err := storeUploadUnique(p.Info, p.Name)
+		q.mu.Lock()
+		if cur, ok := q.pending[p.Info.ID]; ok {
+			if err == nil || os.IsNotExist(err) {
+				delete(q.pending, p.Info.ID)
+			} else {
+				cur.Attempts++
+				cur.LastError = err.Error()
+				cur.NextTry = time.Now().Add(min(storeRetryMin<<min(cur.Attempts-1, 10), storeRetryMax))
+			}
+			q.saveLocked()
+		}
+		q.mu.Unlock()
+		switch {
+		case err == nil:
+			log.Printf("File moved to %s after %d attempts", dstPath, p.Attempts+1)
+		case os.IsNotExist(err):
+			log.Printf("Upload %s is gone, no longer trying to store it: %s", p.Info.ID, err.Error())
+		default:
+			log.Printf("Storing upload %s failed again (attempt %d): %s", p.Info.ID, p.Attempts+1, err.Error())
+		}
+	}
+}
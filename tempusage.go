@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempUsage is a snapshot of the disk space used in TempUploadPath,
+// refreshed by the temp-usage job.
+type tempUsage struct {
+	Bytes int64 `json:"bytes"`
+	// Sessions is the space used by each incomplete upload: its data, its
+	// .info and .hash files and whatever else is kept for it.
+	Sessions map[string]int64 `json:"sessions"`
+	Updated  time.Time        `json:"updated"`
+}
+
+var (
+	tempUsageMu     sync.Mutex
+	latestTempUsage tempUsage
+	// tempAlerted holds the thresholds currently exceeded, "total" or an
+	// upload ID, so an alert is sent once when a threshold is crossed rather
+	// than on every run.
+	tempAlerted = map[string]bool{}
+)
+
+// tempAlert is the JSON body posted to TEMP_ALERT_WEBHOOK.
+type tempAlert struct {
+	Alert     string    `json:"alert"`
+	Upload    string    `json:"upload,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Threshold int64     `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+// measureTempUsage is the temp-usage job. It measures TempUploadPath and
+// alerts when an upload uses more than TempAlertSession or the directory
+// more than TempAlertTotal.
+func measureTempUsage(ctx context.Context) (string, error) {
+	entries, err := os.ReadDir(TempUploadPath)
+	if err != nil {
+		return "", err
+	}
+	usage := tempUsage{Sessions: map[string]int64{}, Updated: time.Now()}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		usage.Bytes += info.Size()
+		id, _, _ := strings.Cut(entry.Name(), ".")
+		if uploadIDPattern.MatchString(id) {
+			usage.Sessions[id] += info.Size()
+		}
+	}
+	tempUsageMu.Lock()
+	latestTempUsage = usage
+	tempUsageMu.Unlock()
+
+	var alerts []tempAlert
+	exceeded := map[string]bool{}
+	if TempAlertTotal > 0 && usage.Bytes > TempAlertTotal {
+		exceeded["total"] = true
+		alerts = append(alerts, tempAlert{Alert: "temp_total_usage", Bytes: usage.Bytes, Threshold: TempAlertTotal})
+	}
+	if TempAlertSession > 0 {
+		for id, n := range usage.Sessions {
+			if n > TempAlertSession {
+				exceeded[id] = true
+				alerts = append(alerts, tempAlert{Alert: "temp_session_usage", Upload: id, Bytes: n, Threshold: TempAlertSession})
+			}
+		}
+	}
+	alerts = slices.DeleteFunc(alerts, func(a tempAlert) bool {
+		key := a.Upload
+		if key == "" {
+			key = "total"
+		}
+		return tempAlerted[key]
+	})
+	tempAlerted = exceeded
+
+	var errs []error
+	for _, alert := range alerts {
+		alert.Time = usage.Updated
+		if alert.Upload != "" {
+			log.Printf("Upload %s uses %d bytes in %s, over the alert threshold of %s", alert.Upload, alert.Bytes, TempUploadPath, formatByteSize(alert.Threshold))
+		} else {
+			log.Printf("%s uses %d bytes, over the alert threshold of %s", TempUploadPath, alert.Bytes, formatByteSize(alert.Threshold))
+		}
+		if TempAlertWebhook != "" {
+			if err := postTempAlert(ctx, alert); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return "", errors.Join(errs...)
+}
+
+func postTempAlert(ctx context.Context, alert tempAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, TempAlertWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("alert webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook answered %s", resp.Status)
+	}
+	return nil
+}
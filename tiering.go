@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tieredSuffix marks the stub left in place of a file that was moved to cold
+// storage.
+const tieredSuffix = ".tiered"
+
+// tieredStub is the content of a <name>.tiered stub.
+type tieredStub struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Target   string    `json:"target"`
+	TieredAt time.Time `json:"tiered_at"`
+}
+
+// tiering is the cold storage target, nil unless TIERING_TARGET is set.
+var tiering storageTarget
+
+// restoreMu serializes restores, so concurrent reads of a tiered file only
+// fetch it once.
+var restoreMu sync.Mutex
+
+// tierOldFiles moves every file in UploadPath last modified before cutoff
+// to cold storage and replaces it with a stub. It runs as the "tiering"
+// scheduler job.
+func tierOldFiles(ctx context.Context, cutoff time.Time) (int, error) {
+	moved := 0
+	err := filepath.WalkDir(UploadPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, tieredSuffix) || isSidecar(p) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(UploadPath, p)
+		name := filepath.ToSlash(rel)
+		if storedSince(name, info.ModTime()).After(cutoff) {
+			return nil
+		}
+		if err := tierFile(ctx, tiering, name, info); err != nil {
+			log.Printf("Unable to move %s to cold storage: %s", name, err.Error())
+			return nil
+		}
+		moved++
+		return nil
+	})
+	return moved, err
+}
+
+// tierFile moves name to target, in cold storage or the target of its
+// routing rule, and replaces it with a stub.
+func tierFile(ctx context.Context, target storageTarget, name string, info fs.FileInfo) error {
+	p := filepath.Join(UploadPath, filepath.FromSlash(name))
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := target.Put(ctx, name, f, info.Size()); err != nil {
+		return err
+	}
+	// Only drop the local copy once the remote one is known to be complete.
+	size, err := target.Size(ctx, name)
+	if err != nil {
+		return err
+	}
+	if size != info.Size() {
+		return fmt.Errorf("remote size %d, expected %d", size, info.Size())
+	}
+	err = writeTieredStub(name, tieredStub{
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Target:   target.String(),
+		TieredAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// writeTieredStub records that name, relative to UploadPath, is in cold
+// storage.
+func writeTieredStub(name string, stub tieredStub) error {
+	p := filepath.Join(UploadPath, filepath.FromSlash(name)) + tieredSuffix
+	data, err := json.Marshal(stub)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// readTieredStub returns the stub of name, relative to UploadPath, or an
+// error satisfying os.IsNotExist if the file was not tiered.
+func readTieredStub(name string) (tieredStub, error) {
+	var stub tieredStub
+	data, err := os.ReadFile(filepath.Join(UploadPath, filepath.FromSlash(name)) + tieredSuffix)
+	if err != nil {
+		return stub, err
+	}
+	return stub, json.Unmarshal(data, &stub)
+}
+
+// restoreTiered brings a tiered file back from cold storage, or from the
+// target of its routing rule. The restored file counts as modified now, so
+// it stays on local disk for another TieringAfter. It returns an error satisfying os.IsNotExist if name was
+// never tiered.
+func restoreTiered(ctx context.Context, name string) error {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	p := filepath.Join(UploadPath, filepath.FromSlash(name))
+	if _, err := os.Stat(p); err == nil {
+		// Restored while waiting for the lock.
+		return nil
+	}
+	stub, err := readTieredStub(name)
+	if err != nil {
+		return err
+	}
+	target := routedTarget(stub)
+	if target == nil {
+		return fmt.Errorf("file is on %s, which is neither TIERING_TARGET nor the target of a routing rule", stub.Target)
+	}
+	src, err := target.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := p + ".restore-tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, src)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != stub.Size {
+		err = fmt.Errorf("restored %d bytes, expected %d", n, stub.Size)
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Remove(p + tieredSuffix)
+	log.Printf("Restored %s from %s", name, target)
+	return nil
+}
+
+// openStored opens name, relative to UploadPath, restoring it from cold
+// storage first if it was tiered.
+func openStored(ctx context.Context, name string) (*os.File, error) {
+	p := filepath.Join(UploadPath, filepath.FromSlash(name))
+	f, err := os.Open(p)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	if err := restoreTiered(ctx, name); err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return os.Open(p)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Upload tokens are the tokens of UPLOAD_POLICIES, handed out alone or in
+// guest links to let clients upload with the role of a policy. When one
+// leaks, the admin API shows what it allows and revokes it at once:
+//
+//	GET    /tokens       every token, its role and use
+//	GET    /tokens/<id>  the limits of the token, its uses and the uploads
+//	                     in progress made with it
+//	DELETE /tokens/<id>  revoke the token
+//
+// Tokens are named by their ID, the start of their SHA-256, so they appear
+// in no URL or log; "uploader admin" takes either. A revoked token creates
+// no more uploads, and the uploads made with it take no more data. The
+// tokens of a policy neither expire nor run out of uses: they are valid
+// until revoked or removed from UPLOAD_POLICIES. Uses and revocations are
+// kept by every replica on its own, in tokens.json in TempUploadPath.
+
+// errUploadTokenRevoked is returned for HTTP uploads presenting a revoked
+// token, or made with one.
+var errUploadTokenRevoked = tusd.NewError("ERR_UPLOAD_TOKEN_REVOKED", "upload token revoked", http.StatusUnauthorized)
+
+var tokenIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// tokenID returns the ID of the upload token.
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// tokenUse is what is tracked of a token.
+type tokenUse struct {
+	Uses     int       `json:"uses"`
+	LastUsed time.Time `json:"last_used,omitzero"`
+	Revoked  time.Time `json:"revoked,omitzero"`
+}
+
+// tokenInfo describes a token for the admin API. Expires and
+// RemainingUses are null for tokens that do not expire or run out.
+type tokenInfo struct {
+	ID            string     `json:"id"`
+	Role          string     `json:"role"`
+	MaxSize       string     `json:"max_size,omitempty"`
+	AllowedTypes  []string   `json:"allowed_types,omitempty"`
+	Folder        string     `json:"folder,omitempty"`
+	RetentionDays int        `json:"retention_days,omitempty"`
+	DeadlineHours int        `json:"deadline_hours,omitempty"`
+	Expires       *time.Time `json:"expires"`
+	RemainingUses *int       `json:"remaining_uses"`
+	tokenUse
+	// Uploads are the IDs of the uploads in progress made with the token.
+	Uploads []string `json:"uploads,omitempty"`
+}
+
+// tokenRegistry tracks the uses and revocations of the upload tokens.
+type tokenRegistry struct {
+	journal string
+
+	mu     sync.Mutex
+	tokens map[string]*tokenUse
+}
+
+var uploadTokens = &tokenRegistry{tokens: map[string]*tokenUse{}}
+
+// newTokenRegistry loads the token uses from journal, or keeps them in
+// memory only if journal is empty.
+func newTokenRegistry(journal string) (*tokenRegistry, error) {
+	t := &tokenRegistry{journal: journal, tokens: map[string]*tokenUse{}}
+	if journal == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &t.tokens); err != nil {
+			return nil, fmt.Errorf("%s: %w", journal, err)
+		}
+	}
+	return t, nil
+}
+
+func (t *tokenRegistry) saveLocked() {
+	if t.journal == "" {
+		return
+	}
+	data, err := json.Marshal(t.tokens)
+	if err == nil {
+		tmp := t.journal + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, t.journal)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save upload tokens: %s", err.Error())
+	}
+}
+
+// revoked reports whether the token id is revoked.
+func (t *tokenRegistry) revoked(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.tokens[id]
+	return u != nil && !u.Revoked.IsZero()
+}
+
+// used counts an upload created with the token id.
+func (t *tokenRegistry) used(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.tokens[id]
+	if u == nil {
+		u = &tokenUse{}
+		t.tokens[id] = u
+	}
+	u.Uses++
+	u.LastUsed = time.Now()
+	t.saveLocked()
+}
+
+// revoke revokes the token id, and reports whether it was not already.
+func (t *tokenRegistry) revoke(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.tokens[id]
+	if u == nil {
+		u = &tokenUse{}
+		t.tokens[id] = u
+	}
+	if !u.Revoked.IsZero() {
+		return false
+	}
+	u.Revoked = time.Now()
+	t.saveLocked()
+	return true
+}
+
+func (t *tokenRegistry) use(id string) tokenUse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u := t.tokens[id]; u != nil {
+		return *u
+	}
+	return tokenUse{}
+}
+
+// describe returns what the token id allows, false if no policy has it.
+func (t *tokenRegistry) describe(id string) (tokenInfo, bool) {
+	for _, p := range UploadPolicies {
+		if slices.ContainsFunc(p.Tokens, func(token string) bool { return tokenID(token) == id }) {
+			return tokenInfo{
+				ID:            id,
+				Role:          p.Role,
+				MaxSize:       p.MaxSize,
+				AllowedTypes:  p.AllowedTypes,
+				Folder:        p.Folder,
+				RetentionDays: p.RetentionDays,
+				DeadlineHours: p.DeadlineHours,
+				tokenUse:      t.use(id),
+			}, true
+		}
+	}
+	return tokenInfo{}, false
+}
+
+// checkUploadToken refuses writes to an upload made with a revoked token.
+func checkUploadToken(info tusd.FileInfo) error {
+	if id := info.MetaData["token_id"]; id != "" && uploadTokens.revoked(id) {
+		return errUploadTokenRevoked
+	}
+	return nil
+}
+
+func (a *adminAPI) tokens(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tokens"), "/")
+	if id != "" && !tokenIDPattern.MatchString(id) {
+		httpError(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		list := []tokenInfo{}
+		for _, p := range UploadPolicies {
+			for _, token := range p.Tokens {
+				info, _ := uploadTokens.describe(tokenID(token))
+				list = append(list, info)
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case id != "" && r.Method == http.MethodGet:
+		info, ok := uploadTokens.describe(id)
+		if !ok {
+			httpError(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		uploads, err := incompleteUploads()
+		if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for upload := range uploads {
+			u, err := a.composer.Core.GetUpload(r.Context(), upload)
+			if err != nil {
+				continue
+			}
+			if fi, err := u.GetInfo(r.Context()); err == nil && fi.MetaData["token_id"] == id {
+				info.Uploads = append(info.Uploads, upload)
+			}
+		}
+		slices.Sort(info.Uploads)
+		writeJSON(w, http.StatusOK, info)
+	case id != "" && r.Method == http.MethodDelete:
+		if _, ok := uploadTokens.describe(id); !ok {
+			httpError(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		if uploadTokens.revoke(id) {
+			log.Printf("Upload token %s revoked by admin", id)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fingerprintSample is the size of the samples fileFingerprint in
+// fingerprint.js hashes.
+const fingerprintSample = 64 << 10
+
+// uploadCLIRetries is how many times in a row a chunk is sent again after
+// it failed.
+const uploadCLIRetries = 5
+
+// runUpload implements "uploader upload": it uploads files to a running
+// server with the tus protocol, e.g.
+//
+//	uploader upload --url https://upload.example.com footage/*.mp4
+//
+// Files are fingerprinted like the upload page does, so an upload started
+// in a browser, or by another run of the command, is continued rather than
+// started over, and one started here can be finished in a browser. The
+// chunks the server recorded for the upload are compared with the file
+// first: an upload whose recorded chunks differ from the file is of another
+// file that merely shares its fingerprint, and a new upload is started
+// without it.
+func runUpload(args []string) int {
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	base := fs.String("url", "http://localhost:8080", "address of the server")
+	chunkFlag := fs.String("chunk", "8M", "size of every PATCH request (K, M and G suffixes)")
+	token := fs.String("token", "", "upload token of an upload policy")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	chunk, err := parseByteSize(*chunkFlag)
+	if err != nil || chunk <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid --chunk: %s\n", *chunkFlag)
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: uploader upload [--url URL] [--chunk SIZE] [--token TOKEN] FILE...")
+		return 2
+	}
+	c := &uploadClient{
+		base:  strings.TrimSuffix(*base, "/"),
+		chunk: chunk,
+		token: *token,
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure},
+		}},
+	}
+	status := 0
+	for _, file := range fs.Args() {
+		if err := c.upload(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, err.Error())
+			status = 1
+		}
+	}
+	return status
+}
+
+type uploadClient struct {
+	base   string
+	chunk  int64
+	token  string
+	client *http.Client
+}
+
+func (c *uploadClient) do(method, url string, body io.Reader, size int64, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return c.client.Do(req)
+}
+
+func (c *uploadClient) upload(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	fp, err := fileFingerprint(f, size)
+	if err != nil {
+		return err
+	}
+
+	var location string
+	offset := int64(0)
+	found, err := c.findUpload(fp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: unable to look for an upload to continue: %s\n", file, err.Error())
+	}
+	if found != nil {
+		switch matched, err := matchesChunks(f, found.Chunks); {
+		case err != nil:
+			return err
+		case matched:
+			location, offset = c.base+"/files/"+found.ID, found.Offset
+			fmt.Printf("%s: continuing upload %s at %s of %s\n", file, found.ID, formatByteSize(offset), formatByteSize(size))
+		default:
+			fmt.Printf("%s: upload %s has the fingerprint of the file but other data, starting over\n", file, found.ID)
+			fp = ""
+		}
+	}
+	if location == "" {
+		if location, err = c.create(file, stat, fp); err != nil {
+			return err
+		}
+	}
+
+	failures := 0
+	// Empty files are complete once created.
+	for offset < size {
+		length := min(c.chunk, size-offset)
+		res, err := c.do(http.MethodPatch, location, io.NewSectionReader(f, offset, length), length, map[string]string{
+			"Upload-Offset": strconv.FormatInt(offset, 10),
+			"Content-Type":  "application/offset+octet-stream",
+		})
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+			res.Body.Close()
+			if res.StatusCode == http.StatusNoContent {
+				if offset, err = strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64); err != nil {
+					return fmt.Errorf("invalid Upload-Offset %q", res.Header.Get("Upload-Offset"))
+				}
+				failures = 0
+				fmt.Printf("\r%s: %s of %s", file, formatByteSize(offset), formatByteSize(size))
+				continue
+			}
+			if wait, _ := strconv.Atoi(res.Header.Get("Retry-After")); res.StatusCode == http.StatusServiceUnavailable && res.Header.Get("Upload-Queue-Position") != "" && wait > 0 {
+				fmt.Printf("\r%s: queued at position %s, waiting %s\n", file, res.Header.Get("Upload-Queue-Position"), time.Duration(wait)*time.Second)
+				time.Sleep(time.Duration(wait) * time.Second)
+				continue
+			}
+			err = fmt.Errorf("patch at %d: %s", offset, res.Status)
+			if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusConflict && res.StatusCode != http.StatusLocked {
+				return err
+			}
+		}
+		if failures++; failures > uploadCLIRetries {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\n%s: %s, trying again\n", file, err.Error())
+		time.Sleep(time.Duration(failures) * time.Second)
+		if offset, err = c.offset(location); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("\r%s: uploaded %s to %s\n", file, formatByteSize(size), location)
+	return nil
+}
+
+// create creates the upload of file with the metadata the upload page
+// sends.
+func (c *uploadClient) create(file string, stat os.FileInfo, fp string) (string, error) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	meta := []string{
+		"filename " + b64(filepath.Base(file)),
+		"lastmodified " + b64(strconv.FormatInt(stat.ModTime().UnixMilli(), 10)),
+	}
+	if fp != "" {
+		meta = append(meta, "fingerprint "+b64(fp))
+	}
+	if t := mime.TypeByExtension(filepath.Ext(file)); t != "" {
+		meta = append(meta, "filetype "+b64(t))
+	}
+	res, err := c.do(http.MethodPost, c.base+"/files/", nil, 0, map[string]string{
+		"Upload-Length":   strconv.FormatInt(stat.Size(), 10),
+		"Upload-Metadata": strings.Join(meta, ","),
+	})
+	if err != nil {
+		return "", err
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("create: %s: %s", res.Status, errorMessage(body))
+	}
+	location, err := res.Location()
+	if err != nil {
+		return "", err
+	}
+	return location.String(), nil
+}
+
+// offset asks the server how much of the upload at location it has.
+func (c *uploadClient) offset(location string) (int64, error) {
+	res, err := c.do(http.MethodHead, location, nil, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("head: %s", res.Status)
+	}
+	return strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// findUpload returns the incomplete upload of the file with the
+// fingerprint fp, nil if there is none.
+func (c *uploadClient) findUpload(fp string) (*uploadStatus, error) {
+	res, err := c.do(http.MethodGet, c.base+"/api/uploads?fingerprint="+url.QueryEscape(fp), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+	var list []uploadStatus
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return &list[0], nil
+}
+
+// fileFingerprint returns the fingerprint fingerprint.js computes for the
+// file f of the given size: "<size>-<sha256>" of its start, middle and end.
+func fileFingerprint(f *os.File, size int64) (string, error) {
+	h := sha256.New()
+	n := int64(fingerprintSample)
+	if size <= 3*n {
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+			return "", err
+		}
+	} else {
+		mid := size / 2
+		for _, start := range []int64{0, mid, size - n} {
+			if _, err := io.Copy(h, io.NewSectionReader(f, start, n)); err != nil {
+				return "", err
+			}
+		}
+	}
+	return strconv.FormatInt(size, 10) + "-" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// matchesChunks reports whether every chunk the server recorded for an
+// upload matches the data of f.
+func matchesChunks(f *os.File, chunks []chunkHash) (bool, error) {
+	for _, c := range chunks {
+		h := c.newHash()
+		n, err := io.Copy(h, io.NewSectionReader(f, c.Offset, c.Size))
+		if err != nil {
+			return false, err
+		}
+		if n != c.Size || !c.matches(h) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
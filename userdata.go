@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// The data of a user is what the FTP and SFTP uploads of the user left:
+// the stored files the index attributes to them, their incomplete uploads
+// and their receipts. "uploader admin export-user" hands it out as one
+// archive, "uploader admin purge-user" removes it.
+//
+// A purge redacts the user from what the server keeps about it: the purge
+// is logged under the pseudonym of the user, the truncated SHA-256 of the
+// name, so it stays auditable without naming them, and the failed logins
+// counted for them are forgotten. Login events already logged or published
+// over MQTT are outside the server and have to be redacted there. Copies in
+// cold storage and on the replica are not deleted either; the purge reports
+// them so they can be removed by hand.
+
+// userPseudonym is how logs name a user whose data was purged.
+func userPseudonym(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return "user-" + hex.EncodeToString(sum[:6])
+}
+
+// byUser returns the names of the files uploaded by user, sorted.
+func (idx *fileIndex) byUser(user string) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var names []string
+	for name, rec := range idx.files {
+		if rec.User == user {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// userExport is the metadata.json of a user data export.
+type userExport struct {
+	User     string                `json:"user"`
+	Exported time.Time             `json:"exported"`
+	Files    map[string]fileRecord `json:"files"`
+	Sessions []sessionInfo         `json:"sessions"`
+	Receipts []uploadReceipt       `json:"receipts"`
+	// Missing are the files whose data could not be read into the export.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// userPurge reports what a purge removed.
+type userPurge struct {
+	Pseudonym string   `json:"pseudonym"`
+	Files     []string `json:"files"`
+	Sessions  []string `json:"sessions"`
+	Receipts  int      `json:"receipts"`
+	// RemoteCopies are the files that were tiered or replicated: their
+	// copies on the remote targets are left to be removed by hand.
+	RemoteCopies []string `json:"remote_copies,omitempty"`
+}
+
+// userSessions returns the incomplete uploads of user.
+func userSessions(ctx context.Context, composer *tusd.StoreComposer, user string) []sessionInfo {
+	uploads, err := incompleteUploads()
+	if err != nil {
+		return nil
+	}
+	var sessions []sessionInfo
+	for id, modified := range uploads {
+		upload, err := composer.Core.GetUpload(ctx, id)
+		if err != nil {
+			continue
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil || info.MetaData["user"] != user {
+			continue
+		}
+		sessions = append(sessions, sessionInfo{ID: id, Offset: info.Offset, Size: info.Size, Filename: info.MetaData["filename"], Modified: modified})
+	}
+	slices.SortFunc(sessions, func(a, b sessionInfo) int { return a.Modified.Compare(b.Modified) })
+	return sessions
+}
+
+// userReceipts returns the receipts issued to user and their paths.
+func userReceipts(user string) ([]uploadReceipt, []string) {
+	entries, _ := os.ReadDir(filepath.Join(TempUploadPath, "receipts"))
+	var receipts []uploadReceipt
+	var paths []string
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		p := receiptPath(id)
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var receipt uploadReceipt
+		if json.Unmarshal(data, &receipt) == nil && receipt.User == user {
+			receipts = append(receipts, receipt)
+			paths = append(paths, p)
+		}
+	}
+	return receipts, paths
+}
+
+// exportUser writes the data of user to w as a gzipped tar archive holding
+// metadata.json and the stored files under files/.
+func exportUser(ctx context.Context, composer *tusd.StoreComposer, user string, w io.Writer) error {
+	export := userExport{User: user, Exported: time.Now().UTC(), Files: map[string]fileRecord{}, Sessions: []sessionInfo{}}
+	names := storedFiles.byUser(user)
+	for _, name := range names {
+		if rec, ok := storedFiles.get(name); ok {
+			export.Files[name] = rec
+		}
+	}
+	export.Sessions = append(export.Sessions, userSessions(ctx, composer, user)...)
+	export.Receipts, _ = userReceipts(user)
+	if export.Receipts == nil {
+		export.Receipts = []uploadReceipt{}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Tiered files are restored to be read.
+		f, err := openStored(ctx, name)
+		if err != nil {
+			export.Missing = append(export.Missing, name)
+			continue
+		}
+		stat, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: "files/" + name, Mode: 0644, Size: stat.Size(), ModTime: stat.ModTime()})
+		}
+		if err == nil {
+			_, err = io.CopyN(tw, f, stat.Size())
+		}
+		f.Close()
+		if err != nil {
+			// The archive is broken past this point.
+			return err
+		}
+	}
+	meta, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "metadata.json", Mode: 0644, Size: int64(len(meta)), ModTime: export.Exported}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(meta); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// purgeUser removes the data of user.
+func purgeUser(ctx context.Context, composer *tusd.StoreComposer, user string) (userPurge, error) {
+	purge := userPurge{Pseudonym: userPseudonym(user), Files: []string{}, Sessions: []string{}}
+	var errs []error
+	for _, session := range userSessions(ctx, composer, user) {
+		if err := terminateUpload(ctx, composer, session.ID); err != nil && !errors.Is(err, tusd.ErrNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		purge.Sessions = append(purge.Sessions, session.ID)
+	}
+	for _, name := range storedFiles.byUser(user) {
+		_, err := os.Stat(filepath.Join(UploadPath, filepath.FromSlash(name)))
+		tiered := os.IsNotExist(err)
+		if err := deleteStored(name, tiered); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		// A record whose file is gone already is dropped too.
+		storedFiles.remove(name)
+		purge.Files = append(purge.Files, name)
+		if tiered || replication != nil {
+			purge.RemoteCopies = append(purge.RemoteCopies, name)
+		}
+	}
+	_, paths := userReceipts(user)
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		purge.Receipts++
+	}
+	logins.forgetUser(user)
+	return purge, errors.Join(errs...)
+}
+
+// forgetUser drops the failed logins made with the name user.
+func (g *loginGuard) forgetUser(user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for host, f := range g.failures {
+		if f.user == user {
+			delete(g.failures, host)
+		}
+	}
+}
+
+// users exports (GET /users/<user>/export) or purges (DELETE /users/<user>)
+// the data of a user.
+func (a *adminAPI) users(w http.ResponseWriter, r *http.Request) {
+	if storedFiles == nil {
+		httpError(w, "No file index with this storage backend", http.StatusConflict)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/users"), "/")
+	user, export := strings.CutSuffix(rest, "/export")
+	switch {
+	case user == "" || strings.Contains(user, "/"):
+		httpError(w, "Invalid user", http.StatusBadRequest)
+	case export && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+userPseudonym(user)+`.tar.gz"`)
+		if err := exportUser(r.Context(), a.composer, user, w); err != nil {
+			// The status is sent already, the client sees a truncated
+			// archive.
+			log.Printf("Export of %s failed: %s", userPseudonym(user), err.Error())
+			return
+		}
+		log.Printf("Data of %s exported by admin", userPseudonym(user))
+	case !export && r.Method == http.MethodDelete:
+		purge, err := purgeUser(r.Context(), a.composer, user)
+		log.Printf("Data of %s purged by admin: %d files, %d uploads, %d receipts", purge.Pseudonym, len(purge.Files), len(purge.Sessions), purge.Receipts)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, purge)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Validator checks uploads when they are created, from their declared
+// length and metadata, and once they are complete, before they are
+// accepted. The validators run in the order of UPLOAD_VALIDATORS; the first
+// error rejects the upload. A complete upload rejected with a client error
+// (4xx) is removed, one rejected with any other error is kept so the client
+// can try to finish it again. New checks implement Validator and are added
+// to validatorNames.
+type Validator interface {
+	ValidateCreate(ctx context.Context, info tusd.FileInfo) error
+	ValidateFinish(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error
+}
+
+// validatorNames are the validators UPLOAD_VALIDATORS can list:
+//
+//   - type: the file name, against ALLOWED_EXTENSIONS and
+//     BLOCKED_EXTENSIONS, and the content of SVG images
+//   - policy: the types and size limit of the policy of the upload
+//   - size: empty files
+//   - scan: the content scan by ICAP_URL
+//   - image: the decoding and sanitizing of images with SANITIZE_IMAGES
+//   - webhook: the verdict of VALIDATION_WEBHOOK
+var validatorNames = map[string]func() Validator{
+	"type":    func() Validator { return typeValidator{} },
+	"policy":  func() Validator { return policyValidator{} },
+	"size":    func() Validator { return sizeValidator{} },
+	"scan":    func() Validator { return scanValidator{} },
+	"image":   func() Validator { return imageValidator{} },
+	"webhook": func() Validator { return webhookValidator{} },
+}
+
+// defaultValidators are the validators run without UPLOAD_VALIDATORS,
+// followed by webhook if VALIDATION_WEBHOOK is set.
+const defaultValidators = "type,policy,size,scan,image"
+
+// validators is the chain of UPLOAD_VALIDATORS.
+var validators []Validator
+
+// parseValidators parses the comma separated list of UPLOAD_VALIDATORS.
+func parseValidators(list string) ([]Validator, error) {
+	var chain []Validator
+	seen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		newValidator, ok := validatorNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown validator %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("validator %q listed twice", name)
+		}
+		seen[name] = true
+		chain = append(chain, newValidator())
+	}
+	return chain, nil
+}
+
+func validateCreate(ctx context.Context, info tusd.FileInfo) error {
+	for _, v := range validators {
+		if err := v.ValidateCreate(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateFinish runs the chain on a complete upload. It reports whether
+// the upload was rejected for good, to be removed.
+func validateFinish(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) (bool, error) {
+	for _, v := range validators {
+		if err := v.ValidateFinish(ctx, upload, info); err != nil {
+			var e tusd.Error
+			rejected := errors.As(err, &e) && e.HTTPResponse.StatusCode >= 400 && e.HTTPResponse.StatusCode < 500
+			return rejected, err
+		}
+	}
+	return false, nil
+}
+
+type typeValidator struct{}
+
+func (typeValidator) ValidateCreate(ctx context.Context, info tusd.FileInfo) error {
+	return checkUploadName(info.MetaData["filename"])
+}
+
+func (typeValidator) ValidateFinish(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	return checkUploadContent(ctx, upload, info)
+}
+
+type policyValidator struct{}
+
+func (policyValidator) ValidateCreate(ctx context.Context, info tusd.FileInfo) error {
+	return checkUploadPolicy(info)
+}
+
+func (policyValidator) ValidateFinish(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	return nil
+}
+
+type sizeValidator struct{}
+
+func (sizeValidator) ValidateCreate(ctx context.Context, info tusd.FileInfo) error {
+	if !info.SizeIsDeferred && info.Size == 0 && !info.IsPartial {
+		return errEmptyUpload
+	}
+	return nil
+}
+
+func (sizeValidator) ValidateFinish(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	if info.Size == 0 && !info.IsPartial {
+		return errEmptyUpload
+	}
+	return nil
+}
+
+type scanValidator struct{}
+
+func (scanValidator) ValidateCreate(ctx context.Context, info tusd.FileInfo) error {
+	return nil
+}
+
+func (scanValidator) ValidateFinish(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	return scanUpload(ctx, upload, info)
+}
+
+type imageValidator struct{}
+
+func (imageValidator) ValidateCreate(ctx context.Context, info tusd.FileInfo) error {
+	return nil
+}
+
+func (imageValidator) ValidateFinish(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	return sanitizeImage(info)
+}
+
+// validationWebhookTimeout bounds a call of VALIDATION_WEBHOOK.
+const validationWebhookTimeout = 30 * time.Second
+
+var (
+	// errUploadRejected is returned, with the reason given by the webhook
+	// in the message, for uploads VALIDATION_WEBHOOK turned down.
+	errUploadRejected = tusd.NewError("ERR_UPLOAD_REJECTED", "upload was rejected", http.StatusForbidden)
+	// errValidationUnavailable is returned when VALIDATION_WEBHOOK could not
+	// be asked or failed.
+	errValidationUnavailable = tusd.NewError("ERR_VALIDATION_UNAVAILABLE", "upload validation is unavailable, try again later", http.StatusServiceUnavailable)
+)
+
+// validationRequest is the JSON body posted to VALIDATION_WEBHOOK, with the
+// stage "create" or "finish". The ID and the SHA-256 are only known once
+// the upload is complete.
+type validationRequest struct {
+	Stage    string            `json:"stage"`
+	ID       string            `json:"id,omitempty"`
+	Size     int64             `json:"size"`
+	Deferred bool              `json:"size_is_deferred,omitempty"`
+	SHA256   string            `json:"sha256,omitempty"`
+	MetaData map[string]string `json:"metadata"`
+}
+
+// webhookValidator asks VALIDATION_WEBHOOK. A 2xx answer accepts the
+// upload, a 4xx one rejects it with the first line of the body as the
+// reason, anything else fails the validation for the client to retry.
+type webhookValidator struct{}
+
+func (webhookValidator) ValidateCreate(ctx context.Context, info tusd.FileInfo) error {
+	return callValidationWebhook(ctx, validationRequest{Stage: "create", Size: info.Size, Deferred: info.SizeIsDeferred, MetaData: info.MetaData})
+}
+
+func (webhookValidator) ValidateFinish(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	req := validationRequest{Stage: "finish", ID: info.ID, Size: info.Size, MetaData: info.MetaData}
+	req.SHA256, _ = uploadSHA256(info)
+	return callValidationWebhook(ctx, req)
+}
+
+func callValidationWebhook(ctx context.Context, v validationRequest) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, validationWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ValidationWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errValidationUnavailable
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		return nil
+	case res.StatusCode >= 400 && res.StatusCode <= 499:
+		reason, _ := bufio.NewReader(io.LimitReader(res.Body, 1024)).ReadString('\n')
+		if reason = strings.TrimSpace(reason); reason == "" {
+			return errUploadRejected
+		}
+		return tusd.NewError(errUploadRejected.ErrorCode, reason, http.StatusForbidden)
+	}
+	return errValidationUnavailable
+}
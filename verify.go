@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// How completed uploads are checked against what was received before they
+// are accepted, selected with ASSEMBLY_VERIFY. "size" compares the length
+// of the stored data with the declared one. "chunks" reads the data back
+// and compares every chunk with its hash recorded while it was received,
+// "full" compares the hash of the whole data with the running hash; both
+// check the size first. "none" skips the checks. Uploads whose running hash
+// broke while they were received cannot be compared and are accepted after
+// the size check. Corrupted chunks are rebuilt from their parity when the
+// upload has one, see parity.go.
+const (
+	verifyNone   = "none"
+	verifySize   = "size"
+	verifyChunks = "chunks"
+	verifyFull   = "full"
+)
+
+var errUploadCorrupted = tusd.NewError("ERR_UPLOAD_CORRUPTED", "stored data differs from the received data", http.StatusInternalServerError)
+
+// verifyAssembly checks the data of the completed upload info at the
+// ASSEMBLY_VERIFY level.
+func verifyAssembly(ctx context.Context, upload tusd.Upload, info tusd.FileInfo) error {
+	if AssemblyVerify == verifyNone {
+		return nil
+	}
+	if err := checkStoredSize(info); err != nil || AssemblyVerify == verifySize {
+		return err
+	}
+	hashes, err := sessionHashes(info.ID)
+	if err != nil {
+		return err
+	}
+	if hashes.Broken || len(hashes.Chunks) == 0 {
+		log.Printf("Upload %s has no complete hash, verified by its size only", info.ID)
+		return nil
+	}
+	r, err := upload.GetReader(ctx)
+	if errors.Is(err, errDataDiscarded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if AssemblyVerify == verifyFull {
+		alg, want, err := hashes.Digest()
+		if errors.Is(err, errHashIncomplete) {
+			// The running BLAKE3 hash is lost with a restart.
+			log.Printf("Upload %s has no complete hash, verified by its size only", info.ID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		got, err := digestReader(alg, r)
+		if err != nil {
+			return err
+		}
+		if got == want {
+			return nil
+		}
+		log.Printf("Upload %s has %s %s stored, %s was received", info.ID, alg, got, want)
+		if err := repairChunks(info, hashes); err != nil {
+			return err
+		}
+		repaired, err := upload.GetReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer repaired.Close()
+		if got, err = digestReader(alg, repaired); err != nil {
+			return err
+		}
+		if got != want {
+			return errUploadCorrupted
+		}
+		return nil
+	}
+	var offset int64
+	for _, c := range hashes.Chunks {
+		if c.Offset != offset {
+			log.Printf("Upload %s has a gap in its chunk hashes at %d, verified by its size only", info.ID, offset)
+			return nil
+		}
+		h := c.newHash()
+		if _, err := io.CopyN(h, r, c.Size); err != nil {
+			return err
+		}
+		if !c.matches(h) {
+			log.Printf("Upload %s differs from the received data in the chunk at %d", info.ID, c.Offset)
+			return repairChunks(info, hashes)
+		}
+		offset += c.Size
+	}
+	return nil
+}
+
+// storedVerification is the answer of GET /files/<id>/verify.
+type storedVerification struct {
+	UploadID string `json:"upload_id"`
+	checksumResult
+	Size     int64     `json:"size"`
+	Verified time.Time `json:"verified,omitzero"`
+}
+
+// storedVerifySlots bounds the stored files hashed at once on request.
+var storedVerifySlots = make(chan struct{}, 2)
+
+// withStoredVerify answers GET /files/<id>/verify, which hashes the file
+// stored from the upload id again and compares it with the checksum
+// recorded when it was stored, so downstream systems can confirm a file is
+// intact right before they fetch it. Like receipts, it is served to whoever
+// knows the upload ID. The answer is 200 with the outcome as JSON, whatever
+// it is, or 404 if no stored file comes from the upload. Files in cold
+// storage or moved by a routing rule are hashed from their target.
+func withStoredVerify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := strings.CutSuffix(r.URL.Path, "/verify")
+		if !ok || !uploadIDPattern.MatchString(id) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var name string
+		if storedFiles != nil {
+			name, ok = storedFiles.byUpload(id)
+		}
+		if !ok {
+			httpError(w, "Stored file not found", http.StatusNotFound)
+			return
+		}
+		select {
+		case storedVerifySlots <- struct{}{}:
+			defer func() { <-storedVerifySlots }()
+		case <-r.Context().Done():
+			return
+		}
+		res := storedVerification{UploadID: id, checksumResult: storedFiles.verifyChecksum(name)}
+		if res.Status == checksumTiered {
+			res.checksumResult = verifyTiered(r.Context(), name, res.checksumResult)
+		}
+		if rec, ok := storedFiles.get(name); ok {
+			res.Size, res.Verified = rec.Size, rec.Verified
+		}
+		log.Printf("[%s] Stored file %s of upload %s verified: %s", requestID(r), name, id, res.Status)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, res)
+	})
+}
+
+// verifyTiered hashes the copy of the tiered file name in its target and
+// compares it with the checksum in res.
+func verifyTiered(ctx context.Context, name string, res checksumResult) checksumResult {
+	stub, err := readTieredStub(name)
+	if err != nil {
+		return res
+	}
+	target := routedTarget(stub)
+	if target == nil {
+		return res
+	}
+	r, err := target.Get(ctx, name)
+	if err != nil {
+		res.Status, res.Error = checksumFailed, err.Error()
+		return res
+	}
+	defer r.Close()
+	sum, err := hashReader(r)
+	switch {
+	case err != nil:
+		res.Status, res.Error = checksumFailed, err.Error()
+	case sum != res.Expected:
+		res.Status, res.Actual = checksumMismatch, sum
+	default:
+		res.Status = checksumOK
+		storedFiles.markVerified(name, time.Now())
+	}
+	return res
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// virusTotalAPI is the VirusTotal v3 file report endpoint; the SHA-256 of the
+// file is appended.
+const virusTotalAPI = "https://www.virustotal.com/api/v3/files/"
+
+const (
+	vtRetryMin = time.Minute
+	vtRetryMax = time.Hour
+)
+
+// errVTRateLimited is returned when VirusTotal refuses a lookup because the
+// request rate or the daily quota of the API key is exceeded.
+var errVTRateLimited = errors.New("VirusTotal quota exceeded")
+
+// vtVerdict is the VirusTotal report on the checksum of a stored file.
+type vtVerdict struct {
+	Checked time.Time `json:"checked"`
+	// Known is false when VirusTotal has never seen the file.
+	Known      bool `json:"known"`
+	Malicious  int  `json:"malicious,omitempty"`
+	Suspicious int  `json:"suspicious,omitempty"`
+	Engines    int  `json:"engines,omitempty"`
+}
+
+// flagged reports whether any engine considers the file malicious.
+func (v vtVerdict) flagged() bool {
+	return v.Malicious > 0
+}
+
+func (v vtVerdict) String() string {
+	switch {
+	case !v.Known:
+		return "unknown"
+	case v.flagged():
+		return fmt.Sprintf("malicious %d/%d", v.Malicious, v.Engines)
+	case v.Suspicious > 0:
+		return fmt.Sprintf("suspicious %d/%d", v.Suspicious, v.Engines)
+	}
+	return fmt.Sprintf("clean 0/%d", v.Engines)
+}
+
+// vtLookup is a stored file waiting to be looked up.
+type vtLookup struct {
+	SHA256    string    `json:"sha256"`
+	Queued    time.Time `json:"queued"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	NextTry   time.Time `json:"next_try"`
+}
+
+// vtLookupQueue looks up the checksum of every stored file on VirusTotal,
+// without uploading any content, and records the verdict in the file index.
+// Lookups are sent at most VirusTotalRate per minute and pause when
+// VirusTotal reports the quota of the API key as exceeded. The queue is
+// journaled in virustotal.json in TempUploadPath.
+type vtLookupQueue struct {
+	journal string
+	apiKey  string
+	client  *http.Client
+
+	mu          sync.Mutex
+	pending     map[string]*vtLookup
+	throttled   int
+	pausedUntil time.Time
+}
+
+// virusTotal is nil unless VIRUSTOTAL_API_KEY is set and the file storage
+// backend is used.
+var virusTotal *vtLookupQueue
+
+func newVTLookupQueue(journal, apiKey string) (*vtLookupQueue, error) {
+	q := &vtLookupQueue{
+		journal: journal,
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: time.Minute},
+		pending: map[string]*vtLookup{},
+	}
+	data, err := os.ReadFile(journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &q.pending); err != nil {
+			return nil, fmt.Errorf("%s: %w", journal, err)
+		}
+	}
+	return q, nil
+}
+
+// enqueue queues a lookup of the file stored as name with checksum sum.
+func (q *vtLookupQueue) enqueue(name, sum string) {
+	if sum == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.pending[name] = &vtLookup{SHA256: sum, Queued: now, NextTry: now}
+	q.saveLocked()
+}
+
+func (q *vtLookupQueue) saveLocked() {
+	data, err := json.Marshal(q.pending)
+	if err == nil {
+		tmp := q.journal + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, q.journal)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save VirusTotal queue: %s", err.Error())
+	}
+}
+
+// run sends one lookup per tick of the rate limit until ctx is done.
+func (q *vtLookupQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute / time.Duration(VirusTotalRate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		q.lookupNext(ctx)
+	}
+}
+
+// lookupNext looks up the due file that was queued first.
+func (q *vtLookupQueue) lookupNext(ctx context.Context) {
+	q.mu.Lock()
+	now := time.Now()
+	if now.Before(q.pausedUntil) {
+		q.mu.Unlock()
+		return
+	}
+	var name string
+	var next *vtLookup
+	for n, l := range q.pending {
+		if !l.NextTry.After(now) && (next == nil || l.Queued.Before(next.Queued)) {
+			name, next = n, l
+		}
+	}
+	if next == nil {
+		q.mu.Unlock()
+		return
+	}
+	lookup := *next
+	q.mu.Unlock()
+
+	// Do not spend quota on files that were deleted or replaced meanwhile.
+	if rec, ok := storedFiles.get(name); !ok || rec.SHA256 != lookup.SHA256 {
+		q.done(name, lookup)
+		return
+	}
+	verdict, err := vtLookupHash(ctx, q.client, q.apiKey, lookup.SHA256)
+	if ctx.Err() != nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cur, ok := q.pending[name]
+	if !ok || !cur.Queued.Equal(lookup.Queued) {
+		// Stored again during the lookup, the new version is due.
+		return
+	}
+	switch {
+	case errors.Is(err, errVTRateLimited):
+		q.throttled++
+		pause := min(vtRetryMin<<min(q.throttled-1, 10), vtRetryMax)
+		q.pausedUntil = time.Now().Add(pause)
+		log.Printf("VirusTotal quota exceeded, pausing lookups for %s", pause)
+	case err != nil:
+		q.throttled = 0
+		cur.Attempts++
+		cur.LastError = err.Error()
+		cur.NextTry = time.Now().Add(min(vtRetryMin<<min(cur.Attempts-1, 10), vtRetryMax))
+		q.saveLocked()
+		log.Printf("VirusTotal lookup of %s failed (attempt %d): %s", name, cur.Attempts, err.Error())
+	default:
+		q.throttled = 0
+		delete(q.pending, name)
+		q.saveLocked()
+		storedFiles.setVerdict(name, lookup.SHA256, verdict)
+		if verdict.flagged() {
+			log.Printf("VirusTotal flags %s (%s) as malicious: %d of %d engines", name, lookup.SHA256, verdict.Malicious, verdict.Engines)
+		}
+	}
+}
+
+// done removes name from the queue unless it was queued again since lookup.
+func (q *vtLookupQueue) done(name string, lookup vtLookup) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cur, ok := q.pending[name]; ok && cur.Queued.Equal(lookup.Queued) {
+		delete(q.pending, name)
+		q.saveLocked()
+	}
+}
+
+// vtLookupHash fetches the VirusTotal report on the file with checksum sum.
+// Files VirusTotal has never seen yield a verdict that is not Known.
+func vtLookupHash(ctx context.Context, client *http.Client, apiKey, sum string) (vtVerdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, virusTotalAPI+sum, nil)
+	if err != nil {
+		return vtVerdict{}, err
+	}
+	req.Header.Set("x-apikey", apiKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return vtVerdict{}, err
+	}
+	defer resp.Body.Close()
+	verdict := vtVerdict{Checked: time.Now()}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return verdict, nil
+	case http.StatusTooManyRequests:
+		return vtVerdict{}, errVTRateLimited
+	default:
+		return vtVerdict{}, fmt.Errorf("VirusTotal answered %s", resp.Status)
+	}
+	var report struct {
+		Data struct {
+			Attributes struct {
+				Stats map[string]int `json:"last_analysis_stats"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return vtVerdict{}, err
+	}
+	stats := report.Data.Attributes.Stats
+	verdict.Known = true
+	verdict.Malicious = stats["malicious"]
+	verdict.Suspicious = stats["suspicious"]
+	for _, n := range stats {
+		verdict.Engines += n
+	}
+	return verdict, nil
+}
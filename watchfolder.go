@@ -0,0 +1,348 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// The watch folder is a directory, WATCH_FOLDER, an ingest system like a
+// MAM watches for new files: every stored upload is copied into it, at the
+// path of the WATCH_FOLDER_PATH template, and described by an XML sidecar
+// written next to it once the file is complete, at WATCH_FOLDER_SIDECAR_PATH,
+// from the template in the file WATCH_FOLDER_SIDECAR, or defaultSidecar.
+// The templates are those of exportTemplate, executed with a watchExport,
+// e.g.
+//
+//	WATCH_FOLDER_PATH={{date "2006/01/02"}}/{{.ID}}/{{.Filename}}
+//
+// Both the file and its sidecar are written under a temporary name and
+// renamed into place. Exports waiting to be written are journaled in
+// watchfolder.json in TempUploadPath and retried with backoff, like
+// replicas, unless the templates cannot place them in the watch folder.
+const (
+	defaultWatchPath        = "{{.StoredName}}"
+	defaultWatchSidecarPath = "{{.Path}}.xml"
+	// watchPartSuffix marks the files of the watch folder being written,
+	// which ingest systems should ignore.
+	watchPartSuffix = ".part"
+)
+
+const defaultSidecar = `<?xml version="1.0" encoding="UTF-8"?>
+<asset>
+  <id>{{xml .ID}}</id>
+  <filename>{{xml .Filename}}</filename>
+  <path>{{xml .Path}}</path>
+  <size>{{.Size}}</size>
+  <sha256>{{xml .SHA256}}</sha256>
+  <received>{{date "2006-01-02T15:04:05Z07:00"}}</received>
+{{- with .User}}
+  <user>{{xml .}}</user>
+{{- end}}
+{{- with .Role}}
+  <role>{{xml .}}</role>
+{{- end}}
+  <metadata>
+{{- range $key, $value := .Metadata}}
+    <field name="{{xml $key}}">{{xml $value}}</field>
+{{- end}}
+  </metadata>
+</asset>
+`
+
+// watchExport is what is known of a stored upload for the watch folder
+// templates. Path is set for the sidecar template, to where the file is in
+// the watch folder.
+type watchExport struct {
+	ID         string            `json:"id"`
+	Filename   string            `json:"filename"`
+	StoredName string            `json:"stored_name"`
+	Size       int64             `json:"size"`
+	SHA256     string            `json:"sha256,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Role       string            `json:"role,omitempty"`
+	Received   time.Time         `json:"received"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Path       string            `json:"-"`
+}
+
+// internalMetadata are the metadata the server sets on uploads for itself,
+// left out of the sidecars.
+var internalMetadata = []string{"user", "role", "token_id", "limit_override", "pin", "queued", "start", "deadline", "delivery_owner"}
+
+// watchStatus tracks an export that still has to be written.
+type watchStatus struct {
+	Export    watchExport `json:"export"`
+	Attempts  int         `json:"attempts"`
+	LastError string      `json:"last_error,omitempty"`
+	NextTry   time.Time   `json:"next_try"`
+}
+
+// watchEntry is an export waiting to be written, for GET /watch-folder.
+type watchEntry struct {
+	Name      string    `json:"name"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	NextTry   time.Time `json:"next_try"`
+}
+
+// watchFolderExporter writes the stored uploads into the watch folder in
+// the background.
+type watchFolderExporter struct {
+	dir                    string
+	path, sidecarPath, xml *template.Template
+	journal                string
+	wake                   chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*watchStatus
+}
+
+// errWatchUnexportable is returned for exports the templates cannot place
+// in the watch folder, which no retry is going to change: they are dropped.
+var errWatchUnexportable = errors.New("not exportable")
+
+// watchFolder is nil unless WATCH_FOLDER is set.
+var watchFolder *watchFolderExporter
+
+func newWatchFolderExporter(dir, pathTemplate, sidecarPathTemplate, sidecarFile, journal string) (*watchFolderExporter, error) {
+	w := &watchFolderExporter{dir: dir, journal: journal, wake: make(chan struct{}, 1), pending: map[string]*watchStatus{}}
+	var err error
+	if w.path, err = exportTemplate("WATCH_FOLDER_PATH", cmp.Or(pathTemplate, defaultWatchPath)); err != nil {
+		return nil, err
+	}
+	if w.sidecarPath, err = exportTemplate("WATCH_FOLDER_SIDECAR_PATH", cmp.Or(sidecarPathTemplate, defaultWatchSidecarPath)); err != nil {
+		return nil, err
+	}
+	sidecar := defaultSidecar
+	if sidecarFile != "" {
+		data, err := os.ReadFile(sidecarFile)
+		if err != nil {
+			return nil, err
+		}
+		sidecar = string(data)
+	}
+	if w.xml, err = exportTemplate("WATCH_FOLDER_SIDECAR", sidecar); err != nil {
+		return nil, err
+	}
+	// The templates are tried on an example, so mistakes show at startup.
+	example := watchExport{ID: "example", Filename: "example.mp4", StoredName: "example.mp4", Received: time.Now(), Path: "example.mp4"}
+	if _, _, err := w.paths(example); err != nil {
+		return nil, err
+	}
+	if _, err := executeExport(w.xml, example); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &w.pending); err != nil {
+			return nil, fmt.Errorf("%s: %w", journal, err)
+		}
+	}
+	return w, nil
+}
+
+// paths returns where the file of e and its sidecar go, relative to the
+// watch folder.
+func (w *watchFolderExporter) paths(e watchExport) (string, string, error) {
+	file, err := executeExport(w.path, e)
+	if err != nil {
+		return "", "", fmt.Errorf("WATCH_FOLDER_PATH: %w", err)
+	}
+	e.Path = path.Clean(file)
+	sidecar, err := executeExport(w.sidecarPath, e)
+	if err != nil {
+		return "", "", fmt.Errorf("WATCH_FOLDER_SIDECAR_PATH: %w", err)
+	}
+	sidecar = path.Clean(sidecar)
+	for _, p := range []string{e.Path, sidecar} {
+		if !filepath.IsLocal(filepath.FromSlash(p)) {
+			return "", "", fmt.Errorf("%q is outside the watch folder", p)
+		}
+	}
+	if e.Path == sidecar {
+		return "", "", fmt.Errorf("the file and its sidecar are both %q", sidecar)
+	}
+	return e.Path, sidecar, nil
+}
+
+// watchExportOf returns the export of the upload info stored as name.
+func watchExportOf(info tusd.FileInfo, name string, size int64, sum string) watchExport {
+	meta := maps.Clone(info.MetaData)
+	for _, key := range internalMetadata {
+		delete(meta, key)
+	}
+	return watchExport{
+		ID:         info.ID,
+		Filename:   info.MetaData["filename"],
+		StoredName: filepath.ToSlash(name),
+		Size:       size,
+		SHA256:     sum,
+		User:       info.MetaData["user"],
+		Role:       info.MetaData["role"],
+		Received:   time.Now().UTC(),
+		Metadata:   meta,
+	}
+}
+
+// enqueue schedules the export of a stored upload.
+func (w *watchFolderExporter) enqueue(e watchExport) {
+	w.mu.Lock()
+	w.pending[e.StoredName] = &watchStatus{Export: e, NextTry: time.Now()}
+	w.saveLocked()
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watchFolderExporter) saveLocked() {
+	data, err := json.Marshal(w.pending)
+	if err == nil {
+		tmp := w.journal + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, w.journal)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save watch folder journal: %s", err.Error())
+	}
+}
+
+// run writes the pending exports until ctx is done.
+func (w *watchFolderExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(replicaCatchUp)
+	defer ticker.Stop()
+	for {
+		w.catchUp(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *watchFolderExporter) catchUp(ctx context.Context) {
+	w.mu.Lock()
+	var due []*watchStatus
+	now := time.Now()
+	for _, status := range w.pending {
+		if !status.NextTry.After(now) {
+			due = append(due, status)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, status := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		e := status.Export
+		err := w.export(ctx, e)
+		w.mu.Lock()
+		switch {
+		case w.pending[e.StoredName] != status:
+			// Stored again while it was exported, the new version is due.
+		case err == nil:
+			delete(w.pending, e.StoredName)
+			log.Printf("Exported %s to the watch folder", e.StoredName)
+		case errors.Is(err, errLocalMissing):
+			delete(w.pending, e.StoredName)
+			log.Printf("Not exporting %s to the watch folder, it was deleted", e.StoredName)
+		case errors.Is(err, errWatchUnexportable):
+			delete(w.pending, e.StoredName)
+			log.Printf("Not exporting %s to the watch folder: %s", e.StoredName, err.Error())
+		default:
+			status.Attempts++
+			status.LastError = err.Error()
+			status.NextTry = time.Now().Add(min(replicaRetryMin<<min(status.Attempts-1, 10), replicaRetryMax))
+			log.Printf("Export of %s to the watch folder failed (attempt %d): %s", e.StoredName, status.Attempts, err.Error())
+		}
+		w.saveLocked()
+		w.mu.Unlock()
+	}
+}
+
+// export copies the stored file of e into the watch folder, then writes
+// its sidecar.
+func (w *watchFolderExporter) export(ctx context.Context, e watchExport) error {
+	file, sidecar, err := w.paths(e)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWatchUnexportable, err)
+	}
+	e.Path = file
+	xmlData, err := executeExport(w.xml, e)
+	if err != nil {
+		return fmt.Errorf("%w: WATCH_FOLDER_SIDECAR: %w", errWatchUnexportable, err)
+	}
+	src, err := openStored(ctx, e.StoredName)
+	if errors.Is(err, os.ErrNotExist) {
+		return errLocalMissing
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst := filepath.Join(w.dir, filepath.FromSlash(file))
+	if err := writeWatchFile(dst, src); err != nil {
+		return err
+	}
+	return writeWatchFile(filepath.Join(w.dir, filepath.FromSlash(sidecar)), strings.NewReader(xmlData))
+}
+
+// writeWatchFile writes r to p, through a temporary file next to it.
+func writeWatchFile(p string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + watchPartSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// backlog returns the exports waiting to be written, by name.
+func (w *watchFolderExporter) backlog() []watchEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	list := make([]watchEntry, 0, len(w.pending))
+	for name, status := range w.pending {
+		list = append(list, watchEntry{Name: name, Attempts: status.Attempts, LastError: status.LastError, NextTry: status.NextTry})
+	}
+	slices.SortFunc(list, func(a, b watchEntry) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVHandler exposes UploadPath over WebDAV below prefix, so it can be
+// mounted from Finder or Explorer. Browsing works on the stored files
+// directly, moving and deleting go through the file index and are limited
+// to the files of the principal, while every newly written file becomes an
+// upload in the tus store and is finalized through finishUpload, picking up
+// the usual timestamped name in UploadPath.
+// Requests are made by a principal of the authenticators, like uploads, and
+// the policy of its role applies to the files it writes.
+func newWebDAVHandler(prefix string, composer *tusd.StoreComposer) http.Handler {
+	return &davHandler{&webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: &davFS{Dir: webdav.Dir(UploadPath), composer: composer},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("WebDAV %s %s: %s", r.Method, r.URL.Path, err.Error())
+			}
+		},
+	}}
+}
+
+// davHandler authenticates the WebDAV requests.
+type davHandler struct {
+	*webdav.Handler
+}
+
+// davRequestKey is the context key of the *davRequest of a WebDAV request.
+type davRequestKey struct{}
+
+// davRequest is the WebDAV request a file is opened for, with its body and
+// the principal making it.
+type davRequest struct {
+	r    *http.Request
+	body *davBody
+	p    Principal
+}
+
+func (h *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.Clone(r.Context())
+	// WebDAV clients only send basic authentication, upload tokens are
+	// taken from its password.
+	if _, token, ok := r.BasicAuth(); ok {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	p, err := authenticate(r)
+	if err == nil && p == (Principal{}) {
+		err = errNoCredentials
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="uploads"`)
+		var e tusd.Error
+		if errors.As(err, &e) {
+			httpErrorCode(w, e.ErrorCode, e.Message, e.HTTPResponse.StatusCode)
+			return
+		}
+		httpErrorCode(w, "ERR_NOT_SIGNED_IN", "Sign in, or use an upload token as the password", http.StatusUnauthorized)
+		return
+	}
+	body := &davBody{ReadCloser: r.Body}
+	r.Body = body
+	r = r.WithContext(context.WithValue(r.Context(), davRequestKey{}, &davRequest{r: r, body: body, p: p}))
+	h.Handler.ServeHTTP(w, r)
+}
+
+// davBody remembers why reading a request body failed, which the WebDAV
+// handler does not tell the files it writes.
+type davBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+type davFS struct {
+	webdav.Dir
+	composer *tusd.StoreComposer
+}
+
+// davName returns the stored name of the WebDAV path name, "" for the root.
+func davName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		f, err := fs.Dir.OpenFile(ctx, name, flag, perm)
+		if os.IsNotExist(err) && restoreTiered(ctx, strings.TrimPrefix(path.Clean("/"+name), "/")) == nil {
+			f, err = fs.Dir.OpenFile(ctx, name, flag, perm)
+		}
+		return f, err
+	}
+	base := path.Base(name)
+	if base == "/" || base == "." {
+		return nil, os.ErrInvalid
+	}
+	req, _ := ctx.Value(davRequestKey{}).(*davRequest)
+	if req == nil {
+		return nil, os.ErrPermission
+	}
+	meta := tusd.MetaData{
+		"filename": base,
+		"filetype": mime.TypeByExtension(path.Ext(base)),
+		"source":   "webdav",
+	}
+	if err := authenticateUpload(req.r, meta); err != nil {
+		return nil, os.ErrPermission
+	}
+	w, err := newIngestWriter(context.Background(), fs.composer, meta)
+	if _, ok := uploadRejection(err); ok {
+		log.Printf("WebDAV upload of %s rejected: %s", name, err.Error())
+		return nil, os.ErrPermission
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &davUpload{ingestWriter: w, req: req, name: base, modTime: time.Now()}, nil
+}
+
+// RemoveAll deletes the stored files at name, with their records and
+// sidecars, then name itself. Only the files of the principal may be
+// deleted, a directory once all of its files are.
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	rel := davName(name)
+	if rel == "" {
+		return os.ErrPermission
+	}
+	p := filepath.Join(UploadPath, filepath.FromSlash(rel))
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	req, _ := ctx.Value(davRequestKey{}).(*davRequest)
+	if !info.IsDir() {
+		if !davOwns(req, rel) {
+			return os.ErrPermission
+		}
+		return deleteDAVFile(rel)
+	}
+	if !davOwnsAll(req, rel) {
+		return os.ErrPermission
+	}
+	err = filepath.WalkDir(p, func(fp string, d iofs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isSidecar(fp) {
+			return err
+		}
+		r, _ := filepath.Rel(UploadPath, fp)
+		if err := deleteDAVFile(filepath.ToSlash(r)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fs.Dir.RemoveAll(ctx, name)
+}
+
+// deleteDAVFile deletes the stored file rel, or the file a tiered stub
+// stands for.
+func deleteDAVFile(rel string) error {
+	if name, ok := strings.CutSuffix(rel, tieredSuffix); ok {
+		return deleteStored(name, true)
+	}
+	return deleteStored(rel, false)
+}
+
+// Rename moves the stored files at oldName to newName, with their records
+// and sidecars. Only the files of the principal may be moved, and only
+// within the folder of its policy.
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	src, dst := davName(oldName), davName(newName)
+	if src == "" || dst == "" {
+		return os.ErrPermission
+	}
+	info, err := os.Stat(filepath.Join(UploadPath, filepath.FromSlash(src)))
+	if err != nil {
+		return err
+	}
+	req, _ := ctx.Value(davRequestKey{}).(*davRequest)
+	if req == nil || !davInFolder(req.p, dst) {
+		return os.ErrPermission
+	}
+	if !info.IsDir() {
+		if strings.HasSuffix(src, tieredSuffix) || strings.HasSuffix(dst, tieredSuffix) || !davOwns(req, src) {
+			return os.ErrPermission
+		}
+		return renameStored(src, dst)
+	}
+	if !davOwnsAll(req, src) {
+		return os.ErrPermission
+	}
+	if err := fs.Dir.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	root := filepath.Join(UploadPath, filepath.FromSlash(dst))
+	return filepath.WalkDir(root, func(fp string, d iofs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isSidecar(fp) || strings.HasSuffix(fp, tieredSuffix) {
+			return err
+		}
+		r, _ := filepath.Rel(root, fp)
+		storedRenamed(path.Join(src, filepath.ToSlash(r)), path.Join(dst, filepath.ToSlash(r)))
+		return nil
+	})
+}
+
+// davOwns reports whether the principal of req may delete or move the
+// stored file name, or the file its tiered stub stands for: one it
+// uploaded itself, in the folder of its policy.
+func davOwns(req *davRequest, name string) bool {
+	if req == nil || storedFiles == nil || !davInFolder(req.p, name) {
+		return false
+	}
+	rec, ok := storedFiles.get(strings.TrimSuffix(name, tieredSuffix))
+	return ok && (req.p.User != "" && rec.User == req.p.User || req.p.TokenID != "" && rec.TokenID == req.p.TokenID)
+}
+
+// davOwnsAll reports whether the principal of req owns every stored file in
+// the directory dir.
+func davOwnsAll(req *davRequest, dir string) bool {
+	err := filepath.WalkDir(filepath.Join(UploadPath, filepath.FromSlash(dir)), func(fp string, d iofs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isSidecar(fp) {
+			return err
+		}
+		r, _ := filepath.Rel(UploadPath, fp)
+		if !davOwns(req, filepath.ToSlash(r)) {
+			return os.ErrPermission
+		}
+		return nil
+	})
+	return err == nil
+}
+
+// davInFolder reports whether name is in the folder the policy of p stores
+// its uploads in, anywhere if it sets none.
+func davInFolder(p Principal, name string) bool {
+	policy := policyFor(tusd.MetaData{"user": p.User, "role": p.Role})
+	if policy == nil || policy.Folder == "" {
+		return true
+	}
+	folder := path.Clean(filepath.ToSlash(policy.Folder))
+	return strings.HasPrefix(name, folder+"/")
+}
+
+// davUpload is the write-only file handed out for PUT requests.
+type davUpload struct {
+	*ingestWriter
+	req     *davRequest
+	name    string
+	modTime time.Time
+	failed  bool
+}
+
+var (
+	errDAVWriteOnly  = errors.New("file is write-only")
+	errDAVIncomplete = errors.New("request body incomplete")
+)
+
+func (f *davUpload) Write(p []byte) (int, error) {
+	n, err := f.ingestWriter.Write(p)
+	if err != nil {
+		f.failed = true
+	}
+	return n, err
+}
+
+// Close finalizes the upload if the whole body of the PUT request was
+// written. The WebDAV handler closes the file even when copying the body
+// failed, in which case the upload is discarded.
+func (f *davUpload) Close() error {
+	r := f.req.r
+	if r.Method == http.MethodPut && (f.failed || f.req.body.err != nil || r.ContentLength >= 0 && f.Size() != r.ContentLength) {
+		f.Abort()
+		return errDAVIncomplete
+	}
+	return f.ingestWriter.Close()
+}
+
+func (f *davUpload) Read(p []byte) (int, error)                   { return 0, errDAVWriteOnly }
+func (f *davUpload) Seek(offset int64, whence int) (int64, error) { return 0, errDAVWriteOnly }
+func (f *davUpload) Readdir(count int) ([]os.FileInfo, error)     { return nil, errDAVWriteOnly }
+func (f *davUpload) Stat() (os.FileInfo, error)                   { return f, nil }
+
+func (f *davUpload) Name() string { return f.name }
+func (f *davUpload) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.end()
+}
+func (f *davUpload) Mode() os.FileMode  { return 0644 }
+func (f *davUpload) ModTime() time.Time { return f.modTime }
+func (f *davUpload) IsDir() bool        { return false }
+func (f *davUpload) Sys() any           { return nil }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// wsMaxFrame bounds the chunk a single WebSocket frame may carry.
+	wsMaxFrame     = 16 << 20
+	wsIdleTimeout  = 5 * time.Minute
+	wsWriteTimeout = 30 * time.Second
+)
+
+// wsHandler streams uploads over a single WebSocket connection, for clients
+// sending thousands of small chunks, where a tus PATCH per chunk costs more
+// than the chunk itself.
+//
+// GET /ws/?filename=...&filetype=...&size=...&fingerprint=... starts a new
+// upload, size and fingerprint being optional; GET /ws/<id> resumes one.
+// Once connected the server sends
+//
+//	{"id": "<id>", "offset": <bytes received so far>, "size": <length>}
+//
+// with the "deadline" the upload must be complete by, if it has one,
+// after which every binary frame the client sends is the next chunk of the
+// file. Each chunk is acknowledged with {"offset": <n>} once it is stored,
+// so the client can keep several chunks in flight and, after losing the
+// connection, resume from the last acknowledged offset. Uploads without a
+// size are finished by sending the text frame {"action": "finish"}. When
+// complete, the server sends {"id": ..., "offset": ..., "size": ...,
+// "complete": true} and closes the connection. Errors are sent as
+// {"error": "...", "code": "ERR_...", "retriable": ...} before closing,
+// with the code and retriable flag of the apiError schema.
+//
+// Uploads live in the tus store, so they are finished through finishUpload
+// like any other, and can be resumed over tus as well.
+type wsHandler struct {
+	composer *tusd.StoreComposer
+}
+
+// wsMessage is a text frame from the server, or a command from the client.
+type wsMessage struct {
+	ID       string    `json:"id,omitempty"`
+	Offset   int64     `json:"offset"`
+	Size     int64     `json:"size,omitempty"`
+	Deadline time.Time `json:"deadline,omitzero"`
+	Complete bool      `json:"complete,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// Code and Retriable describe Error like in apiError.
+	Code      string `json:"code,omitempty"`
+	Retriable bool   `json:"retriable,omitempty"`
+	Action    string `json:"action,omitempty"`
+}
+
+// wsFrame is a frame as received, keeping whether it was binary, which the
+// codecs of the websocket package do not report.
+type wsFrame struct {
+	binary bool
+	data   []byte
+}
+
+var wsFrameCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		data, err := json.Marshal(v)
+		return data, websocket.TextFrame, err
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		*v.(*wsFrame) = wsFrame{binary: payloadType == websocket.BinaryFrame, data: data}
+		return nil
+	},
+}
+
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.Trim(r.URL.Path, "/")
+	if id == "" {
+		q := r.URL.Query()
+		info := tusd.FileInfo{SizeIsDeferred: true, MetaData: tusd.MetaData{
+			"filename": q.Get("filename"),
+			"filetype": q.Get("filetype"),
+			"source":   "websocket",
+		}}
+		if fp := q.Get("fingerprint"); fp != "" {
+			info.MetaData["fingerprint"] = fp
+		}
+		if v := q.Get("size"); v != "" {
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || size < 0 {
+				httpError(w, "Invalid size", http.StatusBadRequest)
+				return
+			}
+			info.Size = size
+			info.SizeIsDeferred = false
+		}
+		var err error
+		if id, err = h.create(r, info); err != nil {
+			h.sessionError(w, err)
+			return
+		}
+	}
+
+	lock, err := lockUpload(r.Context(), h.composer, id)
+	if err != nil {
+		httpError(w, "Upload is busy", http.StatusServiceUnavailable)
+		return
+	}
+	defer lock.Unlock()
+	upload, err := h.composer.Core.GetUpload(r.Context(), id)
+	if err != nil {
+		h.sessionError(w, err)
+		return
+	}
+	info, err := upload.GetInfo(r.Context())
+	if err != nil {
+		h.sessionError(w, err)
+		return
+	}
+	if !pinnedTo(info, clientPin(r.RemoteAddr, r.Header)) {
+		h.sessionError(w, errUploadPinned)
+		return
+	}
+	// Origins are not checked: like tus, the endpoint is open to uploads
+	// from any page.
+	websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.MaxPayloadBytes = wsMaxFrame
+			h.stream(ws, upload, info)
+		},
+	}.ServeHTTP(w, r)
+}
+
+// create creates the upload info, after what the tus creation callback does.
+func (h *wsHandler) create(r *http.Request, info tusd.FileInfo) (string, error) {
+	changes, err := prepareUpload(createHook(r, info), h.composer)
+	if err != nil {
+		return "", err
+	}
+	if changes.MetaData != nil {
+		info.MetaData = changes.MetaData
+	}
+	upload, err := h.composer.Core.NewUpload(r.Context(), info)
+	if err != nil {
+		return "", err
+	}
+	if info, err = upload.GetInfo(r.Context()); err != nil {
+		return "", err
+	}
+	log.Printf("[%s] WebSocket upload %s created", requestID(r), info.ID)
+	return info.ID, nil
+}
+
+// stream receives the chunks of the upload until it is complete or the
+// connection is lost.
+func (h *wsHandler) stream(ws *websocket.Conn, upload tusd.Upload, info tusd.FileInfo) {
+	ctx := ws.Request().Context()
+	send := func(msg wsMessage) error {
+		ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return wsFrameCodec.Send(ws, msg)
+	}
+	fail := func(err error) {
+		msg := wsMessage{Error: "upload error", Code: statusCode(http.StatusInternalServerError), Retriable: true}
+		if e, ok := uploadRejection(err); ok {
+			header := http.Header{}
+			for k, v := range e.HTTPResponse.Header {
+				header.Set(k, v)
+			}
+			msg.Error, msg.Code = e.Message, e.ErrorCode
+			msg.Retriable = retriableError(e.HTTPResponse.StatusCode, e.ErrorCode, header)
+		} else {
+			log.Printf("WebSocket upload %s failed at %d: %s", info.ID, info.Offset, err.Error())
+		}
+		send(msg)
+	}
+
+	hello := wsMessage{ID: info.ID, Offset: info.Offset, Deadline: uploadDeadline(info)}
+	if !info.SizeIsDeferred {
+		hello.Size = info.Size
+	}
+	if send(hello) != nil {
+		return
+	}
+	for info.SizeIsDeferred || info.Offset < info.Size {
+		var frame wsFrame
+		ws.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		if err := wsFrameCodec.Receive(ws, &frame); err != nil {
+			if errors.Is(err, websocket.ErrFrameTooLarge) {
+				send(wsMessage{Error: "chunk too large", Code: "ERR_CHUNK_TOO_LARGE"})
+			}
+			return
+		}
+		if !frame.binary {
+			var cmd wsMessage
+			if json.Unmarshal(frame.data, &cmd) != nil || cmd.Action != "finish" || !info.SizeIsDeferred {
+				send(wsMessage{Error: "unexpected message", Code: "ERR_UNEXPECTED_MESSAGE"})
+				return
+			}
+			if err := h.composer.LengthDeferrer.AsLengthDeclarableUpload(upload).DeclareLength(ctx, info.Offset); err != nil {
+				fail(err)
+				return
+			}
+			info.Size = info.Offset
+			info.SizeIsDeferred = false
+			break
+		}
+		if !info.SizeIsDeferred && info.Offset+int64(len(frame.data)) > info.Size {
+			send(wsMessage{Error: "chunk exceeds the upload size", Code: "ERR_CHUNK_EXCEEDS_SIZE"})
+			return
+		}
+		n, err := upload.WriteChunk(ctx, info.Offset, bytes.NewReader(frame.data))
+		info.Offset += n
+		if err != nil {
+			fail(err)
+			return
+		}
+		if send(wsMessage{Offset: info.Offset}) != nil {
+			return
+		}
+	}
+
+	if err := upload.FinishUpload(ctx); err != nil {
+		fail(err)
+		return
+	}
+	finishUpload(info)
+	send(wsMessage{ID: info.ID, Offset: info.Offset, Size: info.Size, Complete: true})
+}
+
+func (h *wsHandler) sessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, tusd.ErrNotFound) {
+		httpError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if e, ok := uploadRejection(err); ok {
+		httpErrorCode(w, e.ErrorCode, e.Message, e.HTTPResponse.StatusCode)
+		return
+	}
+	log.Printf("WebSocket upload error: %s", err.Error())
+	httpError(w, "Upload error", http.StatusInternalServerError)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math/bits"
+)
+
+// xxh64 is XXH64 with seed 0, the 64-bit xxHash, a non-cryptographic hash
+// many times faster than SHA-256. It detects corruption, not tampering.
+// Sum appends the digest in its canonical, big-endian form.
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+const (
+	xxhPrime1 uint64 = 0x9E3779B185EBCA87
+	xxhPrime2 uint64 = 0xC2B2AE3D27D4EB4F
+	xxhPrime3 uint64 = 0x165667B19E3779F9
+	xxhPrime4 uint64 = 0x85EBCA77C2B2AE63
+	xxhPrime5 uint64 = 0x27D4EB2F165667C5
+)
+
+func newXXH64() hash.Hash64 {
+	h := &xxh64{}
+	h.Reset()
+	return h
+}
+
+func (h *xxh64) Reset() {
+	// The seed is 0, and the arithmetic wraps around.
+	p1, p2 := xxhPrime1, xxhPrime2
+	h.v = [4]uint64{p1 + p2, p2, 0, -p1}
+	h.total, h.n = 0, 0
+}
+
+func (h *xxh64) Size() int      { return 8 }
+func (h *xxh64) BlockSize() int { return 32 }
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	return bits.RotateLeft64(acc, 31) * xxhPrime1
+}
+
+func xxhMerge(acc, v uint64) uint64 {
+	acc ^= xxhRound(0, v)
+	return acc*xxhPrime1 + xxhPrime4
+}
+
+func (h *xxh64) stripes(p []byte) {
+	for ; len(p) >= 32; p = p[32:] {
+		h.v[0] = xxhRound(h.v[0], binary.LittleEndian.Uint64(p))
+		h.v[1] = xxhRound(h.v[1], binary.LittleEndian.Uint64(p[8:]))
+		h.v[2] = xxhRound(h.v[2], binary.LittleEndian.Uint64(p[16:]))
+		h.v[3] = xxhRound(h.v[3], binary.LittleEndian.Uint64(p[24:]))
+	}
+}
+
+func (h *xxh64) Write(p []byte) (int, error) {
+	written := len(p)
+	h.total += uint64(written)
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < 32 {
+			return written, nil
+		}
+		h.stripes(h.buf[:])
+		h.n = 0
+	}
+	whole := len(p) &^ 31
+	h.stripes(p[:whole])
+	h.n = copy(h.buf[:], p[whole:])
+	return written, nil
+}
+
+func (h *xxh64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		v := h.v
+		acc = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, x := range v {
+			acc = xxhMerge(acc, x)
+		}
+	} else {
+		acc = xxhPrime5
+	}
+	acc += h.total
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxhRound(0, binary.LittleEndian.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(p)) * xxhPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxhPrime2 + xxhPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc ^= uint64(b) * xxhPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxhPrime1
+	}
+	acc ^= acc >> 33
+	acc *= xxhPrime2
+	acc ^= acc >> 29
+	acc *= xxhPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+func (h *xxh64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.Sum64())
+}
+
+// MarshalBinary saves the state of h, to continue hashing after a restart.
+func (h *xxh64) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 4*8+8+32+1)
+	for _, v := range h.v {
+		b = binary.BigEndian.AppendUint64(b, v)
+	}
+	b = binary.BigEndian.AppendUint64(b, h.total)
+	b = append(b, h.buf[:]...)
+	return append(b, byte(h.n)), nil
+}
+
+func (h *xxh64) UnmarshalBinary(b []byte) error {
+	if len(b) != 4*8+8+32+1 || b[len(b)-1] >= 32 {
+		return errors.New("invalid xxh64 state")
+	}
+	for i := range h.v {
+		h.v[i] = binary.BigEndian.Uint64(b[i*8:])
+	}
+	h.total = binary.BigEndian.Uint64(b[32:])
+	copy(h.buf[:], b[40:72])
+	h.n = int(b[72])
+	return nil
+}